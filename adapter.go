@@ -0,0 +1,184 @@
+package toml
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TypeAdapter converts values of a Go type from and to TOML values, for types
+// that should accept more than one kind of TOML value (such as a size that can
+// be written as 1048576 or "1MiB"). Register it with [RegisterType],
+// [Decoder.RegisterType], or [Encoder.RegisterType].
+//
+// time.Duration and json.Number are implemented as a TypeAdapter.
+type TypeAdapter interface {
+	// Decode converts a TOML value to a value of the registered type. The
+	// tomlValue is a string, int64, uint64, float64, bool, time.Time, []any,
+	// or map[string]any, and pos is the position of the key.
+	//
+	// If the returned value isn't of the registered type it's decoded with the
+	// normal rules for the type's kind; return tomlValue as-is to use the
+	// default behaviour.
+	Decode(tomlValue any, pos Position) (any, error)
+
+	// Encode converts a value of the registered type to a value that's written
+	// as a single TOML value, such as a string, integer, or array.
+	//
+	// The typ is the TOML type of tomlValue in the same format as
+	// MetaData.Type(); it can be empty to use the type of tomlValue. Tables are
+	// not supported.
+	Encode(goValue any) (tomlValue any, typ string, err error)
+}
+
+var (
+	adaptersMu sync.Mutex
+	adapters   atomic.Value // map[reflect.Type]TypeAdapter
+)
+
+func init() {
+	adapters.Store(map[reflect.Type]TypeAdapter{
+		reflect.TypeOf(time.Duration(0)): durationAdapter{},
+		reflect.TypeOf(json.Number("")):  numberAdapter{},
+	})
+}
+
+// RegisterType registers the adapter for the type t for all decoders and
+// encoders.
+//
+// Adapters registered with [Decoder.RegisterType] or [Encoder.RegisterType]
+// take precedence. The adapter is used after checking for [Unmarshaler],
+// [Marshaler], and the encoding.Text* interfaces, so it can't override those.
+//
+// Registering nil removes the adapter for t; this can be used to remove the
+// built-in adapters.
+func RegisterType(t reflect.Type, a TypeAdapter) {
+	adaptersMu.Lock()
+	defer adaptersMu.Unlock()
+
+	old := adapters.Load().(map[reflect.Type]TypeAdapter)
+	m := make(map[reflect.Type]TypeAdapter, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	if a == nil {
+		delete(m, t)
+	} else {
+		m[t] = a
+	}
+	adapters.Store(m)
+}
+
+// lookupAdapter gets the adapter for t from local, falling back to the global
+// adapters. It returns nil if there is no adapter.
+func lookupAdapter(local map[reflect.Type]TypeAdapter, t reflect.Type) TypeAdapter {
+	if a, ok := local[t]; ok {
+		return a
+	}
+	return adapters.Load().(map[reflect.Type]TypeAdapter)[t]
+}
+
+// adapterConversion is implemented by the built-in adapters to record a
+// different conversion than CustomUnmarshal, or none if it returns 0.
+type adapterConversion interface {
+	conversion(tomlValue any) ConversionKind
+}
+
+// durationAdapter parses strings with time.ParseDuration, reads integers as
+// nanoseconds, and reads floats as seconds.
+type durationAdapter struct {
+	format DurationFormat // Set from Encoder.DurationFormat.
+}
+
+func (durationAdapter) Decode(v any, _ Position) (any, error) {
+	switch vv := v.(type) {
+	case string:
+		d, err := time.ParseDuration(vv)
+		if err != nil {
+			return nil, errParseDuration{vv}
+		}
+		return d, nil
+	case int64:
+		return time.Duration(vv), nil
+	case float64:
+		ns := vv * float64(time.Second)
+		if math.IsNaN(ns) || ns >= math.MaxInt64 || ns <= math.MinInt64 {
+			return nil, errParseRange{i: vv, size: "time.Duration"}
+		}
+		return time.Duration(math.Round(ns)), nil
+	}
+	return v, nil
+}
+
+func (a durationAdapter) Encode(v any) (any, string, error) {
+	d := v.(time.Duration)
+	switch a.format {
+	case DurationSeconds:
+		return durSeconds(d), tomlFloat.typeString(), nil
+	case DurationNanoseconds:
+		return int64(d), tomlInteger.typeString(), nil
+	}
+	return d.String(), tomlString.typeString(), nil
+}
+
+func (durationAdapter) conversion(v any) ConversionKind {
+	switch v.(type) {
+	case int64, float64:
+		return UnitInterpretation
+	}
+	return 0
+}
+
+// durSeconds is a duration that's written as the exact number of seconds, as
+// d.Seconds() loses precision for durations longer than about 104 days.
+type durSeconds time.Duration
+
+func (d durSeconds) MarshalTOML() ([]byte, error) {
+	n, sign := uint64(d), ""
+	if d < 0 {
+		n, sign = uint64(-d), "-" // Also correct for math.MinInt64.
+	}
+	frac := strings.TrimRight(fmt.Sprintf("%09d", n%uint64(time.Second)), "0")
+	if frac == "" {
+		frac = "0"
+	}
+	return []byte(sign + strconv.FormatUint(n/uint64(time.Second), 10) + "." + frac), nil
+}
+
+// numberAdapter accepts any number for a json.Number, and writes it as an
+// integer or float.
+type numberAdapter struct{}
+
+func (numberAdapter) Decode(v any, _ Position) (any, error) {
+	switch vv := v.(type) {
+	case int64:
+		return json.Number(strconv.FormatInt(vv, 10)), nil
+	case uint64:
+		return json.Number(strconv.FormatUint(vv, 10)), nil
+	case float64:
+		return json.Number(strconv.FormatFloat(vv, 'f', -1, 64)), nil
+	}
+	return nil, fmt.Errorf("incompatible types: TOML value has type %s; destination has type json.Number", fmtType(v))
+}
+
+func (numberAdapter) Encode(v any) (any, string, error) {
+	n := v.(json.Number)
+	if n == "" { /// Useful zero value.
+		return int64(0), tomlInteger.typeString(), nil
+	}
+	if i, err := n.Int64(); err == nil {
+		return i, tomlInteger.typeString(), nil
+	}
+	if f, err := n.Float64(); err == nil {
+		return f, tomlFloat.typeString(), nil
+	}
+	return nil, "", fmt.Errorf("unable to convert %q to int64 or float64", n)
+}
+
+func (numberAdapter) conversion(any) ConversionKind { return Widening }
@@ -0,0 +1,164 @@
+package toml_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+type byteSize int64
+
+// byteSizeAdapter accepts integers and strings such as "1MiB".
+type byteSizeAdapter struct{}
+
+func (byteSizeAdapter) Decode(v any, pos toml.Position) (any, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	mult := int64(1)
+	for suffix, m := range map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s, mult = strings.TrimSuffix(s, suffix), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size %q on line %d", v, pos.Line)
+	}
+	return byteSize(n * mult), nil
+}
+
+func (byteSizeAdapter) Encode(v any) (any, string, error) {
+	n := v.(byteSize)
+	if n > 0 && n%(1<<20) == 0 {
+		return fmt.Sprintf("%dMiB", n>>20), "String", nil
+	}
+	return int64(n), "", nil
+}
+
+// point is written as a string, rather than as a table.
+type point struct{ X, Y int }
+
+type pointAdapter struct{}
+
+func (pointAdapter) Decode(v any, _ toml.Position) (any, error) {
+	var p point
+	_, err := fmt.Sscanf(v.(string), "%d,%d", &p.X, &p.Y)
+	return p, err
+}
+
+func (pointAdapter) Encode(v any) (any, string, error) {
+	p := v.(point)
+	return fmt.Sprintf("%d,%d", p.X, p.Y), "String", nil
+}
+
+func TestRegisterType(t *testing.T) {
+	type config struct {
+		Cache  byteSize
+		Buffer byteSize
+		Limits []byteSize
+		Max    *byteSize
+		Origin point
+	}
+
+	in := `cache  = "2MiB"
+buffer = 512
+limits = [1024, "4KiB"]
+max    = "1GiB"
+origin = "1,2"
+`
+	var c config
+	meta, err := toml.NewDecoder(strings.NewReader(in)).
+		RecordConversions(true).
+		RegisterType(reflect.TypeOf(byteSize(0)), byteSizeAdapter{}).
+		RegisterType(reflect.TypeOf(point{}), pointAdapter{}).
+		Decode(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	max := byteSize(1 << 30)
+	want := config{Cache: 2 << 20, Buffer: 512, Limits: []byteSize{1024, 4096}, Max: &max, Origin: point{1, 2}}
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("\nhave: %#v\nwant: %#v", c, want)
+	}
+
+	var conv []string
+	for _, c := range meta.Conversions() {
+		conv = append(conv, c.String())
+	}
+	sort.Strings(conv)
+	wantConv := []string{
+		"cache: custom unmarshal String to toml_test.byteSize",
+		"limits: custom unmarshal String to toml_test.byteSize",
+		"max: custom unmarshal String to toml_test.byteSize",
+		"origin: custom unmarshal String to toml_test.point",
+	}
+	if !reflect.DeepEqual(conv, wantConv) {
+		t.Errorf("\nhave: %q\nwant: %q", conv, wantConv)
+	}
+
+	var buf bytes.Buffer
+	err = toml.NewEncoder(&buf).
+		RegisterType(reflect.TypeOf(byteSize(0)), byteSizeAdapter{}).
+		RegisterType(reflect.TypeOf(point{}), pointAdapter{}).
+		Encode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTOML := `Cache = "2MiB"
+Buffer = 512
+Limits = [1024, 4096]
+Max = "1024MiB"
+Origin = "1,2"
+`
+	if buf.String() != wantTOML {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), wantTOML)
+	}
+
+	// Errors from the adapter have the position.
+	_, err = toml.NewDecoder(strings.NewReader("\ncache = \"lots\"")).
+		RegisterType(reflect.TypeOf(byteSize(0)), byteSizeAdapter{}).
+		Decode(&c)
+	if err == nil || !strings.Contains(err.Error(), `toml: line 2 (last key "cache"): invalid size "lots" on line 2`) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// Without the adapter the integer kind is used.
+	_, err = toml.Decode(`cache = "2MiB"`, &c)
+	if err == nil || !strings.Contains(err.Error(), "incompatible types") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestRegisterTypeGlobal(t *testing.T) {
+	toml.RegisterType(reflect.TypeOf(byteSize(0)), byteSizeAdapter{})
+	defer toml.RegisterType(reflect.TypeOf(byteSize(0)), nil)
+
+	var c struct{ Size byteSize }
+	if _, err := toml.Decode(`size = "3KiB"`, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Size != 3<<10 {
+		t.Errorf("wrong value: %d", c.Size)
+	}
+
+	// Adapters on the Decoder take precedence.
+	_, err := toml.NewDecoder(strings.NewReader(`size = "3KiB"`)).
+		RegisterType(reflect.TypeOf(byteSize(0)), byteSizeAdapterFail{}).
+		Decode(&c)
+	if err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+type byteSizeAdapterFail struct{ byteSizeAdapter }
+
+func (byteSizeAdapterFail) Decode(any, toml.Position) (any, error) { return nil, fmt.Errorf("nope") }
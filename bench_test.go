@@ -2,9 +2,11 @@ package toml_test
 
 import (
 	"bytes"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"testing"
@@ -64,6 +66,131 @@ func BenchmarkDecode(b *testing.B) {
 			toml.Decode(doc, &val)
 		}
 	})
+
+	b.Run("comments", func(b *testing.B) {
+		var doc strings.Builder
+		for i := 0; i < 200; i++ {
+			fmt.Fprintf(&doc, "# Section %d: a long comment describing what the table below is\n", i)
+			fmt.Fprintf(&doc, "# used for, which goes on for a while. Ünïcödé is allowed here too.\n")
+			fmt.Fprintf(&doc, "[table_%d]  # trailing comment\n", i)
+			fmt.Fprintf(&doc, "key = %d  # trailing comment on a key\n", i)
+			fmt.Fprintf(&doc, "other_key = \"value\"\n\n")
+		}
+
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			var val map[string]any
+			toml.Decode(doc.String(), &val)
+		}
+	})
+}
+
+func BenchmarkDecodeManyKeys(b *testing.B) {
+	var doc strings.Builder
+	for i := 0; i < 2_000; i++ {
+		fmt.Fprintf(&doc, "[table_%d]\n", i)
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&doc, "key_%d = %d\n", j, j)
+		}
+	}
+	d := []byte(doc.String())
+
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("skip-key-order=%t", skip), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				var val map[string]map[string]int
+				_, err := toml.NewDecoder(bytes.NewReader(d)).SkipKeyOrder(skip).Decode(&val)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeFlat(b *testing.B) {
+	docs := make([][]byte, 100)
+	for i := range docs {
+		var doc strings.Builder
+		for j := 0; j < 10; j++ {
+			fmt.Fprintf(&doc, "key_%d = \"value %d\"\n", j, i*j)
+		}
+		docs[i] = []byte(doc.String())
+	}
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		for _, d := range docs {
+			var val map[string]string
+			_, err := toml.NewDecoder(bytes.NewReader(d)).Decode(&val)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeTables(b *testing.B) {
+	var doc strings.Builder
+	for i := 0; i < 100_000; i++ {
+		fmt.Fprintf(&doc, "[[entries]]\nname = \"entry-%d\"\nversion = \"1.%d.0\"\nchecksum = \"%064x\"\n\n", i, i, i)
+	}
+	d := []byte(doc.String())
+
+	type entry struct{ Name, Version, Checksum string }
+
+	// Report the largest heap size seen while decoding, excluding the input;
+	// the total allocations are about the same.
+	heap := func() uint64 {
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	base := heap()
+	peak := func(b *testing.B, max *uint64) {
+		if h := heap() - base; h > *max {
+			*max = h
+		}
+		b.ReportMetric(float64(*max)/(1<<20), "peak-MiB")
+	}
+
+	b.Run("Decode", func(b *testing.B) {
+		var max uint64
+		for n := 0; n < b.N; n++ {
+			var v struct{ Entries []entry }
+			meta, err := toml.NewDecoder(bytes.NewReader(d)).Decode(&v)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			peak(b, &max)
+			runtime.KeepAlive(meta)
+			b.StartTimer()
+		}
+	})
+	b.Run("DecodeTables", func(b *testing.B) {
+		var max uint64
+		for n := 0; n < b.N; n++ {
+			i := 0
+			err := toml.NewDecoder(bytes.NewReader(d)).DecodeTables(func(md *toml.MetaData, key toml.Key, prim toml.Primitive) error {
+				var e entry
+				if err := md.PrimitiveDecode(prim, &e); err != nil {
+					return err
+				}
+				if i++; i%10_000 == 0 {
+					b.StopTimer()
+					peak(b, &max)
+					b.StartTimer()
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
 }
 
 func BenchmarkEncode(b *testing.B) {
@@ -124,6 +251,26 @@ func BenchmarkEncode(b *testing.B) {
 			}
 		})
 	}
+
+	b.Run("metadata", func(b *testing.B) {
+		// Implicit tables, which are written in the order of the document.
+		var doc strings.Builder
+		for i := 0; i < 1_000; i++ {
+			fmt.Fprintf(&doc, "[a.k%d.x]\nv = %d\n", i, i)
+		}
+		var v map[string]any
+		meta, err := toml.Decode(doc.String(), &v)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			buf.Reset()
+			toml.NewEncoder(buf).MetaData(&meta).Encode(v)
+		}
+	})
 }
 
 func BenchmarkExample(b *testing.B) {
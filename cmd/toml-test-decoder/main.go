@@ -3,14 +3,13 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
+	"io"
 	"log"
 	"os"
 	"path"
 
 	"github.com/BurntSushi/toml"
-	"github.com/BurntSushi/toml/internal/tag"
 )
 
 func init() {
@@ -30,14 +29,13 @@ func main() {
 		flag.Usage()
 	}
 
-	var decoded any
-	if _, err := toml.NewDecoder(os.Stdin).Decode(&decoded); err != nil {
-		log.Fatalf("Error decoding TOML: %s", err)
+	in, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Error reading TOML: %s", err)
 	}
-
-	j := json.NewEncoder(os.Stdout)
-	j.SetIndent("", "  ")
-	if err := j.Encode(tag.Add("", decoded)); err != nil {
-		log.Fatalf("Error encoding JSON: %s", err)
+	j, err := toml.ToJSON(in, toml.JSONOptions{Tagged: true, Indent: "  "})
+	if err != nil {
+		log.Fatalf("Error decoding TOML: %s", err)
 	}
+	os.Stdout.Write(j)
 }
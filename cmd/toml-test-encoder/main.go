@@ -3,14 +3,13 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
+	"io"
 	"log"
 	"os"
 	"path"
 
 	"github.com/BurntSushi/toml"
-	"github.com/BurntSushi/toml/internal/tag"
 )
 
 func init() {
@@ -30,17 +29,13 @@ func main() {
 		flag.Usage()
 	}
 
-	var tmp any
-	if err := json.NewDecoder(os.Stdin).Decode(&tmp); err != nil {
-		log.Fatalf("Error decoding JSON: %s", err)
-	}
-
-	rm, err := tag.Remove(tmp)
+	in, err := io.ReadAll(os.Stdin)
 	if err != nil {
-		log.Fatalf("Error decoding JSON: %s", err)
+		log.Fatalf("Error reading JSON: %s", err)
 	}
-
-	if err := toml.NewEncoder(os.Stdout).Encode(rm); err != nil {
+	t, err := toml.FromJSON(in, toml.JSONOptions{Tagged: true})
+	if err != nil {
 		log.Fatalf("Error encoding TOML: %s", err)
 	}
+	os.Stdout.Write(t)
 }
@@ -2,7 +2,6 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -20,6 +19,8 @@ var (
 	flagTypes = false
 	flagJSON  = false
 	flagTime  = false
+
+	flagExtract = ""
 )
 
 func init() {
@@ -27,6 +28,7 @@ func init() {
 	flag.BoolVar(&flagTypes, "types", flagTypes, "Show the types for every key.")
 	flag.BoolVar(&flagTime, "time", flagTypes, "Show how long the parsing took.")
 	flag.BoolVar(&flagJSON, "json", flagTypes, "Output parsed document as JSON.")
+	flag.StringVar(&flagExtract, "extract", flagExtract, "Output only this table (e.g. \"database.primary\") as a TOML document.")
 	flag.Usage = usage
 	flag.Parse()
 }
@@ -42,6 +44,11 @@ func main() {
 		flag.Usage()
 	}
 	for _, f := range flag.Args() {
+		if flagExtract != "" {
+			extract(f)
+			continue
+		}
+
 		var tmp any
 		start := time.Now()
 		md, err := toml.DecodeFile(f, &tmp)
@@ -59,12 +66,33 @@ func main() {
 			printTypes(md)
 		}
 		if flagJSON {
-			enc := json.NewEncoder(os.Stdout)
-			enc.SetEscapeHTML(false)
-			enc.SetIndent("", "  ")
-			enc.Encode(tmp)
+			b, err := os.ReadFile(f)
+			if err != nil {
+				log.Fatal(err)
+			}
+			j, err := toml.ToJSON(b, toml.JSONOptions{Indent: "  "})
+			if err != nil {
+				log.Fatalf("Error in '%s': %s", f, err)
+			}
+			os.Stdout.Write(j)
+		}
+	}
+}
+
+func extract(f string) {
+	b, err := os.ReadFile(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := toml.ExtractSection(b, strings.Split(flagExtract, "."))
+	if err != nil {
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			log.Fatalf("Error in '%s': %s", f, perr.ErrorWithPosition())
 		}
+		log.Fatalf("Error in '%s': %s", f, err)
 	}
+	os.Stdout.Write(out)
 }
 
 func printTypes(md toml.MetaData) {
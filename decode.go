@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"math"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,15 +19,48 @@ import (
 
 // Unmarshaler is the interface implemented by objects that can unmarshal a
 // TOML description of themselves.
+//
+// The value is the decoded TOML value, with the same types as when decoding to
+// any: a table is a map[string]any, an array of tables is a []map[string]any,
+// etc. A table only has the keys that are in the document, so the comma-ok
+// idiom can be used to distinguish an absent key from a key set to a zero
+// value:
+//
+//	retries, ok := m["retries"]         // ok is false if "retries" isn't set.
+//	sub, _ := m["sub"].(map[string]any) // "sub = {}" is an empty non-nil map.
+//
+// The same applies to nested tables. An empty table or array is never nil and
+// never omitted.
 type Unmarshaler interface {
 	UnmarshalTOML(any) error
 }
 
+// KeyUnmarshaler is like [Unmarshaler], but the method also gets the key of
+// the value, for example to return errors such as "dishes.eggsalad.price must
+// be positive". It's used instead of UnmarshalTOML if a type implements both.
+//
+// The key is the full key, such as Key{"menu", "dishes", "price"}; keys in an
+// array of tables don't have an index. It's empty for the entire document.
+type KeyUnmarshaler interface {
+	UnmarshalTOMLWithKey(key Key, data any) error
+}
+
 // Unmarshal decodes the contents of data in TOML format into a pointer v.
 //
 // See [Decoder] for a description of the decoding process.
 func Unmarshal(data []byte, v any) error {
-	_, err := NewDecoder(bytes.NewReader(data)).Decode(v)
+	_, err := NewDecoder(bytes.NewReader(data)).SkipKeyOrder(true).Decode(v)
+	return err
+}
+
+// UnmarshalWithProfile is like [Unmarshal], but decodes with the options in p:
+//
+//	err := toml.UnmarshalWithProfile(data, &cfg, toml.DecodeProfileStrict)
+//
+// SkipKeyOrder is always set, as the MetaData isn't returned.
+func UnmarshalWithProfile(data []byte, v any, p DecodeProfile) error {
+	p.SkipKeyOrder = true
+	_, err := NewDecoder(bytes.NewReader(data)).Profile(p).Decode(v)
 	return err
 }
 
@@ -36,14 +71,15 @@ func Decode(data string, v any) (MetaData, error) {
 	return NewDecoder(strings.NewReader(data)).Decode(v)
 }
 
-// DecodeFile reads the contents of a file and decodes it with [Decode].
+// DecodeFile reads the contents of a file and decodes it with [Decode]. The
+// file is read as it's parsed, and errors have the path as [ParseError.Source].
 func DecodeFile(path string, v any) (MetaData, error) {
 	fp, err := os.Open(path)
 	if err != nil {
 		return MetaData{}, err
 	}
 	defer fp.Close()
-	return NewDecoder(fp).Decode(v)
+	return decodeFile(fp, path, v)
 }
 
 // DecodeFS reads the contents of a file from [fs.FS] and decodes it with
@@ -54,7 +90,54 @@ func DecodeFS(fsys fs.FS, path string, v any) (MetaData, error) {
 		return MetaData{}, err
 	}
 	defer fp.Close()
-	return NewDecoder(fp).Decode(v)
+	return decodeFile(fp, path, v)
+}
+
+// DecodeFileOptional is like [DecodeFile], but a file that doesn't exist is
+// decoded as an empty document. The returned bool reports if the file exists.
+//
+// Other errors, such as not having permission to read the file, are still
+// returned.
+func DecodeFileOptional(path string, v any) (MetaData, bool, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return decodeMissing(err, v)
+	}
+	defer fp.Close()
+	meta, err := decodeFile(fp, path, v)
+	return meta, true, err
+}
+
+// DecodeFSOptional is like [DecodeFS], but a file that doesn't exist is
+// decoded as an empty document. The returned bool reports if the file exists.
+func DecodeFSOptional(fsys fs.FS, path string, v any) (MetaData, bool, error) {
+	fp, err := fsys.Open(path)
+	if err != nil {
+		return decodeMissing(err, v)
+	}
+	defer fp.Close()
+	meta, err := decodeFile(fp, path, v)
+	return meta, true, err
+}
+
+// decodeMissing decodes an empty document if err from opening the file says
+// it doesn't exist. Errors from decoding the file itself are never treated as
+// a missing file, even if they wrap fs.ErrNotExist.
+func decodeMissing(err error, v any) (MetaData, bool, error) {
+	if !errors.Is(err, fs.ErrNotExist) {
+		return MetaData{}, true, err
+	}
+	meta, err := Decode("", v)
+	return meta, false, err
+}
+
+// decodeFile decodes the opened file fp, which is an error if it's a
+// directory.
+func decodeFile(fp fs.File, path string, v any) (MetaData, error) {
+	if st, err := fp.Stat(); err == nil && st.IsDir() {
+		return MetaData{}, fmt.Errorf("toml: can't decode %q: is a directory", path)
+	}
+	return NewDecoder(fp).SetName(path).Decode(v)
 }
 
 // Primitive is a TOML value that hasn't been decoded into a Go value.
@@ -86,16 +169,47 @@ const (
 // interchangeably, but structs offer better type safety.
 //
 // TOML table arrays correspond to either a slice of structs or a slice of maps.
+// A document with just one top-level array of tables (e.g. only [[migration]]
+// tables) can be decoded directly in to a slice; it's an error if the document
+// has any other top-level keys.
+//
+// Unexported struct fields are never set. It's an error if a key matches the
+// toml tag of an unexported field, as that's almost certainly a mistake;
+// unexported fields without a tag are ignored.
+//
+// Pointers are allocated for every key that's in the document, and left alone
+// for keys that aren't, so a *bool can tell "false" apart from "not set".
+// Existing slice and array elements are decoded in to, so they can be pre-filled
+// with defaults; map elements start from the zero value unless they're a table.
+//
+// Decoding several documents in to the same value layers them: a key in a later
+// document replaces the existing value, except for tables, which are merged
+// with the existing struct, map, or map element. It doesn't matter if a table
+// is defined with a header, dotted keys, or an inline table in either document;
+// that inline tables can't be extended only applies within one document.
 //
 // TOML datetimes correspond to [time.Time]. Local datetimes are parsed in the
-// local timezone.
+// local timezone, with the location set to [LocalDatetimeZone], [LocalDateZone],
+// or [LocalTimeZone].
 //
 // [time.Duration] types are treated as nanoseconds if the TOML value is an
-// integer, or they're parsed with time.ParseDuration() if they're strings.
+// integer, as seconds if it's a float (1.5 is 1500ms), or they're parsed with
+// time.ParseDuration() if they're strings.
+// Other types can accept more than one kind of TOML value in the same way with
+// a [TypeAdapter].
 //
 // All other TOML types (float, string, int, bool and array) correspond to the
 // obvious Go types.
 //
+// A single primitive value decoded in to a slice is decoded as a slice with one
+// element, so "a = 1" and "a = [1]" can both be decoded in to []int. This isn't
+// done for the elements of an array: "a = [1]" can't be decoded in to [][]int.
+//
+// Integers larger than the int64 range but within the uint64 range can be
+// decoded in to uint64 (and uint on 64-bit systems); decoding them in to any
+// will produce a uint64 value. This is an extension to the TOML specification,
+// which only requires supporting the int64 range.
+//
 // An exception to the above rules is if a type implements the TextUnmarshaler
 // interface, in which case any primitive TOML value (floats, strings, integers,
 // booleans, datetimes) will be converted to a []byte and given to the value's
@@ -107,18 +221,69 @@ const (
 // TOML keys can map to either keys in a Go map or field names in a Go struct.
 // The special `toml` struct tag can be used to map TOML keys to struct fields
 // that don't match the key name exactly (see the example). A case insensitive
-// match to struct names will be tried if an exact match can't be found.
+// match to struct names will be tried if an exact match can't be found (unless
+// [Decoder.CaseSensitive] is set). Fields with the tag `toml:"-"` are ignored;
+// use `toml:"-,"` for a key that is literally named "-".
+//
+// If more than one key in a table matches the same field (e.g. "name" and
+// "Name") then they're decoded in the order of the document, so the last value
+// is used and tables are merged, or it's an error with
+// [Decoder.DisallowKeyCollisions]. Every key is listed in [MetaData.Keys] with
+// its original spelling. Keys in a Go map are always used as-is, so two
+// different TOML keys never set the same map key. Map keys must be strings or
+// implement [encoding.TextUnmarshaler], in which case the TOML key is given to
+// UnmarshalText.
+//
+// An array of tables can be decoded in to a map by adding the "keyed" option
+// with a key name; for example with `toml:"servers,keyed=name"` the string
+// value of the "name" key in every table is used as the map key. It's an error
+// if the key is missing or if the same name is used more than once.
+//
+// Keys can be renamed with the "deprecated" option, which can be given more than
+// once; for example with `toml:"new_name,deprecated=old_name"` the value of
+// "old_name" is used if "new_name" isn't set. This adds a warning to
+// [MetaData.Warnings], and the old key won't be in [MetaData.Undecoded].
+//
+// A struct field with the "union" option is a table where only one of the
+// pointer fields (the variants) can be set; for example with
+// `toml:"input,union"` "[input.file]" and "[input.kafka]" can't both be in the
+// document. With `toml:"input,union=required"` exactly one variant must be set.
+// The variant that was set is reported by [MetaData.UnionChoice].
+//
+// Integer, float, and boolean fields with the "string" option, such as
+// `toml:"port,string"`, accept the value as a TOML string ("8080", "true"). The
+// unquoted value is also accepted, so existing documents keep working after
+// adding the option. Using it on other types is an error.
+//
+// Decoding a table in to a struct which has fields but none that are exported
+// is an error, unless it implements an unmarshaler (see
+// [Decoder.AllowOpaqueStructs]).
 //
 // The mapping between TOML values and Go values is loose. That is, there may
 // exist TOML values that cannot be placed into your representation, and there
 // may be parts of your representation that do not correspond to TOML values.
 // This loose mapping can be made stricter by using the IsDefined and/or
-// Undecoded methods on the MetaData returned.
+// Undecoded methods on the MetaData returned, or with options such as
+// [Decoder.DisallowUnknownFields]. [DecodeProfileStrict] sets all the options
+// to make decoding as strict as possible.
+//
+// Byte-order marks at the start of the document are skipped. A UTF-8 BOM at the
+// start of any other line (e.g. from concatenating files) is skipped too, and
+// adds a warning to [MetaData.Warnings]; anywhere else outside strings and
+// comments it's an error.
 //
 // This decoder does not handle cyclic types. Decode will not terminate if a
 // cyclic type is passed.
 type Decoder struct {
-	r io.Reader
+	r            io.Reader
+	opts         DecodeProfile
+	defaultTypes map[reflect.Type]interfaceFunc
+	adapters     map[reflect.Type]TypeAdapter
+	tracer       func(TraceEvent)
+	name         string
+
+	rest   []byte // Read after the delimiter, but not used yet; see Delimiter.
+	offset int64  // Offset in r after the last document.
 }
 
 // NewDecoder creates a new Decoder.
@@ -126,13 +291,483 @@ func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{r: r}
 }
 
+// RecordConversions sets if implicit conversions should be recorded; they can
+// be retrieved with [MetaData.Conversions] after decoding.
+//
+// This only records which conversions were done (e.g. a TOML integer to a Go
+// float64); it doesn't change how anything is decoded.
+func (dec *Decoder) RecordConversions(record bool) *Decoder {
+	dec.opts.RecordConversions = record
+	return dec
+}
+
+// AllowOpaqueStructs sets if tables can be decoded in to structs without any
+// exported fields and without an unmarshaler.
+//
+// By default this is an error, as nothing would be decoded. Set this to true to
+// silently ignore these tables instead.
+func (dec *Decoder) AllowOpaqueStructs(allow bool) *Decoder {
+	dec.opts.AllowOpaqueStructs = allow
+	return dec
+}
+
+// AllowIntegralFloats sets if TOML floats without a fractional part (such as
+// 5.0) can be decoded in to integer types.
+//
+// By default a float is never accepted for an integer type, and a float with a
+// fractional part (such as 2.5) is always an error, as it can't be converted
+// without losing information.
+func (dec *Decoder) AllowIntegralFloats(allow bool) *Decoder {
+	dec.opts.AllowIntegralFloats = allow
+	return dec
+}
+
+// WeakTypes sets if some values of the wrong TOML type are accepted: the
+// integers 0 and 1, and the strings "true" and "false" (case-insensitive,
+// ignoring surrounding whitespace) can be decoded in to a bool. Other integers
+// and strings are still an error.
+//
+// This is useful for documents written by tools that don't use TOML booleans.
+func (dec *Decoder) WeakTypes(weak bool) *Decoder {
+	dec.opts.WeakTypes = weak
+	return dec
+}
+
+// DisallowKeyCollisions sets if it's an error when more than one key in a
+// table matches the same struct field, such as "name" and "Name" for the field
+// Name. The default is to use the last one in the document, or to merge them
+// for tables.
+func (dec *Decoder) DisallowKeyCollisions(disallow bool) *Decoder {
+	dec.opts.DisallowKeyCollisions = disallow
+	return dec
+}
+
+// UseJSONInterfaces sets if types that implement [json.Unmarshaler], but not
+// [Unmarshaler] or [encoding.TextUnmarshaler], are decoded with UnmarshalJSON.
+//
+// The TOML value is converted to JSON as with [ToJSON]. JSON has no datetime
+// type, so datetimes are given as strings, and NaN and infinity are given as
+// the strings "nan", "inf", and "-inf".
+func (dec *Decoder) UseJSONInterfaces(use bool) *Decoder {
+	dec.opts.UseJSONInterfaces = use
+	return dec
+}
+
+// WarnIntegerDates sets if a warning is added to [MetaData.Warnings] for
+// integers that look like a date written without dashes (e.g. 20240101) for a
+// key with a name that suggests it's a date, such as "date" or "start_time".
+//
+// This is a heuristic, and it's easy to have false positives, so it's not
+// enabled by default.
+func (dec *Decoder) WarnIntegerDates(warn bool) *Decoder {
+	dec.opts.WarnIntegerDates = warn
+	return dec
+}
+
+// MaxKeyLength sets the maximum length of a single key in bytes; this is
+// checked for every part of a dotted key or table name separately. A longer key
+// is an error, which is reported as soon as the limit is reached, without
+// reading the rest of the key.
+//
+// The default of 0 means there's no limit.
+func (dec *Decoder) MaxKeyLength(n int) *Decoder {
+	dec.opts.MaxKeyLength = n
+	return dec
+}
+
+// MaxValueLength sets the maximum length of a single value in bytes, such as a
+// string or number. Arrays and inline tables aren't counted as a whole, but
+// every value in them is checked. A longer value is an error, which is
+// reported as soon as the limit is reached, without reading the rest of the
+// value.
+//
+// The length is of the TOML source, excluding quotes for strings; e.g. the
+// string "\u00e9" is 6 bytes.
+//
+// The default of 0 means there's no limit.
+func (dec *Decoder) MaxValueLength(n int) *Decoder {
+	dec.opts.MaxValueLength = n
+	return dec
+}
+
+// Deadline sets the maximum time to spend on reading and parsing the document.
+// If it takes longer a [TimeoutError] is returned, so that a slow document can
+// be told apart from an invalid one.
+//
+// The time is checked every few thousand characters, so the deadline may be
+// exceeded by a small amount. Decoding the parsed values in to Go types isn't
+// counted.
+//
+// The default of 0 means there's no deadline.
+func (dec *Decoder) Deadline(d time.Duration) *Decoder {
+	dec.opts.Deadline = d
+	return dec
+}
+
+// ArrayLengthMismatch sets what to do if a TOML array has a different length
+// than the fixed-size Go array it's decoded in to. The default of LengthError
+// is an error for both shorter and longer TOML arrays.
+//
+// This applies to every level of nested arrays such as [2][3]int.
+//
+// Arrays of pointers such as [8]*Stage are an exception: a shorter TOML array
+// is never an error, and the remaining elements are set to nil unless
+// LengthZeroFill is set. The [Encoder] leaves out nil elements at the end of
+// these arrays.
+func (dec *Decoder) ArrayLengthMismatch(m LengthMismatch) *Decoder {
+	dec.opts.ArrayLengthMismatch = m
+	return dec
+}
+
+// LengthMismatch is what to do when the length of a TOML array doesn't match
+// the Go array; see [Decoder.ArrayLengthMismatch]. The flags can be combined
+// to allow both.
+type LengthMismatch uint8
+
+const (
+	// LengthError is an error if the lengths don't match.
+	LengthError LengthMismatch = 0
+
+	// LengthZeroFill sets the remaining elements to the zero value if the
+	// TOML array is shorter. Pointers are set to a new zero value rather than
+	// nil.
+	LengthZeroFill LengthMismatch = 1 << 0
+
+	// LengthTruncate ignores the remaining values if the TOML array is longer.
+	LengthTruncate LengthMismatch = 1 << 1
+)
+
+// RegisterDefaultType sets the concrete type to decode TOML tables in to for
+// destinations of the interface type iface.
+//
+// Only empty interfaces (any) are supported by default; for other interfaces
+// the decoder can't know which type to use. With this, concrete is called for
+// every table that's decoded to iface, and the table is decoded in to the
+// returned value using the normal rules. It should return a new pointer (or
+// value) of a type that implements iface:
+//
+//	dec.RegisterDefaultType(reflect.TypeOf((*Notifier)(nil)).Elem(),
+//		func() any { return new(EmailNotifier) })
+//
+// This will panic if iface is not an interface type.
+func (dec *Decoder) RegisterDefaultType(iface reflect.Type, concrete func() any) *Decoder {
+	if iface == nil || iface.Kind() != reflect.Interface {
+		panic(fmt.Sprintf("toml: RegisterDefaultType: %v is not an interface type", iface))
+	}
+	return dec.registerInterface(iface, func(map[string]any) (any, error) { return concrete(), nil })
+}
+
+// RegisterInterfaceDecoder is like [Decoder.RegisterDefaultType], but the
+// concrete type can depend on the table, for example on a "type" key:
+//
+//	dec.RegisterInterfaceDecoder(reflect.TypeOf((*Part)(nil)).Elem(),
+//		func(table map[string]any) (any, error) {
+//			switch table["type"] {
+//			case "disk":
+//				return new(Disk), nil
+//			case "network":
+//				return new(Network), nil
+//			}
+//			return nil, fmt.Errorf("unknown part type %q", table["type"])
+//		})
+//
+// The table is decoded in to the returned value using the normal rules; a key
+// that's only used to select the type is in [MetaData.Undecoded] unless the
+// type has a field for it. Errors are returned with the position of the table.
+//
+// This will panic if iface is not an interface type.
+func (dec *Decoder) RegisterInterfaceDecoder(iface reflect.Type, concrete func(table map[string]any) (any, error)) *Decoder {
+	if iface == nil || iface.Kind() != reflect.Interface {
+		panic(fmt.Sprintf("toml: RegisterInterfaceDecoder: %v is not an interface type", iface))
+	}
+	return dec.registerInterface(iface, concrete)
+}
+
+// interfaceFunc returns the value to decode a table in to for an interface
+// type; see RegisterInterfaceDecoder.
+type interfaceFunc func(table map[string]any) (any, error)
+
+func (dec *Decoder) registerInterface(iface reflect.Type, f interfaceFunc) *Decoder {
+	if dec.defaultTypes == nil {
+		dec.defaultTypes = make(map[reflect.Type]interfaceFunc)
+	}
+	dec.defaultTypes[iface] = f
+	return dec
+}
+
+// RegisterType sets the adapter for the type t for this Decoder, taking
+// precedence over adapters registered with the global [RegisterType].
+func (dec *Decoder) RegisterType(t reflect.Type, a TypeAdapter) *Decoder {
+	if dec.adapters == nil {
+		dec.adapters = make(map[reflect.Type]TypeAdapter)
+	}
+	dec.adapters[t] = a
+	return dec
+}
+
+// PartialMetaData sets if the MetaData for the part of the document
+// that was parsed is returned if there's a syntax error, rather than an empty
+// MetaData. This can be used to show where in the document the error is, e.g.
+// "in [cluster.nodes], after 412 entries".
+//
+// The MetaData is incomplete: it has the keys, types, and positions of
+// everything before the error (and nothing after it), but the value that has
+// the error is left out, and nothing is decoded. Errors from decoding the
+// values in to Go types aren't affected, as the MetaData is always returned for
+// those.
+func (dec *Decoder) PartialMetaData(partial bool) *Decoder {
+	dec.opts.PartialMetaData = partial
+	return dec
+}
+
+// SetTrace sets a function that's called for every key that's decoded in to a
+// struct field or map, with the Go destination and what was done with it. This
+// is intended for debugging, for example to find out why a key in the document
+// didn't set a field:
+//
+//	dec.SetTrace(func(ev toml.TraceEvent) { log.Print(ev) })
+//
+// Which logs something like:
+//
+//	line 3: key "nmae" matched no field in main.Config (closest: "name" on field FullName)
+//
+// Keys in a table are decoded in a random order, so the order of the events
+// isn't the order of the document. The default of nil doesn't trace anything.
+func (dec *Decoder) SetTrace(fn func(TraceEvent)) *Decoder {
+	dec.tracer = fn
+	return dec
+}
+
+// DisallowUnknownFields sets if it's an error when a key in a table doesn't
+// match any field of the struct it's decoded in to. The default is to ignore
+// these keys; they're still listed in [MetaData.Undecoded].
+//
+// This only applies to structs; maps accept any key.
+//
+// Keys in a table that's decoded in to a [Primitive] aren't checked until the
+// Primitive is decoded with [MetaData.PrimitiveDecode], which uses the same
+// setting: it's an error if the Primitive has a key that's not in the struct
+// it's decoded in to.
+func (dec *Decoder) DisallowUnknownFields(disallow bool) *Decoder {
+	dec.opts.DisallowUnknownFields = disallow
+	return dec
+}
+
+// DisallowPlaceholders sets if it's an error when the document has a
+// placeholder comment for a key that wasn't given a value, such as:
+//
+//	# api_key =   # required: your API key
+//
+// The error is a [PlaceholderError] with all such keys, as listed by
+// [MetaData.Placeholders]; nothing is decoded. The default is to ignore them.
+func (dec *Decoder) DisallowPlaceholders(disallow bool) *Decoder {
+	dec.opts.DisallowPlaceholders = disallow
+	return dec
+}
+
+// StrictTypes sets if TOML integers can only be decoded in to integer types.
+//
+// By default an integer can also be decoded in to a float type, as long as it
+// can be represented exactly.
+func (dec *Decoder) StrictTypes(strict bool) *Decoder {
+	dec.opts.StrictTypes = strict
+	return dec
+}
+
+// RequireOffsets sets if all datetimes in the document must have a timezone
+// offset. Local datetimes, local dates, and local times are an error, even for
+// keys that aren't decoded.
+func (dec *Decoder) RequireOffsets(require bool) *Decoder {
+	dec.opts.RequireOffsets = require
+	return dec
+}
+
+// CaseSensitive sets if keys must match the field name exactly. By default a
+// case-insensitive match is used if there is no exact match.
+func (dec *Decoder) CaseSensitive(sensitive bool) *Decoder {
+	dec.opts.CaseSensitive = sensitive
+	return dec
+}
+
+// CanonicalKeys sets if keys in the document that only differ in case are the
+// same key, such as "Server" in "[Server]" and "server" in "server.port = 1".
+// The spelling that's used first is used for all of them: it's the key in maps
+// and MetaData, and it's what the Encoder writes. Every other spelling adds a
+// warning to [MetaData.Warnings], and is listed in [MetaData.Aliases].
+//
+// TOML keys are case sensitive, so this isn't the default; it's ignored if
+// [Decoder.CaseSensitive] is set.
+func (dec *Decoder) CanonicalKeys(canonical bool) *Decoder {
+	dec.opts.CanonicalKeys = canonical
+	return dec
+}
+
+// Version sets the version of the TOML specification the document is parsed
+// with; this is either [Version10] or [Version11].
+//
+// The default is TOML 1.0, or TOML 1.1 if the BURNTSUSHI_TOML_110 environment
+// variable is set. Decode returns an error for other versions.
+func (dec *Decoder) Version(v Version) *Decoder {
+	dec.opts.Version = v
+	return dec
+}
+
+// SkipKeyOrder sets if the order of keys in the document isn't recorded, which
+// saves time and memory for documents with many keys. [Unmarshal] sets this, as
+// the MetaData isn't returned.
+//
+// [MetaData.Keys] and [MetaData.Undecoded] still work, but are slower and
+// return the keys ordered by their position in the document, with every array
+// of tables listed once instead of once for every table in it.
+func (dec *Decoder) SkipKeyOrder(skip bool) *Decoder {
+	dec.opts.SkipKeyOrder = skip
+	return dec
+}
+
+// Delimiter sets a line that ends the document, for streams with several
+// documents such as "+++" for front matter. The line must be exactly delim,
+// optionally followed by a \r\n; it's only recognized between top-level items,
+// not inside strings or arrays.
+//
+// Decode stops at the delimiter, and the next call decodes the document after
+// it. [io.EOF] is returned once there's no more input. If the reader implements
+// [io.Seeker] it's positioned directly after the delimiter line; otherwise the
+// data that was read past it is available from [Decoder.Buffered].
+//
+// The default of "" reads the entire input as one document.
+func (dec *Decoder) Delimiter(delim string) *Decoder {
+	dec.opts.Delimiter = delim
+	return dec
+}
+
+// SetName sets the name of the input, such as the path of the file, which is
+// added to errors as [ParseError.Source]. [DecodeFile] and [DecodeFS] set this
+// to the path.
+func (dec *Decoder) SetName(name string) *Decoder {
+	dec.name = name
+	return dec
+}
+
+// Buffered returns the data that was read from the reader but isn't decoded
+// yet, because it's after the delimiter; see [Decoder.Delimiter]. It's valid
+// until the next call to Decode.
+func (dec *Decoder) Buffered() io.Reader {
+	return bytes.NewReader(dec.rest)
+}
+
+// InputOffset returns the offset in the input after the last document that was
+// decoded, including the delimiter line and any byte-order marks. This is the
+// total size of the input if there's no delimiter.
+func (dec *Decoder) InputOffset() int64 {
+	return dec.offset
+}
+
+// input gets the reader for the next document.
+func (dec *Decoder) input() io.Reader {
+	if len(dec.rest) == 0 {
+		return dec.r
+	}
+	return io.MultiReader(bytes.NewReader(dec.rest), dec.r)
+}
+
+// consumed records that the lexer read the document up to lx.end from the
+// reader returned by input(), and seeks back to there if possible.
+func (dec *Decoder) consumed(lx *lexer) {
+	seek := len(dec.rest) == 0
+	dec.offset, dec.rest = dec.offset+int64(lx.end), []byte(lx.rest)
+	if s, ok := dec.r.(io.Seeker); ok && seek && len(dec.rest) > 0 {
+		if _, err := s.Seek(-int64(len(dec.rest)), io.SeekCurrent); err == nil {
+			dec.rest = nil
+		}
+	}
+}
+
+// Profile sets all options to the values in p, overwriting any options set
+// before. Options can still be changed afterwards:
+//
+//	dec := toml.NewDecoder(r).Profile(toml.DecodeProfileStrict).MaxValueLength(0)
+func (dec *Decoder) Profile(p DecodeProfile) *Decoder {
+	dec.opts = p
+	return dec
+}
+
+// DecodeProfile is a set of options for the [Decoder]. Every field is the same
+// as the Decoder method with the same name.
+//
+// Use [Decoder.Profile] to set all of them at once. The DecodeProfile* variables
+// are presets; you can copy and change these to make your own:
+//
+//	p := toml.DecodeProfileStrict
+//	p.DisallowUnknownFields = false
+type DecodeProfile struct {
+	RecordConversions     bool
+	AllowOpaqueStructs    bool
+	AllowIntegralFloats   bool
+	StrictTypes           bool
+	DisallowUnknownFields bool
+	DisallowKeyCollisions bool
+	DisallowPlaceholders  bool
+	CaseSensitive         bool
+	CanonicalKeys         bool
+	RequireOffsets        bool
+	UseJSONInterfaces     bool
+	WarnIntegerDates      bool
+	WeakTypes             bool
+	SkipKeyOrder          bool
+	PartialMetaData       bool
+	MaxKeyLength          int
+	MaxValueLength        int
+	Delimiter             string
+	Deadline              time.Duration
+	ArrayLengthMismatch   LengthMismatch
+	Version               Version
+}
+
+var (
+	// DecodeProfileDefault is the default behaviour of a new Decoder.
+	DecodeProfileDefault = DecodeProfile{}
+
+	// DecodeProfileStrict rejects everything that's likely a mistake: keys
+	// that don't match any field, more than one key for the same field,
+	// placeholders without a value, integers for floats, and datetimes
+	// without an offset. Keys and values are also limited to 1K and 1M.
+	DecodeProfileStrict = DecodeProfile{
+		StrictTypes:           true,
+		DisallowUnknownFields: true,
+		DisallowKeyCollisions: true,
+		DisallowPlaceholders:  true,
+		RequireOffsets:        true,
+		MaxKeyLength:          1 << 10,
+		MaxValueLength:        1 << 20,
+	}
+
+	// DecodeProfileLenient accepts as much as possible: floats without a
+	// fractional part for integers, 0, 1, "true", and "false" for booleans,
+	// structs without exported fields, and arrays of any length for
+	// fixed-size Go arrays. Keys are matched case-insensitively, and there are
+	// no limits.
+	DecodeProfileLenient = DecodeProfile{
+		AllowIntegralFloats: true,
+		WeakTypes:           true,
+		AllowOpaqueStructs:  true,
+		ArrayLengthMismatch: LengthZeroFill | LengthTruncate,
+	}
+)
+
 var (
 	unmarshalToml = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	unmarshalKey  = reflect.TypeOf((*KeyUnmarshaler)(nil)).Elem()
 	unmarshalText = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
 	primitiveType = reflect.TypeOf((*Primitive)(nil)).Elem()
+	timePtrType   = reflect.TypeOf((*time.Time)(nil))
 )
 
 // Decode TOML data in to the pointer `v`.
+//
+// The input is read as it's parsed, so syntax errors are returned as soon as
+// they're found, without reading the rest of the input first. Errors from the
+// reader are returned with the byte offset at which they occurred, and can be
+// checked with errors.Is().
 func (dec *Decoder) Decode(v any) (MetaData, error) {
 	rv := reflect.ValueOf(v)
 	if rv.Kind() != reflect.Ptr {
@@ -147,39 +782,304 @@ func (dec *Decoder) Decode(v any) (MetaData, error) {
 		return MetaData{}, fmt.Errorf("toml: cannot decode to nil value of %q", reflect.TypeOf(v))
 	}
 
-	// Check if this is a supported type: struct, map, any, or something that
-	// implements UnmarshalTOML or UnmarshalText.
+	// Check if this is a supported type: struct, map, slice, any, or something
+	// that implements UnmarshalTOML or UnmarshalText.
 	rv = indirect(rv)
 	rt := rv.Type()
-	if rv.Kind() != reflect.Struct && rv.Kind() != reflect.Map &&
+	if rv.Kind() != reflect.Struct && rv.Kind() != reflect.Map && rv.Kind() != reflect.Slice &&
 		!(rv.Kind() == reflect.Interface && rv.NumMethod() == 0) &&
-		!rt.Implements(unmarshalToml) && !rt.Implements(unmarshalText) {
+		!rt.Implements(unmarshalToml) && !rt.Implements(unmarshalKey) && !rt.Implements(unmarshalText) {
 		return MetaData{}, fmt.Errorf("toml: cannot decode to type %s", rt)
 	}
 
-	// TODO: parser should read from io.Reader? Or at the very least, make it
-	// read from []byte rather than string
-	data, err := io.ReadAll(dec.r)
+	tomlNext, err := dec.tomlNext()
 	if err != nil {
 		return MetaData{}, err
 	}
 
-	p, err := parse(string(data))
+	// The input is read as it's lexed, so syntax errors are reported without
+	// having to read everything first.
+	p, err := parseStream(dec.input(), dec.opts, tomlNext, hasRawMessage(rt, nil), false, false, nil)
 	if err != nil {
-		return MetaData{}, err
+		if dec.opts.PartialMetaData && p != nil {
+			return dec.partialMetaData(p), dec.named(err)
+		}
+		return MetaData{}, dec.named(err)
+	}
+	dec.consumed(p.lx)
+	if dec.opts.Delimiter != "" && p.lx.end == 0 {
+		return MetaData{}, io.EOF
 	}
 
-	md := MetaData{
-		mapping: p.mapping,
-		keyInfo: p.keyInfo,
-		keys:    p.ordered,
-		decoded: make(map[string]struct{}, len(p.ordered)),
-		context: nil,
-		data:    data,
+	md := dec.metaData(p)
+	if err := md.checkPlaceholders(); err != nil {
+		return md, err
+	}
+	if rv.Kind() == reflect.Slice && !rt.Implements(unmarshalToml) && !rt.Implements(unmarshalKey) &&
+		!rt.Implements(unmarshalText) {
+		return md, md.unifyList(p.mapping, rv)
+	}
+	if md.unifyFlat(p.mapping, rv) {
+		return md, nil
 	}
 	return md, md.unify(p.mapping, rv)
 }
 
+// metaData creates the MetaData for the document parsed by p.
+func (dec *Decoder) metaData(p *parser) MetaData {
+	return MetaData{
+		mapping:  p.mapping,
+		keyInfo:  p.keyInfo,
+		formats:  p.formats,
+		dotted:   p.dotted,
+		raw:      p.raw,
+		canon:    p.canon,
+		aliases:  p.aliases,
+		keys:     p.ordered,
+		decoded:  make(map[string]struct{}, len(p.ordered)),
+		context:  nil,
+		data:     p.lx.input,
+		name:     dec.name,
+		tomlNext: p.tomlNext,
+
+		opts:         dec.opts,
+		defaultTypes: dec.defaultTypes,
+		adapters:     dec.adapters,
+		tracer:       dec.tracer,
+		placeholders: p.placeholders,
+		warnings:     p.warnings,
+		comments:     p.keyComments,
+	}
+}
+
+// partialMetaData creates the MetaData for the part of the document that p
+// parsed before an error. The key that was being parsed when the error
+// occurred is left out, as it doesn't have a value.
+func (dec *Decoder) partialMetaData(p *parser) MetaData {
+	keys := make([]Key, 0, len(p.ordered))
+	for _, k := range p.ordered {
+		if _, ok := p.keyInfo[k.String()]; ok {
+			keys = append(keys, k)
+		}
+	}
+	p.ordered = keys
+	return dec.metaData(p)
+}
+
+// tomlNext reports if TOML 1.1 should be used.
+func (dec *Decoder) tomlNext() (bool, error) {
+	switch dec.opts.Version {
+	case "":
+		_, ok := os.LookupEnv("BURNTSUSHI_TOML_110")
+		return ok, nil
+	case Version10:
+		return false, nil
+	case Version11:
+		return true, nil
+	}
+	return false, fmt.Errorf("toml: unsupported TOML version %q", dec.opts.Version)
+}
+
+// DecodeTables reads the document one top-level key at a time, and calls fn
+// for every key once it's complete. The data for a key is released after fn
+// returns, so this can be used for documents too large to keep in memory. The
+// Decoder's options are used as with Decode.
+//
+// For arrays of tables fn is called for every table in the array, with prim
+// being that table. Top-level keys that are not in a table are passed once the
+// first header is read. The MetaData has the information for the key and can be
+// used to decode prim:
+//
+//	err := toml.NewDecoder(fp).DecodeTables(func(md *toml.MetaData, key toml.Key, prim toml.Primitive) error {
+//		if key.String() != "entries" {
+//			return nil
+//		}
+//		var e Entry
+//		if err := md.PrimitiveDecode(prim, &e); err != nil {
+//			return err
+//		}
+//		return process(e)
+//	})
+//
+// All tables under a top-level key must be directly after each other: "[a.b]"
+// after "[c]" is an error if "[a]" was before "[c]", even though that's valid
+// TOML. Tables in an array of tables may be after other tables.
+//
+// Errors returned by fn are returned as-is, and stop reading the document.
+func (dec *Decoder) DecodeTables(fn func(md *MetaData, key Key, prim Primitive) error) error {
+	tomlNext, err := dec.tomlNext()
+	if err != nil {
+		return err
+	}
+
+	p, err := parseStream(dec.input(), dec.opts, tomlNext, false, false, false, func(c chunk) error {
+		md := MetaData{
+			mapping:  c.mapping,
+			keyInfo:  c.keyInfo,
+			formats:  c.formats,
+			dotted:   c.dotted,
+			keys:     c.ordered,
+			decoded:  make(map[string]struct{}, len(c.ordered)),
+			data:     c.data,
+			lines:    c.lines,
+			start:    c.start,
+			name:     dec.name,
+			tomlNext: tomlNext,
+
+			opts:         dec.opts,
+			defaultTypes: dec.defaultTypes,
+			adapters:     dec.adapters,
+			tracer:       dec.tracer,
+			placeholders: c.placeholders,
+			warnings:     c.warnings,
+			comments:     c.comments,
+		}
+		if err := md.checkPlaceholders(); err != nil {
+			return err
+		}
+		for _, k := range c.keys {
+			v := c.mapping[k]
+			if tables, ok := v.([]map[string]any); ok {
+				v = tables[len(tables)-1]
+			}
+			md.decoded[k] = struct{}{}
+			if err := fn(&md, Key{k}, Primitive{undecoded: v, context: Key{k}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return dec.named(err)
+	}
+	dec.consumed(p.lx)
+	return nil
+}
+
+// checkPlaceholders returns a PlaceholderError if there are placeholders
+// without a value and DisallowPlaceholders is set.
+func (md *MetaData) checkPlaceholders() error {
+	if !md.opts.DisallowPlaceholders {
+		return nil
+	}
+	if keys := md.Placeholders(); len(keys) > 0 {
+		return PlaceholderError{Keys: keys}
+	}
+	return nil
+}
+
+// named sets the Source of err to the name set with SetName, if it's a
+// ParseError from the parser.
+func (dec *Decoder) named(err error) error {
+	if pErr, ok := err.(ParseError); ok && dec.name != "" {
+		pErr.Source = dec.name
+		return pErr
+	}
+	return err
+}
+
+// unifyFlat is a fast path for decoding a document with only strings, integers,
+// or booleans (and no tables or arrays) in to a map[string]string,
+// map[string]int64, map[string]bool, or map[string]any, which is common for
+// small configuration files.
+//
+// It reports false without changing anything if it can't be used, in which case
+// the result of unify() would be different.
+func (md *MetaData) unifyFlat(mapping map[string]any, rv reflect.Value) bool {
+	if rv.Kind() != reflect.Map || !rv.CanAddr() || md.opts.RecordConversions || md.opts.WarnIntegerDates || md.tracer != nil ||
+		lookupAdapter(md.adapters, rv.Type().Elem()) != nil {
+		return false
+	}
+	switch m := rv.Addr().Interface().(type) {
+	default:
+		return false
+	case *map[string]string:
+		for _, v := range mapping {
+			if _, ok := v.(string); !ok {
+				return false
+			}
+		}
+		if *m == nil {
+			*m = make(map[string]string, len(mapping))
+		}
+		for k, v := range mapping {
+			(*m)[k] = v.(string)
+		}
+	case *map[string]int64:
+		for _, v := range mapping {
+			if _, ok := v.(int64); !ok {
+				return false
+			}
+		}
+		if *m == nil {
+			*m = make(map[string]int64, len(mapping))
+		}
+		for k, v := range mapping {
+			(*m)[k] = v.(int64)
+		}
+	case *map[string]bool:
+		for _, v := range mapping {
+			if _, ok := v.(bool); !ok {
+				return false
+			}
+		}
+		if *m == nil {
+			*m = make(map[string]bool, len(mapping))
+		}
+		for k, v := range mapping {
+			(*m)[k] = v.(bool)
+		}
+	case *map[string]any:
+		for _, v := range mapping {
+			switch v.(type) {
+			case map[string]any, []map[string]any, []any:
+				return false
+			}
+		}
+		if *m == nil {
+			*m = make(map[string]any, len(mapping))
+		}
+		for k, v := range mapping {
+			(*m)[k] = v
+		}
+	}
+	for k := range mapping {
+		md.decoded[Key{k}.String()] = struct{}{}
+	}
+	return true
+}
+
+// unifyList decodes the only top-level key in mapping, which must be an array
+// of tables, in to the slice rv.
+func (md *MetaData) unifyList(mapping map[string]any, rv reflect.Value) error {
+	if len(mapping) == 0 {
+		return nil
+	}
+	if len(mapping) > 1 {
+		keys := make([]string, 0, len(mapping))
+		for k := range mapping {
+			keys = append(keys, strconv.Quote(k))
+		}
+		sort.Strings(keys)
+		return fmt.Errorf("toml: cannot decode to type %s: the document must have only one array of tables, but it has the top-level keys %s",
+			rv.Type(), strings.Join(keys, ", "))
+	}
+
+	var k string
+	for k = range mapping {
+	}
+	tables, ok := mapping[k].([]map[string]any)
+	if !ok {
+		return fmt.Errorf("toml: cannot decode to type %s: %q has type %s rather than being an array of tables",
+			rv.Type(), k, md.keyInfo[k].tomlType.typeString())
+	}
+
+	md.decoded[k] = struct{}{}
+	md.context = Key{k}
+	defer func() { md.context = nil }()
+	return md.unify(tables, rv)
+}
+
 // PrimitiveDecode is just like the other Decode* functions, except it decodes a
 // TOML value that has already been parsed. Valid primitive values can *only* be
 // obtained from values filled by the decoder functions, including this method.
@@ -190,6 +1090,11 @@ func (dec *Decoder) Decode(v any) (MetaData, error) {
 // will only reflect keys that were decoded. Namely, any keys hidden behind a
 // Primitive will be considered undecoded. Executing this method will update the
 // undecoded keys in the meta data. (See the example.)
+//
+// The options from the [Decoder] that returned the meta data are used, so with
+// [Decoder.DisallowUnknownFields] it's an error if primValue has keys that
+// don't match a field in v. The keys that were decoded before the error are
+// still marked as decoded.
 func (md *MetaData) PrimitiveDecode(primValue Primitive, v any) error {
 	md.context = primValue.context
 	defer func() { md.context = nil }()
@@ -202,6 +1107,9 @@ func (md *MetaData) PrimitiveDecode(primValue Primitive, v any) error {
 // Any type mismatch produces an error. Finding a type that we don't know
 // how to handle produces an unsupported type error.
 func (md *MetaData) unify(data any, rv reflect.Value) error {
+	elem := md.arrayElem
+	md.arrayElem = false
+
 	// Special case. Look for a `Primitive` value.
 	// TODO: #76 would make this superfluous after implemented.
 	if rv.Type() == primitiveType {
@@ -215,17 +1123,75 @@ func (md *MetaData) unify(data any, rv reflect.Value) error {
 		}))
 		return nil
 	}
+	if rv.Type() == rawMessageType {
+		return md.e("RawMessage can only be used for the value of a key, not for array elements or the document")
+	}
+
+	// Decode in to the value in interfaces with methods. Pointers are decoded
+	// in to directly, so that instances that are set beforehand are filled in;
+	// other values are copied, as they're not addressable.
+	if rv.Kind() == reflect.Interface && rv.NumMethod() > 0 && !rv.IsNil() {
+		if e := rv.Elem(); e.Kind() == reflect.Ptr && !e.IsNil() {
+			return md.unify(data, indirect(e))
+		}
+		return md.unifyConcrete(data, rv, rv.Elem())
+	}
 
 	rvi := rv.Interface()
+	if v, ok := rvi.(KeyUnmarshaler); ok {
+		key := make(Key, len(md.context))
+		copy(key, md.context)
+		err := v.UnmarshalTOMLWithKey(key, data)
+		if err != nil {
+			return md.parseErr(err)
+		}
+		md.conversion(CustomUnmarshal, data, rv)
+		return nil
+	}
 	if v, ok := rvi.(Unmarshaler); ok {
 		err := v.UnmarshalTOML(data)
 		if err != nil {
 			return md.parseErr(err)
 		}
+		md.conversion(CustomUnmarshal, data, rv)
 		return nil
 	}
 	if v, ok := rvi.(encoding.TextUnmarshaler); ok {
-		return md.unifyText(data, v)
+		// Datetimes to time.Time is just the regular decoding; set it directly
+		// to keep the location of local datetimes.
+		if t, ok := data.(time.Time); ok && rv.Type() == timePtrType {
+			rv.Elem().Set(reflect.ValueOf(t))
+			return nil
+		}
+		err := md.unifyText(data, v)
+		if err != nil {
+			return err
+		}
+		md.conversion(CustomUnmarshal, data, rv)
+		return nil
+	}
+	if md.opts.UseJSONInterfaces {
+		if ok, err := md.unifyJSON(data, rv); ok {
+			return err
+		}
+	}
+	if a := lookupAdapter(md.adapters, rv.Type()); a != nil {
+		v, err := a.Decode(data, md.position(md.keyPos(md.context)))
+		if err != nil {
+			return md.parseErr(err)
+		}
+		if vv := reflect.ValueOf(v); vv.IsValid() && vv.Type() == rv.Type() {
+			rv.Set(vv)
+			kind := CustomUnmarshal
+			if c, ok := a.(adapterConversion); ok {
+				kind = c.conversion(data)
+			}
+			if kind != 0 {
+				md.conversion(kind, data, rv)
+			}
+			return nil
+		}
+		data = v
 	}
 
 	// TODO:
@@ -249,13 +1215,18 @@ func (md *MetaData) unify(data any, rv reflect.Value) error {
 	case reflect.Array:
 		return md.unifyArray(data, rv)
 	case reflect.Slice:
-		return md.unifySlice(data, rv)
+		return md.unifySlice(data, rv, !elem)
 	case reflect.String:
 		return md.unifyString(data, rv)
 	case reflect.Bool:
 		return md.unifyBool(data, rv)
 	case reflect.Interface:
-		if rv.NumMethod() > 0 { /// Only empty interfaces are supported.
+		if rv.NumMethod() > 0 { /// Only empty interfaces are supported, unless registered or set.
+			if f, ok := md.defaultTypes[rv.Type()]; ok {
+				if tmap, ok := data.(map[string]any); ok {
+					return md.unifyDefaultType(tmap, rv, f)
+				}
+			}
 			return md.e("unsupported type %s", rv.Type())
 		}
 		return md.unifyAnything(data, rv)
@@ -273,48 +1244,376 @@ func (md *MetaData) unifyStruct(mapping any, rv reflect.Value) error {
 		}
 		return md.e("type mismatch for %s: expected table but found %s", rv.Type().String(), fmtType(mapping))
 	}
+	if !md.opts.AllowOpaqueStructs && isOpaqueStruct(rv.Type()) {
+		return md.e("type %s has no exported fields and no unmarshaler; implement UnmarshalTOML or UnmarshalText",
+			rv.Type())
+	}
+
+	var (
+		fields  = cachedTypeFields(rv.Type())
+		matches = make([]keyField, 0, len(tmap))
+		inexact bool
+	)
+	for key := range tmap {
+		f := md.findField(fields, key)
+		matches = append(matches, keyField{key, f})
+		inexact = inexact || (f != nil && f.name != key)
+	}
+	if inexact {
+		if err := md.keyCollisions(matches, rv.Type()); err != nil {
+			return err
+		}
+	}
+
+	var (
+		unknown string
+		unions  []*field // Fields with the "union" option that are in tmap.
+	)
+	for _, m := range matches {
+		key, datum, f := m.key, tmap[m.key], m.f
+		if f == nil {
+			var use bool
+			f, use = md.deprecatedField(tmap, fields, key)
+			if f != nil && !use {
+				continue
+			}
+		}
+		if f == nil {
+			if sf, ok := unexportedField(rv.Type(), key, md.opts.CaseSensitive); ok {
+				k := md.context.add(key).String()
+				err := md.parseErrAt(k, fmt.Errorf("%q can't be decoded in to the unexported field %s.%s; export it by starting the name with an uppercase letter",
+					k, rv.Type(), sf.Name))
+				if md.tracer != nil {
+					md.trace(md.context.add(key), TraceUnexported, rv.Type().String()+"."+sf.Name, err)
+				}
+				return err
+			}
+		}
+		if f == nil && md.tracer != nil {
+			md.traceNoField(key, rv.Type(), fields)
+		}
+		if f == nil && md.opts.DisallowUnknownFields {
+			// Report the first one in the document, rather than a random one.
+			if unknown == "" || md.keyPos(md.context.add(key)).Start < md.keyPos(md.context.add(unknown)).Start {
+				unknown = key
+			}
+			continue
+		}
+		if f != nil {
+			subv := rv
+			for _, i := range f.index {
+				subv = indirect(subv.Field(i))
+			}
+
+			if isUnifiable(subv) {
+				md.decoded[md.context.add(key).String()] = struct{}{}
+				md.context = append(md.context, key)
+
+				if f.opts.union {
+					if err := md.checkUnion(datum, subv.Type(), f.opts.required); err != nil {
+						return err
+					}
+					unions = append(unions, f)
+				}
+
+				var (
+					err    error
+					tables []map[string]any
+					keyed  = f.opts.keyed != "" && subv.Kind() == reflect.Map
+				)
+				if keyed {
+					tables, keyed = tableArray(datum)
+				}
+				if keyed {
+					err = md.unifyKeyedMap(tables, subv, f.opts.keyed)
+				} else if subv.Type() == rawMessageType {
+					err = md.unifyRaw(tmap, key, subv)
+				} else if f.opts.asString {
+					err = md.unifyQuoted(datum, subv, rv.Type().String()+fieldPath(rv.Type(), f.index))
+				} else {
+					err = md.unify(datum, subv)
+				}
+				if md.tracer != nil {
+					md.traceDecoded(rv.Type().String()+fieldPath(rv.Type(), f.index), datum, subv, err)
+				}
+				if err != nil {
+					return err
+				}
+				md.context = md.context[0 : len(md.context)-1]
+			} else if f.name != "" {
+				err := md.e("cannot write unexported field %s.%s", rv.Type().String(), f.name)
+				if md.tracer != nil {
+					md.trace(md.context.add(key), TraceUnexported, rv.Type().String()+fieldPath(rv.Type(), f.index), err)
+				}
+				return err
+			}
+		}
+	}
+	if unknown != "" {
+		k := md.context.add(unknown).String()
+		return md.parseErrAt(k, fmt.Errorf("%q doesn't match any field in %s", k, rv.Type()))
+	}
+	return md.requiredUnions(rv.Type(), unions)
+}
+
+// checkUnion checks that at most one of the variants of the union rt is set in
+// the table datum, or exactly one if required is set, and records the variant
+// that was chosen for MetaData.UnionChoice.
+//
+// The variants are all pointer fields of rt; other fields can be used for
+// settings shared by all variants.
+func (md *MetaData) checkUnion(datum any, rt reflect.Type, required bool) error {
+	if rt.Kind() != reflect.Struct {
+		return md.e("the union option can only be used on struct fields, not %s", rt)
+	}
+	tmap, _ := datum.(map[string]any)
+	var (
+		fields = cachedTypeFields(rt)
+		set    []string
+	)
+	for key := range tmap {
+		if f := md.findField(fields, key); f != nil && rt.FieldByIndex(f.index).Type.Kind() == reflect.Ptr {
+			set = append(set, key)
+		}
+	}
+	sort.Slice(set, func(i, j int) bool {
+		return md.keyPos(md.context.add(set[i])).Start < md.keyPos(md.context.add(set[j])).Start
+	})
+
+	k := md.context.String()
+	switch {
+	case len(set) > 1:
+		var (
+			pk, vk = md.indexedKey(md.context.add(set[0])), md.indexedKey(md.context.add(set[1]))
+			pp, vp = md.position(md.keyPos(md.context.add(set[0]))), md.position(md.keyPos(md.context.add(set[1])))
+		)
+		return md.parseErrAt(vk, fmt.Errorf("%q on line %d and %q on line %d are both set, but only one variant of %q can be set",
+			pk, pp.Line, vk, vp.Line, k))
+	case len(set) == 0 && required:
+		return md.unionMissing(rt)
+	case len(set) == 1:
+		if md.unions == nil {
+			md.unions = make(map[string]string)
+		}
+		md.unions[k] = set[0]
+	}
+	return nil
+}
+
+// requiredUnions checks that all fields of rt with the "union=required" option
+// are in the list of fields that were set.
+func (md *MetaData) requiredUnions(rt reflect.Type, set []*field) error {
+	fields := cachedTypeFields(rt)
+outer:
+	for i := range fields {
+		f := &fields[i]
+		if !f.opts.required {
+			continue
+		}
+		for _, s := range set {
+			if s == f {
+				continue outer
+			}
+		}
+		rt := f.typ
+		for rt.Kind() == reflect.Ptr {
+			rt = rt.Elem()
+		}
+		md.context = append(md.context, f.name)
+		return md.unionMissing(rt)
+	}
+	return nil
+}
+
+// unionMissing returns the error for a required union without any variant.
+func (md *MetaData) unionMissing(rt reflect.Type) error {
+	var variants []string
+	for _, f := range cachedTypeFields(rt) {
+		if rt.FieldByIndex(f.index).Type.Kind() == reflect.Ptr {
+			variants = append(variants, strconv.Quote(md.context.add(f.name).String()))
+		}
+	}
+	return md.e("one of %s must be set", strings.Join(variants, ", "))
+}
+
+// keyField is a key in a table, and the struct field it matches.
+type keyField struct {
+	key string
+	f   *field
+}
+
+// keyCollisions checks for keys in matches that match the same field in the
+// struct rt, which is an error with DisallowKeyCollisions. Otherwise, these
+// keys are sorted in the order of the document, so that the last value is
+// used and tables are merged.
+func (md *MetaData) keyCollisions(matches []keyField, rt reflect.Type) error {
+	var (
+		used    = make(map[*field]int, len(matches)) // Field → index in matches.
+		collide bool
+	)
+	for i, m := range matches {
+		if m.f == nil {
+			continue
+		}
+		j, ok := used[m.f]
+		if !ok {
+			used[m.f] = i
+			continue
+		}
+		collide = true
+		if md.opts.DisallowKeyCollisions {
+			var (
+				pk, k  = md.context.add(matches[j].key).String(), md.context.add(m.key).String()
+				pp, kp = md.keyPos(md.context.add(matches[j].key)), md.keyPos(md.context.add(m.key))
+			)
+			ik := md.indexedKey(md.context.add(m.key))
+			if kp.Start < pp.Start {
+				pk, k, pp, kp = k, pk, kp, pp
+				ik = md.indexedKey(md.context.add(matches[j].key))
+			}
+			return md.parseErrAt(ik, fmt.Errorf("%q on line %d and %q on line %d both set the field %s.%s",
+				pk, pp.Line, k, kp.Line, rt, rt.FieldByIndex(m.f.index).Name))
+		}
+	}
+	if collide {
+		pos := make(map[string]int, len(matches))
+		for _, m := range matches {
+			pos[m.key] = md.keyPos(md.context.add(m.key)).Start
+		}
+		sort.SliceStable(matches, func(i, j int) bool { return pos[matches[i].key] < pos[matches[j].key] })
+	}
+	return nil
+}
+
+// elemIndex is the index of the table that's being decoded in the array of
+// tables at the given depth of MetaData.context.
+type elemIndex struct{ depth, i int }
+
+// indexedKey gets the key k in the context with the index of the table for
+// every array of tables that's being decoded, such as "servers[2].name"; this
+// is the same as parser.indexedKey().
+func (md *MetaData) indexedKey(k Key) string {
+	return indexKey(k, md.elems)
+}
+
+// indexKey adds the index of the tables in e to the key k.
+func indexKey(k Key, e []elemIndex) string {
+	if len(e) == 0 {
+		return k.String()
+	}
+	var b []byte
+	for i := range k {
+		if i > 0 {
+			b = append(b, '.')
+		}
+		b = append(b, k.maybeQuoted(i)...)
+		for len(e) > 0 && e[0].depth == i+1 {
+			b = append(strconv.AppendInt(append(b, '['), int64(e[0].i), 10), ']')
+			e = e[1:]
+		}
+	}
+	return string(b)
+}
+
+// keyPos gets the position of the key k in the context, in the table of an
+// array of tables that's being decoded. Tables that are only defined implicitly
+// (e.g. "a" in "a.b = 1") don't have a position, so use the first key in it
+// instead.
+func (md *MetaData) keyPos(k Key) Position {
+	if len(md.elems) > 0 {
+		md.indexPositions()
+	}
+	ik := md.indexedKey(k)
+	if ki, ok := md.keyInfo[ik]; ok {
+		return ki.pos
+	}
+	if md.firstPos == nil {
+		md.firstPos = firstPositions(md.keyInfo)
+	}
+	if p, ok := md.firstPos[ik]; ok || len(md.elems) == 0 {
+		return p
+	}
+
+	// Not in an array of tables, such as for an array of inline tables
+	// decoded with the "keyed" option.
+	if ki, ok := md.keyInfo[k.String()]; ok {
+		return ki.pos
+	}
+	return md.firstPos[k.String()]
+}
 
-	for key, datum := range tmap {
-		var f *field
-		fields := cachedTypeFields(rv.Type())
-		for i := range fields {
-			ff := &fields[i]
-			if ff.name == key {
-				f = ff
-				break
+// firstPositions gets the position of the first key in every table that's in
+// the key strings of keyInfo, but isn't in keyInfo itself.
+func firstPositions(keyInfo map[string]keyInfo) map[string]Position {
+	first := make(map[string]Position)
+	for k, ki := range keyInfo {
+		for i := indexByteKey(k, '.', 0); i > -1; i = indexByteKey(k, '.', i+1) {
+			t := k[:i]
+			if _, ok := keyInfo[t]; ok {
+				continue
 			}
-			if f == nil && strings.EqualFold(ff.name, key) {
-				f = ff
+			if p, ok := first[t]; !ok || ki.pos.Start < p.Start {
+				first[t] = ki.pos
 			}
 		}
-		if f != nil {
-			subv := rv
-			for _, i := range f.index {
-				subv = indirect(subv.Field(i))
-			}
+	}
+	return first
+}
 
-			if isUnifiable(subv) {
-				md.decoded[md.context.add(key).String()] = struct{}{}
-				md.context = append(md.context, key)
+// unifyDefaultType decodes a table in to the concrete type returned by
+// newValue, and assigns that to the interface rv.
+func (md *MetaData) unifyDefaultType(tmap map[string]any, rv reflect.Value, newValue interfaceFunc) error {
+	nv, err := newValue(tmap)
+	if err != nil {
+		return md.parseErr(err)
+	}
+	v := reflect.ValueOf(nv)
+	if !v.IsValid() {
+		return md.e("default type for %s is nil", rv.Type())
+	}
+	if !v.Type().Implements(rv.Type()) {
+		return md.e("default type %s does not implement %s", v.Type(), rv.Type())
+	}
 
-				err := md.unify(datum, subv)
-				if err != nil {
-					return err
-				}
-				md.context = md.context[0 : len(md.context)-1]
-			} else if f.name != "" {
-				return md.e("cannot write unexported field %s.%s", rv.Type().String(), f.name)
-			}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return md.e("default type for %s is a nil %s", rv.Type(), v.Type())
+		}
+		if err := md.unify(tmap, indirect(v)); err != nil {
+			return err
 		}
+		rv.Set(v)
+		return nil
+	}
+	return md.unifyConcrete(tmap, rv, v)
+}
+
+// unifyConcrete decodes data in to a copy of the concrete value v, and assigns
+// that to the interface rv. For pointers, the value v points to is copied; a
+// nil pointer is set to a new value.
+func (md *MetaData) unifyConcrete(data any, rv, v reflect.Value) error {
+	var nv reflect.Value
+	if v.Kind() == reflect.Ptr {
+		nv = reflect.New(v.Type().Elem())
+		if !v.IsNil() {
+			nv.Elem().Set(v.Elem())
+		}
+	} else {
+		// Copy to a new value, as v isn't addressable.
+		nv = reflect.New(v.Type()).Elem()
+		nv.Set(v)
+	}
+	if err := md.unify(data, indirect(nv)); err != nil {
+		return err
 	}
+	rv.Set(nv)
 	return nil
 }
 
 func (md *MetaData) unifyMap(mapping any, rv reflect.Value) error {
-	keyType := rv.Type().Key().Kind()
-	if keyType != reflect.String && keyType != reflect.Interface {
+	if !isMapKeyType(rv.Type().Key()) {
 		return fmt.Errorf("toml: cannot decode to a map with non-string key type (%s in %q)",
-			keyType, rv.Type())
+			rv.Type().Key().Kind(), rv.Type())
 	}
 
 	tmap, ok := mapping.(map[string]any)
@@ -331,28 +1630,208 @@ func (md *MetaData) unifyMap(mapping any, rv reflect.Value) error {
 		md.decoded[md.context.add(k).String()] = struct{}{}
 		md.context = append(md.context, k)
 
+		rvkey, err := unmarshalMapKey(rv.Type().Key(), k)
+		if err != nil {
+			err = md.parseErrAt(md.context.String(), err)
+			if md.tracer != nil {
+				md.trace(md.context, TraceError, fmt.Sprintf("%s[%q]", rv.Type(), k), err)
+			}
+			return err
+		}
+
+		// Tables are merged with an existing element, so that decoding several
+		// documents layers them.
+		//
+		// For interfaces with methods the existing element is always used, as
+		// its type is the only way to know what to decode in to.
 		rvval := reflect.Indirect(reflect.New(rv.Type().Elem()))
+		_, isTable := v.(map[string]any)
+		if et := rv.Type().Elem(); isTable || (et.Kind() == reflect.Interface && et.NumMethod() > 0) {
+			if old := rv.MapIndex(rvkey); old.IsValid() {
+				rvval.Set(copyPtr(old))
+			}
+		}
 
-		err := md.unify(v, indirect(rvval))
+		ev := indirect(rvval)
+		if ev.Type() == rawMessageType {
+			err = md.unifyRaw(tmap, k, ev)
+		} else {
+			err = md.unify(v, ev)
+		}
+		if md.tracer != nil {
+			md.traceDecoded(fmt.Sprintf("%s[%q]", rv.Type(), k), v, ev, err)
+		}
 		if err != nil {
 			return err
 		}
 		md.context = md.context[0 : len(md.context)-1]
 
-		rvkey := indirect(reflect.New(rv.Type().Key()))
+		rv.SetMapIndex(rvkey, rvval)
+	}
+	return nil
+}
+
+// isMapKeyType reports if a TOML key can be used as a key of type kt.
+func isMapKeyType(kt reflect.Type) bool {
+	return kt.Kind() == reflect.String || kt.Kind() == reflect.Interface ||
+		reflect.PtrTo(kt).Implements(unmarshalText)
+}
+
+// unmarshalMapKey converts the TOML key k to a map key of type kt, with
+// UnmarshalText if kt implements encoding.TextUnmarshaler.
+func unmarshalMapKey(kt reflect.Type, k string) (reflect.Value, error) {
+	rvkey := reflect.New(kt).Elem()
+	switch {
+	case reflect.PtrTo(kt).Implements(unmarshalText):
+		err := rvkey.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(k))
+		return rvkey, err
+	case kt.Kind() == reflect.Interface:
+		rvkey.Set(reflect.ValueOf(k))
+	case kt.Kind() == reflect.String:
+		rvkey.SetString(k)
+	}
+	return rvkey, nil
+}
+
+// findField finds the field for the TOML key, preferring an exact match over a
+// case-insensitive one (unless CaseSensitive is set).
+func (md *MetaData) findField(fields []field, key string) *field {
+	var f *field
+	for i := range fields {
+		ff := &fields[i]
+		if ff.name == key {
+			return ff
+		}
+		if f == nil && !md.opts.CaseSensitive && strings.EqualFold(ff.name, key) {
+			f = ff
+		}
+	}
+	return f
+}
+
+// deprecatedField finds the field for a TOML key that's listed as a deprecated
+// name with the "deprecated" option, and adds a warning for it.
+//
+// The value is used only if the current name or an earlier listed deprecated
+// name isn't in tmap as well; if it's not used then the key is just marked as
+// decoded.
+func (md *MetaData) deprecatedField(tmap map[string]any, fields []field, key string) (*field, bool) {
+	for i := range fields {
+		f := &fields[i]
+		for _, old := range f.opts.deprecated {
+			if old != key {
+				continue
+			}
+
+			use := ""
+			for k := range tmap {
+				if md.findField(fields, k) == f {
+					use = k
+					break
+				}
+			}
+			if use == "" {
+				for _, o := range f.opts.deprecated {
+					if _, ok := tmap[o]; ok {
+						use = o
+						break
+					}
+				}
+			}
+
+			if use == key {
+				md.warn(md.context.add(key), "key %q is deprecated; use %q instead", key, f.name)
+				return f, true
+			}
+			md.warn(md.context.add(key), "key %q is deprecated and ignored because %q is also set", key, use)
+			md.decoded[md.context.add(key).String()] = struct{}{}
+			return f, false
+		}
+	}
+	return nil, false
+}
+
+// tableArray returns the data as a list of tables if it's an array of tables,
+// either as [[tbl]] or as an array of inline tables.
+var tableArrayType = reflect.TypeOf([]map[string]any(nil))
+
+func tableArray(data any) ([]map[string]any, bool) {
+	switch d := data.(type) {
+	case []map[string]any:
+		return d, true
+	case []any:
+		tables := make([]map[string]any, 0, len(d))
+		for _, v := range d {
+			tbl, ok := v.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			tables = append(tables, tbl)
+		}
+		return tables, true
+	}
+	return nil, false
+}
+
+// unifyKeyedMap decodes an array of tables in to a map, using the value of the
+// keyField key in every table as the map key.
+func (md *MetaData) unifyKeyedMap(tables []map[string]any, rv reflect.Value, keyField string) error {
+	if !isMapKeyType(rv.Type().Key()) {
+		return fmt.Errorf("toml: cannot decode to a map with non-string key type (%s in %q)",
+			rv.Type().Key().Kind(), rv.Type())
+	}
+	if rv.IsNil() {
+		rv.Set(reflect.MakeMap(rv.Type()))
+	}
 
-		switch keyType {
-		case reflect.Interface:
-			rvkey.Set(reflect.ValueOf(k))
-		case reflect.String:
-			rvkey.SetString(k)
+	seen := make(map[string]int, len(tables))
+	md.elems = append(md.elems, elemIndex{depth: len(md.context)})
+	defer func() { md.elems = md.elems[:len(md.elems)-1] }()
+	for i, tbl := range tables {
+		md.elems[len(md.elems)-1].i = i
+		k, ok := tbl[keyField]
+		if !ok {
+			elem := md.elemKey(i)
+			return md.parseErrAt(elem, fmt.Errorf("%s: missing key %q, which is required as the map key", elem, keyField))
 		}
+		ks, ok := k.(string)
+		if !ok {
+			elem := md.elemKey(i)
+			return md.parseErrAt(elem, fmt.Errorf("%s: key %q must be a string to be used as the map key, but has type %s",
+				elem, keyField, fmtType(k)))
+		}
+		if j, ok := seen[ks]; ok {
+			md.indexPositions()
+			elem, prev := md.elemKey(i), md.elemKey(j)
+			msg := fmt.Sprintf("%s: duplicate %s %q; already used in %s", elem, keyField, ks, prev)
+			if p := md.position(md.keyInfo[prev].pos); p.Line > 0 {
+				msg += fmt.Sprintf(" on line %d", p.Line)
+			}
+			return md.parseErrAt(elem, errors.New(msg))
+		}
+		seen[ks] = i
+		md.decoded[md.context.add(keyField).String()] = struct{}{}
 
+		rvkey, err := unmarshalMapKey(rv.Type().Key(), ks)
+		if err != nil {
+			elem := md.elemKey(i)
+			return md.parseErrAt(elem, fmt.Errorf("%s: %w", elem, err))
+		}
+		rvval := reflect.Indirect(reflect.New(rv.Type().Elem()))
+		if err := md.unify(tbl, indirect(rvval)); err != nil {
+			return err
+		}
 		rv.SetMapIndex(rvkey, rvval)
 	}
 	return nil
 }
 
+// elemKey gets the key for table i of the array of tables in the context, such
+// as "servers[2]".
+func (md *MetaData) elemKey(i int) string {
+	return md.context.String() + "[" + strconv.Itoa(i) + "]"
+}
+
 func (md *MetaData) unifyArray(data any, rv reflect.Value) error {
 	datav := reflect.ValueOf(data)
 	if datav.Kind() != reflect.Slice {
@@ -361,18 +1840,49 @@ func (md *MetaData) unifyArray(data any, rv reflect.Value) error {
 		}
 		return md.badtype("slice", data)
 	}
-	if l := datav.Len(); l != rv.Len() {
-		return md.e("expected array length %d; got TOML array of length %d", rv.Len(), l)
+	l := datav.Len()
+	switch {
+	case l < rv.Len() && md.opts.ArrayLengthMismatch&LengthZeroFill != 0:
+		for i := l; i < rv.Len(); i++ {
+			zeroFill(rv.Index(i))
+		}
+	case l < rv.Len() && rv.Type().Elem().Kind() == reflect.Ptr:
+		for i := l; i < rv.Len(); i++ {
+			rv.Index(i).Set(reflect.Zero(rv.Type().Elem()))
+		}
+	case l > rv.Len() && md.opts.ArrayLengthMismatch&LengthTruncate != 0:
+		datav = datav.Slice(0, rv.Len())
+	case l != rv.Len():
+		return md.parseErr(errArrayLength{want: rv.Len(), have: l})
 	}
 	return md.unifySliceArray(datav, rv)
 }
 
-func (md *MetaData) unifySlice(data any, rv reflect.Value) error {
+// zeroFill sets rv to the zero value, except that pointers are set to a new
+// zero value (also in arrays).
+func zeroFill(rv reflect.Value) {
+	switch rv.Kind() {
+	case reflect.Ptr:
+		rv.Set(reflect.New(rv.Type().Elem()))
+		zeroFill(rv.Elem())
+	case reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			zeroFill(rv.Index(i))
+		}
+	default:
+		rv.Set(reflect.Zero(rv.Type()))
+	}
+}
+
+func (md *MetaData) unifySlice(data any, rv reflect.Value, promote bool) error {
 	datav := reflect.ValueOf(data)
 	if datav.Kind() != reflect.Slice {
 		if !datav.IsValid() {
 			return nil
 		}
+		if promote && isPrimitive(data) {
+			return md.unifyPromote(data, rv)
+		}
 		return md.badtype("slice", data)
 	}
 	n := datav.Len()
@@ -384,29 +1894,229 @@ func (md *MetaData) unifySlice(data any, rv reflect.Value) error {
 }
 
 func (md *MetaData) unifySliceArray(data, rv reflect.Value) error {
-	l := data.Len()
+	var (
+		l      = data.Len()
+		ctx    = len(md.context) // The context isn't reset on errors.
+		tables = data.Type() == tableArrayType
+	)
+	if tables {
+		md.elems = append(md.elems, elemIndex{depth: ctx})
+		defer func() { md.elems = md.elems[:len(md.elems)-1] }()
+	}
 	for i := 0; i < l; i++ {
+		if tables {
+			md.elems[len(md.elems)-1].i = i
+		}
+		md.arrayElem = true
 		err := md.unify(data.Index(i).Interface(), indirect(rv.Index(i)))
 		if err != nil {
-			return err
+			return md.elemErr(md.context[:ctx], data, i, err)
 		}
 	}
 	return nil
 }
 
-func (md *MetaData) unifyString(data any, rv reflect.Value) error {
-	_, ok := rv.Interface().(json.Number)
-	if ok {
-		if i, ok := data.(int64); ok {
-			rv.SetString(strconv.FormatInt(i, 10))
-		} else if f, ok := data.(float64); ok {
-			rv.SetString(strconv.FormatFloat(f, 'f', -1, 64))
-		} else {
-			return md.badtype("string", data)
-		}
+// elemErr adds the index and position of element i of the array data at the
+// key k to err, if it's a ParseError.
+func (md *MetaData) elemErr(k Key, data reflect.Value, i int, err error) error {
+	pErr, ok := err.(ParseError)
+	if !ok {
+		return err
+	}
+	first, ok := data.Index(0).Addr().Interface().(*any)
+	if !ok {
+		return err
+	}
+	key := k.String()
+	if elem, ok := pErr.err.(errArrayElem); ok { /// Element of a nested array.
+		elem.key = fmt.Sprintf("%s[%d]%s", key, i, strings.TrimPrefix(elem.key, key))
+		pErr.err, pErr.Message = elem, elem.Error()
+		return pErr
+	}
+	pos := md.elemPositions(first)
+	if i >= len(pos) {
+		return err
+	}
+
+	inner := pErr.err
+	if inner == nil {
+		inner = errors.New(pErr.Message)
+	}
+	elem := errArrayElem{index: i, key: key, err: inner}
+	p := md.position(pos[i])
+	return ParseError{
+		Message:  elem.Error(),
+		err:      elem,
+		LastKey:  pErr.LastKey,
+		Position: p,
+		Line:     p.Line,
+		Source:   pErr.Source,
+	}.withInputAt(md.data, md.lines, 0)
+}
+
+// elemPositions gets the position of every element of the array that starts
+// with first.
+//
+// These aren't recorded when decoding as they're only needed for errors, so the
+// document is parsed again, and the array is found in the new parse by its
+// place in the mapping.
+func (md *MetaData) elemPositions(first *any) []Position {
+	p := md.reparse()
+	if p == nil {
 		return nil
 	}
+	if array := findArray(md.mapping, p.mapping, first); array != nil {
+		return p.arrayPos[&array[0]]
+	}
+	return nil
+}
+
+// indexPositions adds the position of every [[..]] and every key in it to
+// keyInfo, with the index of the table in the key (see indexedKey).
+//
+// That's an entry for every key in every table, and they're only needed for
+// errors and such, so they're taken from parsing the document again the first
+// time they're needed.
+func (md *MetaData) indexPositions() {
+	if md.indexed {
+		return
+	}
+	md.indexed = true
+	p := md.reparse()
+	if p == nil {
+		return
+	}
+	for k, ki := range p.keyInfo {
+		if _, ok := md.keyInfo[k]; !ok {
+			md.keyInfo[k] = ki
+		}
+	}
+	md.firstPos = nil
+}
+
+// reparse parses the document again with the positions of array elements and
+// keys in arrays of tables, or returns nil if that fails.
+func (md *MetaData) reparse() *parser {
+	if md.reparsed == nil {
+		opts := md.opts
+		opts.Deadline = 0
+		p, err := parseStream(strings.NewReader(md.data), opts, md.tomlNext, false, true, false, nil)
+		if err != nil {
+			return nil
+		}
+		md.reparsed = p
+	}
+	return md.reparsed
+}
+
+// findArray finds the array that starts with first in have, and returns the
+// array in the same place in other.
+func findArray(have, other any, first *any) []any {
+	switch have := have.(type) {
+	case map[string]any:
+		other, _ := other.(map[string]any)
+		for k, v := range have {
+			if a := findArray(v, other[k], first); a != nil {
+				return a
+			}
+		}
+	case []map[string]any:
+		other, ok := other.([]map[string]any)
+		if !ok || len(other) != len(have) {
+			return nil
+		}
+		for i := range have {
+			if a := findArray(have[i], other[i], first); a != nil {
+				return a
+			}
+		}
+	case []any:
+		other, ok := other.([]any)
+		if !ok || len(other) != len(have) {
+			return nil
+		}
+		if len(have) > 0 && &have[0] == first {
+			return other
+		}
+		for i := range have {
+			if a := findArray(have[i], other[i], first); a != nil {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+// unifyPromote decodes the primitive value data in to a slice with one element.
+func (md *MetaData) unifyPromote(data any, rv reflect.Value) error {
+	if rv.IsNil() || rv.Cap() < 1 {
+		rv.Set(reflect.MakeSlice(rv.Type(), 1, 1))
+	}
+	rv.SetLen(1)
+	if err := md.unify(data, indirect(rv.Index(0))); err != nil {
+		return err
+	}
+	md.conversion(Promotion, data, rv)
+	return nil
+}
+
+// isPrimitive reports if data is a primitive TOML value, rather than an array
+// or table.
+func isPrimitive(data any) bool {
+	switch data.(type) {
+	case string, int64, uint64, float64, bool, time.Time:
+		return true
+	}
+	return false
+}
+
+// unifyQuoted decodes data in to rv for fields with the "string" option, which
+// are written as a TOML string. Unquoted values are also accepted.
+func (md *MetaData) unifyQuoted(data any, rv reflect.Value, field string) error {
+	t := rv.Type()
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Kind() == reflect.Ptr { /// Has an unmarshaler.
+			break
+		}
+		s, ok := data.(string)
+		if !ok || t.Kind() == reflect.String {
+			return md.unify(data, rv)
+		}
+		var (
+			v   any
+			err error
+		)
+		switch k := t.Kind(); {
+		case k == reflect.Bool:
+			if s != "true" && s != "false" {
+				return md.parseErr(errQuotedNum{s: s, typ: t.String()})
+			}
+			v = s == "true"
+		case k == reflect.Float32 || k == reflect.Float64:
+			v, err = strconv.ParseFloat(s, 64)
+		case k >= reflect.Uint:
+			v, err = strconv.ParseUint(s, 10, 64)
+		default:
+			v, err = strconv.ParseInt(s, 10, 64)
+		}
+		if errors.Is(err, strconv.ErrRange) {
+			return md.parseErr(errParseRange{i: s, size: t.Kind().String()})
+		}
+		if err != nil {
+			return md.parseErr(errQuotedNum{s: s, typ: t.String()})
+		}
+		return md.unify(v, rv)
+	}
+	return md.e("the string option on %s can only be used on integer, float, boolean, and string fields, not %s", field, t)
+}
 
+func (md *MetaData) unifyString(data any, rv reflect.Value) error {
 	if s, ok := data.(string); ok {
 		rv.SetString(s)
 		return nil
@@ -420,9 +2130,12 @@ func (md *MetaData) unifyFloat64(data any, rv reflect.Value) error {
 	if num, ok := data.(float64); ok {
 		switch rvk {
 		case reflect.Float32:
-			if num < -math.MaxFloat32 || num > math.MaxFloat32 {
+			// Values that are a bit larger than MaxFloat32 are fine if they
+			// round to it, such as 3.4028235e+38 which the encoder writes.
+			if math.IsInf(float64(float32(num)), 0) {
 				return md.parseErr(errParseRange{i: num, size: rvk.String()})
 			}
+			md.conversion(Narrowing, data, rv)
 			fallthrough
 		case reflect.Float64:
 			rv.SetFloat(num)
@@ -433,38 +2146,56 @@ func (md *MetaData) unifyFloat64(data any, rv reflect.Value) error {
 	}
 
 	if num, ok := data.(int64); ok {
+		if md.opts.StrictTypes {
+			return md.badtype("float", data)
+		}
 		if (rvk == reflect.Float32 && (num < -maxSafeFloat32Int || num > maxSafeFloat32Int)) ||
 			(rvk == reflect.Float64 && (num < -maxSafeFloat64Int || num > maxSafeFloat64Int)) {
 			return md.parseErr(errUnsafeFloat{i: num, size: rvk.String()})
 		}
 		rv.SetFloat(float64(num))
+		md.conversion(Widening, data, rv)
 		return nil
 	}
+	if num, ok := data.(uint64); ok {
+		return md.parseErr(errUnsafeFloat{i: num, size: rvk.String()})
+	}
 
 	return md.badtype("float", data)
 }
 
 func (md *MetaData) unifyInt(data any, rv reflect.Value) error {
-	_, ok := rv.Interface().(time.Duration)
-	if ok {
-		// Parse as string duration, and fall back to regular integer parsing
-		// (as nanosecond) if this is not a string.
-		if s, ok := data.(string); ok {
-			dur, err := time.ParseDuration(s)
-			if err != nil {
-				return md.parseErr(errParseDuration{s})
-			}
-			rv.SetInt(int64(dur))
-			return nil
+	rvk := rv.Kind()
+
+	// Only positive numbers larger than math.MaxInt64 are stored as uint64.
+	if unum, ok := data.(uint64); ok {
+		if rvk < reflect.Uint {
+			// Signed integers can never hold this; report it against the
+			// int64 range like before uint64 support.
+			return md.parseErr(errParseRange{i: unum, size: "int64"})
+		}
+		if rv.OverflowUint(unum) {
+			return md.parseErr(errParseRange{i: unum, size: rvk.String()})
 		}
+		rv.SetUint(unum)
+		return nil
 	}
 
 	num, ok := data.(int64)
+	fromFloat := false
+	if f, isFloat := data.(float64); isFloat {
+		if !md.opts.AllowIntegralFloats || f != math.Trunc(f) || math.IsInf(f, 0) {
+			return md.parseErr(errFloatToInt{f: f, typ: rv.Type().String()})
+		}
+		if f < math.MinInt64 || f >= math.MaxInt64 {
+			return md.parseErr(errParseRange{i: f, size: rvk.String()})
+		}
+		num, ok, fromFloat = int64(f), true, true
+	}
 	if !ok {
 		return md.badtype("integer", data)
 	}
 
-	rvk := rv.Kind()
 	switch {
 	case rvk >= reflect.Int && rvk <= reflect.Int64:
 		if (rvk == reflect.Int8 && (num < math.MinInt8 || num > math.MaxInt8)) ||
@@ -473,6 +2204,9 @@ func (md *MetaData) unifyInt(data any, rv reflect.Value) error {
 			return md.parseErr(errParseRange{i: num, size: rvk.String()})
 		}
 		rv.SetInt(num)
+		if fromFloat || rv.Type().Bits() < 64 {
+			md.conversion(Narrowing, data, rv)
+		}
 	case rvk >= reflect.Uint && rvk <= reflect.Uint64:
 		unum := uint64(num)
 		if rvk == reflect.Uint8 && (num < 0 || unum > math.MaxUint8) ||
@@ -481,25 +2215,117 @@ func (md *MetaData) unifyInt(data any, rv reflect.Value) error {
 			return md.parseErr(errParseRange{i: num, size: rvk.String()})
 		}
 		rv.SetUint(unum)
+		md.conversion(Narrowing, data, rv)
 	default:
 		panic("unreachable")
 	}
+	if !fromFloat {
+		md.warnIntegerDate(num)
+	}
 	return nil
 }
 
 func (md *MetaData) unifyBool(data any, rv reflect.Value) error {
-	if b, ok := data.(bool); ok {
-		rv.SetBool(b)
+	switch v := data.(type) {
+	case bool:
+		rv.SetBool(v)
+		return nil
+	case int64:
+		if md.opts.WeakTypes {
+			if v != 0 && v != 1 {
+				return md.parseErr(errWeakBool{v})
+			}
+			rv.SetBool(v == 1)
+			md.conversion(Weak, data, rv)
+			return nil
+		}
+	case string:
+		s := strings.ToLower(strings.TrimSpace(v))
+		if s != "true" && s != "false" {
+			if md.opts.WeakTypes {
+				return md.parseErr(errWeakBool{v})
+			}
+			break
+		}
+		if !md.opts.WeakTypes {
+			return md.parseErr(errQuotedBool{v})
+		}
+		rv.SetBool(s == "true")
+		md.conversion(Weak, data, rv)
 		return nil
 	}
 	return md.badtype("boolean", data)
 }
 
 func (md *MetaData) unifyAnything(data any, rv reflect.Value) error {
+	if num, ok := data.(int64); ok {
+		md.warnIntegerDate(num)
+	}
+	if tmap, ok := data.(map[string]any); ok {
+		if old, ok := rv.Interface().(map[string]any); ok && old != nil {
+			data = mergeTables(old, tmap)
+		}
+	}
 	rv.Set(reflect.ValueOf(data))
 	return nil
 }
 
+// mergeTables returns a copy of dst with all keys from src added, merging
+// tables that are in both.
+func mergeTables(dst, src map[string]any) map[string]any {
+	m := make(map[string]any, len(dst)+len(src))
+	for k, v := range dst {
+		m[k] = v
+	}
+	for k, v := range src {
+		if s, ok := v.(map[string]any); ok {
+			if d, ok := m[k].(map[string]any); ok {
+				v = mergeTables(d, s)
+			}
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// copyPtr returns a pointer to a copy of what rv points to, or rv itself if it
+// isn't a pointer, so that merging in to a map element doesn't change a value
+// that may be shared.
+func copyPtr(rv reflect.Value) reflect.Value {
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return rv
+	}
+	c := reflect.New(rv.Type().Elem())
+	c.Elem().Set(rv.Elem())
+	return c
+}
+
+// unifyJSON calls UnmarshalJSON if rv implements json.Unmarshaler; it reports
+// if it did.
+func (md *MetaData) unifyJSON(data any, rv reflect.Value) (bool, error) {
+	u, ok := rv.Interface().(json.Unmarshaler)
+	if !ok && rv.CanAddr() {
+		u, ok = rv.Addr().Interface().(json.Unmarshaler)
+	}
+	if !ok {
+		return false, nil
+	}
+
+	v, err := toJSON(data, JSONOptions{})
+	if err != nil {
+		return true, md.parseErr(err)
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return true, md.parseErr(err)
+	}
+	if err := u.UnmarshalJSON(j); err != nil {
+		return true, md.parseErr(err)
+	}
+	md.conversion(CustomUnmarshal, data, rv)
+	return true, nil
+}
+
 func (md *MetaData) unifyText(data any, v encoding.TextUnmarshaler) error {
 	var s string
 	switch sdata := data.(type) {
@@ -523,6 +2349,8 @@ func (md *MetaData) unifyText(data any, v encoding.TextUnmarshaler) error {
 		s = fmt.Sprintf("%v", sdata)
 	case int64:
 		s = fmt.Sprintf("%d", sdata)
+	case uint64:
+		s = fmt.Sprintf("%d", sdata)
 	case float64:
 		s = fmt.Sprintf("%f", sdata)
 	default:
@@ -534,31 +2362,123 @@ func (md *MetaData) unifyText(data any, v encoding.TextUnmarshaler) error {
 	return nil
 }
 
+// conversion records a conversion of data to rv, if enabled.
+func (md *MetaData) conversion(kind ConversionKind, data any, rv reflect.Value) {
+	if !md.opts.RecordConversions {
+		return
+	}
+	rt := rv.Type()
+	if rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	k := make(Key, len(md.context))
+	copy(k, md.context)
+	md.conversions = append(md.conversions, Conversion{
+		Key:          k,
+		Position:     md.position(md.keyInfo[k.String()].pos),
+		FromTOMLType: tomlTypeOfData(data).typeString(),
+		ToGoType:     rt.String(),
+		Kind:         kind,
+	})
+}
+
+// warn adds a warning for the key k.
+func (md *MetaData) warn(k Key, format string, args ...any) {
+	k = append(Key(nil), k...)
+	md.warnings = append(md.warnings, Warning{
+		Key:      k,
+		Position: md.position(md.keyInfo[k.String()].pos),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// warnIntegerDate adds a warning if WarnIntegerDates is set, and num looks like
+// a date written without dashes (20240101) for a key with a name that suggests
+// it's a date.
+func (md *MetaData) warnIntegerDate(num int64) {
+	if !md.opts.WarnIntegerDates || num < 10000101 || num > 99991231 || len(md.context) == 0 {
+		return
+	}
+	d, err := time.Parse("20060102", strconv.FormatInt(num, 10))
+	if err != nil {
+		return
+	}
+	k := strings.ToLower(md.context[len(md.context)-1])
+	for _, w := range []string{"date", "day", "when", "time", "since", "until", "expire", "birth"} {
+		if strings.Contains(k, w) {
+			md.warn(md.context, "integer %d looks like a date; use %s (without quotes) for a TOML date",
+				num, d.Format("2006-01-02"))
+			return
+		}
+	}
+}
+
+// tomlTypeOfData returns the TOML type of parsed data.
+func tomlTypeOfData(data any) tomlType {
+	switch data.(type) {
+	case int64, uint64:
+		return tomlInteger
+	case float64:
+		return tomlFloat
+	case time.Time:
+		return tomlDatetime
+	case string:
+		return tomlString
+	case bool:
+		return tomlBool
+	case map[string]any:
+		return tomlHash
+	case []map[string]any:
+		return tomlArrayHash
+	}
+	return tomlArray
+}
+
 func (md *MetaData) badtype(dst string, data any) error {
+	if _, ok := data.(time.Time); ok && (dst == "integer" || dst == "float") {
+		return md.parseErr(errDatetimeNumber{dst})
+	}
 	return md.e("incompatible types: TOML value has type %s; destination has type %s", fmtType(data), dst)
 }
 
 func (md *MetaData) parseErr(err error) error {
-	k := md.context.String()
-	d := string(md.data)
+	return md.parseErrAt(md.context.String(), err)
+}
+
+// parseErrAt is like parseErr, but uses the position of the given key, falling
+// back to the current context if there is no position for it.
+func (md *MetaData) parseErrAt(k string, err error) error {
+	if len(md.elems) > 0 {
+		md.indexPositions()
+	}
+	ki, ok := md.keyInfo[k]
+	if !ok {
+		ki, ok = md.keyInfo[md.indexedKey(md.context)]
+	}
+	if !ok {
+		ki = md.keyInfo[md.context.String()]
+	}
+	pos := md.position(ki.pos)
 	return ParseError{
 		Message:  err.Error(),
 		err:      err,
-		LastKey:  k,
-		Position: md.keyInfo[k].pos.withCol(d),
-		Line:     md.keyInfo[k].pos.Line,
-		input:    d,
-	}
+		LastKey:  md.context.String(),
+		Position: pos,
+		Line:     pos.Line,
+		Source:   md.name,
+	}.withInputAt(md.data, md.lines, 0)
 }
 
 func (md *MetaData) e(format string, args ...any) error {
 	f := "toml: "
+	if md.name != "" {
+		f += strings.ReplaceAll(md.name, "%", "%%") + ": "
+	}
 	if len(md.context) > 0 {
-		f = fmt.Sprintf("toml: (last key %q): ", md.context)
-		p := md.keyInfo[md.context.String()].pos
-		if p.Line > 0 {
-			f = fmt.Sprintf("toml: line %d (last key %q): ", p.Line, md.context)
+		if p := md.position(md.keyInfo[md.context.String()].pos); p.Line > 0 {
+			f += fmt.Sprintf("line %d ", p.Line)
 		}
+		f += fmt.Sprintf("(last key %q): ", md.context)
 	}
 	return fmt.Errorf(f+format, args...)
 }
@@ -586,6 +2506,9 @@ func indirect(v reflect.Value) reflect.Value {
 			if _, ok := pvi.(Unmarshaler); ok {
 				return pv
 			}
+			if _, ok := pvi.(KeyUnmarshaler); ok {
+				return pv
+			}
 		}
 		return v
 	}
@@ -606,6 +2529,9 @@ func isUnifiable(rv reflect.Value) bool {
 	if _, ok := rvi.(Unmarshaler); ok {
 		return true
 	}
+	if _, ok := rvi.(KeyUnmarshaler); ok {
+		return true
+	}
 	return false
 }
 
@@ -2,17 +2,24 @@ package toml
 
 import (
 	"bytes"
+	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"math"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"testing/fstest"
+	"testing/iotest"
 	"time"
 
 	"github.com/BurntSushi/toml/internal"
@@ -37,6 +44,162 @@ func TestDecodeReader(t *testing.T) {
 	}
 }
 
+func TestDecodeReaderError(t *testing.T) {
+	errBoom := errors.New("boom")
+	tests := []struct {
+		r       io.Reader
+		wantErr error
+		want    string
+	}{
+		{iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("a = 42"))),
+			iotest.ErrTimeout, "toml: reading input at byte 1: timeout"},
+		{io.MultiReader(strings.NewReader("a = 42\nb = "), iotest.ErrReader(errBoom)),
+			errBoom, "toml: reading input at byte 11: boom"},
+		{io.MultiReader(strings.NewReader("\xef\xbb\xbfa = 42"), iotest.ErrReader(errBoom)),
+			errBoom, "toml: reading input at byte 9: boom"},
+		// Valid document, but still an error as there may be more data.
+		{io.MultiReader(strings.NewReader("a = 42\n"), iotest.ErrReader(errBoom)),
+			errBoom, "toml: reading input at byte 7: boom"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var s struct{ A, B int }
+			_, err := NewDecoder(tt.r).Decode(&s)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", err, tt.want)
+			}
+		})
+	}
+}
+
+// Syntax errors should be reported without reading everything.
+func TestDecodeReaderEarlyError(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("a = 1\nb = = 2\n"))
+
+	done := make(chan error)
+	go func() {
+		var s struct{ A, B int }
+		_, err := NewDecoder(pr).Decode(&s)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errorContains(err, "line 2") {
+			t.Fatalf("wrong error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Decode blocked on read after syntax error")
+	}
+}
+
+func TestDeprecationHandler(t *testing.T) {
+	var have []string
+	SetDeprecationHandler(func(api string, caller runtime.Frame) {
+		have = append(have, fmt.Sprintf("%s %s:%d", api, filepath.Base(caller.File), caller.Line))
+	})
+	defer SetDeprecationHandler(nil)
+
+	_, _, line, _ := runtime.Caller(0)
+	for i := 0; i < 2; i++ {
+		var s struct{ A int }
+		DecodeReader(strings.NewReader("a = 1"), &s)
+		PrimitiveDecode(Primitive{undecoded: int64(1)}, &s.A)
+	}
+	want := []string{
+		fmt.Sprintf("DecodeReader decode_test.go:%d", line+3),
+		fmt.Sprintf("PrimitiveDecode decode_test.go:%d", line+4),
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+
+	// Reported again for a new handler, and not at all without one.
+	have = nil
+	SetDeprecationHandler(func(api string, caller runtime.Frame) { have = append(have, api) })
+	var i int
+	PrimitiveDecode(Primitive{undecoded: int64(1)}, &i)
+	SetDeprecationHandler(nil)
+	PrimitiveDecode(Primitive{undecoded: int64(1)}, &i)
+	DecodeReader(strings.NewReader("a = 1"), &struct{ A int }{})
+	if want := []string{"PrimitiveDecode"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func init() { panicOnBug = true }
+
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error) { panic("boom") }
+
+// Escapes the lexer should never let through are an error, not a panic.
+func TestParseBadEscape(t *testing.T) {
+	tests := []struct {
+		in, tomlNext string
+		want         string
+	}{
+		{`abc\`, "", "invalid escape at end of string"},
+		{`abc\q`, "", `invalid escape: '\q'`},
+		{`\e`, "", `invalid escape: '\e'`},
+		{`\x41`, "", `invalid escape: '\x'`},
+		{`\x4`, "1", `invalid escape: '\x' needs 2 hex digits`},
+		{`\u12`, "", `invalid escape: '\u' needs 4 hex digits`},
+		{`\U0001F60`, "", `invalid escape: '\U' needs 8 hex digits`},
+		{`\uzzzz`, "", `invalid escape: 'zzzz' is not a hexadecimal number`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			input := "k = \"" + tt.in + "\"\n"
+			p := &parser{lx: lex(input, tt.tomlNext != ""), tomlNext: tt.tomlNext != ""}
+			it := item{typ: itemStringEsc, val: tt.in, pos: Position{Line: 1, Start: 5, Len: len(tt.in)}}
+
+			var pErr ParseError
+			func() {
+				defer func() { pErr, _ = recover().(ParseError) }()
+				p.replaceEscapes(it, tt.in)
+			}()
+			if pErr.Message != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", pErr.Message, tt.want)
+			}
+			if pErr.Position.Line != 1 || pErr.Position.Col != 6 {
+				t.Errorf("wrong position: %#v", pErr.Position)
+			}
+		})
+	}
+}
+
+// Panics in the parser that aren't a ParseError are returned as an error with
+// the position that was reached.
+func TestParseInternalError(t *testing.T) {
+	panicOnBug = false
+	defer func() { panicOnBug = true }()
+
+	var s struct{ A, B int }
+	_, err := NewDecoder(io.MultiReader(strings.NewReader("a = 1\nb = "), panicReader{})).Decode(&s)
+
+	var pErr ParseError
+	if !errors.As(err, &pErr) {
+		t.Fatalf("not a ParseError: %#v", err)
+	}
+	if want := "toml: line 2 (last key \"b\"): internal error: boom"; err.Error() != want {
+		t.Errorf("\nhave: %s\nwant: %s", err, want)
+	}
+	if pErr.Position.Line != 2 {
+		t.Errorf("wrong position: %#v", pErr.Position)
+	}
+
+	_, err = NewDecoder(panicReader{}).Decode(&s)
+	if !errorContains(err, "internal error: boom") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
 func TestDecodeFile(t *testing.T) {
 	tmp, err := os.CreateTemp("", "toml-")
 	if err != nil {
@@ -82,6 +245,272 @@ func TestDecodeFS(t *testing.T) {
 	}
 }
 
+func TestDecodeTables(t *testing.T) {
+	var doc strings.Builder
+	doc.WriteString("title = 'x'\nowner.name = 'me'\n\n[owner.address]\ncity = 'here'\n\n")
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&doc, "[[entries]]\nname = 'entry %d'\nhash = '%s'\n[entries.deps]\nn = %d\n\n", i, strings.Repeat("x", 64), i)
+		if i == 1000 {
+			doc.WriteString("[other]\nk = 1\n\n")
+		}
+	}
+	doc.WriteString("[last]\nk = 2\n")
+	in := doc.String()
+
+	type entry struct {
+		Name string
+		Hash string
+		Deps struct{ N int }
+	}
+	var (
+		keys    []string
+		entries []entry
+		all     map[string]any
+	)
+	if _, err := Decode(in, &all); err != nil {
+		t.Fatal(err)
+	}
+	err := NewDecoder(strings.NewReader(in)).DecodeTables(func(md *MetaData, key Key, prim Primitive) error {
+		if len(keys) == 0 || keys[len(keys)-1] != key.String() {
+			keys = append(keys, key.String())
+		}
+		if key.String() != "entries" {
+			var v any
+			if err := md.PrimitiveDecode(prim, &v); err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(v, all[key[0]]) {
+				t.Errorf("%s:\nhave: %#v\nwant: %#v", key, v, all[key[0]])
+			}
+			return nil
+		}
+
+		var e entry
+		if err := md.PrimitiveDecode(prim, &e); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+
+		// Positions are for the entire document.
+		pos := md.Position("entries", "name")
+		if want := fmt.Sprintf("entry %d", len(entries)-1); in[pos.Start:pos.Start+pos.Len] != want {
+			t.Errorf("wrong position %v for %s: %q", pos, want, in[pos.Start:pos.Start+pos.Len])
+		}
+		if n := strings.Count(in[:pos.Start], "\n") + 1; pos.Line != n || pos.Col != 9 {
+			t.Errorf("wrong position %v for line %d", pos, n)
+		}
+		if u := md.Undecoded(); len(u) > 0 {
+			t.Errorf("undecoded: %v", u)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"title", "owner", "entries", "other", "entries", "last"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("\nhave: %q\nwant: %q", keys, want)
+	}
+	if len(entries) != 2000 {
+		t.Fatalf("%d entries", len(entries))
+	}
+	if e := entries[1234]; e.Name != "entry 1234" || e.Deps.N != 1234 || len(e.Hash) != 64 {
+		t.Errorf("wrong entry: %v", e)
+	}
+}
+
+func TestDecodeTablesError(t *testing.T) {
+	pad := strings.Repeat("x", 100)
+	var doc strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&doc, "[t%d]\nk = '%s'\n", i, pad)
+	}
+	in := doc.String()
+
+	tests := []struct {
+		in      string
+		decode  bool
+		wantErr string
+	}{
+		{in + "[t1000]\nk = = 1\n", false, `
+toml: error: expected value but found '=' instead
+
+At line 2002, column 5:
+
+   2001 | [t1000]
+   2002 | k = = 1
+              ^
+`[1:]},
+		{in + "[t1000]\nk = 1\n", true,
+			`toml: line 2002 (last key "t1000.k"): incompatible types: TOML value has type int64; destination has type string`},
+		{in + "[t1000]\nl = [\n  1,\n  1000,\n]\n", true, `
+toml: error: error at index 1 of "t1000.l": 1000 is out of range for int8
+
+At line 2004, column 3-6:
+
+   2002 | l = [
+   2003 |   1,
+   2004 |   1000,
+            ^^^^
+`[1:]},
+		{"[a]\nk = 1\n[c]\n[a.b]\n", false, `
+toml: error: Key 'a.b' must be directly after the other tables in 'a' when decoding one table at a time.
+
+At line 4, column 2:
+
+      2 | k = 1
+      3 | [c]
+      4 | [a.b]
+           ^
+`[1:]},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			err := NewDecoder(strings.NewReader(tt.in)).DecodeTables(func(md *MetaData, key Key, prim Primitive) error {
+				if !tt.decode {
+					return nil
+				}
+				var s struct {
+					K string
+					L []int8
+				}
+				return md.PrimitiveDecode(prim, &s)
+			})
+			if err == nil {
+				t.Fatal("error is nil")
+			}
+			have := err.Error()
+			var pErr ParseError
+			if errors.As(err, &pErr) {
+				have = pErr.ErrorWithPosition()
+			}
+			if have != tt.wantErr {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", have, tt.wantErr)
+			}
+		})
+	}
+
+	// Errors from the function are returned as-is.
+	var n int
+	err := NewDecoder(strings.NewReader(in)).DecodeTables(func(md *MetaData, key Key, prim Primitive) error {
+		if n++; n == 3 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if err != io.ErrUnexpectedEOF || n != 3 {
+		t.Errorf("wrong error: %v (%d)", err, n)
+	}
+}
+
+func TestDecodeFileOptional(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.toml"), []byte("a = 42"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "empty.toml"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"a.toml":     &fstest.MapFile{Data: []byte("a = 42")},
+		"empty.toml": &fstest.MapFile{},
+		"dir/x":      &fstest.MapFile{},
+	}
+
+	tests := []struct {
+		path    string
+		want    int
+		exists  bool
+		wantErr string
+	}{
+		{"a.toml", 42, true, ""},
+		{"empty.toml", 0, true, ""},
+		{"missing.toml", 0, false, ""},
+		{"dir", 0, true, `toml: can't decode "%s": is a directory`},
+		{"missing/a.toml", 0, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			for _, useFS := range []bool{false, true} {
+				var (
+					s      struct{ A int }
+					meta   MetaData
+					exists bool
+					err    error
+					path   = filepath.Join(dir, tt.path)
+				)
+				if useFS {
+					path = tt.path
+					meta, exists, err = DecodeFSOptional(fsys, path, &s)
+				} else {
+					meta, exists, err = DecodeFileOptional(path, &s)
+				}
+				if tt.wantErr != "" {
+					if want := fmt.Sprintf(tt.wantErr, path); !errorContains(err, want) {
+						t.Fatalf("wrong error:\nhave: %v\nwant: %s", err, want)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s.A != tt.want || exists != tt.exists {
+					t.Errorf("have %d, %t; want %d, %t", s.A, exists, tt.want, tt.exists)
+				}
+				if (len(meta.Keys()) == 0) != (tt.want == 0) {
+					t.Errorf("wrong keys: %v", meta.Keys())
+				}
+			}
+		})
+	}
+
+	// Other errors are still returned.
+	_, exists, err := DecodeFSOptional(errFS{err: fs.ErrPermission}, "a.toml", new(struct{}))
+	if !errors.Is(err, fs.ErrPermission) || !exists {
+		t.Errorf("wrong error: %v, %t", err, exists)
+	}
+	if os.Geteuid() != 0 {
+		path := filepath.Join(dir, "a.toml")
+		if err := os.Chmod(path, 0); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := DecodeFileOptional(path, new(struct{}))
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("wrong error: %v", err)
+		}
+	}
+
+	// Only errors from opening the file make it missing, not errors from
+	// reading it.
+	_, exists, err = DecodeFSOptional(errFS{err: fs.ErrNotExist, read: true}, "a.toml", new(struct{}))
+	if !errors.Is(err, fs.ErrNotExist) || !exists {
+		t.Errorf("wrong error: %v, %t", err, exists)
+	}
+}
+
+// errFS returns err when opening a file, or when reading it if read is set.
+type errFS struct {
+	err  error
+	read bool
+}
+
+func (f errFS) Open(name string) (fs.File, error) {
+	if f.read {
+		return errFile{f.err}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: f.err}
+}
+
+type errFile struct{ err error }
+
+func (f errFile) Stat() (fs.FileInfo, error) { return nil, f.err }
+func (f errFile) Read([]byte) (int, error)   { return 0, f.err }
+func (f errFile) Close() error               { return nil }
+
 func TestDecodeBOM(t *testing.T) {
 	for _, tt := range [][]byte{
 		[]byte("\xff\xfea = \"b\""),
@@ -101,6 +530,94 @@ func TestDecodeBOM(t *testing.T) {
 	}
 }
 
+//go:embed testdata/bom
+var bomFiles embed.FS
+
+func TestDecodeBOMConcatenated(t *testing.T) {
+	t.Run("doubled", func(t *testing.T) {
+		var s struct{ A string }
+		meta, err := Decode("\xef\xbb\xbf\xef\xbb\xbfa = \"b\"", &s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.A != "b" || len(meta.Warnings()) > 0 {
+			t.Errorf("wrong result: %q; %v", s.A, meta.Warnings())
+		}
+	})
+
+	t.Run("after newline", func(t *testing.T) {
+		var m map[string]any
+		meta, err := Decode("a = 1\n\xef\xbb\xbf[tbl]\nb = 2\n", &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := fmt.Sprint(m); have != "map[a:1 tbl:map[b:2]]" {
+			t.Errorf("wrong result: %s", have)
+		}
+		w := meta.Warnings()
+		if len(w) != 1 || w[0].String() != "toml: line 2: skipped byte-order mark (U+FEFF) at the start of the line; this usually happens when files are concatenated" {
+			t.Errorf("wrong warnings: %v", w)
+		}
+		if w[0].Position.Col != 1 || w[0].Position.Start != 6 || w[0].Position.Len != 3 {
+			t.Errorf("wrong position: %#v", w[0].Position)
+		}
+	})
+
+	t.Run("mid-line", func(t *testing.T) {
+		for _, in := range []string{
+			"a = \xef\xbb\xbf1",
+			"a = 1 \xef\xbb\xbf",
+			"  \xef\xbb\xbfa = 1",
+			"a = [1, \xef\xbb\xbf2]",
+			"[tbl\xef\xbb\xbf]",
+		} {
+			var m map[string]any
+			_, err := Decode(in, &m)
+			var pErr ParseError
+			if !errors.As(err, &pErr) {
+				t.Fatalf("%q: not a ParseError: %v", in, err)
+			}
+			if want := "unexpected byte-order mark (U+FEFF); remove it, or only use it at the start of the file"; pErr.Message != want {
+				t.Errorf("%q: wrong error: %s", in, pErr.Message)
+			}
+			if in[pErr.Position.Start:pErr.Position.Start+pErr.Position.Len] != "\xef\xbb\xbf" {
+				t.Errorf("%q: wrong position: %#v", in, pErr.Position)
+			}
+		}
+
+		// Allowed in strings.
+		var m map[string]any
+		if _, err := Decode("a = '\xef\xbb\xbf'", &m); err != nil || m["a"] != "\ufeff" {
+			t.Errorf("wrong result: %q; %v", m, err)
+		}
+	})
+
+	t.Run("DecodeFS", func(t *testing.T) {
+		var cat []byte
+		for _, f := range []string{"testdata/bom/server.toml", "testdata/bom/db.toml"} {
+			b, err := bomFiles.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cat = append(cat, b...)
+		}
+		var c struct {
+			Host string
+			DB   struct{ Name string }
+		}
+		meta, err := DecodeFS(fstest.MapFS{"all.toml": {Data: cat}}, "all.toml", &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Host != "localhost" || c.DB.Name != "app" {
+			t.Errorf("wrong result: %#v", c)
+		}
+		if w := meta.Warnings(); len(w) != 1 || w[0].Position.Line != 3 {
+			t.Errorf("wrong warnings: %v", w)
+		}
+	})
+}
+
 func TestDecodeEmbedded(t *testing.T) {
 	type Dog struct{ Name string }
 	type Age int
@@ -253,84 +770,1800 @@ Number = 123
 	}
 }
 
-func TestDecodePointers(t *testing.T) {
-	type Object struct {
-		Type        string
-		Description string
+func TestDecodeDashKey(t *testing.T) {
+	const input = `
+Number = 123
+- = 234
+`
+	var s struct {
+		Number int `toml:"-"`
+		Dash   int `toml:"-,"`
 	}
-
-	type Dict struct {
-		NamedObject map[string]*Object
-		BaseObject  *Object
-		Strptr      *string
-		Strptrs     []*string
+	if _, err := Decode(input, &s); err != nil {
+		t.Fatal(err)
 	}
-	s1, s2, s3 := "blah", "abc", "def"
-	expected := &Dict{
-		Strptr:  &s1,
-		Strptrs: []*string{&s2, &s3},
-		NamedObject: map[string]*Object{
-			"foo": {"FOO", "fooooo!!!"},
-			"bar": {"BAR", "ba-ba-ba-ba-barrrr!!!"},
-		},
-		BaseObject: &Object{"BASE", "da base"},
+	if s.Number != 0 || s.Dash != 234 {
+		t.Errorf("wrong values: %+v", s)
 	}
 
-	ex1 := `
-Strptr = "blah"
-Strptrs = ["abc", "def"]
+	var s2 struct {
+		Omit int `toml:"-,omitempty"`
+	}
+	if _, err := Decode(input, &s2); err != nil {
+		t.Fatal(err)
+	}
+	if s2.Omit != 234 {
+		t.Errorf("wrong values: %+v", s2)
+	}
+}
 
-[NamedObject.foo]
-Type = "FOO"
-Description = "fooooo!!!"
+type textUnmarshaler string
 
-[NamedObject.bar]
-Type = "BAR"
-Description = "ba-ba-ba-ba-barrrr!!!"
+func (t *textUnmarshaler) UnmarshalText(text []byte) error {
+	*t = textUnmarshaler(text)
+	return nil
+}
 
-[BaseObject]
-Type = "BASE"
-Description = "da base"
+func TestDecodeConversions(t *testing.T) {
+	var s struct {
+		Float  float64
+		Int8   int8
+		Uint   uint
+		Small  float32
+		Dur    time.Duration
+		DurStr time.Duration
+		Text   textUnmarshaler
+		Inner  InnerInt
+		Time   time.Time
+		Num    json.Number
+		Int    int64
+		Str    string
+	}
+	const in = `float = 1
+int8 = 42
+uint = 3
+small = 1.5
+dur = 1_000
+dur_str = "1s"
+text = "ok"
+time = 2020-01-02T03:04:05Z
+num = 6
+int = 7
+str = "x"
+inner = 8
 `
-	dict := new(Dict)
-	_, err := Decode(ex1, dict)
+	meta, err := NewDecoder(strings.NewReader(in)).RecordConversions(true).Decode(&s)
 	if err != nil {
-		t.Errorf("Decode error: %v", err)
+		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(expected, dict) {
-		t.Fatalf("\n%#v\n!=\n%#v\n", expected, dict)
+
+	have := make([]string, 0, len(meta.Conversions()))
+	for _, c := range meta.Conversions() {
+		have = append(have, fmt.Sprintf("%s; line %d, col %d", c, c.Position.Line, c.Position.Col))
+	}
+	sort.Strings(have)
+	want := []string{
+		"dur: unit interpretation Integer to time.Duration; line 5, col 7",
+		"float: widening Integer to float64; line 1, col 9",
+		"inner: custom unmarshal Integer to toml.InnerInt; line 12, col 9",
+		"int8: narrowing Integer to int8; line 2, col 8",
+		"num: widening Integer to json.Number; line 9, col 7",
+		"small: narrowing Float to float32; line 4, col 9",
+		"text: custom unmarshal String to toml.textUnmarshaler; line 7, col 9",
+		"uint: narrowing Integer to uint; line 3, col 8",
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave:\n\t%s\nwant:\n\t%s", strings.Join(have, "\n\t"), strings.Join(want, "\n\t"))
 	}
-}
 
-func TestDecodeBadDatetime(t *testing.T) {
-	var x struct{ T time.Time }
-	for _, s := range []string{"123", "1230"} {
-		input := "T = " + s
-		if _, err := Decode(input, &x); err == nil {
-			t.Errorf("Expected invalid DateTime error for %q", s)
-		}
+	meta, err = Decode(in, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := meta.Conversions(); len(c) > 0 {
+		t.Errorf("recorded conversions without RecordConversions: %v", c)
 	}
 }
 
-type sphere struct {
-	Center [3]float64
-	Radius float64
+type notifier interface{ Notify() string }
+
+type emailNotifier struct {
+	To      string
+	Subject string
 }
 
-func TestDecodeArrayWrongSize(t *testing.T) {
-	var s1 sphere
-	if _, err := Decode(`center = [0.1, 2.3]`, &s1); err == nil {
-		t.Fatal("Expected array type mismatch error")
+func (e *emailNotifier) Notify() string { return "mail " + e.To + ": " + e.Subject }
+
+type logNotifier struct{ Prefix string }
+
+func (l logNotifier) Notify() string { return "log " + l.Prefix }
+
+func TestDecodeDefaultType(t *testing.T) {
+	notifierType := reflect.TypeOf((*notifier)(nil)).Elem()
+	decode := func(in string, v any, concrete func() any) error {
+		_, err := NewDecoder(strings.NewReader(in)).
+			RegisterDefaultType(notifierType, concrete).
+			Decode(v)
+		return err
 	}
-}
+	newEmail := func() any { return new(emailNotifier) }
 
-func TestDecodeIntOverflow(t *testing.T) {
+	t.Run("top level", func(t *testing.T) {
+		var s struct{ N notifier }
+		err := decode("[n]\nto = 'a@example.com'\nsubject = 'x'", &s, newEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := s.N.Notify(), "mail a@example.com: x"; have != want {
+			t.Errorf("\nhave: %q\nwant: %q", have, want)
+		}
+	})
+
+	t.Run("map", func(t *testing.T) {
+		var s struct{ N map[string]notifier }
+		err := decode("[n.a]\nto = 'a'\n[n.b]\nto = 'b'", &s, newEmail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.N) != 2 || s.N["a"].Notify() != "mail a: " || s.N["b"].Notify() != "mail b: " {
+			t.Errorf("wrong value: %#v", s.N)
+		}
+	})
+
+	t.Run("slice", func(t *testing.T) {
+		var s struct{ N []notifier }
+		err := decode("[[n]]\nprefix = 'a'\n[[n]]\nprefix = 'b'", &s,
+			func() any { return logNotifier{} })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.N) != 2 || s.N[0].Notify() != "log a" || s.N[1].Notify() != "log b" {
+			t.Errorf("wrong value: %#v", s.N)
+		}
+	})
+
+	tests := []struct {
+		in       string
+		v        any
+		concrete func() any
+		wantErr  string
+	}{
+		{"[n]\nto = 1", new(struct{ N notifier }), newEmail,
+			"toml: line 2 (last key \"n.to\"): incompatible types: TOML value has type int64; destination has type string"},
+		{"n = 'x'", new(struct{ N notifier }), newEmail,
+			"toml: line 1 (last key \"n\"): unsupported type toml.notifier"},
+		{"[n]", new(struct{ N notifier }), func() any { return "x" },
+			"default type string does not implement toml.notifier"},
+		{"[n]", new(struct{ N fmt.Stringer }), newEmail,
+			"unsupported type fmt.Stringer"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			err := decode(tt.in, tt.v, tt.concrete)
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeInterfaceDecoder(t *testing.T) {
+	notifierType := reflect.TypeOf((*notifier)(nil)).Elem()
+	concrete := func(table map[string]any) (any, error) {
+		switch table["kind"] {
+		case "email":
+			return new(emailNotifier), nil
+		case "log":
+			return logNotifier{}, nil
+		}
+		return nil, fmt.Errorf("unknown kind %q", table["kind"])
+	}
+	decode := func(in string, v any) (MetaData, error) {
+		return NewDecoder(strings.NewReader(in)).RegisterInterfaceDecoder(notifierType, concrete).Decode(v)
+	}
+
+	var s struct{ N []notifier }
+	meta, err := decode(`
+[[n]]
+kind = "email"
+to = "a@example.com"
+
+[[n]]
+kind = "log"
+prefix = "x"
+`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, n := range s.N {
+		have = append(have, n.Notify())
+	}
+	if want := []string{"mail a@example.com: ", "log x"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+	if u := fmt.Sprint(meta.Undecoded()); u != "[n.kind n.kind]" {
+		t.Errorf("undecoded: %s", u)
+	}
+
+	// Existing elements are decoded in to, so use a new value.
+	_, err = decode("[[n]]\nkind = 'log'\n[[n]]\nkind = 'sms'", new(struct{ N []notifier }))
+	if !errorContains(err, `toml: line 3 (last key "n"): unknown kind "sms"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, err = decode("[[n]]\nkind = 'email'\nto = 1", new(struct{ N []notifier }))
+	if !errorContains(err, `incompatible types: TOML value has type int64; destination has type string`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+type plugin interface{ Name() string }
+
+// fooPlugin is set from a string with UnmarshalTOML.
+type fooPlugin struct{ opt string }
+
+func (f *fooPlugin) Name() string { return "foo " + f.opt }
+func (f *fooPlugin) UnmarshalTOML(v any) error {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("fooPlugin: not a string: %T", v)
+	}
+	f.opt = s
+	return nil
+}
+
+type barPlugin struct {
+	Level int
+	Tags  []string
+}
+
+func (b barPlugin) Name() string { return fmt.Sprintf("bar %d %v", b.Level, b.Tags) }
+
+func TestDecodeInterfaceExisting(t *testing.T) {
+	foo, bar := &fooPlugin{opt: "default"}, &barPlugin{Level: 1}
+	s := struct {
+		Plugins map[string]plugin
+		Field   plugin
+	}{
+		Plugins: map[string]plugin{"foo": foo, "bar": bar, "val": barPlugin{Level: 2}, "nilptr": (*barPlugin)(nil)},
+		Field:   barPlugin{},
+	}
+	_, err := Decode(`
+field = {level = 9}
+[plugins]
+foo = "x"
+bar = {tags = ["a"]}
+val = {level = 3}
+nilptr = {level = 4}
+`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have := map[string]string{"field": s.Field.Name()}
+	for k, p := range s.Plugins {
+		have[k] = fmt.Sprintf("%T %s", p, p.Name())
+	}
+	want := map[string]string{
+		"field":  "bar 9 []",
+		"foo":    "*toml.fooPlugin foo x",
+		"bar":    "*toml.barPlugin bar 1 [a]",
+		"val":    "toml.barPlugin bar 3 []",
+		"nilptr": "*toml.barPlugin bar 4 []",
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+	// Pointers that were set beforehand are filled in.
+	if s.Plugins["foo"] != foo || foo.opt != "x" || s.Plugins["bar"] != bar || bar.Tags[0] != "a" {
+		t.Errorf("not filled in: %#v %#v", foo, bar)
+	}
+
+	// Also for struct fields.
+	f := &fooPlugin{}
+	s.Field = f
+	if _, err := Decode(`field = "y"`, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Field != f || f.opt != "y" {
+		t.Errorf("not filled in: %#v", s.Field)
+	}
+
+	_, err = Decode("[plugins]\nnew = 'x'", &s)
+	if !errorContains(err, `toml: line 2 (last key "plugins.new"): unsupported type toml.plugin`) {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, err = Decode("[plugins]\nfoo = 1", &s)
+	if !errorContains(err, `fooPlugin: not a string: int64`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestDecodeOpaqueStruct(t *testing.T) {
+	var s struct {
+		S set[string]
+		T time.Time
+	}
+	_, err := Decode("t = 2020-01-02T03:04:05Z\n[s]\na = 1", &s)
+	want := `toml: line 2 (last key "s"): type toml.set[string] has no exported fields and no unmarshaler; implement UnmarshalTOML or UnmarshalText`
+	if !errorContains(err, want) {
+		t.Fatalf("wrong error\nhave: %v\nwant: %q", err, want)
+	}
+
+	_, err = NewDecoder(strings.NewReader("t = 2020-01-02T03:04:05Z\n[s]\na = 1")).
+		AllowOpaqueStructs(true).Decode(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.T.Year() != 2020 {
+		t.Errorf("wrong time: %s", s.T)
+	}
+}
+
+func TestDecodeDeprecated(t *testing.T) {
+	type config struct {
+		Timeout int `toml:"timeout,deprecated=wait,deprecated=delay"`
+		Other   int `toml:"other"`
+	}
+
+	tests := []struct {
+		in           string
+		want         int
+		wantWarnings []string
+	}{
+		{"timeout = 1", 1, nil},
+		{"other = 2", 0, nil},
+		{"wait = 1", 1, []string{
+			`toml: line 1 (key "wait"): key "wait" is deprecated; use "timeout" instead`}},
+		{"delay = 1", 1, []string{
+			`toml: line 1 (key "delay"): key "delay" is deprecated; use "timeout" instead`}},
+		{"wait = 1\ntimeout = 2", 2, []string{
+			`toml: line 1 (key "wait"): key "wait" is deprecated and ignored because "timeout" is also set`}},
+		{"delay = 1\nwait = 2", 2, []string{
+			`toml: line 1 (key "delay"): key "delay" is deprecated and ignored because "wait" is also set`,
+			`toml: line 2 (key "wait"): key "wait" is deprecated; use "timeout" instead`}},
+		{"delay = 1\nwait = 2\ntimeout = 3", 3, []string{
+			`toml: line 1 (key "delay"): key "delay" is deprecated and ignored because "timeout" is also set`,
+			`toml: line 2 (key "wait"): key "wait" is deprecated and ignored because "timeout" is also set`}},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var c config
+			meta, err := Decode(tt.in, &c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Timeout != tt.want {
+				t.Errorf("wrong value: %d; want %d", c.Timeout, tt.want)
+			}
+
+			var have []string
+			for _, w := range meta.Warnings() {
+				have = append(have, w.String())
+			}
+			sort.Strings(have)
+			if !reflect.DeepEqual(have, tt.wantWarnings) {
+				t.Errorf("wrong warnings\nhave: %q\nwant: %q", have, tt.wantWarnings)
+			}
+			if u := meta.Undecoded(); len(u) > 0 {
+				t.Errorf("undecoded keys: %v", u)
+			}
+		})
+	}
+
+	t.Run("encode", func(t *testing.T) {
+		have, err := Marshal(config{Timeout: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "timeout = 5\nother = 0\n"; string(have) != want {
+			t.Errorf("\nhave: %q\nwant: %q", have, want)
+		}
+	})
+}
+
+func TestDecodeKeyed(t *testing.T) {
+	type server struct {
+		Name string
+		Host string
+	}
+	type config struct {
+		Servers map[string]server `toml:"servers,keyed=name"`
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		var c config
+		meta, err := Decode(`
+[[servers]]
+name = "alpha"
+host = "10.0.0.1"
+
+[[servers]]
+name = "beta"
+host = "10.0.0.2"
+`, &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]server{
+			"alpha": {Name: "alpha", Host: "10.0.0.1"},
+			"beta":  {Name: "beta", Host: "10.0.0.2"},
+		}
+		if !reflect.DeepEqual(c.Servers, want) {
+			t.Errorf("\nhave: %#v\nwant: %#v", c.Servers, want)
+		}
+		if u := meta.Undecoded(); len(u) > 0 {
+			t.Errorf("undecoded keys: %v", u)
+		}
+		// Only recorded when needed for an error.
+		for k := range meta.keyInfo {
+			if strings.Contains(k, "[") {
+				t.Errorf("position for %q recorded without an error", k)
+			}
+		}
+	})
+
+	t.Run("inline", func(t *testing.T) {
+		var c config
+		_, err := Decode(`servers = [{name = "alpha", host = "10.0.0.1"}]`, &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Servers["alpha"].Host != "10.0.0.1" {
+			t.Errorf("wrong value: %#v", c.Servers)
+		}
+	})
+
+	tests := []struct {
+		name, in, wantErr string
+		wantLine          int
+	}{
+		{"missing", `
+[[servers]]
+name = "alpha"
+
+[[servers]]
+host = "10.0.0.2"
+`, `servers[1]: missing key "name"`, 5},
+		{"duplicate", `
+[[servers]]
+name = "alpha"
+
+[[servers]]
+name = "alpha"
+`, `servers[1]: duplicate name "alpha"; already used in servers[0] on line 2`, 5},
+		{"not a string", `
+[[servers]]
+name = 1
+`, `servers[0]: key "name" must be a string`, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c config
+			_, err := Decode(tt.in, &c)
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %q", err, tt.wantErr)
+			}
+			var pErr ParseError
+			if !errors.As(err, &pErr) {
+				t.Fatalf("not a ParseError: %T", err)
+			}
+			if pErr.Position.Line != tt.wantLine {
+				t.Errorf("wrong line: %d; want %d", pErr.Position.Line, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestDecodeUnion(t *testing.T) {
+	type (
+		file  struct{ Path string }
+		kafka struct{ Topic string }
+		input struct {
+			Buffer int
+			File   *file
+			Kafka  *kafka
+		}
+		config struct {
+			Input input `toml:"input,union"`
+		}
+		required struct {
+			Input *input `toml:"input,union=required"`
+		}
+		pipelines struct {
+			Pipeline []struct {
+				Name  string
+				Input input `toml:"input,union"`
+			}
+		}
+	)
+
+	t.Run("one", func(t *testing.T) {
+		var c config
+		meta, err := Decode(`
+[input]
+buffer = 10
+[input.kafka]
+topic = "logs"
+`, &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := config{Input: input{Buffer: 10, Kafka: &kafka{Topic: "logs"}}}
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("\nhave: %#v\nwant: %#v", c, want)
+		}
+		if v, ok := meta.UnionChoice("input"); v != "kafka" || !ok {
+			t.Errorf("wrong choice: %q %t", v, ok)
+		}
+	})
+
+	t.Run("zero", func(t *testing.T) {
+		var c config
+		meta, err := Decode(`[input]`+"\n"+`buffer = 10`, &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Input.File != nil || c.Input.Kafka != nil {
+			t.Errorf("variant set: %#v", c.Input)
+		}
+		if v, ok := meta.UnionChoice("input"); v != "" || ok {
+			t.Errorf("wrong choice: %q %t", v, ok)
+		}
+
+		var r required
+		_, err = Decode(`[input]`+"\n"+`buffer = 10`, &r)
+		if !errorContains(err, `toml: line 1 (last key "input"): one of "input.File", "input.Kafka" must be set`) {
+			t.Errorf("wrong error: %v", err)
+		}
+		_, err = Decode(`a = 1`, &r)
+		if !errorContains(err, `one of "input.File", "input.Kafka" must be set`) {
+			t.Errorf("wrong error: %v", err)
+		}
+		if _, err := Decode(`input.file.path = "/log"`, &r); err != nil || r.Input.File.Path != "/log" {
+			t.Errorf("wrong result: %v; %#v", err, r.Input)
+		}
+	})
+
+	t.Run("two", func(t *testing.T) {
+		var c config
+		_, err := Decode(`
+[input.file]
+path = "/var/log"
+
+[input.kafka]
+topic = "logs"
+`, &c)
+		var pErr ParseError
+		if !errors.As(err, &pErr) {
+			t.Fatalf("not a ParseError: %v", err)
+		}
+		if want := `"input.file" on line 2 and "input.kafka" on line 5 are both set, but only one variant of "input" can be set`; pErr.Message != want {
+			t.Errorf("\nhave: %s\nwant: %s", pErr.Message, want)
+		}
+		if pErr.Position.Line != 5 {
+			t.Errorf("wrong line: %d", pErr.Position.Line)
+		}
+	})
+
+	t.Run("array of tables", func(t *testing.T) {
+		in := `
+[[pipeline]]
+name = "a"
+[pipeline.input.file]
+path = "/var/log"
+
+[[pipeline]]
+name = "b"
+[pipeline.input.kafka]
+topic = "logs"
+`
+		var p pipelines
+		meta, err := Decode(in, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Pipeline[0].Input.File == nil || p.Pipeline[1].Input.Kafka == nil {
+			t.Errorf("wrong value: %#v", p.Pipeline)
+		}
+		if v, ok := meta.UnionChoice("pipeline", "input"); v != "kafka" || !ok {
+			t.Errorf("wrong choice: %q %t", v, ok)
+		}
+
+		_, err = Decode(in+"[pipeline.input.file]\npath = \"/tmp\"\n", &p)
+		if !errorContains(err, `toml: line 11 (last key "pipeline.input"): "pipeline[1].input.kafka" on line 9 and "pipeline[1].input.file" on line 11 are both set`) {
+			t.Errorf("wrong error: %v", err)
+		}
+
+		// In the first table of the array.
+		_, err = Decode(strings.Replace(in, "\n\n", "\n[pipeline.input.kafka]\ntopic = \"x\"\n\n", 1), &p)
+		if !errorContains(err, `toml: line 6 (last key "pipeline.input"): "pipeline[0].input.file" on line 4 and "pipeline[0].input.kafka" on line 6 are both set`) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestDecodeCanonicalKeys(t *testing.T) {
+	in := `
+[Server]
+host = "a"
+limits.max = 2
+
+[server.TLS]
+cert = "c"
+KEY = "k"
+
+[[Users]]
+name = "x"
+
+[[users]]
+NAME = "y"
+`[1:]
+
+	t.Run("struct", func(t *testing.T) {
+		var c struct {
+			Server struct {
+				Host   string
+				Limits struct{ Max int }
+				TLS    struct{ Cert, Key string }
+			}
+			Users []struct{ Name string }
+		}
+		meta, err := NewDecoder(strings.NewReader(in)).CanonicalKeys(true).Decode(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Server.Host != "a" || c.Server.Limits.Max != 2 || c.Server.TLS.Cert != "c" || c.Server.TLS.Key != "k" {
+			t.Errorf("%#v", c.Server)
+		}
+		if len(c.Users) != 2 || c.Users[0].Name != "x" || c.Users[1].Name != "y" {
+			t.Errorf("%#v", c.Users)
+		}
+		if u := meta.Undecoded(); len(u) > 0 {
+			t.Errorf("undecoded: %v", u)
+		}
+	})
+
+	t.Run("map", func(t *testing.T) {
+		var m map[string]any
+		meta, err := NewDecoder(strings.NewReader(in)).CanonicalKeys(true).Decode(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]any{
+			"Server": map[string]any{
+				"host":   "a",
+				"limits": map[string]any{"max": int64(2)},
+				"TLS":    map[string]any{"cert": "c", "KEY": "k"},
+			},
+			"Users": []map[string]any{{"name": "x"}, {"name": "y"}},
+		}
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("\nhave: %#v\nwant: %#v", m, want)
+		}
+
+		var warn []string
+		for _, w := range meta.Warnings() {
+			warn = append(warn, w.String())
+		}
+		wantWarn := []string{
+			`toml: line 5 (key "server"): "server" is the same key as "Server", which is used instead as it was written first`,
+			`toml: line 12 (key "users"): "users" is the same key as "Users", which is used instead as it was written first`,
+			`toml: line 13 (key "Users.NAME"): "Users.NAME" is the same key as "Users.name", which is used instead as it was written first`,
+		}
+		if !reflect.DeepEqual(warn, wantWarn) {
+			t.Errorf("\nhave: %q\nwant: %q", warn, wantWarn)
+		}
+
+		for _, k := range [][]string{{"server", "tls", "cert"}, {"SERVER", "Host"}, {"server", "LIMITS", "max"}, {"USERS"}} {
+			if !meta.IsDefined(k...) {
+				t.Errorf("IsDefined(%q) is false", k)
+			}
+		}
+		if typ := meta.Type("SERVER", "TLS"); typ != "Hash" {
+			t.Errorf("Type: %q", typ)
+		}
+		if meta.IsDefined("servers") {
+			t.Error("IsDefined(servers) is true")
+		}
+		if a := meta.Aliases(Key{"SERVER"}); !reflect.DeepEqual(a, []Key{{"server"}}) {
+			t.Errorf("Aliases: %q", a)
+		}
+		if a := meta.Aliases(Key{"users", "name"}); !reflect.DeepEqual(a, []Key{{"Users", "NAME"}}) {
+			t.Errorf("Aliases: %q", a)
+		}
+		if a := meta.Aliases(Key{"Server", "host"}); a != nil {
+			t.Errorf("Aliases: %q", a)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := NewEncoder(buf).MetaData(&meta).Encode(m); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"server", "users", "NAME"} {
+			if strings.Contains(buf.String(), k) {
+				t.Errorf("encoded %q:\n%s", k, buf)
+			}
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		var m map[string]any
+		_, err := NewDecoder(strings.NewReader("[a]\nx = 1\n[A]\ny = 1")).CanonicalKeys(true).Decode(&m)
+		if !errorContains(err, "Key 'a' has already been defined") {
+			t.Errorf("wrong error: %v", err)
+		}
+		_, err = NewDecoder(strings.NewReader("a = 1\nA = 2")).CanonicalKeys(true).Decode(&m)
+		if err == nil {
+			t.Error("no error")
+		}
+	})
+
+	t.Run("case sensitive", func(t *testing.T) {
+		var m map[string]any
+		meta, err := NewDecoder(strings.NewReader("a = 1\nA = 2")).CanonicalKeys(true).CaseSensitive(true).Decode(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 2 || len(meta.Warnings()) != 0 {
+			t.Errorf("%v %v", m, meta.Warnings())
+		}
+	})
+}
+
+func TestDecodeStringOption(t *testing.T) {
+	type config struct {
+		Int   int     `toml:"int,string"`
+		Int8  int8    `toml:"int8,string"`
+		Uint  uint64  `toml:"uint,string"`
+		Float float64 `toml:"float,string"`
+		Bool  bool    `toml:"bool,string"`
+		Ptr   *int    `toml:"ptr,string"`
+		Str   string  `toml:"str,string"`
+	}
+
+	t.Run("round-trip", func(t *testing.T) {
+		n := 3
+		in := config{Int: -42, Int8: 127, Uint: math.MaxUint64, Float: 1.5, Bool: true, Ptr: &n, Str: "s"}
+		buf := new(bytes.Buffer)
+		if err := NewEncoder(buf).Encode(in); err != nil {
+			t.Fatal(err)
+		}
+		want := `int = "-42"
+int8 = "127"
+uint = "18446744073709551615"
+float = "1.5"
+bool = "true"
+ptr = "3"
+str = "s"
+`
+		if buf.String() != want {
+			t.Errorf("\nhave:\n%s\nwant:\n%s", buf, want)
+		}
+
+		var out config
+		if _, err := Decode(buf.String(), &out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("\nhave: %#v\nwant: %#v", out, in)
+		}
+	})
+
+	t.Run("unquoted", func(t *testing.T) {
+		var c config
+		_, err := Decode(`int = 1`+"\n"+`uint = 2`+"\n"+`float = 3.5`+"\n"+`bool = true`, &c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := config{Int: 1, Uint: 2, Float: 3.5, Bool: true}
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("\nhave: %#v\nwant: %#v", c, want)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			in, err string
+		}{
+			{`int = "x"`, `toml: line 1 (last key "int"): invalid int in string "x" for a field with the string option`},
+			{`int = "1.5"`, `invalid int in string "1.5"`},
+			{`int8 = "128"`, `128 is out of range for int8`},
+			{`uint = "-1"`, `invalid uint64 in string "-1"`},
+			{`uint = "18446744073709551616"`, `18446744073709551616 is out of range for uint64`},
+			{`float = "1e400"`, `1e400 is out of range for float64`},
+			{`bool = "yes"`, `invalid bool in string "yes"`},
+			{`bool = "1"`, `invalid bool in string "1"`},
+		}
+		for _, tt := range tests {
+			t.Run("", func(t *testing.T) {
+				var c config
+				_, err := Decode(tt.in, &c)
+				if !errorContains(err, tt.err) {
+					t.Errorf("wrong error\nhave: %v\nwant: %s", err, tt.err)
+				}
+				var pErr ParseError
+				if !errors.As(err, &pErr) || pErr.Position.Line != 1 {
+					t.Errorf("not a ParseError with a position: %#v", err)
+				}
+			})
+		}
+	})
+
+	t.Run("not scalar", func(t *testing.T) {
+		tests := []struct {
+			in  any
+			doc string
+			err string
+		}{
+			{&struct {
+				T time.Time `toml:"t,string"`
+			}{}, `t = 2006-01-02T15:04:05Z`, "}.T can only be used on integer, float, boolean, and string fields, not time.Time"},
+			{&struct {
+				L []int `toml:"l,string"`
+			}{L: []int{1}}, `l = [1]`, "not []int"},
+			{&struct {
+				M map[string]int `toml:"m,string"`
+			}{M: map[string]int{"a": 1}}, `[m]`, "not map[string]int"},
+		}
+		for _, tt := range tests {
+			t.Run("", func(t *testing.T) {
+				_, err := Decode(tt.doc, tt.in)
+				if !errorContains(err, tt.err) {
+					t.Errorf("wrong error\nhave: %v\nwant: %s", err, tt.err)
+				}
+
+				err = NewEncoder(new(bytes.Buffer)).Encode(reflect.ValueOf(tt.in).Elem().Interface())
+				if !errorContains(err, "can only be used on integer, float, boolean, and string fields") {
+					t.Errorf("wrong encode error: %v", err)
+				}
+			})
+		}
+	})
+}
+
+func TestDecodePointers(t *testing.T) {
+	type Object struct {
+		Type        string
+		Description string
+	}
+
+	type Dict struct {
+		NamedObject map[string]*Object
+		BaseObject  *Object
+		Strptr      *string
+		Strptrs     []*string
+	}
+	s1, s2, s3 := "blah", "abc", "def"
+	expected := &Dict{
+		Strptr:  &s1,
+		Strptrs: []*string{&s2, &s3},
+		NamedObject: map[string]*Object{
+			"foo": {"FOO", "fooooo!!!"},
+			"bar": {"BAR", "ba-ba-ba-ba-barrrr!!!"},
+		},
+		BaseObject: &Object{"BASE", "da base"},
+	}
+
+	ex1 := `
+Strptr = "blah"
+Strptrs = ["abc", "def"]
+
+[NamedObject.foo]
+Type = "FOO"
+Description = "fooooo!!!"
+
+[NamedObject.bar]
+Type = "BAR"
+Description = "ba-ba-ba-ba-barrrr!!!"
+
+[BaseObject]
+Type = "BASE"
+Description = "da base"
+`
+	dict := new(Dict)
+	_, err := Decode(ex1, dict)
+	if err != nil {
+		t.Errorf("Decode error: %v", err)
+	}
+	if !reflect.DeepEqual(expected, dict) {
+		t.Fatalf("\n%#v\n!=\n%#v\n", expected, dict)
+	}
+}
+
+// Explicitly present keys always set a pointer, and absent keys never do,
+// wherever the struct is.
+func TestDecodePointerPresence(t *testing.T) {
+	type rule struct {
+		Enabled *bool
+		Deep    **bool
+	}
+	type doc struct {
+		Field  rule
+		Ptr    *rule
+		Map    map[string]rule
+		MapPtr map[string]*rule
+		Tables []rule
+		Ptrs   []*rule
+		Array  [1]rule
+		Inline []rule
+	}
+	tru, fal := true, false
+	truP, falP := &tru, &fal
+
+	tests := []struct {
+		name string
+		kv   string
+		want *bool
+	}{
+		{"true", "enabled = true\ndeep = true", truP},
+		{"false", "enabled = false\ndeep = false", falP},
+		{"absent", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inline := strings.ReplaceAll(tt.kv, "\n", ", ")
+			in := fmt.Sprintf("inline = [{%[2]s}]\n[field]\n%[1]s\n[ptr]\n%[1]s\n[map.x]\n%[1]s\n"+
+				"[mapPtr.x]\n%[1]s\n[[tables]]\n%[1]s\n[[ptrs]]\n%[1]s\n[[array]]\n%[1]s\n", tt.kv, inline)
+
+			// Decode twice: once into new values, and once into existing
+			// elements where every pointer is already set to true. Absent keys
+			// keep the existing value there, so they can be used as defaults.
+			set := func() rule { b := true; bp := &b; return rule{Enabled: &b, Deep: &bp} }
+			ptr := func(r rule) *rule { return &r }
+			kept := map[string]bool{"tables": true, "ptrs": true, "array": true, "inline": true}
+			for i, d := range []doc{{}, {Ptr: &rule{}, Tables: []rule{set()}, Ptrs: []*rule{ptr(set())},
+				Array: [1]rule{set()}, Inline: []rule{set()}}} {
+				if _, err := Decode(in, &d); err != nil {
+					t.Fatal(err)
+				}
+				all := map[string]rule{"field": d.Field, "ptr": *d.Ptr, "map": d.Map["x"], "mapPtr": *d.MapPtr["x"],
+					"tables": d.Tables[0], "ptrs": *d.Ptrs[0], "array": d.Array[0], "inline": d.Inline[0]}
+				for k, r := range all {
+					want := tt.want
+					if i == 1 && kept[k] && want == nil {
+						want = truP
+					}
+					if want == nil {
+						if r.Enabled != nil || r.Deep != nil {
+							t.Errorf("%s: pointers not nil: %v, %v", k, r.Enabled, r.Deep)
+						}
+						continue
+					}
+					if r.Enabled == nil || r.Deep == nil || *r.Deep == nil {
+						t.Errorf("%s: nil pointer: %v, %v", k, r.Enabled, r.Deep)
+						continue
+					}
+					if *r.Enabled != *want || **r.Deep != *want {
+						t.Errorf("%s: have %t, %t; want %t", k, *r.Enabled, **r.Deep, *want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeUnexportedTag(t *testing.T) {
+	type creds struct {
+		User     string `toml:"user"`
+		password string `toml:"password"`
+		secret   string
+	}
+	var s creds
+	_, err := Decode("user = \"a\"\nsecret = \"b\"", &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Decode("user = \"a\"\nPassword = \"b\"", &s)
+	var pErr ParseError
+	if !errors.As(err, &pErr) {
+		t.Fatalf("not a ParseError: %#v", err)
+	}
+	want := `"Password" can't be decoded in to the unexported field toml.creds.password`
+	if !strings.HasPrefix(pErr.Message, want) || pErr.Position.Line != 2 {
+		t.Errorf("wrong error on line %d:\nhave: %s\nwant: %s", pErr.Position.Line, pErr.Message, want)
+	}
+
+	_, err = NewDecoder(strings.NewReader("Password = \"b\"")).CaseSensitive(true).Decode(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeBadDatetime(t *testing.T) {
+	var x struct{ T time.Time }
+	for _, s := range []string{"123", "1230"} {
+		input := "T = " + s
+		if _, err := Decode(input, &x); err == nil {
+			t.Errorf("Expected invalid DateTime error for %q", s)
+		}
+	}
+}
+
+type sphere struct {
+	Center [3]float64
+	Radius float64
+}
+
+func TestDecodeArrayWrongSize(t *testing.T) {
+	var s1 sphere
+	if _, err := Decode(`center = [0.1, 2.3]`, &s1); err == nil {
+		t.Fatal("Expected array type mismatch error")
+	}
+}
+
+func TestDecodeIntOverflow(t *testing.T) {
 	type table struct {
 		Value int8
 	}
-	var tab table
-	if _, err := Decode(`value = 500`, &tab); err == nil {
-		t.Fatal("Expected integer out-of-bounds error.")
+	var tab table
+	if _, err := Decode(`value = 500`, &tab); err == nil {
+		t.Fatal("Expected integer out-of-bounds error.")
+	}
+}
+
+// The same conversions should be done no matter how a value is reached.
+func TestDecodeConversionsConsistent(t *testing.T) {
+	values := []string{
+		`1`, `-1`, `300`, `2.5`, `5.0`, `1e39`, `16777217`, `9007199254740993`,
+		`18446744073709551615`, `"str"`, `true`, `2024-01-01`,
+	}
+	types := []reflect.Type{
+		reflect.TypeOf(float32(0)), reflect.TypeOf(float64(0)), reflect.TypeOf(int(0)),
+		reflect.TypeOf(int8(0)), reflect.TypeOf(uint8(0)), reflect.TypeOf(uint64(0)),
+		reflect.TypeOf(""), reflect.TypeOf(false), reflect.TypeOf(time.Duration(0)),
+	}
+
+	// Decode the value and return the leaf.
+	shapes := []struct {
+		name   string
+		decode func(val string, typ reflect.Type) (reflect.Value, error)
+	}{
+		{"field", func(val string, typ reflect.Type) (reflect.Value, error) {
+			rv := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "V", Type: typ}}))
+			_, err := Decode("v = "+val, rv.Interface())
+			return rv.Elem().Field(0), err
+		}},
+		{"pointer", func(val string, typ reflect.Type) (reflect.Value, error) {
+			rv := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "V", Type: reflect.PointerTo(typ)}}))
+			_, err := Decode("v = "+val, rv.Interface())
+			if rv.Elem().Field(0).IsNil() {
+				return reflect.Zero(typ), err
+			}
+			return rv.Elem().Field(0).Elem(), err
+		}},
+		{"slice", func(val string, typ reflect.Type) (reflect.Value, error) {
+			rv := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "V", Type: reflect.SliceOf(typ)}}))
+			_, err := Decode("v = ["+val+"]", rv.Interface())
+			if rv.Elem().Field(0).Len() == 0 {
+				return reflect.Zero(typ), err
+			}
+			return rv.Elem().Field(0).Index(0), err
+		}},
+		{"array", func(val string, typ reflect.Type) (reflect.Value, error) {
+			rv := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "V", Type: reflect.ArrayOf(1, typ)}}))
+			_, err := Decode("v = ["+val+"]", rv.Interface())
+			return rv.Elem().Field(0).Index(0), err
+		}},
+		{"map", func(val string, typ reflect.Type) (reflect.Value, error) {
+			rv := reflect.New(reflect.MapOf(reflect.TypeOf(""), typ))
+			_, err := Decode("v = "+val, rv.Interface())
+			if v := rv.Elem().MapIndex(reflect.ValueOf("v")); v.IsValid() {
+				return v, err
+			}
+			return reflect.Zero(typ), err
+		}},
+		{"inline table", func(val string, typ reflect.Type) (reflect.Value, error) {
+			rv := reflect.New(reflect.MapOf(reflect.TypeOf(""), reflect.MapOf(reflect.TypeOf(""), typ)))
+			_, err := Decode("t = {v = "+val+"}", rv.Interface())
+			if v := rv.Elem().MapIndex(reflect.ValueOf("t")); v.IsValid() && v.MapIndex(reflect.ValueOf("v")).IsValid() {
+				return v.MapIndex(reflect.ValueOf("v")), err
+			}
+			return reflect.Zero(typ), err
+		}},
+	}
+
+	for _, val := range values {
+		for _, typ := range types {
+			t.Run(val+"/"+typ.String(), func(t *testing.T) {
+				var want string
+				for i, s := range shapes {
+					v, err := s.decode(val, typ)
+					have := fmt.Sprintf("%v", v)
+					if err != nil {
+						have = "error"
+					}
+					if i == 0 {
+						want = have
+					} else if have != want {
+						t.Errorf("%s: %s; but %s: %s (%v)", shapes[0].name, want, s.name, have, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeFloatToInt(t *testing.T) {
+	types := []any{
+		new(int), new(int8), new(int16), new(int32), new(int64),
+		new(uint), new(uint8), new(uint16), new(uint32), new(uint64),
+	}
+	tests := []struct {
+		in       string
+		integral bool
+		want     string
+		wantErr  string
+	}{
+		{`v = 5.0`, false, "", "TOML value 5.0 is a float; destination %s is an integer type"},
+		{`v = 5.0`, true, "5", ""},
+		{`v = 5e1`, true, "50", ""},
+		{`v = 2.5`, false, "", "TOML value 2.5 has a fractional part; destination %s is an integer type"},
+		{`v = 2.5`, true, "", "TOML value 2.5 has a fractional part; destination %s is an integer type"},
+		{`v = nan`, true, "", "TOML value nan is a float; destination %s is an integer type"},
+		{`v = -inf`, true, "", "TOML value -inf is a float; destination %s is an integer type"},
+		{`v = 1e300`, true, "", "out of range"},
+	}
+	for _, tt := range tests {
+		for _, typ := range types {
+			rt := reflect.TypeOf(typ).Elem()
+			t.Run(fmt.Sprintf("%s/%s/%t", tt.in, rt, tt.integral), func(t *testing.T) {
+				in := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "V", Type: rt}}))
+				_, err := NewDecoder(strings.NewReader(tt.in)).AllowIntegralFloats(tt.integral).Decode(in.Interface())
+				wantErr := tt.wantErr
+				if strings.Contains(wantErr, "%s") {
+					wantErr = fmt.Sprintf(wantErr, rt)
+				}
+				if !errorContains(err, wantErr) {
+					t.Fatalf("wrong error\nhave: %v\nwant: %s", err, wantErr)
+				}
+				if err != nil {
+					var pErr ParseError
+					if !errors.As(err, &pErr) || strings.Contains(wantErr, "integer type") && !strings.Contains(pErr.ErrorWithUsage(), "TOML has separate integer and float types") {
+						t.Errorf("no usage:\n%s", pErr.ErrorWithUsage())
+					}
+					return
+				}
+				if have := fmt.Sprint(in.Elem().Field(0)); have != tt.want {
+					t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeWeakTypes(t *testing.T) {
+	tests := []struct {
+		in      string
+		weak    bool
+		want    string
+		wantErr string
+	}{
+		{`v = true`, false, "true", ""},
+		{`v = true`, true, "true", ""},
+		{`v = 0`, true, "false", ""},
+		{`v = 1`, true, "true", ""},
+		{`v = 2`, true, "", "integer 2 can't be used as a boolean; only 0 and 1 are accepted"},
+		{`v = -1`, true, "", "integer -1 can't be used as a boolean"},
+		{`v = "True"`, true, "true", ""},
+		{`v = " FALSE "`, true, "false", ""},
+		{`v = "no"`, true, "", `string "no" can't be used as a boolean; only "true" and "false" are accepted`},
+		{`v = 1.0`, true, "", "incompatible types: TOML value has type float64; destination has type boolean"},
+
+		{`v = 1`, false, "", "incompatible types: TOML value has type int64; destination has type boolean"},
+		{`v = "no"`, false, "", "incompatible types: TOML value has type string; destination has type boolean"},
+		{`v = "True"`, false, "", "TOML booleans are the bare tokens true and false, without quotes"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%t", tt.in, tt.weak), func(t *testing.T) {
+			var s struct{ V bool }
+			meta, err := NewDecoder(strings.NewReader(tt.in)).WeakTypes(tt.weak).RecordConversions(true).Decode(&s)
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if have := fmt.Sprint(s.V); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+			if c := meta.Conversions(); tt.in != `v = true` && (len(c) != 1 || c[0].Kind != Weak) {
+				t.Errorf("conversions: %v", c)
+			}
+		})
+	}
+
+	var s struct{ X bool }
+	_, err := Decode(`x = "true"`, &s)
+	var pErr ParseError
+	if !errors.As(err, &pErr) {
+		t.Fatalf("not a ParseError: %v", err)
+	}
+	want := `toml: error: incompatible types: TOML value has type string ("true"); destination has type boolean; TOML booleans are the bare tokens true and false, without quotes
+
+At line 1, column 6-9:
+
+      1 | x = "true"
+               ^^^^
+Error help:
+
+    TOML booleans are written as the bare words true and false, without quotes; a
+    quoted "true" is a string, not a boolean:
+
+        # INVALID for a boolean
+        enabled = "true"
+
+        enabled = true
+        verbose = false
+
+    Strings and the integers 0 and 1 can be accepted by the program with
+    Decoder.WeakTypes().
+`
+	if have := pErr.ErrorWithUsage(); have != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+	}
+}
+
+func TestDecodePromoteSlice(t *testing.T) {
+	var s struct {
+		Str  []string
+		Int  []int
+		Text []textUnmarshaler
+		Map  map[string][]string
+		Tbl  struct{ List []float64 }
+		Arr  []struct{ List []bool }
+		Same []string
+	}
+	in := `
+		str  = "a"
+		int  = 42
+		text = "t"
+		map  = {k = "v"}
+		tbl  = {list = 1.5}
+		arr  = [{list = true}]
+		same = ["x", "y"]
+	`
+	meta, err := NewDecoder(strings.NewReader(in)).RecordConversions(true).Decode(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := fmt.Sprintf("%q %v %q %q %v %v %q", s.Str, s.Int, s.Text, s.Map, s.Tbl, s.Arr, s.Same)
+	want := `["a"] [42] ["t"] map["k":["v"]] {[1.5]} [{[true]}] ["x" "y"]`
+	if have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	var kinds []string
+	for _, c := range meta.Conversions() {
+		if c.Kind == Promotion {
+			kinds = append(kinds, c.String())
+		}
+	}
+	sort.Strings(kinds)
+	have = strings.Join(kinds, "\n")
+	want = `arr.list: promotion Bool to []bool
+int: promotion Integer to []int
+map.k: promotion String to []string
+str: promotion String to []string
+tbl.list: promotion Float to []float64
+text: promotion String to []toml.textUnmarshaler`
+	if have != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+	}
+
+	// Array elements aren't promoted.
+	var s2 struct{ Nested [][]string }
+	_, err = Decode(`nested = ["a", ["b"]]`, &s2)
+	if !errorContains(err, "incompatible types: TOML value has type string; destination has type slice") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestDecodeKeyCollision(t *testing.T) {
+	type S struct {
+		Name string
+		Sub  struct{ A, B int }
+	}
+	tests := []struct {
+		in      string
+		strict  bool
+		dest    func() any
+		want    string
+		wantErr string
+		undec   string
+	}{
+		{"Name = 'a'\nname = 'b'", false, func() any { return new(S) }, "&{b {0 0}}", "", ""},
+		{"name = 'a'\nName = 'b'", false, func() any { return new(S) }, "&{b {0 0}}", "", ""},
+		{"NAME = 'a'\nname = 'b'\nName = 'c'", false, func() any { return new(S) }, "&{c {0 0}}", "", ""},
+		{"sub.a = 1\nSub.b = 2", false, func() any { return new(S) }, "&{ {1 2}}", "", ""},
+		{"Sub.a = 1\nsub.a = 2\nSUB.b = 3", false, func() any { return new(S) }, "&{ {2 3}}", "", ""},
+		{"Name = 'a'\nname = 'b'", true, func() any { return new(S) }, "",
+			`toml: line 2: "Name" on line 1 and "name" on line 2 both set the field toml.S.Name`, ""},
+		{"name = 'a'\n\n\nName = 'b'", true, func() any { return new(S) }, "",
+			`toml: line 4: "name" on line 1 and "Name" on line 4 both set the field toml.S.Name`, ""},
+		{"sub.a = 1\nSub.b = 2", true, func() any { return new(S) }, "",
+			`"sub" on line 1 and "Sub" on line 2 both set the field toml.S.Sub`, ""},
+		{"[[arr]]\nname = 'a'\nNAME = 'b'\n[[arr]]\nname = 'c'\nNAME = 'd'", true, func() any { return &struct{ Arr []S }{} }, "",
+			`toml: line 3 (last key "arr"): "arr.name" on line 2 and "arr.NAME" on line 3 both set the field toml.S.Name`, ""},
+		{"Name = 'a'\nname = 'b'", false, func() any { return &map[string]string{} }, "&map[Name:a name:b]", "", ""},
+		{"Name = 'a'\nname = 'b'", true, func() any { return &map[string]string{} }, "&map[Name:a name:b]", "", ""},
+		{"[Sub]\nA = 1\n[sub]\nb = 2", true, func() any { return &map[string]map[string]int{} },
+			"&map[Sub:map[A:1] sub:map[b:2]]", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			dest := tt.dest()
+			meta, err := NewDecoder(strings.NewReader(tt.in)).DisallowKeyCollisions(tt.strict).Decode(dest)
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if have := fmt.Sprintf("%v", dest); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+			if u := fmt.Sprintf("%v", meta.Undecoded()); u != "[]" && u != tt.undec {
+				t.Errorf("undecoded: %s", u)
+			}
+			var keys []string
+			for _, k := range meta.Keys() {
+				keys = append(keys, k.String())
+			}
+			for _, line := range strings.Split(tt.in, "\n") {
+				k, _, ok := strings.Cut(line, " =")
+				if ok && !strings.Contains(strings.Join(keys, " "), k) {
+					t.Errorf("key %q not in %v", k, keys)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodePlaceholders(t *testing.T) {
+	in := `
+# api_key =   # required: your API key
+name = "n"
+# timeout =
+# retries = 5
+
+[db]
+# password =
+user = "u"
+`
+	var c struct {
+		APIKey string `toml:"api_key"`
+		Name   string
+	}
+	meta, err := Decode(in, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A commented-out key is a placeholder only if it has no value.
+	if have := fmt.Sprintf("%v", meta.Placeholders()); have != "[api_key timeout db.password]" {
+		t.Errorf("placeholders: %s", have)
+	}
+
+	c.Name = ""
+	_, err = NewDecoder(strings.NewReader(in)).DisallowPlaceholders(true).Decode(&c)
+	var pErr PlaceholderError
+	if !errors.As(err, &pErr) {
+		t.Fatalf("not a PlaceholderError: %#v", err)
+	}
+	if have := fmt.Sprintf("%v", pErr.Keys); have != "[api_key timeout db.password]" {
+		t.Errorf("keys: %s", have)
+	}
+	if want := `toml: placeholders "api_key", "timeout", "db.password" have no value`; err.Error() != want {
+		t.Errorf("\nhave: %s\nwant: %s", err, want)
+	}
+	if c.Name != "" {
+		t.Errorf("decoded with an error: %q", c.Name)
+	}
+
+	_, err = NewDecoder(strings.NewReader("# api_key =\napi_key = 'k'\n# port = 80\n")).DisallowPlaceholders(true).Decode(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewDecoder(strings.NewReader("# api_key =\n")).DisallowPlaceholders(true).Decode(&c)
+	if !errorContains(err, `placeholder "api_key" has no value`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+// countReader returns the byte b forever, and counts how much was read.
+type countReader struct {
+	b byte
+	n int
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.b
+	}
+	r.n += len(p)
+	return len(p), nil
+}
+
+func TestDecodeMaxLength(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	tests := []struct {
+		in          string
+		maxKey, max int
+		wantErr     string
+	}{
+		{`a = 1`, 0, 0, ""},
+		{long + ` = "` + long + `"`, 0, 0, ""},
+		{long + ` = 1`, 100, 0, ""},
+		{long + `x = 1`, 100, 0, "toml: error: key is longer than the maximum of 100 bytes\n\nAt line 1, column 1:"},
+		{`a.` + long + `x.b = 1`, 100, 0, "At line 1, column 3:"},
+		{`"` + long + `x" = 1`, 100, 0, "At line 1, column 2:"},
+		{"\n[tbl." + long + "x]", 100, 0, "key is longer than the maximum of 100 bytes\n\nAt line 2, column 6:"},
+		{"[[" + long + "x]]", 100, 0, "At line 1, column 3:"},
+		{`a = "` + long + `"`, 0, 100, ""},
+		{`a = "` + long + `x"`, 0, 100, "value is longer than the maximum of 100 bytes\n\nAt line 1, column 6:"},
+		{`a = '` + long + `x'`, 0, 100, "value is longer"},
+		{"a = \"\"\"\n" + long + "\nx\"\"\"", 0, 100, "value is longer than the maximum of 100 bytes\n\nAt line 1, column 8:"},
+		{`a = "` + strings.Repeat(`\n`, 50) + `x"`, 0, 100, "value is longer"},
+		{`a = "` + strings.Repeat(`\n`, 50) + `"`, 0, 100, ""},
+		{`a = 1` + strings.Repeat("0", 100), 0, 100, "value is longer"},
+		{`a = [1, 2, "` + long + `x"]`, 0, 100, "At line 1, column 13:"},
+		{`a = {b = "` + long + `x"}`, 0, 100, "At line 1, column 11:"},
+		{`a = ["` + long[:50] + `", "` + long[:50] + `"]`, 0, 100, ""},
+		{long + `x = "` + long + `"`, 0, 100, ""}, // No key limit.
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var v any
+			_, err := NewDecoder(strings.NewReader(tt.in)).MaxKeyLength(tt.maxKey).MaxValueLength(tt.max).Decode(&v)
+			if err != nil {
+				var pErr ParseError
+				if errors.As(err, &pErr) {
+					err = errors.New(pErr.ErrorWithPosition())
+				}
+			}
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Should stop reading once the limit is reached.
+	for _, tt := range []struct {
+		prefix string
+		b      byte
+	}{{"", 'k'}, {`k = "`, 'v'}, {`k = "`, '\\'}} {
+		r := &countReader{b: tt.b}
+		var v any
+		_, err := NewDecoder(io.MultiReader(strings.NewReader(tt.prefix), r)).
+			MaxKeyLength(1 << 20).MaxValueLength(1 << 20).Decode(&v)
+		if !errorContains(err, "is longer than the maximum of 1048576 bytes") {
+			t.Fatal(err)
+		}
+		if r.n > 2<<20 {
+			t.Errorf("read %d bytes", r.n)
+		}
+	}
+}
+
+func TestDecodeWarnIntegerDates(t *testing.T) {
+	in := `
+when       = 20240101
+start_date = 20241301 # Not a valid date.
+port       = 20240101
+count      = 2024
+[tbl]
+BirthDay = 19700101
+`
+	for _, warn := range []bool{false, true} {
+		var v struct {
+			When      int64
+			StartDate any `toml:"start_date"`
+			Port      int
+			Count     any
+			Tbl       map[string]any
+		}
+		meta, err := NewDecoder(strings.NewReader(in)).WarnIntegerDates(warn).Decode(&v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var have []string
+		for _, w := range meta.Warnings() {
+			have = append(have, w.String())
+		}
+		var want []string
+		if warn {
+			want = []string{
+				`toml: line 2 (key "when"): integer 20240101 looks like a date; use 2024-01-01 (without quotes) for a TOML date`,
+				`toml: line 7 (key "tbl.BirthDay"): integer 19700101 looks like a date; use 1970-01-01 (without quotes) for a TOML date`,
+			}
+		}
+		sort.Strings(have)
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("\nhave: %q\nwant: %q", have, want)
+		}
+	}
+}
+
+func TestDecodeProfile(t *testing.T) {
+	type T struct{ Known int }
+	type S struct {
+		Name    string
+		Ratio   float64
+		Retries int
+		When    time.Time
+		Sub     T
+	}
+	tests := []struct {
+		in                   string
+		def, strict, lenient string // Error for each profile.
+	}{
+		{"name = 'a'\nratio = 1.5\nretries = 3\nwhen = 2024-01-02T03:04:05Z", "", "", ""},
+		{"name = 'a'\nunknown = 1", "", `"unknown" doesn't match any field in toml.S`, ""},
+		{"[sub]\nunknown = 1", "", `"sub.unknown" doesn't match any field in toml.T`, ""},
+		{"ratio = 2", "", "incompatible types: TOML value has type int64; destination has type float", ""},
+		{"when = 2024-01-02T03:04:05", "", `datetime "2024-01-02T03:04:05" has no timezone offset`, ""},
+		{"when = 03:04:05", "", `datetime "03:04:05" has no timezone offset`, ""},
+		{"retries = 3.0", "is a float; destination int is an integer type", "is a float; destination int is an integer type", ""},
+		{"name = 'a'\nNAME = 'b'", "", `"name" on line 1 and "NAME" on line 2 both set the field toml.S.Name`, ""},
+		{"name = '" + strings.Repeat("x", 1<<20+1) + "'", "", "value is longer than the maximum of 1048576 bytes", ""},
+	}
+	for _, tt := range tests {
+		for _, p := range []struct {
+			name    string
+			profile DecodeProfile
+			want    string
+		}{
+			{"default", DecodeProfileDefault, tt.def},
+			{"strict", DecodeProfileStrict, tt.strict},
+			{"lenient", DecodeProfileLenient, tt.lenient},
+		} {
+			name := tt.in
+			if len(name) > 40 {
+				name = name[:40]
+			}
+			t.Run(p.name+"/"+name, func(t *testing.T) {
+				var v S
+				_, err := NewDecoder(strings.NewReader(tt.in)).Profile(p.profile).Decode(&v)
+				if !errorContains(err, p.want) {
+					t.Errorf("wrong error\nhave: %v\nwant: %s", err, p.want)
+				}
+			})
+		}
+	}
+
+	t.Run("override", func(t *testing.T) {
+		var v S
+		_, err := NewDecoder(strings.NewReader("ratio = 2\nunknown = 1")).
+			Profile(DecodeProfileStrict).StrictTypes(false).DisallowUnknownFields(false).Decode(&v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Ratio != 2 {
+			t.Errorf("ratio: %v", v.Ratio)
+		}
+
+		// Profile overwrites options that were set before.
+		_, err = NewDecoder(strings.NewReader("ratio = 2")).StrictTypes(true).Profile(DecodeProfileDefault).Decode(&v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("case sensitive", func(t *testing.T) {
+		var v struct {
+			Name  string
+			Other string `toml:"other"`
+		}
+		meta, err := NewDecoder(strings.NewReader("name = 'a'\nOTHER = 'b'")).CaseSensitive(true).Decode(&v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Name != "" || v.Other != "" {
+			t.Errorf("%#v", v)
+		}
+		if u := fmt.Sprint(meta.Undecoded()); u != "[name OTHER]" {
+			t.Errorf("undecoded: %s", u)
+		}
+
+		_, err = NewDecoder(strings.NewReader("name = 'a'")).CaseSensitive(true).DisallowUnknownFields(true).Decode(&v)
+		if !errorContains(err, `"name" doesn't match any field`) {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+
+	t.Run("maps", func(t *testing.T) {
+		var v map[string]any
+		_, err := NewDecoder(strings.NewReader("a = 1\n[b]\nc = 2")).DisallowUnknownFields(true).Decode(&v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestUnmarshalWithProfile(t *testing.T) {
+	var s struct{ Known int }
+	if err := UnmarshalWithProfile([]byte("known = 1\nunknown = 2"), &s, DecodeProfileDefault); err != nil {
+		t.Fatal(err)
+	}
+	err := UnmarshalWithProfile([]byte("known = 1\nunknown = 2"), &s, DecodeProfileStrict)
+	if !errorContains(err, `"unknown" doesn't match any field`) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// \e is only in TOML 1.1.
+	var m map[string]any
+	for _, v := range []Version{"", Version10} {
+		err = UnmarshalWithProfile([]byte(`s = "\e"`), &m, DecodeProfile{Version: v})
+		if !errorContains(err, "invalid escape") {
+			t.Errorf("%q: wrong error: %v", v, err)
+		}
+	}
+	if err := UnmarshalWithProfile([]byte(`s = "\e"`), &m, DecodeProfile{Version: Version11}); err != nil {
+		t.Fatal(err)
+	}
+	if m["s"] != "\x1b" {
+		t.Errorf("wrong value: %q", m["s"])
+	}
+	_, err = NewDecoder(strings.NewReader("")).Version("1.2.0").Decode(&m)
+	if !errorContains(err, `unsupported TOML version "1.2.0"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestDecodeArrayLengthMismatch(t *testing.T) {
+	one, two := 1, 2
+	tests := []struct {
+		in      string
+		policy  LengthMismatch
+		v, want any // v is a pointer to the destination, want the value.
+		wantErr string
+	}{
+		{"a = [1, 2]", LengthError, new([2]int), [2]int{1, 2}, ""},
+		{"a = [1, 2]", LengthError, new([3]int), nil, "toml: line 1 (last key \"a\"): expected array length 3; got TOML array of length 2"},
+		{"a = [1, 2, 3]", LengthError, new([2]int), nil, "expected array length 2; got TOML array of length 3"},
+
+		{"a = [1]", LengthZeroFill, &[3]int{7, 7, 7}, [3]int{1, 0, 0}, ""},
+		{"a = [1, 2, 3]", LengthZeroFill, new([2]int), nil, "expected array length 2; got TOML array of length 3"},
+		{"a = [1]", LengthZeroFill, new([2]*int), [2]*int{&one, new(int)}, ""},
+
+		{"a = [1, 2, 3]", LengthTruncate, new([2]int), [2]int{1, 2}, ""},
+		{"a = [1]", LengthTruncate, new([2]int), nil, "expected array length 2; got TOML array of length 1"},
+		{"a = [1, 2, 3]", LengthTruncate, new([2]*int), [2]*int{&one, &two}, ""},
+
+		{"a = [1]", LengthZeroFill | LengthTruncate, new([2]int), [2]int{1, 0}, ""},
+		{"a = [1, 2, 3]", LengthZeroFill | LengthTruncate, new([2]int), [2]int{1, 2}, ""},
+
+		// Nested.
+		{"a = [[1, 2, 3], [4]]", LengthError, new([2][3]int), nil, "expected array length 3; got TOML array of length 1"},
+		{"a = [[1, 2, 3], [4]]", LengthZeroFill, new([2][3]int), [2][3]int{{1, 2, 3}, {4, 0, 0}}, ""},
+		{"a = [[1, 2]]", LengthZeroFill, new([2][2]*int), [2][2]*int{{&one, &two}, {new(int), new(int)}}, ""},
+		{"a = [[1, 2, 3], [4], [5]]", LengthTruncate, new([2][2]int), nil, "expected array length 2; got TOML array of length 1"},
+		{"a = [[1, 2, 3], [4, 5], [6]]", LengthTruncate, new([2][2]int), [2][2]int{{1, 2}, {4, 5}}, ""},
+
+		// Arrays of pointers are set to nil if the TOML array is shorter.
+		{"a = [2]", LengthError, &[3]*int{&one, &one, &one}, [3]*int{&two, nil, nil}, ""},
+		{"a = []", LengthError, new([2]*int), [2]*int{}, ""},
+		{"a = [1, 2, 3]", LengthError, new([2]*int), nil, "expected array length 2; got TOML array of length 3"},
+		{"[[a]]\nn = 1\n[[a]]\nn = 2", LengthError, new([3]*struct{ N int }), [3]*struct{ N int }{{N: 1}, {N: 2}}, ""},
+		{"[[a]]\n[[a]]\n[[a]]", LengthError, new([2]*struct{ N int }), nil, "expected array length 2; got TOML array of length 3"},
+		{"[[a]]\n[[a]]\n[[a]]", LengthTruncate, new([2]*struct{ N int }), [2]*struct{ N int }{{}, {}}, ""},
+
+		// Pointers to arrays are the same as arrays.
+		{"a = [1, 2]", LengthError, new(*[2]int), &[2]int{1, 2}, ""},
+		{"a = [1]", LengthError, new(*[2]int), nil, "expected array length 2; got TOML array of length 1"},
+		{"a = [1]", LengthZeroFill, new(*[2]int), &[2]int{1, 0}, ""},
+		{"a = [1, 2, 3]", LengthError, new(*[2]int), nil, "expected array length 2; got TOML array of length 3"},
+		{"a = [1, 2, 3]", LengthTruncate, new(*[2]int), &[2]int{1, 2}, ""},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			v := reflect.New(reflect.StructOf([]reflect.StructField{{
+				Name: "A", Type: reflect.TypeOf(tt.v).Elem(), Tag: `toml:"a"`}}))
+			v.Elem().Field(0).Set(reflect.ValueOf(tt.v).Elem())
+
+			_, err := NewDecoder(strings.NewReader(tt.in)).ArrayLengthMismatch(tt.policy).Decode(v.Interface())
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if tt.wantErr != "" {
+				var pErr ParseError
+				if !errors.As(err, &pErr) || pErr.Position.Line < 1 {
+					t.Errorf("not a ParseError with position: %#v", err)
+				}
+				return
+			}
+			if have := v.Elem().Field(0).Interface(); !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("\nhave: %v\nwant: %v", have, tt.want)
+			}
+		})
+	}
+}
+
+type contactKind string
+
+func (c *contactKind) UnmarshalText(text []byte) error {
+	if string(text) != "ok" {
+		return fmt.Errorf("unknown contact kind %q", text)
+	}
+	*c = contactKind(text)
+	return nil
+}
+
+func TestDecodeArrayElementError(t *testing.T) {
+	tests := []struct {
+		in      string
+		v       any
+		wantErr string
+	}{
+		{`contacts = ["ok", "ok", "bogus"]`, &struct{ Contacts []contactKind }{}, `
+toml: error: error at index 2 of "contacts": unknown contact kind "bogus"
+
+At line 1, column 26-30:
+
+      1 | contacts = ["ok", "ok", "bogus"]
+                                   ^^^^^
+`[1:]},
+		{"contacts = [\n  \"ok\",\n  \"bogus\", # Comment\n]", &struct{ Contacts [2]contactKind }{}, `
+toml: error: error at index 1 of "contacts": unknown contact kind "bogus"
+
+At line 3, column 4-8:
+
+      1 | contacts = [
+      2 |   "ok",
+      3 |   "bogus", # Comment
+             ^^^^^
+`[1:]},
+		{`contacts = [["ok"], ["ok", "bogus"]]`, &struct{ Contacts [][]contactKind }{}, `
+toml: error: error at index 1 of "contacts[1]": unknown contact kind "bogus"
+
+At line 1, column 29-33:
+
+      1 | contacts = [["ok"], ["ok", "bogus"]]
+                                      ^^^^^
+`[1:]},
+		{`tbl = [{contacts = ["ok"]}, {contacts = ["bogus"]}]`, &struct {
+			Tbl []struct{ Contacts []contactKind }
+		}{}, `
+toml: error: error at index 0 of "tbl[1].contacts": unknown contact kind "bogus"
+
+At line 1, column 43-47:
+
+      1 | tbl = [{contacts = ["ok"]}, {contacts = ["bogus"]}]
+                                                    ^^^^^
+`[1:]},
+		{"\ufeff[[tbl]]\ncontacts = ['ok']\n[[tbl]]\ncontacts = ['ok', 'bogus']", &struct {
+			Tbl []struct{ Contacts []contactKind }
+		}{}, `
+toml: error: error at index 1 of "tbl.contacts": unknown contact kind "bogus"
+
+At line 4, column 20-24:
+
+      2 | contacts = ['ok']
+      3 | [[tbl]]
+      4 | contacts = ['ok', 'bogus']
+                             ^^^^^
+`[1:]},
+		{`ints = [1, 2, 300]`, &struct{ Ints []int8 }{}, `
+toml: error: error at index 2 of "ints": 300 is out of range for int8
+
+At line 1, column 15-17:
+
+      1 | ints = [1, 2, 300]
+                        ^^^
+`[1:]},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			_, err := Decode(tt.in, tt.v)
+			var pErr ParseError
+			if !errors.As(err, &pErr) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if have := pErr.ErrorWithPosition(); have != tt.wantErr {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", have, tt.wantErr)
+			}
+		})
 	}
 }
 
@@ -350,6 +2583,7 @@ func TestDecodeFloatOverflow(t *testing.T) {
 
 		{fmt.Sprintf(`F32 = %f`, math.MaxFloat32), false},
 		{fmt.Sprintf(`F32 = %f`, -math.MaxFloat32), false},
+		{`F32 = 3.4028235e+38`, false}, // Rounds to MaxFloat32.
 		{fmt.Sprintf(`F32 = %d`, maxSafeFloat32Int), false},
 		{fmt.Sprintf(`F32 = %d`, -maxSafeFloat32Int), false},
 		{fmt.Sprintf(`F64 = %f`, math.MaxFloat64), false},
@@ -481,6 +2715,48 @@ func TestDecodeSizedInts(t *testing.T) {
 	}
 }
 
+func TestDecodeUint64(t *testing.T) {
+	tests := []struct {
+		in                  any
+		toml, want, wantErr string
+	}{
+		{&struct{ U uint64 }{}, `U = 18446744073709551615`, "&{18446744073709551615}", ""},
+		{&struct{ U uint64 }{}, `U = +18_446_744_073_709_551_615`, "&{18446744073709551615}", ""},
+		{&struct{ U uint64 }{}, `U = 9223372036854775808`, "&{9223372036854775808}", ""},
+		{&struct{ U any }{}, `U = 18446744073709551615`, "&{18446744073709551615}", ""},
+		{&struct{ U json.Number }{}, `U = 18446744073709551615`, "&{18446744073709551615}", ""},
+
+		{&struct{ U int64 }{}, `U = 18446744073709551615`, "&{0}", "18446744073709551615 is out of range for int64"},
+		{&struct{ U uint32 }{}, `U = 18446744073709551615`, "&{0}", "18446744073709551615 is out of range for uint32"},
+		{&struct{ U float64 }{}, `U = 18446744073709551615`, "&{0}", "18446744073709551615 is out of the safe float64 range"},
+		{&struct{ U uint64 }{}, `U = 18446744073709551616`, "&{0}", "18446744073709551616 is out of range for uint64"},
+		{&struct{ U int64 }{}, `U = -9223372036854775809`, "&{0}", "-9223372036854775809 is out of range for int64"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			_, err := Decode(tt.toml, tt.in)
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+
+			have := fmt.Sprintf("%v", tt.in)
+			if have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+
+	var m map[string]any
+	_, err := Decode(`U = 18446744073709551615`, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := m["U"].(uint64); !ok || u != math.MaxUint64 {
+		t.Errorf("wrong value: %T %[1]v", m["U"])
+	}
+}
+
 type NopUnmarshalTOML int
 
 func (n *NopUnmarshalTOML) UnmarshalTOML(p any) error {
@@ -517,7 +2793,7 @@ func TestDecodeTypes(t *testing.T) {
 		{new(struct{ F int }), "", `toml: line 1 (last key "F"): incompatible types: TOML value has type bool; destination has type integer`},
 		{new(map[string]int), "", `toml: line 1 (last key "F"): incompatible types: TOML value has type bool; destination has type integer`},
 		{new(int), "", `toml: cannot decode to type int`},
-		{new([]int), "", "toml: cannot decode to type []int"},
+		{new([]int), "", `toml: cannot decode to type []int: "F" has type Bool rather than being an array of tables`},
 	} {
 		t.Run(fmt.Sprintf("%T", tt.v), func(t *testing.T) {
 			_, err := Decode(`F = true`, tt.v)
@@ -656,6 +2932,203 @@ type ingredient struct {
 	Name string
 }
 
+// jsonRange only implements the encoding/json interfaces, and makes sure that
+// lo <= hi.
+type jsonRange struct{ lo, hi int }
+
+func (r jsonRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int{"lo": r.lo, "hi": r.hi})
+}
+
+func (r *jsonRange) UnmarshalJSON(b []byte) error {
+	var m struct{ Lo, Hi *int }
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	if m.Lo == nil || m.Hi == nil {
+		return errors.New("range needs lo and hi")
+	}
+	if *m.Lo > *m.Hi {
+		return fmt.Errorf("invalid range: %d > %d", *m.Lo, *m.Hi)
+	}
+	r.lo, r.hi = *m.Lo, *m.Hi
+	return nil
+}
+
+func TestDecodeJSONInterfaces(t *testing.T) {
+	type S struct {
+		R     jsonRange
+		Ptr   *jsonRange
+		Map   map[string]jsonRange
+		Slice []jsonRange
+	}
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{`
+R     = {lo = 1, hi = 2}
+Ptr   = {lo = 3, hi = 3}
+Map   = {a = {lo = 4, hi = 5}}
+Slice = [{lo = 6, hi = 7}]
+`, "R:{lo:1 hi:2} Ptr:{lo:3 hi:3} Map:map[a:{lo:4 hi:5}] Slice:[{lo:6 hi:7}]", ""},
+		{`R = {lo = 2, hi = 1}`, "", `toml: line 1 (last key "R"): invalid range: 2 > 1`},
+		{`Map.a = {lo = 2}`, "", `range needs lo and hi`},
+		{`Slice = [{lo = 1, hi = 2}, {lo = 9, hi = 0}]`, "", `invalid range: 9 > 0`},
+		{`R = "1-2"`, "", `json: cannot unmarshal string`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var s S
+			_, err := NewDecoder(strings.NewReader(tt.in)).UseJSONInterfaces(true).Decode(&s)
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			have := fmt.Sprintf("R:%+v Ptr:%+v Map:%+v Slice:%+v", s.R, *s.Ptr, s.Map, s.Slice)
+			if have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+
+	// Off by default.
+	var s S
+	_, err := Decode(`R = {lo = 1, hi = 2}`, &s)
+	if !errorContains(err, "has no exported fields and no unmarshaler") {
+		t.Fatal(err)
+	}
+}
+
+// presence records the keys and values given to UnmarshalTOML.
+type presence struct{ m map[string]any }
+
+func (p *presence) UnmarshalTOML(v any) error {
+	p.m, _ = v.(map[string]any)
+	return nil
+}
+
+func TestDecodeUnmarshalerPresence(t *testing.T) {
+	var s struct{ P presence }
+	_, err := Decode(`
+[p]
+retries = 0
+name    = ""
+tbl     = {}
+arr     = []
+[p.sub]
+[p.nested]
+n = 0
+`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := s.P.m
+
+	if _, ok := m["absent"]; ok {
+		t.Error("absent key is in map")
+	}
+	if v, ok := m["retries"]; !ok || v != int64(0) {
+		t.Errorf("retries: %#v, %t", v, ok)
+	}
+	if v, ok := m["name"]; !ok || v != "" {
+		t.Errorf("name: %#v, %t", v, ok)
+	}
+	for _, k := range []string{"tbl", "sub"} {
+		if v, ok := m[k].(map[string]any); !ok || v == nil || len(v) != 0 {
+			t.Errorf("%s: %#v, %t", k, m[k], ok)
+		}
+	}
+	if v, ok := m["arr"].([]any); !ok || v == nil || len(v) != 0 {
+		t.Errorf("arr: %#v, %t", m["arr"], ok)
+	}
+	nested, _ := m["nested"].(map[string]any)
+	if _, ok := nested["absent"]; ok {
+		t.Error("absent key is in nested map")
+	}
+	if v, ok := nested["n"]; !ok || v != int64(0) {
+		t.Errorf("nested.n: %#v, %t", v, ok)
+	}
+	if len(m) != 6 || len(nested) != 1 {
+		t.Errorf("wrong keys: %v", m)
+	}
+}
+
+// price records the key given to UnmarshalTOMLWithKey.
+type price struct {
+	n   int64
+	key Key
+}
+
+func (p *price) UnmarshalTOMLWithKey(key Key, v any) error {
+	n, ok := v.(int64)
+	p.n, p.key = n, key
+	if !ok {
+		return fmt.Errorf("%q is not an integer", key)
+	}
+	if p.n < 0 {
+		return fmt.Errorf("%s must be positive", key)
+	}
+	return nil
+}
+
+// UnmarshalTOML is never called, as UnmarshalTOMLWithKey is preferred.
+func (p *price) UnmarshalTOML(any) error { return errors.New("UnmarshalTOML called") }
+
+func TestDecodeKeyUnmarshaler(t *testing.T) {
+	var s struct {
+		Menu struct {
+			Dishes []struct {
+				Name  string
+				Price price
+				Extra map[string]*price
+			}
+		}
+		Top price
+	}
+	_, err := Decode(`
+top = 1
+
+[[menu.dishes]]
+name = "pasta"
+price = 2
+
+[[menu.dishes]]
+name = "eggsalad"
+price = 3
+extra = {bread = 4}
+`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have := []string{s.Top.key.String()}
+	for _, d := range s.Menu.Dishes {
+		have = append(have, d.Price.key.String())
+		for _, e := range d.Extra {
+			have = append(have, e.key.String())
+		}
+	}
+	want := []string{"top", "menu.dishes.price", "menu.dishes.price", "menu.dishes.extra.bread"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+
+	_, err = Decode("[[menu.dishes]]\n[[menu.dishes]]\nprice = -1\n", &s)
+	if !errorContains(err, `toml: line 3 (last key "menu.dishes.price"): menu.dishes.price must be positive`) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	var p price
+	_, err = Decode("", &p)
+	if !errorContains(err, `"" is not an integer`) || len(p.key) != 0 {
+		t.Errorf("wrong error: %v; key: %q", err, p.key)
+	}
+}
+
 func TestDecodePrimitive(t *testing.T) {
 	type S struct {
 		P Primitive
@@ -715,6 +3188,62 @@ func TestDecodePrimitive(t *testing.T) {
 	}
 }
 
+func TestDecodePrimitiveStrict(t *testing.T) {
+	in := `
+		name = "x"
+		[server]
+		host = "localhost"
+		port = 80
+	`
+	keys := func(md MetaData) string { return fmt.Sprint(md.Undecoded()) }
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprint(strict), func(t *testing.T) {
+			// Keys in the Primitive aren't checked yet.
+			var s struct {
+				Name   string
+				Server Primitive
+			}
+			md, err := NewDecoder(strings.NewReader(in)).DisallowUnknownFields(strict).Decode(&s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, want := keys(md), "[server.host server.port]"; have != want {
+				t.Errorf("after Decode\nhave: %s\nwant: %s", have, want)
+			}
+
+			// Decoding in to a struct without all keys is an error only in
+			// strict mode, and the other keys are still decoded.
+			var partial struct{ Host string }
+			err = md.PrimitiveDecode(s.Server, &partial)
+			if strict {
+				if !errorContains(err, `"server.port" doesn't match any field`) {
+					t.Errorf("wrong error: %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if partial.Host != "localhost" {
+				t.Errorf("Host not decoded: %q", partial.Host)
+			}
+			if have, want := keys(md), "[server.port]"; have != want {
+				t.Errorf("after partial PrimitiveDecode\nhave: %s\nwant: %s", have, want)
+			}
+
+			var full struct {
+				Host string
+				Port int
+			}
+			if err := md.PrimitiveDecode(s.Server, &full); err != nil {
+				t.Fatal(err)
+			}
+			if have, want := keys(md), "[]"; have != want {
+				t.Errorf("after full PrimitiveDecode\nhave: %s\nwant: %s", have, want)
+			}
+		})
+	}
+}
+
 func TestDecodeDatetime(t *testing.T) {
 	// Test here in addition to toml-test to ensure the TZs are correct.
 	tz7 := time.FixedZone("", -3600*7)
@@ -736,12 +3265,12 @@ func TestDecodeDatetime(t *testing.T) {
 		{"1979-05-27T07:32:12-07:00  # c", time.Date(1979, 05, 27, 07, 32, 12, 0, tz7)},
 
 		// Local times.
-		{"1979-05-27T07:32:00", time.Date(1979, 05, 27, 07, 32, 0, 0, internal.LocalDatetime)},
-		{"1979-05-27T07:32:00.999999", time.Date(1979, 05, 27, 07, 32, 0, 999999000, internal.LocalDatetime)},
-		{"1979-05-27T07:32:00.25", time.Date(1979, 05, 27, 07, 32, 0, 250000000, internal.LocalDatetime)},
-		{"1979-05-27", time.Date(1979, 05, 27, 0, 0, 0, 0, internal.LocalDate)},
-		{"07:32:00", time.Date(0, 1, 1, 07, 32, 0, 0, internal.LocalTime)},
-		{"07:32:00.999999", time.Date(0, 1, 1, 07, 32, 0, 999999000, internal.LocalTime)},
+		{"1979-05-27T07:32:00", time.Date(1979, 05, 27, 07, 32, 0, 0, LocalDatetimeZone)},
+		{"1979-05-27T07:32:00.999999", time.Date(1979, 05, 27, 07, 32, 0, 999999000, LocalDatetimeZone)},
+		{"1979-05-27T07:32:00.25", time.Date(1979, 05, 27, 07, 32, 0, 250000000, LocalDatetimeZone)},
+		{"1979-05-27", time.Date(1979, 05, 27, 0, 0, 0, 0, LocalDateZone)},
+		{"07:32:00", time.Date(0, 1, 1, 07, 32, 0, 0, LocalTimeZone)},
+		{"07:32:00.999999", time.Date(0, 1, 1, 07, 32, 0, 999999000, LocalTimeZone)},
 	} {
 		t.Run(tt.in, func(t *testing.T) {
 			var x struct{ D time.Time }
@@ -753,6 +3282,11 @@ func TestDecodeDatetime(t *testing.T) {
 			if h, w := x.D.Format(time.RFC3339Nano), tt.want.Format(time.RFC3339Nano); h != w {
 				t.Errorf("\nhave: %s\nwant: %s", h, w)
 			}
+			have := []bool{IsLocalDatetime(x.D), IsLocalDate(x.D), IsLocalTime(x.D)}
+			want := []bool{IsLocalDatetime(tt.want), IsLocalDate(tt.want), IsLocalTime(tt.want)}
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("IsLocalDatetime, IsLocalDate, IsLocalTime\nhave: %v\nwant: %v", have, want)
+			}
 		})
 	}
 }
@@ -821,6 +3355,12 @@ func TestDecodeDuration(t *testing.T) {
 			"&{0s}", ""},
 		{&struct{ T time.Duration }{}, `t = 12345678`,
 			"&{12.345678ms}", ""},
+		{&struct{ T time.Duration }{}, `t = 1.5`,
+			"&{1.5s}", ""},
+		{&struct{ T time.Duration }{}, `t = -0.000000002`,
+			"&{-2ns}", ""},
+		{&struct{ T time.Duration }{}, `t = 90.0`,
+			"&{1m30s}", ""},
 
 		{&struct{ T *time.Duration }{}, `T = "5s"`,
 			"&{5s}", ""},
@@ -839,7 +3379,8 @@ func TestDecodeDuration(t *testing.T) {
 
 		{&struct{ T time.Duration }{}, `t = "99 bottles of beer"`, "&{0s}", `invalid duration: "99 bottles of beer"`},
 		{&struct{ T time.Duration }{}, `t = "one bottle of beer"`, "&{0s}", `invalid duration: "one bottle of beer"`},
-		{&struct{ T time.Duration }{}, `t = 1.2`, "&{0s}", "incompatible types:"},
+		{&struct{ T time.Duration }{}, `t = 1e12`, "&{0s}", "1e+12 is out of range for time.Duration"},
+		{&struct{ T time.Duration }{}, `t = nan`, "&{0s}", "NaN is out of range for time.Duration"},
 		{&struct{ T time.Duration }{}, `t = {}`, "&{0s}", "incompatible types:"},
 		{&struct{ T time.Duration }{}, `t = []`, "&{0s}", "incompatible types:"},
 	}
@@ -1004,89 +3545,487 @@ func TestCustomEncode(t *testing.T) {
 		t.Errorf("Encode failed: %s", err)
 	}
 
-	have := strings.TrimSpace(buf.String())
-	want := strings.ReplaceAll(strings.TrimSpace(`
-		Int = 10
-		Enum = "OTHER_VALUE"
-		Slice = ["text1", "text2"]
-	`), "\t", "")
-	if want != have {
-		t.Errorf("\nhave: %s\nwant: %s\n", have, want)
+	have := strings.TrimSpace(buf.String())
+	want := strings.ReplaceAll(strings.TrimSpace(`
+		Int = 10
+		Enum = "OTHER_VALUE"
+		Slice = ["text1", "text2"]
+	`), "\t", "")
+	if want != have {
+		t.Errorf("\nhave: %s\nwant: %s\n", have, want)
+	}
+}
+
+// Test for #341
+func TestCustomDecode(t *testing.T) {
+	var outer Outer
+	_, err := Decode(`
+		Int = 10
+		Enum = "OTHER_VALUE"
+		Slice = ["text1", "text2"]
+	`, &outer)
+	if err != nil {
+		t.Fatalf("Decode failed: %s", err)
+	}
+
+	if outer.Int.value != 10 {
+		t.Errorf("\nhave:\n%v\nwant:\n%v\n", outer.Int.value, 10)
+	}
+	if *outer.Enum != OtherValue {
+		t.Errorf("\nhave:\n%v\nwant:\n%v\n", outer.Enum, OtherValue)
+	}
+	if fmt.Sprint(outer.Slice.value) != fmt.Sprint([]string{"text1", "text2"}) {
+		t.Errorf("\nhave:\n%v\nwant:\n%v\n", outer.Slice.value, []string{"text1", "text2"})
+	}
+}
+
+// TODO: this should be improved for v2:
+// https://github.com/BurntSushi/toml/issues/384
+func TestDecodeDoubleTags(t *testing.T) {
+	var s struct {
+		A int `toml:"a"`
+		B int `toml:"a"`
+		C int `toml:"c"`
+	}
+	_, err := Decode(`
+		a = 1
+		b = 2
+		c = 3
+	`, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{0 0 3}`
+	have := fmt.Sprintf("%v", s)
+	if want != have {
+		t.Errorf("\nhave: %s\nwant: %s\n", have, want)
+	}
+}
+
+func TestMetaKeys(t *testing.T) {
+	tests := []struct {
+		in         string
+		want, skip []Key // skip is with SkipKeyOrder, if different.
+	}{
+		{"", []Key{}, nil},
+		{"b=1\na=1", []Key{Key{"b"}, Key{"a"}}, nil},
+		{"a.b=1\na.a=1", []Key{Key{"a", "b"}, Key{"a", "a"}}, nil}, // TODO: should include "a"
+		{"[tbl]\na=1", []Key{Key{"tbl"}, Key{"tbl", "a"}}, nil},
+		{"[tbl]\na.a=1", []Key{Key{"tbl"}, Key{"tbl", "a", "a"}}, nil}, // TODO: should include "a.a"
+		{"tbl={a=1}", []Key{Key{"tbl"}, Key{"tbl", "a"}}, nil},
+		{"tbl={a={b=1}}", []Key{Key{"tbl"}, Key{"tbl", "a"}, Key{"tbl", "a", "b"}}, nil},
+		{"[[arr]]\na=1\n[[arr]]\na=2\nb=3",
+			[]Key{Key{"arr"}, Key{"arr", "a"}, Key{"arr"}, Key{"arr", "a"}, Key{"arr", "b"}},
+			[]Key{Key{"arr"}, Key{"arr", "a"}, Key{"arr", "b"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			for _, skip := range []bool{false, true} {
+				var x any
+				meta, err := NewDecoder(strings.NewReader(tt.in)).SkipKeyOrder(skip).Decode(&x)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				want := tt.want
+				if skip && tt.skip != nil {
+					want = tt.skip
+				}
+				have := meta.Keys()
+				if !reflect.DeepEqual(want, have) {
+					t.Errorf("skip=%t\nhave: %s\nwant: %s\n", skip, have, want)
+				}
+				// Nothing is marked as decoded for any.
+				if u := meta.Undecoded(); !reflect.DeepEqual(want, u) {
+					t.Errorf("skip=%t\nundecoded: %s\nwant:      %s\n", skip, u, want)
+				}
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		key          Key
+		parent, last string
+		depth        int
+	}{
+		{Key{}, ``, ``, 0},
+		{nil, ``, ``, 0},
+		{Key{"a"}, ``, `a`, 1},
+		{Key{""}, ``, ``, 1},
+		{Key{"a", "b"}, `a`, `b`, 2},
+		{Key{"a.b", "c"}, `"a.b"`, `c`, 2},
+		{Key{"a", "b.c"}, `a`, `b.c`, 2},
+		{Key{"", "", ""}, `"".""`, ``, 3},
+		{Key{`"`, "x y"}, `"\""`, `x y`, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key.String(), func(t *testing.T) {
+			if have := tt.key.Parent().String(); have != tt.parent {
+				t.Errorf("Parent: %q", have)
+			}
+			if have := tt.key.Last(); have != tt.last {
+				t.Errorf("Last: %q", have)
+			}
+			if have := tt.key.Depth(); have != tt.depth {
+				t.Errorf("Depth: %d", have)
+			}
+			if !tt.key.Equal(tt.key) || !tt.key.HasPrefix(tt.key) || !tt.key.HasPrefix(tt.key.Parent()) {
+				t.Error("not equal to itself")
+			}
+		})
+	}
+
+	prefix := []struct {
+		key, prefix Key
+		want        bool
+	}{
+		{Key{"servers"}, Key{"server"}, false},
+		{Key{"server", "port"}, Key{"server"}, true},
+		{Key{"server"}, Key{"server", "port"}, false},
+		{Key{"a.b", "c"}, Key{"a"}, false},
+		{Key{"a", "b", "c"}, Key{"a", "b"}, true},
+		{Key{"a", "b"}, Key{"a.b"}, false},
+		{Key{"", "a"}, Key{""}, true},
+		{Key{"a"}, Key{""}, false},
+		{Key{"a"}, Key{}, true},
+		{Key{}, Key{}, true},
+	}
+	for _, tt := range prefix {
+		if have := tt.key.HasPrefix(tt.prefix); have != tt.want {
+			t.Errorf("%q.HasPrefix(%q): %t", tt.key, tt.prefix, have)
+		}
+	}
+
+	// Keys that differ must never compare as equal.
+	distinct := []Key{{}, {""}, {"", ""}, {"a"}, {"a", "b"}, {"a.b"}, {`a"`, "b"}, {`a".b`}, {"a", ""}, {"a."}}
+	seen := make(map[string]Key)
+	for _, k := range distinct {
+		if prev, ok := seen[k.Comparable()]; ok {
+			t.Errorf("%q and %q have the same Comparable() %q", prev, k, k.Comparable())
+		}
+		seen[k.Comparable()] = k
+		for _, k2 := range distinct {
+			if k.Equal(k2) != (len(k) == len(k2) && k.Comparable() == k2.Comparable()) {
+				t.Errorf("%q.Equal(%q): %t", k, k2, k.Equal(k2))
+			}
+		}
+	}
+
+	if n := testing.AllocsPerRun(10, func() {
+		k := Key{"a", "b", "c"}
+		_, _, _ = k.Parent(), k.Last(), k.Depth()
+		_, _ = k.Equal(k), k.HasPrefix(Key{"a"})
+	}); n != 0 {
+		t.Errorf("%f allocations", n)
+	}
+}
+
+func TestDiffMetaData(t *testing.T) {
+	tests := []struct {
+		old, new string
+		want     []string
+	}{
+		{`a = 1`, `a = 1`, nil},
+		// Formatting and comments.
+		{"a = 255\nb = 'x'\nc = 1.0\nd = nan", "a = 0xff # c\nb = \"x\"\nc = 1e0\nd = -nan", nil},
+		{"t = 2024-01-01T00:00:00Z", "t = 2024-01-01T01:00:00+01:00", nil},
+		{"a = [1, 2]", "a = [\n\t1,\n\t2,\n]", nil},
+
+		{`a = 1`, "a = 1\nb = 2", []string{"b: added 2"}},
+		{"a = 1\nb = 2", `a = 1`, []string{"b: removed 2"}},
+		{`a = 1`, `a = 2`, []string{"a: value changed 1 → 2"}},
+		{`a = 1`, `a = "1"`, []string{"a: type changed 1 → 1"}},
+		{`a = 1.0`, `a = 1`, []string{"a: type changed 1 → 1"}},
+
+		// Tables.
+		{"[tbl]\na = 1\nb = 2", "[tbl]\na = 1\nb = 3\nc = 4", []string{
+			"tbl.b: value changed 2 → 3",
+			"tbl.c: added 4",
+		}},
+		{"[tbl]\na = 1", "tbl = {a = 1}", nil},
+		{"[tbl]\na = 1", "x = 1", []string{
+			"x: added 1",
+			"tbl: removed map[a:1]",
+			"tbl.a: removed 1",
+		}},
+		{"tbl = 1", "[tbl]\na = 1", []string{
+			"tbl: type changed 1 → map[a:1]",
+			"tbl.a: added 1",
+		}},
+		{"[a.b.c]\nx = 1", "[a.b.c]\nx = 2", []string{"a.b.c.x: value changed 1 → 2"}},
+
+		// Arrays are compared as a whole.
+		{"a = [1, 2]", "a = [1, 3]", []string{"a: value changed [1 2] → [1 3]"}},
+		{"a = [{x = 1}]", "a = [{x = 2}]", []string{"a: value changed [map[x:1]] → [map[x:2]]"}},
+		{"[[a]]\nx = 1\n[[a]]\nx = 2", "[[a]]\nx = 1\n[[a]]\nx = 2", nil},
+		{"[[a]]\nx = 1\n[[a]]\nx = 2", "[[a]]\nx = 1\n[[a]]\nx = 3", []string{
+			"a: value changed [map[x:1] map[x:2]] → [map[x:1] map[x:3]]",
+		}},
+		{"[[a]]\nx = 1", "[[a]]\nx = 1\ny = 2", []string{
+			"a: value changed [map[x:1]] → [map[x:1 y:2]]",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var o, n any
+			oldMeta, err := Decode(tt.old, &o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newMeta, err := Decode(tt.new, &n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var have []string
+			for _, c := range DiffMetaData(oldMeta, newMeta) {
+				have = append(have, c.String())
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("\nold:  %q\nnew:  %q\nhave: %q\nwant: %q", tt.old, tt.new, have, tt.want)
+			}
+		})
+	}
+
+	// Local datetimes are never the same as datetimes with an offset.
+	var v any
+	oldMeta, _ := Decode("t = 2024-01-01T00:00:00", &v)
+	newMeta, _ := Decode("t = "+time.Date(2024, 1, 1, 0, 0, 0, 0, internal.LocalDatetime).Format(time.RFC3339), &v)
+	if c := DiffMetaData(oldMeta, newMeta); len(c) != 1 || c[0].Kind != ValueChanged {
+		t.Errorf("%v", c)
 	}
 }
 
-// Test for #341
-func TestCustomDecode(t *testing.T) {
-	var outer Outer
-	_, err := Decode(`
-		Int = 10
-		Enum = "OTHER_VALUE"
-		Slice = ["text1", "text2"]
-	`, &outer)
+func TestMetaAny(t *testing.T) {
+	const in = `
+i = 1
+u = 18446744073709551615
+f = 1.5
+s = "str"
+b = true
+d = 2020-01-02
+arr = [1, "x"]
+inline = [{a = 1}]
+p = 42
+
+[tbl]
+a = 1
+b.c = 2
+
+[[aot]]
+a = 1
+[[aot]]
+a = 2
+`
+	var s struct {
+		I int
+		P Primitive
+	}
+	meta, err := Decode(in, &s)
 	if err != nil {
-		t.Fatalf("Decode failed: %s", err)
+		t.Fatal(err)
 	}
 
-	if outer.Int.value != 10 {
-		t.Errorf("\nhave:\n%v\nwant:\n%v\n", outer.Int.value, 10)
+	tests := []struct {
+		key     []string
+		want    any
+		wantOK  bool
+		wantLen int
+	}{
+		{[]string{"i"}, int64(1), true, -1},
+		{[]string{"u"}, uint64(math.MaxUint64), true, -1},
+		{[]string{"f"}, 1.5, true, -1},
+		{[]string{"s"}, "str", true, -1},
+		{[]string{"b"}, true, true, -1},
+		{[]string{"d"}, time.Date(2020, 1, 2, 0, 0, 0, 0, internal.LocalDate), true, -1},
+		{[]string{"arr"}, []any{int64(1), "x"}, true, 2},
+		{[]string{"inline"}, []any{map[string]any{"a": int64(1)}}, true, 1},
+		{[]string{"p"}, int64(42), true, -1}, // Not a Primitive.
+		{[]string{"tbl"}, map[string]any{"a": int64(1), "b": map[string]any{"c": int64(2)}}, true, 2},
+		{[]string{"tbl", "b", "c"}, int64(2), true, -1},
+		{[]string{"aot"}, []map[string]any{{"a": int64(1)}, {"a": int64(2)}}, true, 2},
+
+		{[]string{"nope"}, nil, false, -1},
+		{[]string{"tbl", "nope"}, nil, false, -1},
+		{[]string{"i", "nope"}, nil, false, -1},
+		{[]string{"aot", "a"}, nil, false, -1}, // Arrays can't be indexed.
 	}
-	if *outer.Enum != OtherValue {
-		t.Errorf("\nhave:\n%v\nwant:\n%v\n", outer.Enum, OtherValue)
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.key, "."), func(t *testing.T) {
+			have, ok := meta.Any(tt.key...)
+			if ok != tt.wantOK {
+				t.Errorf("ok: %t; want %t", ok, tt.wantOK)
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("\nhave: %#v\nwant: %#v", have, tt.want)
+			}
+			if l := meta.Len(tt.key...); l != tt.wantLen {
+				t.Errorf("Len: %d; want %d", l, tt.wantLen)
+			}
+		})
 	}
-	if fmt.Sprint(outer.Slice.value) != fmt.Sprint([]string{"text1", "text2"}) {
-		t.Errorf("\nhave:\n%v\nwant:\n%v\n", outer.Slice.value, []string{"text1", "text2"})
+
+	// Empty key is the entire document, so there's no need to decode again in
+	// to a map to get at the keys that weren't decoded.
+	doc, ok := meta.Any()
+	if !ok || len(doc.(map[string]any)) != 11 || meta.Len() != 11 {
+		t.Errorf("wrong document: %t %d %#v", ok, meta.Len(), doc)
+	}
+	if u := meta.Undecoded()[0]; u.String() != "u" {
+		t.Errorf("wrong undecoded key: %s", u)
+	} else if v, _ := meta.Any(u...); v != uint64(math.MaxUint64) {
+		t.Errorf("wrong value for undecoded key: %#v", v)
 	}
 }
 
-// TODO: this should be improved for v2:
-// https://github.com/BurntSushi/toml/issues/384
-func TestDecodeDoubleTags(t *testing.T) {
-	var s struct {
-		A int `toml:"a"`
-		B int `toml:"a"`
-		C int `toml:"c"`
-	}
-	_, err := Decode(`
-		a = 1
-		b = 2
-		c = 3
-	`, &s)
+func TestMetaPosition(t *testing.T) {
+	const in = `a = 1
+[srv]
+port = 99999
+inl = {x = 1, y = {z = "2"}}
+
+[x.y]
+[[aot]]
+k = 1
+[[aot]]
+  k = 2
+arr = [{q = 1}]
+`
+	meta, err := Decode(in, new(map[string]any))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	want := `{0 0 3}`
-	have := fmt.Sprintf("%v", s)
-	if want != have {
-		t.Errorf("\nhave: %s\nwant: %s\n", have, want)
+	tests := []struct {
+		key            []string
+		line, col, len int
+	}{
+		{[]string{"a"}, 1, 5, 1},
+		{[]string{"srv"}, 2, 1, 1},
+		{[]string{"srv", "port"}, 3, 8, 5},
+		{[]string{"srv", "inl"}, 4, 8, 1},
+		{[]string{"srv", "inl", "x"}, 4, 12, 1},
+		{[]string{"srv", "inl", "y", "z"}, 4, 25, 1}, // Inside the quotes.
+		{[]string{"x", "y"}, 6, 1, 1},
+		{[]string{"aot"}, 9, 1, 2},
+		{[]string{"aot", "k"}, 10, 7, 1}, // Last table in the array.
+		{[]string{"aot", "arr", "q"}, 11, 13, 1},
+
+		{[]string{"x"}, 0, 0, 0},
+		{[]string{"nope"}, 0, 0, 0},
+		{[]string{"srv", "nope"}, 0, 0, 0},
+		{nil, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.key, "."), func(t *testing.T) {
+			have := meta.Position(tt.key...)
+			if have.Line != tt.line || have.Col != tt.col || have.Len != tt.len {
+				t.Errorf("\nhave: line %d, col %d, len %d\nwant: line %d, col %d, len %d",
+					have.Line, have.Col, have.Len, tt.line, tt.col, tt.len)
+			}
+		})
 	}
 }
 
-func TestMetaKeys(t *testing.T) {
+func TestMetaComment(t *testing.T) {
+	const in = `# The title.
+title = "x"  # trailing
+
+# Not attached to anything.
+
+# Server config.
+# Two lines.
+[server] # srv
+host = "h" # the host
+port = 1
+
+[[replicas]]
+name = "a"
+
+# Second replica.
+[[replicas]] # two
+name = "b"
+`
+	meta, err := Decode(in, new(map[string]any))
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	tests := []struct {
-		in   string
-		want []Key
+		key          string
+		above, after string
 	}{
-		{"", []Key{}},
-		{"b=1\na=1", []Key{Key{"b"}, Key{"a"}}},
-		{"a.b=1\na.a=1", []Key{Key{"a", "b"}, Key{"a", "a"}}}, // TODO: should include "a"
-		{"[tbl]\na=1", []Key{Key{"tbl"}, Key{"tbl", "a"}}},
-		{"[tbl]\na.a=1", []Key{Key{"tbl"}, Key{"tbl", "a", "a"}}}, // TODO: should include "a.a"
-		{"tbl={a=1}", []Key{Key{"tbl"}, Key{"tbl", "a"}}},
-		{"tbl={a={b=1}}", []Key{Key{"tbl"}, Key{"tbl", "a"}, Key{"tbl", "a", "b"}}},
+		{"title", " The title.", " trailing"},
+		{"server", " Server config.\n Two lines.", " srv"},
+		{"server.host", "", " the host"},
+		{"server.port", "", ""},
+		{"replicas[0]", "", ""},
+		{"replicas[1]", " Second replica.", " two"},
+		{"nope", "", ""},
 	}
-
 	for _, tt := range tests {
-		t.Run("", func(t *testing.T) {
-			var x any
-			meta, err := Decode(tt.in, &x)
+		t.Run(tt.key, func(t *testing.T) {
+			above, after := meta.Comment(tt.key)
+			if above != tt.above || after != tt.after {
+				t.Errorf("\nhave: %q, %q\nwant: %q, %q", above, after, tt.above, tt.after)
+			}
+		})
+	}
+}
+
+func TestMetaCounts(t *testing.T) {
+	const in = `a = 1
+b.c = 2
+p = {x = 1, y = 2}
+
+[[aot]]
+k = 1
+[[aot]]
+k = 2
+arr = [{q = 1}]
+`
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip-key-order=%t", skip), func(t *testing.T) {
+			var s struct {
+				A   int
+				P   Primitive
+				Aot []struct{ K int }
+			}
+			meta, err := NewDecoder(strings.NewReader(in)).SkipKeyOrder(skip).Decode(&s)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			have := meta.Keys()
-			if !reflect.DeepEqual(tt.want, have) {
-				t.Errorf("\nhave: %s\nwant: %s\n", have, tt.want)
+			if n := meta.InputSize(); n != len(in) {
+				t.Errorf("InputSize: %d; want %d", n, len(in))
+			}
+			// a, b.c, p, p.x, p.y, aot, aot.k, aot.arr, aot.arr.q
+			if n := meta.KeyCount(); n != 9 {
+				t.Errorf("KeyCount: %d; want 9", n)
+			}
+			// b.c, p.x, p.y, aot.arr, aot.arr.q
+			if n := meta.UndecodedCount(); n != 5 {
+				t.Errorf("UndecodedCount: %d; want 5", n)
+			}
+
+			var p struct{ X int }
+			if err := meta.PrimitiveDecode(s.P, &p); err != nil {
+				t.Fatal(err)
+			}
+			// b.c, p.y, aot.arr, aot.arr.q
+			if n := meta.UndecodedCount(); n != 4 {
+				t.Errorf("UndecodedCount after PrimitiveDecode: %d; want 4", n)
+			}
+			if n := meta.KeyCount(); n != 9 {
+				t.Errorf("KeyCount after PrimitiveDecode: %d; want 9", n)
+			}
+
+			allocs := testing.AllocsPerRun(10, func() { meta.KeyCount(); meta.UndecodedCount() })
+			if allocs != 0 {
+				t.Errorf("allocs: %f", allocs)
 			}
 		})
 	}
@@ -1144,3 +4083,466 @@ func BenchmarkKey(b *testing.B) {
 		k.String()
 	}
 }
+
+func TestDecodeList(t *testing.T) {
+	type Migration struct {
+		Version int
+		SQL     string `toml:"sql"`
+	}
+
+	var have []Migration
+	meta, err := Decode(`
+[[migration]]
+version = 1
+sql = "create table t (id int)"
+
+[[migration]]
+version = 2
+sql = "alter table t add name text"
+`, &have)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Migration{
+		{1, "create table t (id int)"},
+		{2, "alter table t add name text"},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %#v\nwant: %#v", have, want)
+	}
+	if u := meta.Undecoded(); len(u) != 0 {
+		t.Errorf("undecoded: %v", u)
+	}
+
+	// Empty document leaves the slice alone.
+	if _, err := Decode(``, &have); err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != 2 {
+		t.Errorf("wrong length: %d", len(have))
+	}
+
+	tests := []struct {
+		in, wantErr string
+	}{
+		{"version = 1\n[[migration]]\nversion = 2\n[x]",
+			`toml: cannot decode to type []toml.Migration: the document must have only one array of tables, but it has the top-level keys "migration", "version", "x"`},
+		{"[migration]\nversion = 1",
+			`toml: cannot decode to type []toml.Migration: "migration" has type Hash rather than being an array of tables`},
+		{"[[migration]]\nversion = \"1\"",
+			`toml: line 2 (last key "migration.version"): incompatible types`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var m []Migration
+			_, err := Decode(tt.in, &m)
+			if !errorContains(err, tt.wantErr) {
+				t.Errorf("wrong error\nhave: %q\nwant: %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeDeadline(t *testing.T) {
+	var doc strings.Builder
+	for i := 0; i < 10_000; i++ {
+		fmt.Fprintf(&doc, "k%d = [[\"a\\tb\\u00e9\"], [\"c\\nd\", [\"e\\\\f\"]]]\n", i)
+	}
+
+	var m map[string]any
+	_, err := NewDecoder(strings.NewReader(doc.String())).Deadline(time.Nanosecond).Decode(&m)
+	var tErr TimeoutError
+	if !errors.As(err, &tErr) {
+		t.Fatalf("wrong error: %#v", err)
+	}
+	if tErr.Deadline != time.Nanosecond || tErr.Bytes <= 0 || tErr.Position.Line <= 1 || tErr.Position.Col <= 0 {
+		t.Errorf("wrong error: %#v", tErr)
+	}
+	if want := fmt.Sprintf("toml: line %d: parsing took longer than the deadline of 1ns", tErr.Position.Line); !errorContains(err, want) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	if _, err := NewDecoder(strings.NewReader(doc.String())).Deadline(time.Minute).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 10_000 {
+		t.Errorf("wrong length: %d", len(m))
+	}
+
+	// Long comments and strings are skipped over without reading every rune.
+	for _, in := range []string{
+		"# " + strings.Repeat("x", 100_000) + "\nk = 1",
+		"k = '" + strings.Repeat("x", 100_000) + "'",
+	} {
+		_, err = NewDecoder(strings.NewReader(in)).Deadline(time.Nanosecond).Decode(&m)
+		if !errors.As(err, &tErr) {
+			t.Errorf("wrong error: %#v", err)
+		}
+	}
+}
+
+func TestDecodeLayered(t *testing.T) {
+	type server struct {
+		Host string
+		Port int
+	}
+	bases := map[string]string{
+		"base-inline": `server = {host = "a", port = 1}`,
+		"base-header": "[server]\nhost = \"a\"\nport = 1",
+	}
+	overlays := map[string]string{
+		"overlay-dotted": `server.port = 2`,
+		"overlay-header": "[server]\nport = 2",
+	}
+	targets := map[string]func() (any, any){
+		"struct": func() (any, any) {
+			return new(struct{ Server server }), &struct{ Server server }{server{"a", 2}}
+		},
+		"struct-ptr": func() (any, any) {
+			return new(struct{ Server *server }), &struct{ Server *server }{&server{"a", 2}}
+		},
+		"struct-map": func() (any, any) {
+			return new(struct{ Server map[string]any }),
+				&struct{ Server map[string]any }{map[string]any{"host": "a", "port": int64(2)}}
+		},
+		"map": func() (any, any) {
+			return new(map[string]any), &map[string]any{"server": map[string]any{"host": "a", "port": int64(2)}}
+		},
+		"map-struct": func() (any, any) {
+			return new(map[string]server), &map[string]server{"server": {"a", 2}}
+		},
+		"map-map": func() (any, any) {
+			return new(map[string]map[string]int), &map[string]map[string]int{"server": {"host": 0, "port": 2}}
+		},
+	}
+
+	for tName, target := range targets {
+		for bName, base := range bases {
+			for oName, overlay := range overlays {
+				t.Run(tName+"/"+bName+"/"+oName, func(t *testing.T) {
+					have, want := target()
+					b := base
+					if tName == "map-map" { // host isn't an int.
+						b = strings.ReplaceAll(b, `"a"`, "0")
+					}
+					if _, err := Decode(b, have); err != nil {
+						t.Fatal(err)
+					}
+					meta, err := Decode(overlay, have)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(have, want) {
+						t.Errorf("\nhave: %#v\nwant: %#v", have, want)
+					}
+
+					wantKeys := "[server server.port]"
+					if oName == "overlay-dotted" {
+						wantKeys = "[server.port]"
+					}
+					if k := fmt.Sprintf("%v", meta.Keys()); k != wantKeys {
+						t.Errorf("wrong keys: %s", k)
+					}
+					if !meta.IsDefined("server", "port") || meta.IsDefined("server", "host") {
+						t.Error("wrong IsDefined")
+					}
+					// Keys inside an any aren't marked as decoded.
+					if u := meta.Undecoded(); len(u) > 0 && tName != "map" {
+						t.Errorf("undecoded: %v", u)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestDecodeFlat(t *testing.T) {
+	// The named types aren't exactly map[string]..., so they use unify().
+	type (
+		anyMap    map[string]any
+		stringMap map[string]string
+		intMap    map[string]int64
+		boolMap   map[string]bool
+	)
+	check := func(t *testing.T, in string, fast, slow any) {
+		t.Helper()
+		fastMeta, fastErr := Decode(in, fast)
+		slowMeta, slowErr := Decode(in, slow)
+		// Which error is returned depends on the map order, so only check that
+		// both return one; the fast path is never used if there's an error.
+		if (fastErr == nil) != (slowErr == nil) {
+			t.Fatalf("different errors\nfast: %v\nslow: %v", fastErr, slowErr)
+		}
+		if fastErr != nil {
+			return
+		}
+		if f, s := fmt.Sprint(reflect.ValueOf(fast).Elem()), fmt.Sprint(reflect.ValueOf(slow).Elem()); f != s {
+			t.Errorf("different result\nfast: %s\nslow: %s", f, s)
+		}
+		if f, s := fmt.Sprint(fastMeta.Keys(), fastMeta.Undecoded()), fmt.Sprint(slowMeta.Keys(), slowMeta.Undecoded()); f != s {
+			t.Errorf("different meta\nfast: %s\nslow: %s", f, s)
+		}
+	}
+
+	// All valid tests from toml-test, most of which aren't flat.
+	err := filepath.WalkDir("internal/toml-test/tests/valid", func(path string, d os.DirEntry, err error) error {
+		if err != nil || !strings.HasSuffix(path, ".toml") {
+			return err
+		}
+		in, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		t.Run(path, func(t *testing.T) {
+			check(t, string(in), new(map[string]any), new(anyMap))
+			check(t, string(in), new(map[string]string), new(stringMap))
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, in := range []string{
+		``,
+		`a = "x"`,
+		"a = \"x\"\n'b.c' = 'y'\n\"\" = \"\"",
+		"a = 1\nb = -2",
+		"a = true\nb = false",
+		"a = 1\nb = \"x\"",
+		"a = 18446744073709551615",
+		"a = 1\nb = [1]",
+		"a = 1\n[b]\nc = 2",
+		"a = 1\na = 2",
+		"a = 1\nb = {c = 1}",
+	} {
+		t.Run(in, func(t *testing.T) {
+			check(t, in, new(map[string]any), new(anyMap))
+			check(t, in, new(map[string]string), new(stringMap))
+			check(t, in, new(map[string]int64), new(intMap))
+			check(t, in, new(map[string]bool), new(boolMap))
+		})
+	}
+
+	// Existing values are kept.
+	m := map[string]string{"a": "1", "b": "2"}
+	if _, err := Decode(`b = "x"`, &m); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(m) != "map[a:1 b:x]" {
+		t.Errorf("wrong result: %v", m)
+	}
+}
+
+func TestDecodeTrace(t *testing.T) {
+	type config struct {
+		FullName string `toml:"name"`
+		Port     int
+		Timeout  time.Duration
+		Limits   map[string]int
+		Servers  []struct{ Host string }
+		secret   string `toml:"secret"`
+	}
+
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"nmae = \"x\"\nport = 8080\ntimeout = \"5s\"\n[limits]\ncpu = 2\n", []string{
+			`line 1: key "nmae" matched no field in toml.config (closest: "name" on field FullName)`,
+			`line 2: key "port" decoded in to toml.config.Port`,
+			`line 3: key "timeout" decoded in to toml.config.Timeout by its unmarshaler`,
+			`line 4: key "limits" decoded in to toml.config.Limits`,
+			`line 5: key "limits.cpu" decoded in to map[string]int["cpu"]`,
+		}},
+		{"xyz = 1\n", []string{
+			`line 1: key "xyz" matched no field in toml.config`,
+		}},
+		{"[limits]\ncpu = \"x\"\n", []string{
+			`line 2: key "limits.cpu" error decoding in to map[string]int["cpu"]: toml: line 2 (last key "limits.cpu"): incompatible types: TOML value has type string; destination has type integer`,
+		}},
+		{"secret = \"x\"\n", []string{
+			`line 1: key "secret" matched the unexported field toml.config.secret`,
+		}},
+		{"[[servers]]\nhost = \"a\"\nhsot = \"b\"\n[[servers]]\nhost = \"c\"\n", []string{
+			`line 1: key "servers" decoded in to toml.config.Servers`,
+			`line 2: key "servers.host" decoded in to struct { Host string }.Host`,
+			`line 3: key "servers.hsot" matched no field in struct { Host string } (closest: "Host" on field Host)`,
+			`line 5: key "servers.host" decoded in to struct { Host string }.Host`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var (
+				c    config
+				have []string
+			)
+			NewDecoder(strings.NewReader(tt.in)).
+				SetTrace(func(ev TraceEvent) { have = append(have, ev.String()) }).
+				Decode(&c)
+
+			// Keys in a table are decoded in a random order.
+			sort.Strings(have)
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestDecodeDelimiter(t *testing.T) {
+	in := "a = 1\n+++\na = 2 # +++\nb = \"\"\"\n+++\n\"\"\"\n+++\r\n\n+++\n[t]\na = 3\n"
+	want := []map[string]any{
+		{"a": int64(1)},
+		{"a": int64(2), "b": "+++\n"},
+		{},
+		{"t": map[string]any{"a": int64(3)}},
+	}
+
+	t.Run("position", func(t *testing.T) {
+		r, r2 := strings.NewReader(in), strings.NewReader(in)
+		dec := NewDecoder(r).Delimiter("+++")
+		dec2 := NewDecoder(struct{ io.Reader }{r2}).Delimiter("+++")
+
+		var m, m2 map[string]any
+		if _, err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dec2.Decode(&m2); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, want[0]) || !reflect.DeepEqual(m2, want[0]) {
+			t.Errorf("\nhave: %#v\nhave: %#v\nwant: %#v", m, m2, want[0])
+		}
+		if dec.InputOffset() != 10 || dec2.InputOffset() != 10 {
+			t.Errorf("wrong offset: %d, %d", dec.InputOffset(), dec2.InputOffset())
+		}
+
+		// The reader is positioned after the delimiter if it can seek, and
+		// what's read past it is buffered if it can't.
+		if rest, _ := io.ReadAll(r); string(rest) != in[10:] {
+			t.Errorf("wrong rest: %q", rest)
+		}
+		if rest, _ := io.ReadAll(io.MultiReader(dec2.Buffered(), r2)); string(rest) != in[10:] {
+			t.Errorf("wrong buffered: %q", rest)
+		}
+	})
+
+	for _, seek := range []bool{true, false} {
+		t.Run(fmt.Sprintf("seek=%t", seek), func(t *testing.T) {
+			var r io.Reader = strings.NewReader(in)
+			if !seek {
+				r = struct{ io.Reader }{r}
+			}
+			dec := NewDecoder(r).Delimiter("+++")
+
+			var have []map[string]any
+			for {
+				var m map[string]any
+				_, err := dec.Decode(&m)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if m == nil {
+					m = map[string]any{}
+				}
+				have = append(have, m)
+			}
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("\nhave: %#v\nwant: %#v", have, want)
+			}
+			if dec.InputOffset() != int64(len(in)) {
+				t.Errorf("wrong offset: %d", dec.InputOffset())
+			}
+		})
+	}
+
+	// Without a delimiter it's an error.
+	_, err := Decode(in, new(map[string]any))
+	if !errorContains(err, "line 2") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestDecodeSelfNested(t *testing.T) {
+	type node struct {
+		Name     string
+		Child    *node
+		Children map[string]node
+	}
+
+	in := `
+name = "l0"
+[child]
+	name = "l1"
+[child.child]
+	nmae = "l2"
+[child.child.child]
+	name = "l3"
+[children.a]
+	name = "a1"
+[children.a.children.b]
+	name = "b2"
+[children.a.children.b.child]
+	name = "b3"
+`
+	var n node
+	meta, err := Decode(in, &n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := fmt.Sprintf("%s %s %q %s %s %s %s", n.Name, n.Child.Name, n.Child.Child.Name, n.Child.Child.Child.Name,
+		n.Children["a"].Name, n.Children["a"].Children["b"].Name, n.Children["a"].Children["b"].Child.Name)
+	if want := `l0 l1 "" l3 a1 b2 b3`; have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+	if u := fmt.Sprint(meta.Undecoded()); u != "[child.child.nmae]" {
+		t.Errorf("wrong undecoded: %s", u)
+	}
+
+	_, err = NewDecoder(strings.NewReader(in)).DisallowUnknownFields(true).Decode(&node{})
+	if !errorContains(err, `line 6 (last key "child.child"): "child.child.nmae" doesn't match any field in toml.node`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestDecodePartialMetaData(t *testing.T) {
+	in := `name = "x"
+[cluster]
+nodes = 2
+[[cluster.node]]
+addr = "a"
+port = "80
+[after]
+key = 1
+`
+	var m map[string]any
+	meta, err := NewDecoder(strings.NewReader(in)).PartialMetaData(true).Decode(&m)
+	if !errorContains(err, "line 6") {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if have := fmt.Sprint(meta.Keys()); have != "[name cluster cluster.nodes cluster.node cluster.node.addr]" {
+		t.Errorf("wrong keys: %s", have)
+	}
+	if typ := meta.Type("cluster", "nodes"); typ != "Integer" {
+		t.Errorf("wrong type: %q", typ)
+	}
+	if pos := meta.Position("cluster", "node", "addr"); pos.Line != 5 {
+		t.Errorf("wrong position: %#v", pos)
+	}
+	if meta.IsDefined("cluster", "node", "port") || meta.IsDefined("after") {
+		t.Error("defined after the error")
+	}
+	if m != nil {
+		t.Errorf("decoded: %v", m)
+	}
+
+	// Off by default.
+	meta, err = Decode(in, &m)
+	if err == nil || len(meta.Keys()) != 0 {
+		t.Errorf("wrong result: %v; %v", meta.Keys(), err)
+	}
+}
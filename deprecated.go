@@ -3,8 +3,62 @@ package toml
 import (
 	"encoding"
 	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
 )
 
+// deprecation is the *deprecationHandler set with SetDeprecationHandler.
+var deprecation atomic.Value
+
+type deprecationHandler struct {
+	fn   func(api string, caller runtime.Frame)
+	mu   sync.Mutex
+	seen map[uintptr]struct{}
+}
+
+// SetDeprecationHandler sets a function that's called when a deprecated
+// function is used, to find uses that are hard to grep for. The handler is
+// called once for every call site, with the frame of the caller. It can be
+// called concurrently.
+//
+// This only reports [DecodeReader] and [PrimitiveDecode]; the deprecated types
+// can't be detected at runtime.
+//
+// Setting a new handler reports all call sites again. Setting nil disables it,
+// which is the default.
+func SetDeprecationHandler(fn func(api string, caller runtime.Frame)) {
+	if fn == nil {
+		deprecation.Store((*deprecationHandler)(nil))
+		return
+	}
+	deprecation.Store(&deprecationHandler{fn: fn, seen: make(map[uintptr]struct{})})
+}
+
+// reportDeprecated calls the deprecation handler for the caller of the function
+// that calls reportDeprecated, if it wasn't reported already.
+func reportDeprecated(api string) {
+	h, _ := deprecation.Load().(*deprecationHandler)
+	if h == nil {
+		return
+	}
+
+	var pc [1]uintptr
+	if runtime.Callers(3, pc[:]) == 0 {
+		return
+	}
+	h.mu.Lock()
+	_, ok := h.seen[pc[0]]
+	h.seen[pc[0]] = struct{}{}
+	h.mu.Unlock()
+	if ok {
+		return
+	}
+
+	f, _ := runtime.CallersFrames(pc[:]).Next()
+	h.fn(api, f)
+}
+
 // TextMarshaler is an alias for encoding.TextMarshaler.
 //
 // Deprecated: use encoding.TextMarshaler
@@ -18,12 +72,16 @@ type TextUnmarshaler encoding.TextUnmarshaler
 // DecodeReader is an alias for NewDecoder(r).Decode(v).
 //
 // Deprecated: use NewDecoder(reader).Decode(&value).
-func DecodeReader(r io.Reader, v any) (MetaData, error) { return NewDecoder(r).Decode(v) }
+func DecodeReader(r io.Reader, v any) (MetaData, error) {
+	reportDeprecated("DecodeReader")
+	return NewDecoder(r).Decode(v)
+}
 
 // PrimitiveDecode is an alias for MetaData.PrimitiveDecode().
 //
 // Deprecated: use MetaData.PrimitiveDecode.
 func PrimitiveDecode(primValue Primitive, v any) error {
+	reportDeprecated("PrimitiveDecode")
 	md := MetaData{decoded: make(map[string]struct{})}
 	return md.unify(primValue.undecoded, rvalue(v))
 }
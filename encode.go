@@ -8,14 +8,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/BurntSushi/toml/internal"
+	"unicode/utf8"
 )
 
 type tomlEncodeError struct{ error }
@@ -27,6 +29,39 @@ var (
 	errAnything        = errors.New("") // used in testing
 )
 
+// errUnsupported is a value with a type that can't be encoded.
+//
+// The path to the value is added as the error is returned through the arrays
+// and inline tables it's in (see addPath), and key is set by the key/value it's
+// in; it's reported without the path if there is no key.
+type errUnsupported struct {
+	typ       reflect.Type
+	key, path string
+}
+
+func (e errUnsupported) Error() string {
+	if e.key == "" {
+		return "unsupported type: " + e.typ.Kind().String()
+	}
+	return fmt.Sprintf("unsupported type for key '%s%s': %s", e.key, e.path, e.typ)
+}
+
+// addPath adds elem to the path of an errUnsupported in the recovered panic r
+// (or sets the key if isKey is set), and panics again.
+func addPath(r any, elem string, isKey bool) {
+	if e, ok := r.(tomlEncodeError); ok {
+		if u, ok := e.error.(errUnsupported); ok && u.key == "" {
+			if isKey {
+				u.key = elem
+			} else {
+				u.path = elem + u.path
+			}
+			r = tomlEncodeError{u}
+		}
+	}
+	panic(r)
+}
+
 var dblQuotedReplacer = strings.NewReplacer(
 	"\"", "\\\"",
 	"\\", "\\\\",
@@ -69,6 +104,7 @@ var (
 	marshalToml = reflect.TypeOf((*Marshaler)(nil)).Elem()
 	marshalText = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
 	timeType    = reflect.TypeOf((*time.Time)(nil)).Elem()
+	orderedType = reflect.TypeOf((*OrderedMap)(nil)).Elem()
 )
 
 // Marshaler is the interface implemented by types that can marshal themselves
@@ -77,6 +113,17 @@ type Marshaler interface {
 	MarshalTOML() ([]byte, error)
 }
 
+// OrderedMap is the interface implemented by map types that keep track of the
+// order of their keys. These are encoded as a table with the keys in the order
+// of Keys(), rather than sorted.
+//
+// Keys for sub-tables are still written after all other keys, as TOML requires,
+// but the order within these two groups is kept.
+type OrderedMap interface {
+	Keys() []string
+	Get(key string) (any, bool)
+}
+
 // Marshal returns a TOML representation of the Go value.
 //
 // See [Encoder] for a description of the encoding process.
@@ -88,24 +135,139 @@ func Marshal(v any) ([]byte, error) {
 	return buff.Bytes(), nil
 }
 
+// MarshalWithProfile is like [Marshal], but encodes with the options in p:
+//
+//	b, err := toml.MarshalWithProfile(v, toml.EncodeProfile{Indent: "    "})
+func MarshalWithProfile(v any, p EncodeProfile) ([]byte, error) {
+	buff := new(bytes.Buffer)
+	if err := NewEncoder(buff).Profile(p).Encode(v); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// EncodeFile writes a TOML representation of the Go value to a file.
+//
+// The file is replaced atomically: the TOML is written to a temporary file in
+// the same directory first, which is renamed to path once everything is
+// written and synced to disk. Nothing is changed if there is any error.
+//
+// New files are created with perm (before umask); if the file already exists
+// then its permissions are kept.
+func EncodeFile(path string, v any, perm fs.FileMode) error {
+	b, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	keepPerm := false
+	if st, err := os.Stat(path); err == nil {
+		perm, keepPerm = st.Mode().Perm(), true
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// Don't use os.CreateTemp(), as that always uses 0o600 rather than perm
+	// with the umask applied.
+	dir, name := filepath.Split(path)
+	var tmp *os.File
+	for i := 0; ; i++ {
+		tmp, err = os.OpenFile(filepath.Join(dir, "."+name+".tmp"+strconv.FormatInt(time.Now().UnixNano()+int64(i), 36)),
+			os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if err == nil || !errors.Is(err, fs.ErrExist) || i > 100 {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) /// Fails if it was renamed, which is fine.
+
+	_, err = tmp.Write(b)
+	if err == nil && keepPerm {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Make sure the rename is on disk; this isn't supported on all systems, so
+	// ignore errors.
+	if d, err := os.Open(filepath.Clean(dir + ".")); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// WriteFileFS is a filesystem that files can be written to, for [EncodeFS].
+//
+// WriteFile should replace the file atomically, or at least never leave a
+// partially written file on errors.
+type WriteFileFS interface {
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+}
+
+// EncodeFS writes a TOML representation of the Go value to a file in fsys.
+//
+// The value is encoded before anything is written, so WriteFile is never called
+// if there are any errors.
+func EncodeFS(fsys WriteFileFS, path string, v any, perm fs.FileMode) error {
+	b, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	return fsys.WriteFile(path, b, perm)
+}
+
 // Encoder encodes a Go to a TOML document.
 //
 // The mapping between Go values and TOML values should be precisely the same as
 // for [Decode].
 //
 // time.Time is encoded as a RFC 3339 string, and time.Duration as its string
-// representation.
+// representation (see [Encoder.DurationFormat] for other formats). Times are
+// written with their numeric offset, also if they're in a named zone such as
+// America/New_York, and the monotonic clock reading is never written; see
+// [Encoder.TimesInUTC] to write all times in UTC.
 //
 // The [Marshaler] and [encoding.TextMarshaler] interfaces are supported to
 // encoding the value as custom TOML.
 //
+// A [TypeAdapter] can be registered to write other types as a single value.
+//
 // If you want to write arbitrary binary data then you will need to use
 // something like base64 since TOML does not have any binary types.
 //
+// Floats are written with the shortest representation that decodes to the same
+// value for the type: float32(0.1) is written as 0.1, also when it's stored in
+// an any. A float64 is always written with float64 precision, even if its value
+// came from a float32: float64(float32(0.1)) is 0.10000000149011612.
+//
+// The output for numbers and datetimes is the same for all Go versions, so
+// generated files don't change when upgrading Go.
+//
 // When encoding TOML hashes (Go maps or structs), keys without any sub-hashes
 // are encoded first.
 //
-// Go maps will be sorted alphabetically by key for deterministic output.
+// Go maps will be sorted alphabetically by key for deterministic output. Types
+// that implement [OrderedMap] are written in the order of their Keys() method
+// instead. Map keys must be strings or implement [encoding.TextMarshaler], in
+// which case the result of MarshalText is used as the key and for sorting.
+//
+// Keys are written as quoted keys if they contain anything other than A-Za-z0-9,
+// "_", and "-". Control characters (including NUL) and other unprintable
+// characters are escaped as \uXXXX. Map keys or field names with invalid UTF-8
+// are an error, as they can't be written without changing the key.
 //
 // The toml struct tag can be used to provide the key name; if omitted the
 // struct field name will be used. If the "omitempty" option is present the
@@ -118,39 +280,672 @@ func Marshal(v any) ([]byte, error) {
 // If omitzero is given all int and float types with a value of 0 will be
 // skipped.
 //
+// With the "string" option integers, floats, and booleans are written as a
+// TOML string, such as port = "8080", like the same option in encoding/json.
+//
+// Fields of embedded structs are written as if they're fields of the outer
+// struct. With `toml:",omitempty"` on the embedded struct (or pointer to a
+// struct) all its fields are skipped if it's empty by the above rules, also
+// for fields of structs embedded in it.
+//
+// If an embedded struct has a field with the same key as a field in the outer
+// struct the outer field wins, and at the same depth a field with a toml tag
+// wins over one without. Fields with different keys are all written, also if
+// they only differ in case: a Name field and an embedded field tagged "name"
+// are written as "Name" and "name". These are the same rules as for decoding,
+// where keys match a field exactly before falling back to a case-insensitive
+// match, so encoded structs decode to the same value. Any other fields with the
+// same key are an error, as the document would define the key twice.
+//
+// A field with the tag `toml:"-"` is always skipped; use `toml:"-,"` to use "-"
+// as the key name.
+//
+// A map field with the "keyed" option is encoded as an array of tables ordered
+// by the map key, with the map key written as the given key name; for example
+// `toml:"servers,keyed=name"`. This is the reverse of what [Decoder] does. If
+// the tables have that key as well it must be empty or the same as the map key.
+//
+// For a struct field with the "union" option only the variant that isn't nil is
+// written, and it's an error if more than one variant is set.
+//
 // Encoding Go values without a corresponding TOML representation will return an
 // error. Examples of this includes maps with non-string keys, slices with nil
 // elements, embedded non-struct types, and nested slices containing maps or
 // structs. (e.g. [][]map[string]string is not allowed but []map[string]string
 // is okay, as is []map[string][]string).
 //
+// Structs which have fields but none that are exported return an error too,
+// unless they implement a marshaler (see [Encoder.AllowOpaqueStructs]).
+//
 // NOTE: only exported keys are encoded due to the use of reflection. Unexported
-// keys are silently discarded.
+// keys are silently discarded, unless they have a toml tag with a name: that's
+// almost certainly a mistake, so it's an error.
 type Encoder struct {
-	Indent     string // string for a single indentation level; default is two spaces.
-	hasWritten bool   // written any output to w yet?
-	w          *bufio.Writer
+	Indent      string // string for a single indentation level; default is two spaces.
+	hasWritten  bool   // written any output to w yet?
+	wroteBlank  bool   // last thing written was a blank line?
+	pendingNL   int    // newlines not yet written to w.
+	openLine    bool   // last line written to w doesn't end with a newline?
+	w           *bufio.Writer
+	allowOpaque bool
+	useJSON     bool
+	noFinalNL   bool
+	spacing     Spacing
+
+	commentOmitted bool // write omitted fields as comments.
+	commentDepth   int  // max. levels of tables for omitted fields; 0 for no limit.
+	noOmit         bool // write omitted fields; set when writing the comments.
+	maxDepth       int  // don't write tables with longer keys than this, if >0.
+
+	meta     *MetaData                    // placeholders and tables; set with MetaData().
+	metaPos  map[string]Position          // position of tables in meta that don't have one; see eMap().
+	header   func()                       // header of an implicit table, written before the next output.
+	keyOrder map[string][]string          // order of keys in maps; set with KeyOrder().
+	keepOrd  bool                         // write struct fields in declaration order.
+	utc      bool                         // write offset datetimes in UTC.
+	durFmt   DurationFormat               // format for time.Duration; set with DurationFormat().
+	adapters map[reflect.Type]TypeAdapter // set with RegisterType().
+	annotate bool                         // write the types as comments.
+	arrWidth int                          // write wider arrays on multiple lines, if >0.
+	field    *fieldNote                   // struct field being written, for annotate.
+	valKey   string                       // key of the value being written, for MetaData.Format; "" if unknown.
+	arrIdx   map[string]int               // index of the table being written in arrays of tables, for comments.
+	dotted   int                          // number of tables written as dotted keys; see eDotted().
+
+	buffering bool          // writing to arrW; see writeBuffered().
+	arrBuf    *bytes.Buffer // output of arrW.
+	arrW      *bufio.Writer // buffer for writing arrays.
+
+	keySort func(table Key, a, b string) bool // sort keys of maps; set with SetKeySort().
+
+	maxSize int // max. bytes for a single Encode, if >0; set with MaxOutputSize().
+	size    int // bytes written by the current Encode, if maxSize is set.
+	sizeKey Key // last key that was started, for SizeLimitError.
+
+	planning bool         // only record keys in plan; set by Plan().
+	plan     []PlannedKey // keys recorded while planning.
+	goPath   string       // path of the Go value being written while planning.
+
+	writeTop func(key string) bool // only write top-level keys it accepts, if not nil; set by EncodeSplit().
+	skipped  Key                   // don't write this key; set by eKeyedMap().
+}
+
+// PlannedKey is a key that would be written by [Encoder.Encode]; see
+// [Encoder.Plan].
+type PlannedKey struct {
+	Key      Key    // TOML key.
+	TOMLType string // TOML type, in the same format as MetaData.Type().
+	GoPath   string // Go path of the value, e.g. Servers[0].Name or Labels["env"].
 }
 
+// Spacing controls where the [Encoder] writes blank lines.
+type Spacing uint8
+
+const (
+	// SpacingDefault writes a blank line before top-level tables and before
+	// every array table.
+	SpacingDefault Spacing = iota
+
+	// SpacingCompact never writes blank lines.
+	SpacingCompact
+
+	// SpacingLoose writes a blank line between all top-level keys, and before
+	// all tables and array tables.
+	SpacingLoose
+)
+
+// DurationFormat controls how the [Encoder] writes [time.Duration] values.
+type DurationFormat uint8
+
+const (
+	// DurationString writes durations as a string such as "1m30s", in the
+	// format of time.Duration.String(). This is the default.
+	DurationString DurationFormat = iota
+
+	// DurationSeconds writes durations as a float with the number of seconds,
+	// such as 90.0 or 0.25. This is always a float, as integers are decoded as
+	// nanoseconds. The exact duration is written, but decoding it reads it as
+	// a float64, which only has nanosecond precision up to about 104 days.
+	DurationSeconds
+
+	// DurationNanoseconds writes durations as an integer with the number of
+	// nanoseconds.
+	DurationNanoseconds
+)
+
 // NewEncoder create a new Encoder.
 func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{w: bufio.NewWriter(w), Indent: "  "}
 }
 
+// AllowOpaqueStructs sets if structs without any exported fields and without a
+// marshaler can be encoded.
+//
+// By default this is an error, as the result is always an empty table, which
+// is almost certainly not what was intended. Set this to true to encode these
+// as empty tables instead.
+func (enc *Encoder) AllowOpaqueStructs(allow bool) *Encoder {
+	enc.allowOpaque = allow
+	return enc
+}
+
+// UseJSONInterfaces sets if types that implement [json.Marshaler], but not
+// [Marshaler] or [encoding.TextMarshaler], are encoded with MarshalJSON.
+//
+// The JSON is converted to TOML as with [FromJSON]: objects become tables,
+// numbers without a fraction or exponent become integers, and all other
+// numbers become floats. A null is treated like a nil pointer, and nulls
+// inside a JSON object or array are skipped. JSON has no datetime type, so
+// datetimes are always strings.
+//
+// MarshalJSON may be called more than once for the same value.
+func (enc *Encoder) UseJSONInterfaces(use bool) *Encoder {
+	enc.useJSON = use
+	return enc
+}
+
+// TrailingNewline sets if the output ends with a newline; the default is true.
+//
+// The output always ends with exactly one newline if this is set, or no
+// newline if it's not. Nothing is written for empty documents.
+func (enc *Encoder) TrailingNewline(nl bool) *Encoder {
+	enc.noFinalNL = !nl
+	return enc
+}
+
+// CommentOmitted sets if fields that are skipped because of "omitempty" or
+// "omitzero" are written as a comment instead, so that the output shows all the
+// keys that can be set:
+//
+//	# name = ""
+//	port = 8080
+//
+//	# [tls]
+//	# cert = ""
+//
+// Omitted tables are written with all their keys and sub-tables; use
+// [Encoder.CommentOmittedDepth] to limit this.
+func (enc *Encoder) CommentOmitted(comment bool) *Encoder {
+	enc.commentOmitted = comment
+	return enc
+}
+
+// CommentOmittedDepth sets how many levels of tables are written for omitted
+// tables with [Encoder.CommentOmitted]; for example 1 writes only the omitted
+// table itself, without any sub-tables. The default of 0 means there's no limit.
+func (enc *Encoder) CommentOmittedDepth(depth int) *Encoder {
+	enc.commentDepth = depth
+	return enc
+}
+
+// TimesInUTC sets if datetimes with an offset are converted to UTC before
+// they're written. Local datetimes, dates, and times are never converted.
+//
+// Decoding a time gives a time.FixedZone rather than the original named zone,
+// so re-encoding after calculations that cross a DST boundary can give a
+// different offset. Writing in UTC avoids this, which is useful for tests that
+// compare the output.
+func (enc *Encoder) TimesInUTC(utc bool) *Encoder {
+	enc.utc = utc
+	return enc
+}
+
+// DurationFormat sets how time.Duration values are written, including
+// durations in arrays and maps; the default is [DurationString]. All formats
+// can be decoded again.
+//
+// This isn't used if a [TypeAdapter] was registered for time.Duration.
+func (enc *Encoder) DurationFormat(f DurationFormat) *Encoder {
+	enc.durFmt = f
+	return enc
+}
+
+// AnnotateTypes sets if a comment with the type is written after every key,
+// which is useful for generating reference documentation:
+//
+//	timeout = "30s"  # string (time.Duration), optional
+//
+// The comment has the TOML type, the Go type (the field type for struct
+// fields), and "optional" for fields with omitempty or omitzero. Table and
+// array of tables headers get a comment with the Go type. Nothing is added
+// inside inline tables, as they can't have comments.
+func (enc *Encoder) AnnotateTypes(annotate bool) *Encoder {
+	enc.annotate = annotate
+	return enc
+}
+
+// MultilineArrays sets the width after which arrays are written with one
+// element per line, rather than all on one line:
+//
+//	hosts = [
+//	  "alpha.example.com",
+//	  "beta.example.com",
+//	]
+//
+// This is done if the line with the key and array would be wider than width
+// columns. The default of 0 writes all arrays on one line, and 1 writes every
+// array that isn't empty on multiple lines.
+//
+// Only the array itself is split: arrays and inline tables in the array and
+// arrays in inline tables are always written on one line.
+func (enc *Encoder) MultilineArrays(width int) *Encoder {
+	enc.arrWidth = width
+	return enc
+}
+
+// MetaData sets the MetaData of the document that's being written back, for
+// placeholders (see [MetaData.Placeholder]), to write integers in the same
+// base as in the document (see [MetaData.Format]), to keep the comments (see
+// [MetaData.Comment]), and to keep the tables as they were in the document.
+//
+// Tables that were only defined implicitly in the document (such as "a" and
+// "a.b" in "[a.b.c]") don't get a header unless they have keys of their own,
+// and sub-tables of maps are written in the same order as in the document,
+// rather than sorted by key. Tables that were explicitly defined always get a
+// header, also if they're empty.
+//
+// Maps for tables that were defined with dotted keys (see [MetaData.Dotted])
+// are written with dotted keys as well, unless they're empty or have a
+// sub-table that can't be written that way; they get a header then.
+func (enc *Encoder) MetaData(md *MetaData) *Encoder {
+	enc.meta, enc.metaPos = md, nil
+	if md != nil {
+		enc.metaPos = firstPositions(md.keyInfo)
+	}
+	return enc
+}
+
+// Spacing sets where blank lines are written; the default is [SpacingDefault].
+//
+// There is never more than one consecutive blank line.
+func (enc *Encoder) Spacing(s Spacing) *Encoder {
+	enc.spacing = s
+	return enc
+}
+
+// KeyOrder sets the order of the keys in the map that's written as the table
+// key, rather than sorting them; use an empty key for the top-level map:
+//
+//	enc.KeyOrder(nil, []string{"name", "port", "log"})
+//	enc.KeyOrder(toml.Key{"log"}, []string{"level", "file"})
+//
+// Keys in the map that aren't in order are written after the keys that are,
+// sorted by name. Names in order that aren't in the map are ignored, and it's
+// an error if a name is in order more than once. Keys for sub-tables are still
+// written after all other keys, as TOML requires.
+//
+// This takes precedence over the order from [Encoder.MetaData]. It's not used
+// for structs and types that implement [OrderedMap].
+func (enc *Encoder) KeyOrder(key Key, order []string) *Encoder {
+	if enc.keyOrder == nil {
+		enc.keyOrder = make(map[string][]string)
+	}
+	enc.keyOrder[key.String()] = order
+	return enc
+}
+
+// SetKeySort sets the function used to sort the keys of maps, rather than
+// sorting them by name. It's called with the key of the table the map is
+// written as (empty for the top-level map), and should report if a sorts
+// before b:
+//
+//	enc.SetKeySort(func(table toml.Key, a, b string) bool {
+//		if table.String() == "dependencies" {
+//			return naturalLess(a, b)
+//		}
+//		return a < b
+//	})
+//
+// Keys for sub-tables are still written after all other keys, as TOML requires.
+// Keys listed with [Encoder.KeyOrder] are written first, and the order of
+// tables from [Encoder.MetaData] takes precedence. It's not used for structs
+// and types that implement [OrderedMap].
+//
+// The default of nil sorts the keys by name.
+func (enc *Encoder) SetKeySort(less func(table Key, a, b string) bool) *Encoder {
+	enc.keySort = less
+	return enc
+}
+
+// PreserveFieldOrder sets if struct fields are written in the order they're
+// declared in, rather than writing all fields that are tables after the other
+// fields.
+//
+// As keys after a table header are part of that table, a table that's followed
+// by other fields is written as an inline table (or an array of inline tables)
+// to keep the order:
+//
+//	name = "app"
+//	log  = {level = "info"}
+//	port = 8080
+//
+//	[db]
+//	host = "localhost"
+//
+// Fields with the "keyed" option are always written after the other fields.
+func (enc *Encoder) PreserveFieldOrder(preserve bool) *Encoder {
+	enc.keepOrd = preserve
+	return enc
+}
+
+// MaxOutputSize sets the maximum size in bytes of the output of a single call
+// to Encode or EncodeList. Encoding stops with a [SizeLimitError] as soon as the
+// output is larger than n.
+//
+// The output is kept in memory until it's complete, so nothing is written to
+// the writer if the limit is exceeded (or for any other error). Use
+// [EstimateSize] to find the size without encoding twice.
+//
+// The default of 0 means there's no limit.
+func (enc *Encoder) MaxOutputSize(n int) *Encoder {
+	enc.maxSize = n
+	return enc
+}
+
+// RegisterType sets the adapter for the type t for this Encoder, taking
+// precedence over adapters registered with the global [RegisterType].
+func (enc *Encoder) RegisterType(t reflect.Type, a TypeAdapter) *Encoder {
+	if enc.adapters == nil {
+		enc.adapters = make(map[reflect.Type]TypeAdapter)
+	}
+	enc.adapters[t] = a
+	return enc
+}
+
+// EncodeProfile is a set of options for the [Encoder]. Every field is the same
+// as the Encoder method or field with the same name, except that:
+//
+//   - An empty Indent is the default of two spaces; set Encoder.Indent
+//     directly to write without indentation.
+//   - NoTrailingNewline is the inverse of TrailingNewline, so that the zero
+//     value is the default.
+//
+// Use [Encoder.Profile] to set all of them at once, or [MarshalWithProfile].
+type EncodeProfile struct {
+	Indent              string
+	AllowOpaqueStructs  bool
+	UseJSONInterfaces   bool
+	NoTrailingNewline   bool
+	CommentOmitted      bool
+	CommentOmittedDepth int
+	TimesInUTC          bool
+	DurationFormat      DurationFormat
+	AnnotateTypes       bool
+	MultilineArrays     int
+	PreserveFieldOrder  bool
+	Spacing             Spacing
+	MaxOutputSize       int
+	MetaData            *MetaData
+}
+
+// Profile sets all options to the values in p, overwriting any options set
+// before. Adapters set with [Encoder.RegisterType] are kept.
+func (enc *Encoder) Profile(p EncodeProfile) *Encoder {
+	enc.Indent = "  "
+	if p.Indent != "" {
+		enc.Indent = p.Indent
+	}
+	enc.allowOpaque = p.AllowOpaqueStructs
+	enc.useJSON = p.UseJSONInterfaces
+	enc.noFinalNL = p.NoTrailingNewline
+	enc.commentOmitted = p.CommentOmitted
+	enc.commentDepth = p.CommentOmittedDepth
+	enc.utc = p.TimesInUTC
+	enc.durFmt = p.DurationFormat
+	enc.annotate = p.AnnotateTypes
+	enc.arrWidth = p.MultilineArrays
+	enc.keepOrd = p.PreserveFieldOrder
+	enc.spacing = p.Spacing
+	enc.maxSize = p.MaxOutputSize
+	enc.MetaData(p.MetaData)
+	return enc
+}
+
 // Encode writes a TOML representation of the Go value to the [Encoder]'s writer.
 //
 // An error is returned if the value given cannot be encoded to a valid TOML
 // document.
 func (enc *Encoder) Encode(v any) error {
-	rv := eindirect(reflect.ValueOf(v))
-	err := enc.safeEncode(Key([]string{}), rv)
+	rv := enc.eval(reflect.ValueOf(v))
+	return enc.limitOutput(func() error {
+		return enc.finish(enc.safeEncode(Key([]string{}), rv))
+	})
+}
+
+// EncodeList writes the slice or array v as an array of tables named key, with
+// a [[key]] header for every element. This is the counterpart of decoding a
+// document with just one array of tables in to a slice.
+//
+// Nothing is written if v is empty. It's an error if the elements of v aren't
+// tables (Go maps or structs).
+func (enc *Encoder) EncodeList(key string, v any) error {
+	var rv reflect.Value
+	if v != nil {
+		rv = enc.eval(reflect.ValueOf(v))
+	}
+	if k := rv.Kind(); k != reflect.Slice && k != reflect.Array {
+		return fmt.Errorf("toml: EncodeList needs a slice or array, not %s", fmtType(v))
+	}
+	if rv.Len() == 0 {
+		return nil
+	}
+	return enc.limitOutput(func() error {
+		return enc.finish(catchEncode(func() {
+			if !typeEqual(tomlArrayHash, enc.tomlTypeOfGo(rv)) {
+				encPanic(fmt.Errorf("toml: EncodeList needs a list of tables, not %s", rv.Type()))
+			}
+			enc.eArrayOfTables(Key{key}, rv)
+		}))
+	})
+}
+
+// limitOutput runs encode with the output written to a buffer if there's a
+// MaxOutputSize, and writes it to enc.w only if there's no error.
+func (enc *Encoder) limitOutput(encode func() error) error {
+	if enc.maxSize <= 0 {
+		return encode()
+	}
+	var (
+		w   = enc.w
+		buf = new(bytes.Buffer)
+	)
+	enc.w, enc.size, enc.sizeKey = bufio.NewWriter(buf), 0, nil
+	err := encode()
+	enc.w = w
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// checkSize returns a SizeLimitError if more than MaxOutputSize was written.
+func (enc *Encoder) checkSize() error {
+	if enc.maxSize <= 0 || enc.size <= enc.maxSize {
+		return nil
+	}
+	return SizeLimitError{Key: append(Key(nil), enc.sizeKey...), Limit: enc.maxSize, Size: enc.size}
+}
+
+// EstimateSize returns the size in bytes of the TOML document that
+// [Encoder.Encode] writes for v with the options in p, without keeping the
+// output in memory. The MaxOutputSize in p is ignored.
+//
+// The document is encoded to find the size, so this returns the same errors as
+// Encode, and the size is exact unless v has marshalers that don't always
+// return the same output.
+func EstimateSize(v any, p EncodeProfile) (int, error) {
+	var n countWriter
+	enc := NewEncoder(&n).Profile(p)
+	enc.maxSize = 0
+	err := enc.Encode(v)
+	return int(n), err
+}
+
+// EncodeSplit encodes v as several documents, with the options in p, for
+// generating a directory of configuration files. Every top-level table or array
+// of tables is written to the file decide returns for its key. All other
+// top-level keys, and tables for which decide returns "", are written to the
+// file decide returns for "". Keys written to the same file keep the order they
+// have in a single document.
+//
+// Every file is encoded before write is called for any of them, so nothing is
+// written if v can't be encoded. write is called once for every file, in the
+// order of the first key in it, and the first error it returns is returned.
+func EncodeSplit(v any, decide func(key string) string, write func(file string, data []byte) error, p EncodeProfile) error {
+	plan, err := NewEncoder(io.Discard).Profile(p).Plan(v)
+	if err != nil {
+		return err
+	}
+	var (
+		def   = decide("")
+		files = []string{def}
+		file  = make(map[string]string) // Top-level key → file.
+	)
+	for _, k := range plan {
+		if len(k.Key) != 1 {
+			continue
+		}
+		if _, ok := file[k.Key[0]]; ok {
+			continue
+		}
+		f := ""
+		if k.TOMLType == tomlHash.typeString() || k.TOMLType == tomlArrayHash.typeString() {
+			f = decide(k.Key[0])
+		}
+		if f == "" {
+			f = def
+		}
+		if !hasString(files, f) {
+			files = append(files, f)
+		}
+		file[k.Key[0]] = f
+	}
+
+	// Anything that's not in the plan, such as placeholders, is written to the
+	// default file.
+	data := make([][]byte, len(files))
+	for i, f := range files {
+		var b bytes.Buffer
+		enc := NewEncoder(&b).Profile(p)
+		enc.writeTop = func(key string) bool {
+			kf, ok := file[key]
+			return kf == f || (!ok && f == def)
+		}
+		if err := enc.Encode(v); err != nil {
+			return fmt.Errorf("toml: encoding %q: %w", f, err)
+		}
+		data[i] = b.Bytes()
+	}
+	for i, f := range files {
+		if i == 0 && len(data[i]) == 0 {
+			continue
+		}
+		if err := write(f, data[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipKey reports if the key isn't written by this encoder: a top-level key
+// for EncodeSplit, or the key field of a table in eKeyedMap.
+func (enc *Encoder) skipKey(key Key) bool {
+	if enc.skipped != nil && key.Equal(enc.skipped) {
+		return true
+	}
+	return enc.writeTop != nil && len(key) == 1 && !enc.writeTop(key[0])
+}
+
+// countWriter counts the bytes written to it, and discards them.
+type countWriter int
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	*c += countWriter(len(b))
+	return len(b), nil
+}
+
+// finish flushes the output after encoding a document, or returns err if it's
+// not nil.
+func (enc *Encoder) finish(err error) error {
 	if err != nil {
 		return err
 	}
+
+	// Newlines are only written before the next output, so there are never
+	// any extra newlines at the end. If there's no trailing newline then keep
+	// it pending, so it's written if Encode is called again.
+	if enc.pendingNL > 0 || enc.openLine {
+		enc.pendingNL = 1
+		if !enc.noFinalNL {
+			enc.flushNewlines()
+		}
+	}
+	if err := enc.checkSize(); err != nil {
+		return err
+	}
 	return enc.w.Flush()
 }
 
-func (enc *Encoder) safeEncode(key Key, rv reflect.Value) (err error) {
+// Plan returns all keys that would be written by [Encoder.Encode], in the same
+// order as they would be written, without writing anything.
+//
+// Tables are included as a key, as are each of the elements of an array of
+// tables (with TOMLType "ArrayHash"). Values inside inline tables and arrays
+// are not included separately.
+//
+// The same error is returned as Encode would return.
+func (enc *Encoder) Plan(v any) ([]PlannedKey, error) {
+	p := *enc
+	p.w, p.planning, p.plan, p.goPath = bufio.NewWriter(io.Discard), true, nil, ""
+	p.maxSize = 0
+	err := p.safeEncode(Key([]string{}), p.eval(reflect.ValueOf(v)))
+	if err != nil {
+		return nil, err
+	}
+	return p.plan, nil
+}
+
+// planKey records a key while planning.
+func (enc *Encoder) planKey(key Key, typ tomlType) {
+	if enc.maxSize > 0 {
+		enc.sizeKey = key
+	}
+	if !enc.planning || len(key) == 0 {
+		return
+	}
+	k := make(Key, len(key))
+	copy(k, key)
+	t := ""
+	if typ != nil {
+		t = typ.typeString()
+	}
+	enc.plan = append(enc.plan, PlannedKey{Key: k, TOMLType: t, GoPath: enc.goPath})
+}
+
+// withPath calls f with elem added to the Go path while planning.
+func (enc *Encoder) withPath(elem string, f func()) {
+	if !enc.planning {
+		f()
+		return
+	}
+	old := enc.goPath
+	if old == "" {
+		elem = strings.TrimPrefix(elem, ".")
+	}
+	enc.goPath = old + elem
+	defer func() { enc.goPath = old }()
+	f()
+}
+
+func (enc *Encoder) safeEncode(key Key, rv reflect.Value) error {
+	return catchEncode(func() { enc.encode(key, rv) })
+}
+
+// catchEncode runs f, returning the error from encPanic as an error.
+func catchEncode(f func()) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			if terr, ok := r.(tomlEncodeError); ok {
@@ -160,7 +955,7 @@ func (enc *Encoder) safeEncode(key Key, rv reflect.Value) (err error) {
 			panic(r)
 		}
 	}()
-	enc.encode(key, rv)
+	f()
 	return nil
 }
 
@@ -173,7 +968,13 @@ func (enc *Encoder) encode(key Key, rv reflect.Value) {
 		enc.writeKeyValue(key, rv, false)
 		return
 	case rv.Type() == primitiveType: // TODO: #76 would make this superfluous after implemented.
-		enc.encode(key, reflect.ValueOf(rv.Interface().(Primitive).undecoded))
+		enc.encode(key, eindirect(rv))
+		return
+	case isOrderedMap(rv):
+		enc.eTable(key, rv)
+		return
+	case lookupAdapter(enc.adapters, rv.Type()) != nil:
+		enc.writeKeyValue(key, rv, false)
 		return
 	}
 
@@ -186,7 +987,8 @@ func (enc *Encoder) encode(key Key, rv reflect.Value) {
 		reflect.Float32, reflect.Float64, reflect.String, reflect.Bool:
 		enc.writeKeyValue(key, rv, false)
 	case reflect.Array, reflect.Slice:
-		if typeEqual(tomlArrayHash, tomlTypeOfGo(rv)) {
+		rv = trimNil(rv)
+		if typeEqual(tomlArrayHash, enc.tomlTypeOfGo(rv)) {
 			enc.eArrayOfTables(key, rv)
 		} else {
 			enc.writeKeyValue(key, rv, false)
@@ -219,17 +1021,20 @@ func (enc *Encoder) eElement(rv reflect.Value) {
 	case time.Time: // Using TextMarshaler adds extra quotes, which we don't want.
 		format := time.RFC3339Nano
 		switch v.Location() {
-		case internal.LocalDatetime:
+		case LocalDatetimeZone:
 			format = "2006-01-02T15:04:05.999999999"
-		case internal.LocalDate:
+		case LocalDateZone:
 			format = "2006-01-02"
-		case internal.LocalTime:
+		case LocalTimeZone:
 			format = "15:04:05.999999999"
 		}
 		switch v.Location() {
 		default:
+			if enc.utc {
+				v = v.UTC()
+			}
 			enc.wf(v.Format(format))
-		case internal.LocalDatetime, internal.LocalDate, internal.LocalTime:
+		case LocalDatetimeZone, LocalDateZone, LocalTimeZone:
 			enc.wf(v.In(time.UTC).Format(format))
 		}
 		return
@@ -241,7 +1046,10 @@ func (enc *Encoder) eElement(rv reflect.Value) {
 		if s == nil {
 			encPanic(errors.New("MarshalTOML returned nil and no error"))
 		}
-		enc.w.Write(s)
+		// Any trailing newlines are written only if more output follows.
+		t := bytes.TrimRight(s, "\n")
+		enc.wf("%s", t)
+		enc.pendingNL += len(s) - len(t)
 		return
 	case encoding.TextMarshaler:
 		s, err := v.MarshalText()
@@ -253,23 +1061,11 @@ func (enc *Encoder) eElement(rv reflect.Value) {
 		}
 		enc.writeQuoted(string(s))
 		return
-	case time.Duration:
-		enc.writeQuoted(v.String())
+	}
+	if a := lookupAdapter(enc.adapters, rv.Type()); a != nil {
+		v, _ := enc.adapt(a, rv)
+		enc.eElement(reflect.ValueOf(v))
 		return
-	case json.Number:
-		n, _ := rv.Interface().(json.Number)
-
-		if n == "" { /// Useful zero value.
-			enc.w.WriteByte('0')
-			return
-		} else if v, err := n.Int64(); err == nil {
-			enc.eElement(reflect.ValueOf(v))
-			return
-		} else if v, err := n.Float64(); err == nil {
-			enc.eElement(reflect.ValueOf(v))
-			return
-		}
-		encPanic(fmt.Errorf("unable to convert %q to int64 or float64", n))
 	}
 
 	switch rv.Kind() {
@@ -281,9 +1077,13 @@ func (enc *Encoder) eElement(rv reflect.Value) {
 	case reflect.Bool:
 		enc.wf(strconv.FormatBool(rv.Bool()))
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		enc.wf(strconv.FormatInt(rv.Int(), 10))
+		if n := rv.Int(); n < 0 { /// Can't have a sign with a base prefix.
+			enc.wf(strconv.FormatInt(n, 10))
+		} else {
+			enc.writeUint(uint64(n))
+		}
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		enc.wf(strconv.FormatUint(rv.Uint(), 10))
+		enc.writeUint(rv.Uint())
 	case reflect.Float32:
 		f := rv.Float()
 		if math.IsNaN(f) {
@@ -315,20 +1115,60 @@ func (enc *Encoder) eElement(rv reflect.Value) {
 			enc.wf(floatAddDecimal(strconv.FormatFloat(f, 'f', -1, 64)))
 		}
 	case reflect.Array, reflect.Slice:
+		if isOrderedMap(rv) {
+			enc.eMap(nil, rv, true)
+			break
+		}
 		enc.eArrayOrSliceElement(rv)
 	case reflect.Struct:
-		enc.eStruct(nil, rv, true)
+		k := enc.valKey
+		enc.valKey = "" /// Keys in inline tables don't have a format.
+		if isOrderedMap(rv) {
+			enc.eMap(nil, rv, true)
+		} else {
+			enc.eStruct(nil, rv, true)
+		}
+		enc.valKey = k
 	case reflect.Map:
+		k := enc.valKey
+		enc.valKey = ""
 		enc.eMap(nil, rv, true)
+		enc.valKey = k
 	case reflect.Interface:
 		enc.eElement(rv.Elem())
 	default:
-		encPanic(fmt.Errorf("unexpected type: %s", fmtType(rv.Interface())))
+		encPanic(errUnsupported{typ: rv.Type()})
 	}
 }
 
-// By the TOML spec, all floats must have a decimal with at least one number on
-// either side.
+// writeUint writes n in the base from the MetaData.Format for the value.
+func (enc *Encoder) writeUint(n uint64) {
+	var f Format
+	if enc.meta != nil && enc.valKey != "" {
+		f = enc.meta.formats[enc.valKey]
+	}
+	switch f.Base {
+	case 2:
+		enc.wf("0b" + strconv.FormatUint(n, 2))
+	case 8:
+		enc.wf("0o" + strconv.FormatUint(n, 8))
+	case 16:
+		enc.wf("0x" + strconv.FormatUint(n, 16))
+	default:
+		enc.wf(strconv.FormatUint(n, 10))
+	}
+}
+
+// elemKey gets the valKey for the element i of the array with the valKey k.
+func elemKey(k string, i int) string {
+	if k == "" {
+		return ""
+	}
+	return k + "[" + strconv.Itoa(i) + "]"
+}
+
+// By the TOML spec, all floats must have a decimal with at least one number on
+// either side.
 func floatAddDecimal(fstr string) string {
 	if !strings.Contains(fstr, ".") {
 		return fstr + ".0"
@@ -336,20 +1176,57 @@ func floatAddDecimal(fstr string) string {
 	return fstr
 }
 
+// writeQuoted writes s as a basic string. Everything that can't appear in a
+// basic string as-is gets escaped, so this is safe for any input.
 func (enc *Encoder) writeQuoted(s string) {
-	enc.wf("\"%s\"", dblQuotedReplacer.Replace(s))
+	enc.wf("%s", QuoteString(s))
+}
+
+// QuoteString returns s as a TOML basic string, including the surrounding
+// quotes. This is the same as how the [Encoder] writes strings.
+//
+// Quotes, backslashes, control characters, and DEL are escaped; everything
+// else is copied as-is. Invalid UTF-8 is copied as-is too, and the result won't
+// be valid TOML if s has any.
+func QuoteString(s string) string {
+	return `"` + dblQuotedReplacer.Replace(s) + `"`
+}
+
+// QuoteKey returns s as a single TOML key, which is a bare key if possible and
+// a quoted key otherwise. This is the same as how the [Encoder] writes keys.
+//
+// In quoted keys control characters and other unprintable characters are
+// escaped as \uXXXX. Invalid UTF-8 is copied as-is; the Encoder returns an
+// error for keys with invalid UTF-8.
+func QuoteKey(s string) string {
+	return Key{s}.maybeQuoted(0)
 }
 
 func (enc *Encoder) eArrayOrSliceElement(rv reflect.Value) {
-	length := rv.Len()
+	rv = trimNil(rv)
+	var (
+		length = rv.Len()
+		k      = enc.valKey
+		i      int
+	)
+	defer func() {
+		if r := recover(); r != nil {
+			addPath(r, "["+strconv.Itoa(i)+"]", false)
+		}
+	}()
 	enc.wf("[")
-	for i := 0; i < length; i++ {
-		elem := eindirect(rv.Index(i))
+	for i = 0; i < length; i++ {
+		elem := enc.eval(rv.Index(i))
+		if isNil(elem) {
+			encPanic(errArrayNilElement)
+		}
+		enc.valKey = elemKey(k, i)
 		enc.eElement(elem)
 		if i != length-1 {
 			enc.wf(", ")
 		}
 	}
+	enc.valKey = k
 	enc.wf("]")
 }
 
@@ -357,32 +1234,197 @@ func (enc *Encoder) eArrayOfTables(key Key, rv reflect.Value) {
 	if len(key) == 0 {
 		encPanic(errNoKey)
 	}
+	if enc.maxDepth > 0 && len(key) > enc.maxDepth {
+		return
+	}
 	for i := 0; i < rv.Len(); i++ {
-		trv := eindirect(rv.Index(i))
+		trv := enc.eval(rv.Index(i))
 		if isNil(trv) {
 			continue
 		}
-		enc.newline()
-		enc.wf("%s[[%s]]", enc.indentStr(key), key)
-		enc.newline()
-		enc.eMapOrStruct(key, trv, false)
+		enc.withPath("["+strconv.Itoa(i)+"]", func() {
+			enc.planKey(key, tomlArrayHash)
+			enc.header = nil
+			enc.tableSpacing(key, true)
+			if enc.meta != nil && len(enc.meta.comments) > 0 {
+				if enc.arrIdx == nil {
+					enc.arrIdx = make(map[string]int)
+				}
+				enc.arrIdx[key.String()] = i
+			}
+			c := enc.comment(key)
+			enc.writeCommentAbove(key, c)
+			enc.wf("%s[[%s]]", enc.indentStr(key), key)
+			enc.annotateHeader(trv)
+			enc.writeCommentAfter(c)
+			enc.newline()
+			enc.eMapOrStruct(key, trv, false)
+		})
+	}
+}
+
+// eKeyedMap writes a map for a field with the "keyed" option as an array of
+// tables, ordered by the map key. The map key is written as the keyField key,
+// instead of the keyField in the table.
+func (enc *Encoder) eKeyedMap(key Key, rv reflect.Value, keyField string) {
+	for _, mapKey := range sortedMapKeys(rv) {
+		trv := enc.eval(rv.MapIndex(mapKey.v))
+		if isNil(trv) {
+			continue
+		}
+		if trv.Kind() != reflect.Map && trv.Kind() != reflect.Struct && !isOrderedMap(trv) {
+			encPanic(fmt.Errorf("keyed field %q must be a map of tables, but has elements of type %s",
+				key, trv.Type()))
+		}
+		enc.withPath("["+strconv.Quote(mapKey.name)+"]", func() {
+			enc.planKey(key, tomlArrayHash)
+			enc.header = nil
+			enc.tableSpacing(key, true)
+			enc.wf("%s[[%s]]", enc.indentStr(key), key)
+			enc.annotateHeader(trv)
+			enc.newline()
+			enc.field = nil
+
+			// The map key is always written, as the key field may be empty
+			// or missing.
+			if v := keyValue(trv, keyField); v.IsValid() {
+				v = enc.eval(v)
+				if !isEmpty(v) && (v.Kind() != reflect.String || v.String() != mapKey.name) {
+					encPanic(fmt.Errorf("keyed field %q: %q is %v in the table for the map key %q",
+						key, keyField, v.Interface(), mapKey.name))
+				}
+			}
+			enc.writeKeyValue(key.add(keyField), reflect.ValueOf(mapKey.name), false)
+			prev := enc.skipped
+			enc.skipped = key.add(keyField)
+			enc.eMapOrStruct(key, trv, false)
+			enc.skipped = prev
+		})
 	}
 }
 
+// keyValue gets the value of the TOML key k in the map or struct rv, or the
+// zero Value if it doesn't have the key.
+func keyValue(rv reflect.Value, k string) reflect.Value {
+	if om, ok := orderedMap(rv); ok {
+		v, _ := om.Get(k)
+		return reflect.ValueOf(v)
+	}
+	if rv.Kind() == reflect.Map {
+		if rv.Type().Key().Kind() != reflect.String {
+			return reflect.Value{}
+		}
+		return rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key()))
+	}
+	for _, f := range cachedTypeFields(rv.Type()) {
+		if f.name == k {
+			v, _ := rv.FieldByIndexErr(f.index)
+			return v
+		}
+	}
+	return reflect.Value{}
+}
+
 func (enc *Encoder) eTable(key Key, rv reflect.Value) {
-	if len(key) == 1 {
-		// Output an extra newline between top-level tables.
-		// (The newline isn't written if nothing else has been written though.)
-		enc.newline()
+	if enc.maxDepth > 0 && len(key) > enc.maxDepth {
+		return
+	}
+	if len(key) == 0 {
+		enc.eMapOrStruct(key, rv, false)
+		return
 	}
-	if len(key) > 0 {
+
+	enc.planKey(key, tomlHash)
+	enc.header = nil // A parent's header is implied by this one.
+	header := func() {
+		enc.tableSpacing(key, false)
+		c := enc.comment(key)
+		enc.writeCommentAbove(key, c)
 		enc.wf("%s[%s]", enc.indentStr(key), key)
+		enc.annotateHeader(rv)
+		enc.writeCommentAfter(c)
 		enc.newline()
 	}
+	if !enc.isImplicit(key) {
+		header()
+		enc.eMapOrStruct(key, rv, false)
+		return
+	}
+
+	// Only write the header when something is written in the table other than
+	// sub-tables, or if nothing is written at all.
+	enc.header = header
 	enc.eMapOrStruct(key, rv, false)
+	if enc.header != nil {
+		enc.header = nil
+		header()
+	}
+}
+
+// isImplicit reports if the table key was defined implicitly in the document
+// of the MetaData.
+func (enc *Encoder) isImplicit(key Key) bool {
+	if enc.meta == nil || enc.planning {
+		return false
+	}
+	if _, ok := enc.meta.keyInfo[key.String()]; ok {
+		return false
+	}
+	v, _ := enc.meta.Any(key...)
+	_, ok := v.(map[string]any)
+	return ok
+}
+
+// isDotted reports if the table key was defined with dotted keys in the
+// document of the MetaData, and the map rv can still be written that way: it's
+// not empty, and all tables in it are dotted as well.
+func (enc *Encoder) isDotted(key Key, rv reflect.Value) bool {
+	if enc.meta == nil || enc.planning || rv.Kind() != reflect.Map || isOrderedMap(rv) || rv.Len() == 0 {
+		return false
+	}
+	if _, ok := enc.meta.dotted[key.String()]; !ok {
+		return false
+	}
+	if _, ok := enc.meta.keyInfo[key.String()]; ok { /// Has a header.
+		return false
+	}
+	for _, k := range sortedMapKeys(rv) {
+		v := enc.eval(rv.MapIndex(k.v))
+		if typeIsTable(enc.tomlTypeOfGo(v)) && !enc.isDotted(key.add(k.name), v) {
+			return false
+		}
+	}
+	return true
+}
+
+// eDotted writes the table key with dotted keys, as part of the parent table.
+func (enc *Encoder) eDotted(key Key, rv reflect.Value) {
+	enc.planKey(key, tomlHash)
+	enc.dotted++
+	defer func() { enc.dotted-- }()
+	enc.eMap(key, rv, false)
+}
+
+// tableSpacing writes a blank line before a table or array table header, if
+// the Spacing calls for it.
+func (enc *Encoder) tableSpacing(key Key, arrayTable bool) {
+	switch enc.spacing {
+	case SpacingCompact:
+	case SpacingLoose:
+		enc.blankLine()
+	default:
+		if arrayTable || len(key) == 1 {
+			enc.blankLine()
+		}
+	}
 }
 
 func (enc *Encoder) eMapOrStruct(key Key, rv reflect.Value, inline bool) {
+	enc.field = nil
+	if isOrderedMap(rv) {
+		enc.eMap(key, rv, inline)
+		return
+	}
 	switch rv.Kind() {
 	case reflect.Map:
 		enc.eMap(key, rv, inline)
@@ -395,37 +1437,110 @@ func (enc *Encoder) eMapOrStruct(key Key, rv reflect.Value, inline bool) {
 }
 
 func (enc *Encoder) eMap(key Key, rv reflect.Value, inline bool) {
-	rt := rv.Type()
-	if rt.Key().Kind() != reflect.String {
-		encPanic(errNonString)
+	var (
+		mapKeys []string
+		index   func(string) reflect.Value
+	)
+	if om, ok := orderedMap(rv); ok {
+		mapKeys = om.Keys()
+		index = func(k string) reflect.Value {
+			v, _ := om.Get(k)
+			return reflect.ValueOf(&v).Elem()
+		}
+	} else {
+		keys := sortedMapKeys(rv)
+		byName := make(map[string]reflect.Value, len(keys))
+		for _, k := range keys {
+			mapKeys = append(mapKeys, k.name)
+			byName[k.name] = k.v
+		}
+		index = func(k string) reflect.Value { return rv.MapIndex(byName[k]) }
+		if enc.keySort != nil {
+			sort.SliceStable(mapKeys, func(i, j int) bool { return enc.keySort(key, mapKeys[i], mapKeys[j]) })
+		}
+	}
+	order, hasOrder := enc.keyOrder[key.String()]
+	if hasOrder && !isOrderedMap(rv) {
+		mapKeys = orderKeys(key, mapKeys, order)
 	}
 
-	// Sort keys so that we have deterministic output. And write keys directly
-	// underneath this key first, before writing sub-structs or sub-maps.
-	var mapKeysDirect, mapKeysSub []reflect.Value
-	for _, mapKey := range rv.MapKeys() {
-		if typeIsTable(tomlTypeOfGo(eindirect(rv.MapIndex(mapKey)))) {
+	// Write keys directly underneath this key first, before writing
+	// sub-structs or sub-maps.
+	var (
+		mapKeysDirect, mapKeysSub []string
+		names                     = make(map[string]bool, len(mapKeys))
+		cur                       string // Key being written, for errors in inline tables.
+	)
+	if inline {
+		defer func() {
+			if r := recover(); r != nil {
+				addPath(r, "."+Key{cur}.String(), false)
+			}
+		}()
+	}
+	for _, mapKey := range mapKeys {
+		cur = mapKey
+		checkKey(key.add(mapKey))
+		names[mapKey] = true
+		if typeIsTable(enc.tomlTypeOfGo(enc.eval(index(mapKey)))) {
 			mapKeysSub = append(mapKeysSub, mapKey)
 		} else {
 			mapKeysDirect = append(mapKeysDirect, mapKey)
 		}
 	}
 
-	writeMapKeys := func(mapKeys []reflect.Value, trailC bool) {
-		sort.Slice(mapKeys, func(i, j int) bool { return mapKeys[i].String() < mapKeys[j].String() })
+	if enc.meta != nil && !inline && !isOrderedMap(rv) && !hasOrder {
+		pos := make(map[string]int, len(mapKeysSub))
+		for _, k := range mapKeysSub {
+			pos[k] = math.MaxInt
+			kk := key.add(k).String()
+			if ki, ok := enc.meta.keyInfo[kk]; ok {
+				pos[k] = ki.pos.Start
+			} else if p, ok := enc.metaPos[kk]; ok {
+				pos[k] = p.Start
+			}
+		}
+		sort.SliceStable(mapKeysSub, func(i, j int) bool { return pos[mapKeysSub[i]] < pos[mapKeysSub[j]] })
+	}
+
+	// Tables with dotted keys are written after the other keys, as they're
+	// part of this table.
+	var mapKeysDotted []string
+	if enc.meta != nil && len(enc.meta.dotted) > 0 && !inline {
+		sub := mapKeysSub[:0:0]
+		for _, mapKey := range mapKeysSub {
+			if enc.isDotted(key.add(mapKey), enc.eval(index(mapKey))) {
+				mapKeysDotted = append(mapKeysDotted, mapKey)
+			} else {
+				sub = append(sub, mapKey)
+			}
+		}
+		mapKeysSub = sub
+	}
+
+	writeMapKeys := func(mapKeys []string, trailC, direct bool) {
 		for i, mapKey := range mapKeys {
-			val := eindirect(rv.MapIndex(mapKey))
+			cur = mapKey
+			if enc.skipKey(key.add(mapKey)) {
+				continue
+			}
+			val := enc.eval(index(mapKey))
+			if direct && !inline && enc.writePlaceholder(key.add(mapKey), val) {
+				continue
+			}
 			if isNil(val) {
 				continue
 			}
 
 			if inline {
-				enc.writeKeyValue(Key{mapKey.String()}, val, true)
+				enc.writeKeyValue(Key{mapKey}, val, true)
 				if trailC || i != len(mapKeys)-1 {
 					enc.wf(", ")
 				}
 			} else {
-				enc.encode(key.add(mapKey.String()), val)
+				enc.withPath("["+strconv.Quote(mapKey)+"]", func() {
+					enc.encode(key.add(mapKey), val)
+				})
 			}
 		}
 	}
@@ -433,13 +1548,92 @@ func (enc *Encoder) eMap(key Key, rv reflect.Value, inline bool) {
 	if inline {
 		enc.wf("{")
 	}
-	writeMapKeys(mapKeysDirect, len(mapKeysSub) > 0)
-	writeMapKeys(mapKeysSub, false)
+	writeMapKeys(mapKeysDirect, len(mapKeysSub) > 0, true)
+	if !inline {
+		enc.writePlaceholders(key, names)
+	}
+	for _, mapKey := range mapKeysDotted {
+		if !enc.skipKey(key.add(mapKey)) {
+			enc.eDotted(key.add(mapKey), enc.eval(index(mapKey)))
+		}
+	}
+	writeMapKeys(mapKeysSub, false, false)
 	if inline {
 		enc.wf("}")
 	}
 }
 
+// orderKeys returns the sorted keys with the keys in order first, for
+// Encoder.KeyOrder.
+func orderKeys(key Key, keys, order []string) []string {
+	have := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		have[k] = true
+	}
+	var (
+		seen    = make(map[string]bool, len(order))
+		ordered = make([]string, 0, len(keys))
+	)
+	for _, k := range order {
+		if seen[k] {
+			encPanic(fmt.Errorf("toml: KeyOrder for %q has the key %q more than once", key, k))
+		}
+		seen[k] = true
+		if have[k] {
+			ordered = append(ordered, k)
+		}
+	}
+	for _, k := range keys {
+		if !seen[k] {
+			ordered = append(ordered, k)
+		}
+	}
+	return ordered
+}
+
+// mapKey is a key of a Go map, with the name it's written as.
+type mapKey struct {
+	name string
+	v    reflect.Value
+}
+
+// sortedMapKeys returns the keys of the map rv, sorted by name so the output is
+// deterministic.
+//
+// Keys with a string kind are used as-is, and keys that implement
+// [encoding.TextMarshaler] are written as the result of MarshalText. Any other
+// key type is an error, as is two keys with the same name.
+func sortedMapKeys(rv reflect.Value) []mapKey {
+	kt := rv.Type().Key()
+	if kt.Kind() != reflect.String && !kt.Implements(marshalText) {
+		encPanic(errNonString)
+	}
+
+	keys := make([]mapKey, 0, rv.Len())
+	for iter := rv.MapRange(); iter.Next(); {
+		k := iter.Key()
+		if kt.Kind() == reflect.String {
+			keys = append(keys, mapKey{name: k.String(), v: k})
+			continue
+		}
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			encPanic(fmt.Errorf("toml: cannot encode a nil map key of type %s", kt))
+		}
+		text, err := k.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			encPanic(err)
+		}
+		keys = append(keys, mapKey{name: string(text), v: k})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].name < keys[j].name })
+	for i := 1; i < len(keys); i++ {
+		if keys[i].name == keys[i-1].name {
+			encPanic(fmt.Errorf("toml: map has more than one key that's written as %q", keys[i].name))
+		}
+	}
+	return keys
+}
+
 const is32Bit = (32 << (^uint(0) >> 63)) == 32
 
 func pointerTo(t reflect.Type) reflect.Type {
@@ -449,6 +1643,98 @@ func pointerTo(t reflect.Type) reflect.Type {
 	return t
 }
 
+// hidePromoted removes fields that are hidden by a field with the same key
+// that's embedded less deeply, or at the same depth but with a toml tag. These
+// are the same rules as used for decoding, except that fields at the same depth
+// are all kept.
+func hidePromoted(rt reflect.Type, direct, sub [][]int) ([][]int, [][]int) {
+	rank := func(index []int) (string, int) {
+		f := rt.FieldByIndex(index)
+		if name := getOptions(f.Tag).name; name != "" {
+			return name, 2 * len(index)
+		}
+		return f.Name, 2*len(index) + 1
+	}
+	best := make(map[string]int)
+	for _, fields := range [][][]int{direct, sub} {
+		for _, index := range fields {
+			if name, r := rank(index); best[name] == 0 || r < best[name] {
+				best[name] = r
+			}
+		}
+	}
+	keep := func(fields [][]int) [][]int {
+		out := fields[:0]
+		for _, index := range fields {
+			if name, r := rank(index); r == best[name] {
+				out = append(out, index)
+			}
+		}
+		return out
+	}
+	return keep(direct), keep(sub)
+}
+
+// checkDuplicateFields panics if two fields have the same key, which would
+// write an invalid document. Promoted fields that are hidden should already be
+// removed with hidePromoted.
+func checkDuplicateFields(rt reflect.Type, direct, sub [][]int) {
+	seen := make(map[string][]int)
+	for _, fields := range [][][]int{direct, sub} {
+		for _, index := range fields {
+			f := rt.FieldByIndex(index)
+			name := f.Name
+			if n := getOptions(f.Tag).name; n != "" {
+				name = n
+			}
+			if prev, ok := seen[name]; ok {
+				encPanic(fmt.Errorf("toml: duplicate key %q (fields %s and %s)", name,
+					fieldPath(rt, prev)[1:], fieldPath(rt, index)[1:]))
+			}
+			seen[name] = index
+		}
+	}
+}
+
+// checkUnion panics if more than one variant of the union rv for a field with
+// the "union" option is set, as the document can't be decoded again.
+func checkUnion(key Key, rv reflect.Value) {
+	if rv.Kind() != reflect.Struct {
+		encPanic(fmt.Errorf("toml: union field for key '%s' must be a struct, not %s", key, rv.Type()))
+	}
+	var set string
+	for _, f := range cachedTypeFields(rv.Type()) {
+		if rv.Type().FieldByIndex(f.index).Type.Kind() != reflect.Ptr {
+			continue
+		}
+		if v, err := rv.FieldByIndexErr(f.index); err != nil || v.IsNil() {
+			continue
+		}
+		if set != "" {
+			encPanic(fmt.Errorf("toml: more than one variant of the union '%s' is set: %q and %q", key, set, f.name))
+		}
+		set = f.name
+	}
+}
+
+// quoteScalar converts rv to a string for fields with the "string" option.
+func quoteScalar(key Key, rv reflect.Value) reflect.Value {
+	switch rv.Kind() {
+	case reflect.String:
+		return rv
+	case reflect.Bool:
+		return reflect.ValueOf(strconv.FormatBool(rv.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.ValueOf(strconv.FormatInt(rv.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflect.ValueOf(strconv.FormatUint(rv.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		return reflect.ValueOf(strconv.FormatFloat(rv.Float(), 'f', -1, rv.Type().Bits()))
+	}
+	encPanic(fmt.Errorf("toml: the string option for key '%s' can only be used on integer, float, boolean, and string fields, not %s", key, rv.Type()))
+	return rv
+}
+
 func (enc *Encoder) eStruct(key Key, rv reflect.Value, inline bool) {
 	// Write keys for fields directly under this key first, because if we write
 	// a field that creates a new table then all keys under it will be in that
@@ -461,20 +1747,41 @@ func (enc *Encoder) eStruct(key Key, rv reflect.Value, inline bool) {
 		rt                      = rv.Type()
 		fieldsDirect, fieldsSub [][]int
 		addFields               func(rt reflect.Type, rv reflect.Value, start []int)
+		names                   = make(map[string]bool) // Key names, for placeholders.
+		embedded                bool                    // Added fields from an embedded struct?
+		cur                     string                  // Key being written, for errors in inline tables.
 	)
+	if inline {
+		defer func() {
+			if r := recover(); r != nil {
+				addPath(r, "."+Key{cur}.String(), false)
+			}
+		}()
+	}
+	if !enc.allowOpaque && isOpaqueStruct(rt) {
+		encPanic(fmt.Errorf("type %s for key '%s' has no exported fields and no marshaler; implement MarshalTOML or MarshalText",
+			rt, key))
+	}
 	addFields = func(rt reflect.Type, rv reflect.Value, start []int) {
 		for i := 0; i < rt.NumField(); i++ {
 			f := rt.Field(i)
 			isEmbed := f.Anonymous && pointerTo(f.Type).Kind() == reflect.Struct
 			if f.PkgPath != "" && !isEmbed { /// Skip unexported fields.
+				if name := getOptions(f.Tag).name; name != "" {
+					encPanic(fmt.Errorf("toml: can't encode the unexported field %s.%s with the tag %q; export it by starting the name with an uppercase letter",
+						rt, f.Name, name))
+				}
 				continue
 			}
 			opts := getOptions(f.Tag)
 			if opts.skip {
 				continue
 			}
+			if cur = f.Name; opts.name != "" {
+				cur = opts.name
+			}
 
-			frv := eindirect(rv.Field(i))
+			frv := enc.eval(rv.Field(i))
 
 			if is32Bit {
 				// Copy so it works correct on 32bit archs; not clear why this
@@ -490,14 +1797,34 @@ func (enc *Encoder) eStruct(key Key, rv reflect.Value, inline bool) {
 			// not anonymous, like encoding/json does.
 			//
 			// Non-struct anonymous fields use the normal encoding logic.
-			if isEmbed {
-				if getOptions(f.Tag).name == "" && frv.Kind() == reflect.Struct {
+			if isEmbed && opts.name == "" {
+				if opts.omitempty && isEmpty(frv) && !enc.noOmit {
+					continue
+				}
+				if frv.Kind() == reflect.Struct {
+					embedded = true
 					addFields(frv.Type(), frv, append(start, f.Index...))
 					continue
 				}
 			}
 
-			if typeIsTable(tomlTypeOfGo(frv)) {
+			if opts.name != "" {
+				checkKey(key.add(opts.name))
+				names[opts.name] = true
+			} else {
+				names[f.Name] = true
+			}
+
+			tv := frv
+			if enc.commentOmitted && isNil(tv) { /// May be written as a comment.
+				switch tv.Kind() {
+				case reflect.Ptr:
+					tv = reflect.Zero(tv.Type().Elem())
+				case reflect.Map:
+					tv = reflect.MakeMap(tv.Type())
+				}
+			}
+			if typeIsTable(enc.tomlTypeOfGo(tv)) {
 				fieldsSub = append(fieldsSub, append(start, f.Index...))
 			} else {
 				fieldsDirect = append(fieldsDirect, append(start, f.Index...))
@@ -505,8 +1832,15 @@ func (enc *Encoder) eStruct(key Key, rv reflect.Value, inline bool) {
 		}
 	}
 	addFields(rt, rv, nil)
+	if embedded {
+		fieldsDirect, fieldsSub = hidePromoted(rt, fieldsDirect, fieldsSub)
+	}
+	checkDuplicateFields(rt, fieldsDirect, fieldsSub)
 
-	writeFields := func(fields [][]int) {
+	// asValue is set for fields that are written as "key = value" even if
+	// they're tables, for PreserveFieldOrder.
+	nInline := 0
+	writeFields := func(fields [][]int, direct, asValue bool) {
 		for _, fieldIndex := range fields {
 			fieldType := rt.FieldByIndex(fieldIndex)
 			fieldVal := rv.FieldByIndex(fieldIndex)
@@ -515,46 +1849,275 @@ func (enc *Encoder) eStruct(key Key, rv reflect.Value, inline bool) {
 			if opts.skip {
 				continue
 			}
-			if opts.omitempty && isEmpty(fieldVal) {
+			keyName := fieldType.Name
+			if opts.name != "" {
+				keyName = opts.name
+			}
+			cur = keyName
+			if enc.skipKey(key.add(keyName)) {
 				continue
 			}
 
-			fieldVal = eindirect(fieldVal)
+			if direct && !inline && enc.writePlaceholder(key.add(keyName), enc.eval(fieldVal)) {
+				continue
+			}
+			if !inline {
+				enc.field = &fieldNote{typ: fieldType.Type, optional: opts.omitempty || opts.omitzero}
+			}
 
-			if isNil(fieldVal) { /// Don't write anything for nil fields.
+			if opts.omitempty && isEmpty(fieldVal) && !enc.noOmit {
+				enc.writeOmitted(key.add(keyName), fieldVal, inline)
 				continue
 			}
 
-			keyName := fieldType.Name
-			if opts.name != "" {
-				keyName = opts.name
+			fieldVal = enc.eval(fieldVal)
+
+			if isNil(fieldVal) { /// Don't write anything for nil fields.
+				continue
 			}
 
-			if opts.omitzero && isZero(fieldVal) {
+			if opts.omitzero && isZero(fieldVal) && !enc.noOmit {
+				enc.writeOmitted(key.add(keyName), fieldVal, inline)
 				continue
 			}
+			if opts.union {
+				checkUnion(key.add(keyName), fieldVal)
+			}
+			if opts.asString {
+				fieldVal = quoteScalar(key.add(keyName), fieldVal)
+			}
 
 			if inline {
-				enc.writeKeyValue(Key{keyName}, fieldVal, true)
-				if fieldIndex[0] != len(fields)-1 {
+				if nInline > 0 {
 					enc.wf(", ")
 				}
+				nInline++
+				enc.writeKeyValue(Key{keyName}, fieldVal, true)
 			} else {
-				enc.encode(key.add(keyName), fieldVal)
+				enc.withPath(fieldPath(rt, fieldIndex), func() {
+					switch {
+					case opts.keyed != "" && fieldVal.Kind() == reflect.Map:
+						enc.eKeyedMap(key.add(keyName), fieldVal, opts.keyed)
+					case asValue && !direct:
+						enc.writeKeyValue(key.add(keyName), fieldVal, false)
+					default:
+						enc.encode(key.add(keyName), fieldVal)
+					}
+				})
 			}
+			enc.field = nil
 		}
 	}
 
+	if enc.keepOrd && !inline {
+		enc.eStructOrdered(key, rv, fieldsDirect, fieldsSub, names, writeFields)
+		return
+	}
+
 	if inline {
 		enc.wf("{")
 	}
-	writeFields(fieldsDirect)
-	writeFields(fieldsSub)
+	writeFields(fieldsDirect, true, false)
+	if !inline {
+		enc.writePlaceholders(key, names)
+	}
+	writeFields(fieldsSub, false, false)
 	if inline {
 		enc.wf("}")
 	}
 }
 
+// eStructOrdered writes the fields of a struct in declaration order, for
+// PreserveFieldOrder. Tables before the last field that isn't a table are
+// written as inline tables.
+func (enc *Encoder) eStructOrdered(key Key, rv reflect.Value, fieldsDirect, fieldsSub [][]int,
+	names map[string]bool, writeFields func([][]int, bool, bool)) {
+	type field struct {
+		index  []int
+		direct bool
+	}
+	var (
+		rt     = rv.Type()
+		fields = make([]field, 0, len(fieldsDirect)+len(fieldsSub))
+		keyed  [][]int
+	)
+	for _, f := range fieldsDirect {
+		fields = append(fields, field{index: f, direct: true})
+	}
+	for _, f := range fieldsSub {
+		if getOptions(rt.FieldByIndex(f).Tag).keyed != "" {
+			keyed = append(keyed, f)
+			continue
+		}
+		fields = append(fields, field{index: f})
+	}
+	// The field indexes sort in the same order as the fields are declared,
+	// also for fields from embedded structs.
+	sort.SliceStable(fields, func(i, j int) bool {
+		a, b := fields[i].index, fields[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	last := -1
+	for i, f := range fields {
+		if f.direct {
+			last = i
+		}
+	}
+	for i, f := range fields {
+		if i == last+1 {
+			enc.writePlaceholders(key, names)
+		}
+		writeFields([][]int{f.index}, f.direct, i < last)
+	}
+	if last == len(fields)-1 {
+		enc.writePlaceholders(key, names)
+	}
+	writeFields(keyed, false, false)
+}
+
+// writeOmitted writes the omitted field val as a comment, if CommentOmitted is
+// set.
+func (enc *Encoder) writeOmitted(key Key, val reflect.Value, inline bool) {
+	if !enc.commentOmitted || inline || enc.planning {
+		return
+	}
+	val = enc.eval(val)
+	switch {
+	case val.Kind() == reflect.Ptr && val.IsNil():
+		val = reflect.New(val.Type().Elem()).Elem()
+	case val.Kind() == reflect.Map && val.IsNil():
+		val = reflect.MakeMap(val.Type())
+	}
+	if !val.IsValid() || isNil(val) && val.Kind() == reflect.Interface {
+		return
+	}
+
+	// Write the value as if it wasn't omitted, and then comment every line.
+	var (
+		buf = new(bytes.Buffer)
+		sub = *enc
+	)
+	sub.w, sub.hasWritten, sub.wroteBlank, sub.pendingNL, sub.openLine = bufio.NewWriter(buf), false, false, 0, false
+	sub.commentOmitted, sub.noOmit, sub.meta, sub.maxSize = false, true, nil, 0
+	if enc.commentDepth > 0 {
+		sub.maxDepth = len(key) + enc.commentDepth - 1
+	}
+	sub.encode(key, val)
+	if err := sub.w.Flush(); err != nil {
+		encPanic(err)
+	}
+
+	if typeIsTable(enc.tomlTypeOfGo(val)) {
+		enc.tableSpacing(key, false)
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line == "" {
+			enc.blankLine()
+			continue
+		}
+		text := strings.TrimLeft(line, " \t")
+		enc.wf("%s# %s", line[:len(line)-len(text)], text)
+		enc.newline()
+	}
+}
+
+// writePlaceholder writes the placeholder for key if there is one and val is
+// empty, and reports if it was written.
+func (enc *Encoder) writePlaceholder(key Key, val reflect.Value) bool {
+	if enc.meta == nil || enc.planning {
+		return false
+	}
+	if val.IsValid() && !isNil(val) && !isEmpty(val) && !isZero(val) {
+		return false
+	}
+	for _, p := range enc.meta.placeholders {
+		if p.key.Equal(key) {
+			enc.writePlaceholderComment(key, p.hint)
+			return true
+		}
+	}
+	return false
+}
+
+// writePlaceholders writes all placeholders directly under key that aren't in
+// names.
+func (enc *Encoder) writePlaceholders(key Key, names map[string]bool) {
+	if enc.meta == nil || enc.planning {
+		return
+	}
+	for _, p := range enc.meta.placeholders {
+		if p.key.Depth() == key.Depth()+1 && p.key.HasPrefix(key) && !names[p.key.Last()] && !enc.skipKey(p.key) {
+			enc.writePlaceholderComment(p.key, p.hint)
+		}
+	}
+}
+
+func (enc *Encoder) writePlaceholderComment(key Key, hint string) {
+	if len(key) == 1 && enc.spacing == SpacingLoose {
+		enc.blankLine()
+	}
+	k := "# " + key.maybeQuoted(len(key)-1) + " ="
+	if hint == "" {
+		enc.wf("%s%s", enc.indentStr(key), k)
+		enc.newline()
+		return
+	}
+	for i, line := range strings.Split(hint, "\n") {
+		if i == 0 {
+			enc.wf("%s%s   # %s", enc.indentStr(key), k, line)
+		} else {
+			enc.wf("%s#%s# %s", enc.indentStr(key), strings.Repeat(" ", len(k)+2), line)
+		}
+		enc.newline()
+	}
+}
+
+// fieldPath gets the Go path for the field index, including the names of any
+// embedded structs, e.g. ".Embed.Field".
+func fieldPath(rt reflect.Type, index []int) string {
+	var b strings.Builder
+	for _, i := range index {
+		rt = pointerTo(rt)
+		f := rt.Field(i)
+		b.WriteString("." + f.Name)
+		rt = f.Type
+	}
+	return b.String()
+}
+
+// adapt converts rv with the adapter and returns the value and its TOML type.
+func (enc *Encoder) adapt(a TypeAdapter, rv reflect.Value) (any, tomlType) {
+	if d, ok := a.(durationAdapter); ok {
+		d.format = enc.durFmt
+		a = d
+	}
+	v, typ, err := a.Encode(rv.Interface())
+	if err != nil {
+		encPanic(err)
+	}
+	vv := reflect.ValueOf(v)
+	if vv.IsValid() && vv.Type() == rv.Type() {
+		encPanic(fmt.Errorf("adapter for %s returned the same type", rv.Type()))
+	}
+	if typ == "" {
+		t := enc.tomlTypeOfGo(vv)
+		if t == nil {
+			encPanic(fmt.Errorf("adapter for %s returned nil", rv.Type()))
+		}
+		typ = t.typeString()
+	}
+	if !schemaTypes[typ] || typ == "" || typeIsTable(tomlBaseType(typ)) {
+		encPanic(fmt.Errorf("adapter for %s returned unsupported TOML type %q", rv.Type(), typ))
+	}
+	return v, tomlBaseType(typ)
+}
+
 // tomlTypeOfGo returns the TOML type name of the Go value's type.
 //
 // It is used to determine whether the types of array elements are mixed (which
@@ -562,24 +2125,24 @@ func (enc *Encoder) eStruct(key Key, rv reflect.Value, inline bool) {
 // array element, and valueIsNil is returned as true.
 //
 // The type may be `nil`, which means no concrete TOML type could be found.
-func tomlTypeOfGo(rv reflect.Value) tomlType {
+func (enc *Encoder) tomlTypeOfGo(rv reflect.Value) tomlType {
 	if isNil(rv) || !rv.IsValid() {
 		return nil
 	}
 
-	if rv.Kind() == reflect.Struct {
-		if rv.Type() == timeType {
-			return tomlDatetime
-		}
-		if isMarshaler(rv) {
-			return tomlString
-		}
-		return tomlHash
+	if rv.Type() == timeType {
+		return tomlDatetime
 	}
-
 	if isMarshaler(rv) {
 		return tomlString
 	}
+	if a := lookupAdapter(enc.adapters, rv.Type()); a != nil {
+		_, t := enc.adapt(a, rv)
+		return t
+	}
+	if rv.Kind() == reflect.Struct || isOrderedMap(rv) {
+		return tomlHash
+	}
 
 	switch rv.Kind() {
 	case reflect.Bool:
@@ -592,18 +2155,18 @@ func tomlTypeOfGo(rv reflect.Value) tomlType {
 	case reflect.Float32, reflect.Float64:
 		return tomlFloat
 	case reflect.Array, reflect.Slice:
-		if isTableArray(rv) {
+		if enc.isTableArray(rv) {
 			return tomlArrayHash
 		}
 		return tomlArray
 	case reflect.Ptr, reflect.Interface:
-		return tomlTypeOfGo(rv.Elem())
+		return enc.tomlTypeOfGo(rv.Elem())
 	case reflect.String:
 		return tomlString
 	case reflect.Map:
 		return tomlHash
 	default:
-		encPanic(errors.New("unsupported type: " + rv.Kind().String()))
+		encPanic(errUnsupported{typ: rv.Type()})
 		panic("unreachable")
 	}
 }
@@ -612,15 +2175,46 @@ func isMarshaler(rv reflect.Value) bool {
 	return rv.Type().Implements(marshalText) || rv.Type().Implements(marshalToml)
 }
 
+func isOrderedMap(rv reflect.Value) bool {
+	_, ok := orderedMap(rv)
+	return ok
+}
+
+// orderedMap gets rv as an OrderedMap, if it implements it.
+func orderedMap(rv reflect.Value) (OrderedMap, bool) {
+	if !rv.IsValid() || isNil(rv) || !rv.CanInterface() {
+		return nil, false
+	}
+	if rv.Type().Implements(orderedType) {
+		return rv.Interface().(OrderedMap), true
+	}
+	if rv.CanAddr() && rv.Addr().Type().Implements(orderedType) {
+		return rv.Addr().Interface().(OrderedMap), true
+	}
+	return nil, false
+}
+
 // isTableArray reports if all entries in the array or slice are a table.
-func isTableArray(arr reflect.Value) bool {
-	if isNil(arr) || !arr.IsValid() || arr.Len() == 0 {
+func (enc *Encoder) isTableArray(arr reflect.Value) bool {
+	if isNil(arr) || !arr.IsValid() {
+		return false
+	}
+	if arr = trimNil(arr); arr.Len() == 0 {
 		return false
 	}
 
 	ret := true
 	for i := 0; i < arr.Len(); i++ {
-		tt := tomlTypeOfGo(eindirect(arr.Index(i)))
+		elem := eindirect(arr.Index(i))
+		// Leave unsupported types to eElement(), which can report the key.
+		switch elem.Kind() {
+		case reflect.Func, reflect.Chan, reflect.Complex64, reflect.Complex128,
+			reflect.Uintptr, reflect.UnsafePointer:
+			ret = false
+			continue
+		}
+
+		tt := enc.tomlTypeOfGo(elem)
 		// Don't allow nil.
 		if tt == nil {
 			encPanic(errArrayNilElement)
@@ -634,14 +2228,21 @@ func isTableArray(arr reflect.Value) bool {
 }
 
 type tagOptions struct {
-	skip      bool // "-"
-	name      string
-	omitempty bool
-	omitzero  bool
+	skip       bool // "-"
+	name       string
+	omitempty  bool
+	omitzero   bool
+	keyed      string   // "keyed=name"
+	deprecated []string // "deprecated=name"; can be given more than once.
+	union      bool     // "union" or "union=required"
+	required   bool     // "union=required"
+	asString   bool     // "string"
 }
 
 func getOptions(tag reflect.StructTag) tagOptions {
 	t := tag.Get("toml")
+	// Only skip on an exact "-"; use "-," for a key that's literally named "-",
+	// just like encoding/json.
 	if t == "-" {
 		return tagOptions{skip: true}
 	}
@@ -654,6 +2255,18 @@ func getOptions(tag reflect.StructTag) tagOptions {
 			opts.omitempty = true
 		case "omitzero":
 			opts.omitzero = true
+		case "union":
+			opts.union = true
+		case "union=required":
+			opts.union, opts.required = true, true
+		case "string":
+			opts.asString = true
+		default:
+			if strings.HasPrefix(s, "keyed=") {
+				opts.keyed = s[6:]
+			} else if strings.HasPrefix(s, "deprecated=") {
+				opts.deprecated = append(opts.deprecated, s[11:])
+			}
 		}
 	}
 	return opts
@@ -672,10 +2285,16 @@ func isZero(rv reflect.Value) bool {
 }
 
 func isEmpty(rv reflect.Value) bool {
+	if om, ok := orderedMap(rv); ok {
+		return len(om.Keys()) == 0
+	}
 	switch rv.Kind() {
 	case reflect.Array, reflect.Slice, reflect.Map, reflect.String:
 		return rv.Len() == 0
 	case reflect.Struct:
+		if rv.Type() == timeType && rv.CanInterface() {
+			return rv.Interface().(time.Time).IsZero()
+		}
 		if rv.Type().Comparable() {
 			return reflect.Zero(rv.Type()).Interface() == rv.Interface()
 		}
@@ -701,7 +2320,16 @@ func isEmpty(rv reflect.Value) bool {
 
 func (enc *Encoder) newline() {
 	if enc.hasWritten {
-		enc.wf("\n")
+		enc.pendingNL++
+	}
+}
+
+// blankLine writes a blank line, unless nothing was written yet or the last
+// line is already blank.
+func (enc *Encoder) blankLine() {
+	if enc.hasWritten && !enc.wroteBlank {
+		enc.pendingNL++
+		enc.wroteBlank = true
 	}
 }
 
@@ -719,35 +2347,345 @@ func (enc *Encoder) newline() {
 func (enc *Encoder) writeKeyValue(key Key, val reflect.Value, inline bool) {
 	/// Marshaler used on top-level document; call eElement() to just call
 	/// Marshal{TOML,Text}.
+	if !inline && !enc.buffering && (val.Kind() == reflect.Array || val.Kind() == reflect.Slice) && !isMarshaler(val) {
+		enc.writeBuffered(func() { enc.writeKeyValue(key, val, inline) })
+		return
+	}
+	if !inline && len(key) > 0 {
+		defer func() {
+			if r := recover(); r != nil {
+				addPath(r, key.String(), true)
+			}
+		}()
+	}
 	if len(key) == 0 {
 		enc.eElement(val)
 		return
 	}
-	enc.wf("%s%s = ", enc.indentStr(key), key.maybeQuoted(len(key)-1))
-	enc.eElement(val)
 	if !inline {
+		enc.planKey(key, enc.tomlTypeOfGo(val))
+	}
+	if !inline && len(key) == 1 && enc.spacing == SpacingLoose {
+		enc.blankLine()
+	}
+	var c comment
+	if !inline {
+		c = enc.comment(key)
+		enc.writeCommentAbove(key, c)
+	}
+	if inline || enc.dotted == 0 {
+		enc.wf("%s%s = ", enc.indentStr(key), key.maybeQuoted(len(key)-1))
+	} else {
+		enc.wf("%s%s = ", enc.indentStr(key[:len(key)-enc.dotted]), dottedKey(key, len(key)-enc.dotted-1))
+	}
+	if !inline && enc.meta != nil && len(enc.meta.formats) > 0 {
+		enc.valKey = key.String()
+		defer func() { enc.valKey = "" }()
+	}
+	if inline || enc.planning {
+		enc.eElement(val)
+	} else if !enc.annotate {
+		enc.eValue(key, val)
+	} else {
+		enc.eAnnotated(key, val)
+	}
+	if !inline {
+		enc.writeCommentAfter(c)
 		enc.newline()
 	}
 }
 
+// dottedKey gets the parts of key from start as a dotted key.
+func dottedKey(key Key, start int) string {
+	parts := make([]string, 0, len(key)-start)
+	for i := start; i < len(key); i++ {
+		parts = append(parts, key.maybeQuoted(i))
+	}
+	return strings.Join(parts, ".")
+}
+
+// comment gets the comment for key from the MetaData.
+func (enc *Encoder) comment(key Key) comment {
+	if enc.meta == nil || len(enc.meta.comments) == 0 || enc.planning || len(key) == 0 {
+		return comment{}
+	}
+	// Same as parser.indexedKey().
+	var b strings.Builder
+	for i := range key {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(key.maybeQuoted(i))
+		if n, ok := enc.arrIdx[key[:i+1].String()]; ok {
+			b.WriteString("[" + strconv.Itoa(n) + "]")
+		}
+	}
+	return enc.meta.comments[b.String()]
+}
+
+func (enc *Encoder) writeCommentAbove(key Key, c comment) {
+	for _, line := range c.above {
+		enc.wf("%s#%s", enc.indentStr(key), line)
+		enc.newline()
+	}
+}
+
+// writeCommentAfter writes the comment after a value or header, unless there's
+// already a comment from AnnotateTypes.
+func (enc *Encoder) writeCommentAfter(c comment) {
+	if c.after != "" && !enc.annotate {
+		enc.wf("  #%s", c.after)
+	}
+}
+
+// fieldNote is the struct field that's being written, for AnnotateTypes.
+type fieldNote struct {
+	typ      reflect.Type
+	optional bool
+}
+
+// eValue writes the value val for key, as a multiline array if it's too wide
+// for MultilineArrays.
+func (enc *Encoder) eValue(key Key, val reflect.Value) {
+	k := val.Kind()
+	if enc.arrWidth <= 0 || (k != reflect.Array && k != reflect.Slice) || val.Len() == 0 ||
+		isMarshaler(val) || isOrderedMap(val) || lookupAdapter(enc.adapters, val.Type()) != nil {
+		enc.eElement(val)
+		return
+	}
+
+	s := enc.sprint(func(sub *Encoder) { sub.eElement(val) })
+	prefix := enc.indentStr(key) + key.maybeQuoted(len(key)-1) + " = "
+	if displayWidth(prefix+s, 0) <= enc.arrWidth {
+		enc.wf("%s", s)
+		return
+	}
+
+	var (
+		indent = enc.indentStr(key) + enc.Indent
+		valKey = enc.valKey
+		i      int
+	)
+	defer func() {
+		if r := recover(); r != nil {
+			addPath(r, "["+strconv.Itoa(i)+"]", false)
+		}
+	}()
+	enc.wf("[\n")
+	for i = 0; i < val.Len(); i++ {
+		elem := enc.eval(val.Index(i))
+		if isNil(elem) {
+			encPanic(errArrayNilElement)
+		}
+		enc.wf("%s", indent)
+		enc.valKey = elemKey(valKey, i)
+		enc.eElement(elem)
+		enc.wf(",\n")
+	}
+	enc.valKey = valKey
+	enc.wf("%s]", enc.indentStr(key))
+}
+
+// sprint returns what f writes to a copy of the Encoder.
+func (enc *Encoder) sprint(f func(sub *Encoder)) string {
+	var (
+		buf = new(bytes.Buffer)
+		sub = *enc
+	)
+	sub.w, sub.pendingNL, sub.maxSize = bufio.NewWriter(buf), 0, 0
+	f(&sub)
+	if err := sub.w.Flush(); err != nil {
+		encPanic(err)
+	}
+	return buf.String()
+}
+
+// eAnnotated writes the value val for key followed by a comment with the type.
+func (enc *Encoder) eAnnotated(key Key, val reflect.Value) {
+	f := enc.field
+	enc.field = nil
+
+	// Write to a buffer first, as the TOML type of a Marshaler is only known
+	// from what it wrote.
+	s := enc.sprint(func(sub *Encoder) { sub.eValue(key, val) })
+	enc.wf("%s", s)
+
+	tt := enc.tomlTypeOfGo(val)
+	if _, ok := val.Interface().(Marshaler); ok {
+		if p, err := parse(strings.NewReader("v = "+s), DecodeProfile{}, true); err == nil {
+			tt = p.keyInfo["v"].tomlType
+		}
+	}
+	typ := val.Type()
+	if f != nil {
+		typ = f.typ
+	}
+	note := strings.ToLower(tt.typeString()) + " (" + goTypeName(typ) + ")"
+	if f != nil && f.optional {
+		note += ", optional"
+	}
+	enc.wf("  # %s", note)
+}
+
+// annotateHeader writes the Go type of the table rv after the header, if
+// AnnotateTypes is set.
+func (enc *Encoder) annotateHeader(rv reflect.Value) {
+	if enc.annotate && !enc.planning {
+		enc.wf("  # %s", goTypeName(rv.Type()))
+	}
+}
+
+func goTypeName(t reflect.Type) string {
+	return strings.ReplaceAll(t.String(), "interface {}", "any")
+}
+
+// trimNil returns the Go array of pointers rv without the nil elements at the
+// end, as a slice. These aren't written, as decoding a shorter TOML array in to
+// an array of pointers leaves the remaining elements nil. Anything else is
+// returned as-is.
+func trimNil(rv reflect.Value) reflect.Value {
+	if rv.Kind() != reflect.Array || rv.Type().Elem().Kind() != reflect.Ptr {
+		return rv
+	}
+	n := rv.Len()
+	for n > 0 && rv.Index(n-1).IsNil() {
+		n--
+	}
+	if n == rv.Len() {
+		return rv
+	}
+	s := reflect.MakeSlice(reflect.SliceOf(rv.Type().Elem()), n, n)
+	reflect.Copy(s, rv)
+	return s
+}
+
+// writeBuffered calls f with the output written to a buffer, which is written
+// to enc.w only if f doesn't panic. Array elements are only checked as they're
+// written, and nothing should be written for the key if one of them can't be
+// encoded.
+func (enc *Encoder) writeBuffered(f func()) {
+	if enc.arrBuf == nil {
+		enc.arrBuf = new(bytes.Buffer)
+		enc.arrW = bufio.NewWriterSize(enc.arrBuf, 64) /// Written to arrBuf anyway.
+	}
+	w := enc.w
+	enc.arrBuf.Reset()
+	enc.arrW.Reset(enc.arrBuf)
+	enc.w, enc.buffering = enc.arrW, true
+	defer func() { enc.w, enc.buffering = w, false }()
+
+	f()
+	if err := enc.arrW.Flush(); err != nil {
+		encPanic(err)
+	}
+	if _, err := w.Write(enc.arrBuf.Bytes()); err != nil {
+		encPanic(err)
+	}
+}
+
+// flushNewlines writes any pending newlines.
+func (enc *Encoder) flushNewlines() {
+	for ; enc.pendingNL > 0; enc.pendingNL-- {
+		if err := enc.w.WriteByte('\n'); err != nil {
+			encPanic(err)
+		}
+		enc.openLine = false
+		enc.size++
+	}
+}
+
 func (enc *Encoder) wf(format string, v ...any) {
-	_, err := fmt.Fprintf(enc.w, format, v...)
+	if h := enc.header; h != nil {
+		enc.header = nil
+		h()
+	}
+	enc.flushNewlines()
+	n, err := fmt.Fprintf(enc.w, format, v...)
 	if err != nil {
 		encPanic(err)
 	}
-	enc.hasWritten = true
+	enc.hasWritten, enc.wroteBlank, enc.openLine = true, false, true
+	if enc.size += n; enc.maxSize > 0 {
+		if err := enc.checkSize(); err != nil {
+			encPanic(err)
+		}
+	}
 }
 
 func (enc *Encoder) indentStr(key Key) string {
 	return strings.Repeat(enc.Indent, len(key)-1)
 }
 
+// checkKey panics if the last part of key can't be written as a TOML key.
+//
+// All valid UTF-8 can be written (as a quoted key if needed), including NUL
+// bytes and unprintable characters, which are escaped. Invalid UTF-8 can't be
+// written without changing the key, so that's an error.
+func checkKey(key Key) {
+	k := key[len(key)-1]
+	if utf8.ValidString(k) {
+		return
+	}
+	for i := 0; i < len(k); {
+		r, n := utf8.DecodeRuneInString(k[i:])
+		if r == utf8.RuneError && n == 1 {
+			encPanic(fmt.Errorf("toml: cannot encode key %q: invalid UTF-8 at byte %d of %q", key, i, k))
+		}
+		i += n
+	}
+}
+
 func encPanic(err error) {
 	panic(tomlEncodeError{err})
 }
 
+// eval resolves pointers with eindirect. If UseJSONInterfaces is set it also
+// replaces values that implement json.Marshaler with the result of decoding
+// their JSON.
+func (enc *Encoder) eval(v reflect.Value) reflect.Value {
+	v = eindirect(v)
+	if !enc.useJSON || !v.IsValid() || isNil(v) || isMarshaler(v) {
+		return v
+	}
+	m, ok := v.Interface().(json.Marshaler)
+	if !ok && v.CanAddr() {
+		m, ok = v.Addr().Interface().(json.Marshaler)
+	}
+	if !ok {
+		return v
+	}
+
+	j, err := m.MarshalJSON()
+	if err != nil {
+		encPanic(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	var jv any
+	if err := dec.Decode(&jv); err != nil {
+		encPanic(fmt.Errorf("MarshalJSON for %s: %w", v.Type(), err))
+	}
+	tv, ok, err := fromJSON(jv, JSONOptions{})
+	if err != nil {
+		encPanic(fmt.Errorf("MarshalJSON for %s: %w", v.Type(), err))
+	}
+	if !ok { /// null; treat like a nil value.
+		return reflect.ValueOf(&tv).Elem()
+	}
+	return reflect.ValueOf(tv)
+}
+
 // Resolve any level of pointers to the actual value (e.g. **string → string).
 func eindirect(v reflect.Value) reflect.Value {
+	if v.IsValid() && v.Type() == primitiveType {
+		// Primitive values from the decoder are written as the value they
+		// hold; a zero Primitive is treated as nil.
+		if u := v.Interface().(Primitive).undecoded; u != nil {
+			return eindirect(reflect.ValueOf(u))
+		}
+		var n any
+		return reflect.ValueOf(&n).Elem()
+	}
 	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
 		if isMarshaler(v) {
 			return v
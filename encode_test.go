@@ -3,14 +3,23 @@ package toml
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"math"
 	"net"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/BurntSushi/toml/internal"
 )
 
 func TestEncodeRoundTrip(t *testing.T) {
@@ -361,6 +370,61 @@ func TestEncodeAnonymousStructPointerField(t *testing.T) {
 	encodeExpected(t, "non-nil anonymous tagged struct pointer field", v1, expected, nil)
 }
 
+func TestEncodeAnonymousOmitempty(t *testing.T) {
+	type Inner struct {
+		X string `toml:"x,omitempty"`
+		Y int    `toml:"y"`
+	}
+	type Middle struct {
+		Inner `toml:",omitempty"`
+		Z     int `toml:"z"`
+	}
+	type MiddlePtr struct {
+		*Inner `toml:",omitempty"`
+		Z      int `toml:"z"`
+	}
+	type Outer struct {
+		Middle `toml:",omitempty"`
+		A      int `toml:"a"`
+	}
+	type OuterPtr struct {
+		*MiddlePtr `toml:",omitempty"`
+		A          int `toml:"a"`
+	}
+	type NoOmit struct {
+		*Inner
+		A int `toml:"a"`
+	}
+
+	tests := []struct {
+		in   any
+		want string
+	}{
+		// Depth 1.
+		{Middle{Z: 1}, "z = 1\n"},
+		{Middle{Inner: Inner{Y: 2}}, "y = 2\nz = 0\n"},
+		{Middle{Inner: Inner{X: "x"}}, "x = \"x\"\ny = 0\nz = 0\n"},
+		{MiddlePtr{Z: 1}, "z = 1\n"},
+		{MiddlePtr{Inner: &Inner{}, Z: 1}, "z = 1\n"},
+		{MiddlePtr{Inner: &Inner{Y: 2}}, "y = 2\nz = 0\n"},
+		{NoOmit{Inner: &Inner{}}, "y = 0\na = 0\n"},
+
+		// Depth 2.
+		{Outer{A: 1}, "a = 1\n"},
+		{Outer{Middle: Middle{Z: 1}}, "z = 1\na = 0\n"},
+		{Outer{Middle: Middle{Inner: Inner{Y: 2}}}, "y = 2\nz = 0\na = 0\n"},
+		{OuterPtr{A: 1}, "a = 1\n"},
+		{OuterPtr{MiddlePtr: &MiddlePtr{}, A: 1}, "a = 1\n"},
+		{OuterPtr{MiddlePtr: &MiddlePtr{Inner: &Inner{}}, A: 1}, "z = 0\na = 1\n"},
+		{OuterPtr{MiddlePtr: &MiddlePtr{Inner: &Inner{X: "x"}}}, "x = \"x\"\ny = 0\nz = 0\na = 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			encodeExpected(t, fmt.Sprintf("%#v", tt.in), tt.in, tt.want, nil)
+		})
+	}
+}
+
 func TestEncodeNestedAnonymousStructs(t *testing.T) {
 	type A struct{ A string }
 	type B struct{ B string }
@@ -428,6 +492,259 @@ func TestEncodeIgnoredFields(t *testing.T) {
 	encodeExpected(t, "ignored field", value, expected, nil)
 }
 
+func TestEncodeDashKey(t *testing.T) {
+	encodeExpected(t, "dash key", struct {
+		Number int `toml:"-"`
+		Dash   int `toml:"-,"`
+	}{1, 2}, "- = 2", nil)
+
+	encodeExpected(t, "dash key omitempty", struct {
+		Dash string `toml:"-,omitempty"`
+		Str  string
+	}{"", "x"}, `Str = "x"`, nil)
+	encodeExpected(t, "dash key omitempty", struct {
+		Dash string `toml:"-,omitempty"`
+	}{"x"}, `- = "x"`, nil)
+}
+
+type set[T comparable] struct{ m map[T]struct{} }
+
+func TestEncodeOpaqueStruct(t *testing.T) {
+	s := set[string]{m: map[string]struct{}{"a": {}}}
+
+	_, err := Marshal(struct{ S set[string] }{s})
+	want := "type toml.set[string] for key 'S' has no exported fields and no marshaler; implement MarshalTOML or MarshalText"
+	if err == nil || err.Error() != want {
+		t.Errorf("wrong error\nhave: %v\nwant: %s", err, want)
+	}
+
+	encodeExpected(t, "time", struct{ T time.Time }{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		"T = 2020-01-02T03:04:05Z\n", nil)
+	encodeExpected(t, "empty struct", struct{ E struct{} }{}, "\n[E]\n", nil)
+
+	var buf bytes.Buffer
+	err = NewEncoder(&buf).AllowOpaqueStructs(true).Encode(struct{ S set[string] }{s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := buf.String(), "[S]\n"; have != want {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestEncodeKeyed(t *testing.T) {
+	type server struct {
+		Host string `toml:"host"`
+	}
+	type named struct {
+		Name string `toml:"name"`
+		Host string `toml:"host"`
+	}
+
+	encodeExpected(t, "struct", struct {
+		Servers map[string]server `toml:"servers,keyed=name"`
+	}{map[string]server{"beta": {"10.0.0.2"}, "alpha": {"10.0.0.1"}}}, `
+[[servers]]
+  name = "alpha"
+  host = "10.0.0.1"
+
+[[servers]]
+  name = "beta"
+  host = "10.0.0.2"
+`, nil)
+
+	encodeExpected(t, "has name", struct {
+		Servers map[string]named `toml:"servers,keyed=name"`
+	}{map[string]named{"alpha": {"alpha", "10.0.0.1"}}}, `
+[[servers]]
+  name = "alpha"
+  host = "10.0.0.1"
+`, nil)
+
+	encodeExpected(t, "map", struct {
+		Servers map[string]map[string]string `toml:"servers,keyed=name"`
+	}{map[string]map[string]string{"alpha": {"host": "10.0.0.1"}}}, `
+[[servers]]
+  name = "alpha"
+  host = "10.0.0.1"
+`, nil)
+
+	// The map key is used if the name is empty.
+	encodeExpected(t, "empty name", struct {
+		Servers map[string]named `toml:"servers,keyed=name"`
+	}{map[string]named{"alpha": {"", "10.0.0.1"}}}, `
+[[servers]]
+  name = "alpha"
+  host = "10.0.0.1"
+`, nil)
+
+	type omit struct {
+		Name string `toml:"name,omitempty"`
+		Host string `toml:"host"`
+	}
+	encodeExpected(t, "omitempty", struct {
+		Servers map[string]omit `toml:"servers,keyed=name"`
+	}{map[string]omit{"alpha": {"", "10.0.0.1"}}}, `
+[[servers]]
+  name = "alpha"
+  host = "10.0.0.1"
+`, nil)
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).Encode(struct {
+		Servers map[string]named `toml:"servers,keyed=name"`
+	}{map[string]named{"alpha": {"beta", "10.0.0.1"}}})
+	if !errorContains(err, `keyed field "servers": "name" is beta in the table for the map key "alpha"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	var rt struct {
+		Servers map[string]server `toml:"servers,keyed=name"`
+	}
+	_, err = Decode(`
+[[servers]]
+name = "alpha"
+host = "10.0.0.1"
+`, &rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodeExpected(t, "round trip", rt, `
+[[servers]]
+  name = "alpha"
+  host = "10.0.0.1"
+`, nil)
+}
+
+func TestEncodeUnion(t *testing.T) {
+	type (
+		file  struct{ Path string }
+		kafka struct{ Topic string }
+		input struct {
+			File  *file  `toml:"file"`
+			Kafka *kafka `toml:"kafka"`
+		}
+	)
+
+	encodeExpected(t, "one", struct {
+		Input input `toml:"input,union"`
+	}{input{Kafka: &kafka{"logs"}}}, `
+[input]
+  [input.kafka]
+    Topic = "logs"
+`, nil)
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).Encode(struct {
+		Input input `toml:"input,union"`
+	}{input{File: &file{"/log"}, Kafka: &kafka{"logs"}}})
+	if !errorContains(err, `more than one variant of the union 'input' is set: "file" and "kafka"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestEncodeSpacing(t *testing.T) {
+	type srv struct {
+		Host string `toml:"host"`
+	}
+	v := struct {
+		A   int               `toml:"a"`
+		B   string            `toml:"b"`
+		Tbl map[string]any    `toml:"tbl"`
+		Srv []srv             `toml:"srv"`
+		Z   map[string]string `toml:"z"`
+	}{
+		A:   1,
+		B:   "x",
+		Tbl: map[string]any{"k": 1, "sub": map[string]int{"s": 2}, "arr": []srv{{"c"}}},
+		Srv: []srv{{"a"}, {"b"}},
+		Z:   map[string]string{},
+	}
+
+	tests := []struct {
+		spacing Spacing
+		want    string
+	}{
+		{SpacingDefault, `a = 1
+b = "x"
+
+[tbl]
+  k = 1
+
+  [[tbl.arr]]
+    host = "c"
+  [tbl.sub]
+    s = 2
+
+[[srv]]
+  host = "a"
+
+[[srv]]
+  host = "b"
+
+[z]
+`},
+		{SpacingCompact, `a = 1
+b = "x"
+[tbl]
+  k = 1
+  [[tbl.arr]]
+    host = "c"
+  [tbl.sub]
+    s = 2
+[[srv]]
+  host = "a"
+[[srv]]
+  host = "b"
+[z]
+`},
+		{SpacingLoose, `a = 1
+
+b = "x"
+
+[tbl]
+  k = 1
+
+  [[tbl.arr]]
+    host = "c"
+
+  [tbl.sub]
+    s = 2
+
+[[srv]]
+  host = "a"
+
+[[srv]]
+  host = "b"
+
+[z]
+`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).Spacing(tt.spacing).Encode(v); err != nil {
+				t.Fatal(err)
+			}
+			if have := buf.String(); have != tt.want {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", have, tt.want)
+			}
+
+			// Spacing should never change what's decoded.
+			var have, want map[string]any
+			if _, err := Decode(buf.String(), &have); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Decode(tests[0].want, &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("decoded values differ\nhave: %#v\nwant: %#v", have, want)
+			}
+		})
+	}
+}
+
 func TestEncodeNaN(t *testing.T) {
 	s1 := struct {
 		Nan float64 `toml:"nan"`
@@ -463,9 +780,9 @@ func TestEncodePrimitive(t *testing.T) {
 		return buf.String()
 	}
 
-	original := `DataA = 1
+	original := `Data = ["Foo", "Bar"]
+DataA = 1
 DataB = "bbb"
-Data = ["Foo", "Bar"]
 `
 	reEncoded := decodeAndEncode(decodeAndEncode(original))
 
@@ -476,6 +793,40 @@ Data = ["Foo", "Bar"]
 	}
 }
 
+func TestEncodeArrayUnsupported(t *testing.T) {
+	type embed struct{ C complex64 }
+	tests := []struct {
+		in      any
+		wantErr string
+	}{
+		{map[string]any{"xs": []any{1, map[string]any{"f": func() {}}}},
+			"unsupported type for key 'xs[1].f': func()"},
+		{map[string]any{"xs": []any{strings.Repeat("x", 5000), []any{func() {}}}},
+			"unsupported type for key 'xs[1][0]': func()"},
+		{struct{ Xs [][]any }{[][]any{{1}, {2, struct{ C complex64 }{}}}},
+			"unsupported type for key 'Xs[1][1].C': complex64"},
+		{struct{ Xs []any }{[]any{1, []any{nil}}},
+			"cannot encode array with nil element"},
+		{map[string]any{"xs": []any{1, map[string]any{"a": map[string]any{"b c": []any{1, make(chan int)}}}}},
+			`unsupported type for key 'xs[1].a."b c"[1]': chan int`},
+		{struct{ Xs []any }{[]any{1, struct{ embed }{}}},
+			"unsupported type for key 'Xs[1].C': complex64"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			err := NewEncoder(buf).Encode(tt.in)
+			if !errorContains(err, tt.wantErr) {
+				t.Errorf("wrong error\nhave: %q\nwant: %q", err, tt.wantErr)
+			}
+			if buf.Len() > 0 {
+				t.Errorf("partial output written:\n%.100s", buf)
+			}
+		})
+	}
+}
+
 func TestEncodeError(t *testing.T) {
 	tests := []struct {
 		in      any
@@ -612,6 +963,225 @@ Ints2 = "<1,2,3,4>"
 	}
 }
 
+type textString string
+
+func (s textString) MarshalText() ([]byte, error) { return []byte(s), nil }
+
+// Strings are always written as basic strings with everything escaped, so
+// anything should survive a round trip, including as keys and from
+// MarshalText.
+func TestEncodeQuoting(t *testing.T) {
+	tests := []string{
+		"", "can't", "'", "'''", `"`, `"""`, `a'''b"""c`, `trailing'`, `trailing"`,
+		`\`, `\'`, `\"`, "line\nbreak", "line\r\nbreak", "\r", "\t", "\x00\x01\x1f\x7f",
+		"# comment", "= x", "[table]", "ünïcödé", " ", "'''\n'''",
+		"\u200b", "\u00ad\u0085", "\U000e0001",
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			in := struct {
+				Value string
+				Text  textString
+				Map   map[string]string
+			}{tt, textString(tt), map[string]string{tt: tt}}
+
+			b, err := Marshal(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out struct {
+				Value string
+				Text  string
+				Map   map[string]string
+			}
+			if _, err := Decode(string(b), &out); err != nil {
+				t.Fatalf("decoding: %s\n%s", err, b)
+			}
+			if out.Value != tt || out.Text != tt || out.Map[tt] != tt || len(out.Map) != 1 {
+				t.Errorf("changed after round trip\nhave: %#v\nwant: %q\n%s", out, tt, b)
+			}
+		})
+	}
+}
+
+func TestEncodeKeyCharacters(t *testing.T) {
+	// Unprintable characters are escaped.
+	b, err := Marshal(map[string]int{"\u200b\u00ad\u0085": 1, "\U000e0001": 2, "a\x00": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"a\u0000" = 3
+"\u200b\u00ad\u0085" = 1
+"\U000e0001" = 2
+`
+	if string(b) != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", b, want)
+	}
+
+	tests := []struct {
+		in      any
+		wantErr string
+	}{
+		{map[string]int{"a\xffb": 1},
+			`toml: cannot encode key "\"a\xffb\"": invalid UTF-8 at byte 1 of "a\xffb"`},
+		{map[string]map[string]int{"tbl": {"é\xe9": 1}},
+			`toml: cannot encode key "tbl.\"é\xe9\"": invalid UTF-8 at byte 2 of "é\xe9"`},
+		{map[string]any{"tbl": map[string]any{"inline": []any{map[string]int{"\x80": 1}}}},
+			`toml: cannot encode key "tbl.inline.\"\x80\"": invalid UTF-8 at byte 0 of "\x80"`},
+		{struct {
+			Field int `toml:"x\xc0"`
+		}{},
+			`toml: cannot encode key "\"x\xc0\"": invalid UTF-8 at byte 1 of "x\xc0"`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			_, err := Marshal(tt.in)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("wrong error\nhave: %q\nwant: %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQuoteStringKey(t *testing.T) {
+	corpus := []string{
+		"", "a", "A-z_09", "-", "a.b", "a b", "1.5", "true", "#", "=", "[x]",
+		`"`, `\`, `\"`, `'`, "'''", `"""`, `A`, `\n`,
+		"\u00e9", "\u200b\u00ad\u0085", "\U000e0001", "\U0001f600", "\u2028\u2029", "\ufeff",
+		"\x7f", "\x00", "a\x00b", "\r\n", "\ufffd",
+	}
+	for c := rune(0); c < 0x20; c++ {
+		corpus = append(corpus, string(c), "x"+string(c)+"y")
+	}
+
+	for _, s := range corpus {
+		t.Run("", func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).Encode(map[string]string{"k": s}); err != nil {
+				t.Fatal(err)
+			}
+			if want := "k = " + QuoteString(s) + "\n"; buf.String() != want {
+				t.Errorf("QuoteString(%q)\nhave: %q\nwant: %q", s, buf.String(), want)
+			}
+			var v struct{ K string }
+			if _, err := Decode("k = "+QuoteString(s), &v); err != nil || v.K != s {
+				t.Errorf("QuoteString(%q): wrong decoded value %q: %v", s, v.K, err)
+			}
+
+			buf.Reset()
+			if err := NewEncoder(&buf).Encode(map[string]int{s: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if want := QuoteKey(s) + " = 1\n"; buf.String() != want {
+				t.Errorf("QuoteKey(%q)\nhave: %q\nwant: %q", s, buf.String(), want)
+			}
+			var m map[string]int
+			if _, err := Decode(QuoteKey(s)+" = 1", &m); err != nil || m[s] != 1 {
+				t.Errorf("QuoteKey(%q): wrong decoded value %q: %v", s, m, err)
+			}
+		})
+	}
+
+	// Invalid UTF-8 is copied as-is.
+	if have := QuoteString("a\xffb"); have != "\"a\xffb\"" {
+		t.Errorf("wrong result: %q", have)
+	}
+	if have := QuoteKey("a\xffb"); have != "\"a\xffb\"" {
+		t.Errorf("wrong result: %q", have)
+	}
+}
+
+func TestEncodeMaxOutputSize(t *testing.T) {
+	type server struct {
+		Name string
+		Port int
+	}
+	v := struct {
+		Title   string
+		Servers []server
+	}{"test", []server{{"a", 1}, {"b", 2}, {"c", 3}}}
+
+	full, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).MaxOutputSize(len(full)).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != string(full) {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), full)
+	}
+
+	// Nothing is written if the limit is exceeded.
+	buf.Reset()
+	err = NewEncoder(&buf).MaxOutputSize(len(full) - 10).Encode(v)
+	var sErr SizeLimitError
+	if !errors.As(err, &sErr) {
+		t.Fatalf("wrong error: %#v", err)
+	}
+	if sErr.Limit != len(full)-10 || sErr.Key.String() != "Servers.Port" {
+		t.Errorf("wrong error: %#v", sErr)
+	}
+	if want := `toml: output is larger than the limit of 116 bytes while writing "Servers.Port"`; err.Error() != want {
+		t.Errorf("\nhave: %s\nwant: %s", err, want)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("written: %q", buf.String())
+	}
+
+	// The trailing newline is counted too.
+	err = NewEncoder(&buf).MaxOutputSize(len(full) - 1).Encode(v)
+	if !errors.As(err, &sErr) || sErr.Size != len(full) {
+		t.Errorf("wrong error: %#v", err)
+	}
+
+	err = NewEncoder(&buf).MaxOutputSize(10).EncodeList("servers", v.Servers)
+	if !errors.As(err, &sErr) || sErr.Key.String() != "servers" {
+		t.Errorf("wrong error: %#v", err)
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	tests := []struct {
+		v any
+		p EncodeProfile
+	}{
+		{map[string]any{}, EncodeProfile{}},
+		{map[string]any{"a": 1, "b": "\x00\"\n", "c": []any{1.5, true, time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)}}, EncodeProfile{}},
+		{map[string]any{"t": map[string]any{"x": map[string]any{"y": 1}}, "arr": []map[string]any{{"a": 1}, {"a": 2}}}, EncodeProfile{}},
+		{map[string]any{"t": map[string]any{"x": map[string]any{"y": 1}}}, EncodeProfile{Indent: "\t\t", NoTrailingNewline: true}},
+		{map[string]any{"list": []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}, EncodeProfile{MultilineArrays: 10}},
+		{struct {
+			A int `toml:"a,omitempty"`
+			B struct{ C string }
+		}{}, EncodeProfile{CommentOmitted: true, AnnotateTypes: true, MaxOutputSize: 1}},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have, err := EstimateSize(tt.v, tt.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := tt.p
+			p.MaxOutputSize = 0
+			want, err := MarshalWithProfile(tt.v, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have < len(want) {
+				t.Errorf("estimate of %d is less than the size of %d", have, len(want))
+			}
+		})
+	}
+
+	_, err := EstimateSize(map[string]any{"a": make(chan int)}, EncodeProfile{})
+	if err == nil {
+		t.Error("no error")
+	}
+}
+
 func TestEncodeTOMLMarshaler(t *testing.T) {
 	x := struct {
 		Name    string
@@ -669,6 +1239,92 @@ type (
 func (r retNil1) MarshalText() ([]byte, error) { return nil, nil }
 func (r retNil2) MarshalTOML() ([]byte, error) { return nil, nil }
 
+func TestEncodeInterface(t *testing.T) {
+	var prim struct{ Int, Tbl Primitive }
+	_, err := Decode("int = 1\n[tbl]\nk = 'v'", &prim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		m  = food2{F: []string{"a", "b"}}
+		tm = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	)
+
+	tests := []struct {
+		name       string
+		typed, any any
+	}{
+		{"marshaler field",
+			struct{ Z food2 }{m},
+			struct{ Z any }{m}},
+		{"marshaler in map",
+			map[string]map[string]food2{"a": {"z": m}},
+			map[string]any{"a": map[string]any{"z": m}}},
+		{"marshaler pointer in any",
+			struct{ Z *food2 }{&m},
+			struct{ Z any }{&m}},
+		{"marshaler in array",
+			struct{ Z []food2 }{[]food2{m, m}},
+			struct{ Z any }{[]any{m, &m}}},
+		{"marshaler in array of tables",
+			map[string][]map[string]food2{"a": {{"z": m}}},
+			map[string]any{"a": []any{map[string]any{"z": m}}}},
+		{"time",
+			struct{ Z time.Time }{tm},
+			struct{ Z any }{tm}},
+		{"time in array",
+			map[string][]time.Time{"a": {tm}},
+			map[string]any{"a": []any{&tm}}},
+		{"primitive",
+			struct {
+				A map[string]int
+				Z int
+			}{map[string]int{"b": 2}, 1},
+			struct {
+				A map[string]int
+				Z any
+			}{map[string]int{"b": 2}, prim.Int}},
+		{"primitive in map",
+			map[string]any{"a": map[string]any{"b": 2}, "z": 1},
+			map[string]any{"a": map[string]any{"b": 2}, "z": prim.Int}},
+		{"primitive in array",
+			map[string]any{"a": []any{1, []map[string]string{{"k": "v"}}}},
+			map[string]any{"a": []any{prim.Int, []any{prim.Tbl}}}},
+		{"primitive table",
+			map[string]any{"z": map[string]string{"k": "v"}},
+			map[string]any{"z": prim.Tbl}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := Marshal(tt.typed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have, err := Marshal(tt.any)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(have) != string(want) {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+			}
+		})
+	}
+
+	var s struct {
+		Z Primitive
+		A []any
+	}
+	_, err = Marshal(s)
+	if err != nil {
+		t.Errorf("zero Primitive: %s", err)
+	}
+	s.A = []any{Primitive{}}
+	_, err = Marshal(s)
+	if err != errArrayNilElement {
+		t.Errorf("zero Primitive in array: %v", err)
+	}
+}
+
 func TestEncodeEmpty(t *testing.T) {
 	t.Run("text", func(t *testing.T) {
 		var (
@@ -761,18 +1417,76 @@ func TestEncodeDuration(t *testing.T) {
 	}
 }
 
-type jsonT struct {
-	Num  json.Number
-	NumP *json.Number
-	Arr  []json.Number
-	ArrP []*json.Number
-	Tbl  map[string]json.Number
-	TblP map[string]*json.Number
-}
+func TestEncodeDurationFormat(t *testing.T) {
+	type config struct {
+		D   time.Duration
+		P   *time.Duration
+		Arr []time.Duration
+		Map map[string]time.Duration
+	}
+	d := 1500 * time.Millisecond
+	in := config{D: 90 * time.Second, P: &d, Arr: []time.Duration{time.Millisecond, 0}, Map: map[string]time.Duration{"k": time.Hour}}
 
-var (
-	n2, n4, n6 = json.Number("2"), json.Number("4"), json.Number("6")
-	f2, f4, f6 = json.Number("2.2"), json.Number("4.4"), json.Number("6.6")
+	tests := []struct {
+		f    DurationFormat
+		want string
+	}{
+		{DurationString, "D = \"1m30s\"\nP = \"1.5s\"\nArr = [\"1ms\", \"0s\"]\n\n[Map]\n  k = \"1h0m0s\"\n"},
+		{DurationSeconds, "D = 90.0\nP = 1.5\nArr = [0.001, 0.0]\n\n[Map]\n  k = 3600.0\n"},
+		{DurationNanoseconds, "D = 90000000000\nP = 1500000000\nArr = [1000000, 0]\n\n[Map]\n  k = 3600000000000\n"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).DurationFormat(tt.f).Encode(in); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), tt.want)
+			}
+
+			var out config
+			if _, err := Decode(buf.String(), &out); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, in) {
+				t.Errorf("\nhave: %#v\nwant: %#v", out, in)
+			}
+		})
+	}
+
+	// The exact number of seconds is written, also if a float64 can't
+	// represent it.
+	for _, tt := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{-time.Millisecond, "D = -0.001\n"},
+		{math.MaxInt64, "D = 9223372036.854775807\n"},
+		{math.MinInt64, "D = -9223372036.854775808\n"},
+	} {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).DurationFormat(DurationSeconds).Encode(struct{ D time.Duration }{tt.d}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("\nhave: %s\nwant: %s", buf.String(), tt.want)
+		}
+	}
+}
+
+type jsonT struct {
+	Num  json.Number
+	NumP *json.Number
+	Arr  []json.Number
+	ArrP []*json.Number
+	Tbl  map[string]json.Number
+	TblP map[string]*json.Number
+}
+
+var (
+	n2, n4, n6 = json.Number("2"), json.Number("4"), json.Number("6")
+	f2, f4, f6 = json.Number("2.2"), json.Number("4.4"), json.Number("6.6")
 )
 
 func TestEncodeJSONNumber(t *testing.T) {
@@ -1210,31 +1924,177 @@ ArrayOfMixedSlices = [[1, 2], ["a", "b"]]
 	}
 }
 
-func TestEncodeDoubleTags(t *testing.T) {
-	// This writes two "a" keys to the TOML doc, which isn't valid. I don't
-	// think it's worth spending effort preventing this: best we can do is issue
-	// an error, and should be clear what the problem is anyway. Not even worth
-	// documenting really.
-	//
-	// The json package silently skips these fields, which is worse behaviour
-	// IMO.
-	s := struct {
-		A int `toml:"a"`
-		B int `toml:"a"`
-		C int `toml:"c"`
-	}{1, 2, 3}
+// A field in the outer struct hides a promoted field with the same key, and
+// encoding and decoding use the same rules.
+func TestEncodeEmbeddedSameKey(t *testing.T) {
+	type untagged struct{ Name string }
+	type tagged struct {
+		Name string `toml:"name"`
+	}
+	type taggedUpper struct {
+		Name string `toml:"Name"`
+	}
+	type untaggedTable struct{ Name map[string]int }
+
+	tests := []struct {
+		in      any
+		want    string
+		decoded any
+	}{
+		{ // Outer untagged, promoted untagged.
+			&struct {
+				Name string
+				untagged
+			}{"outer", untagged{"inner"}},
+			"Name = \"outer\"\n",
+			&struct {
+				Name string
+				untagged
+			}{"outer", untagged{}},
+		},
+		{ // Outer untagged, promoted tagged.
+			&struct {
+				Name string
+				tagged
+			}{"outer", tagged{"inner"}},
+			"Name = \"outer\"\nname = \"inner\"\n",
+			nil,
+		},
+		{ // Outer tagged, promoted untagged.
+			&struct {
+				Name string `toml:"name"`
+				untagged
+			}{"outer", untagged{"inner"}},
+			"name = \"outer\"\nName = \"inner\"\n",
+			nil,
+		},
+		{ // Outer tagged, promoted tagged.
+			&struct {
+				Name string `toml:"name"`
+				tagged
+			}{"outer", tagged{"inner"}},
+			"name = \"outer\"\n",
+			&struct {
+				Name string `toml:"name"`
+				tagged
+			}{"outer", tagged{}},
+		},
+		{ // Tagged wins at the same depth.
+			&struct {
+				untagged
+				taggedUpper
+			}{untagged{"a"}, taggedUpper{"b"}},
+			"Name = \"b\"\n",
+			&struct {
+				untagged
+				taggedUpper
+			}{untagged{}, taggedUpper{"b"}},
+		},
+		{ // Hidden tables aren't written either.
+			&struct {
+				Name map[string]int
+				untaggedTable
+			}{map[string]int{"a": 1}, untaggedTable{map[string]int{"b": 2}}},
+			"[Name]\n  a = 1\n",
+			&struct {
+				Name map[string]int
+				untaggedTable
+			}{map[string]int{"a": 1}, untaggedTable{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			buf := new(strings.Builder)
+			if err := NewEncoder(buf).Encode(tt.in); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), tt.want)
+			}
+
+			have := reflect.New(reflect.TypeOf(tt.in).Elem()).Interface()
+			if _, err := Decode(buf.String(), have); err != nil {
+				t.Fatal(err)
+			}
+			want := tt.decoded
+			if want == nil {
+				want = tt.in
+			}
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("\nhave: %+v\nwant: %+v", have, want)
+			}
+		})
+	}
+}
+
+func TestEncodeUnexportedTag(t *testing.T) {
 	buf := new(strings.Builder)
-	err := NewEncoder(buf).Encode(s)
+	err := NewEncoder(buf).Encode(struct {
+		User   string `toml:"user"`
+		secret string
+	}{"a", "b"})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if want := "user = \"a\"\n"; buf.String() != want {
+		t.Errorf("\nhave: %s\nwant: %s", buf.String(), want)
+	}
 
-	want := `a = 1
-a = 2
-c = 3
-`
-	if want != buf.String() {
-		t.Errorf("\nhave: %s\nwant: %s\n", buf.String(), want)
+	type creds struct {
+		User     string `toml:"user"`
+		password string `toml:"password"`
+	}
+	err = NewEncoder(buf).Encode(creds{"a", "b"})
+	want := `toml: can't encode the unexported field toml.creds.password with the tag "password"`
+	if !errorContains(err, want) {
+		t.Errorf("wrong error:\nhave: %v\nwant: %s", err, want)
+	}
+}
+
+func TestEncodeDoubleTags(t *testing.T) {
+	type Embed struct {
+		X int `toml:"x"`
+	}
+	type Embed2 struct {
+		X int `toml:"x"`
+	}
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{struct {
+			A int `toml:"a"`
+			B int `toml:"a"`
+			C int `toml:"c"`
+		}{1, 2, 3}, `toml: duplicate key "a" (fields A and B)`},
+		{struct {
+			A int
+			B int `toml:"A"`
+		}{1, 2}, `toml: duplicate key "A" (fields A and B)`},
+		{struct {
+			A int            `toml:"a"`
+			B map[string]int `toml:"a"`
+		}{1, map[string]int{"b": 2}}, `toml: duplicate key "a" (fields A and B)`},
+		{struct {
+			Embed
+			Embed2
+		}{}, `toml: duplicate key "x" (fields Embed.X and Embed2.X)`},
+		{map[string]any{"tbl": struct {
+			A int `toml:"a"`
+			B int `toml:"a"`
+		}{}}, `toml: duplicate key "a" (fields A and B)`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			buf := new(strings.Builder)
+			err := NewEncoder(buf).Encode(tt.in)
+			if !errorContains(err, tt.want) {
+				t.Errorf("wrong error:\nhave: %v\nwant: %s", err, tt.want)
+			}
+			if buf.Len() > 0 {
+				t.Errorf("wrote output: %q", buf.String())
+			}
+		})
 	}
 }
 
@@ -1255,7 +2115,7 @@ func TestMarshalDoc(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		want := `marshal_toml = "asd"`
+		want := "marshal_toml = \"asd\"\n"
 		if want != buf.String() {
 			t.Errorf("\nhave: %s\nwant: %s\n", buf.String(), want)
 		}
@@ -1268,7 +2128,7 @@ func TestMarshalDoc(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		want := `"marshal_text = \"asd\""`
+		want := `"marshal_text = \"asd\""` + "\n"
 		if want != buf.String() {
 			t.Errorf("\nhave: %s\nwant: %s\n", buf.String(), want)
 		}
@@ -1341,3 +2201,2124 @@ k1 = "a"
 		t.Fatalf("\nhave: %s\nwant: %s", h, w)
 	}
 }
+
+func TestEncodePlan(t *testing.T) {
+	type (
+		Base struct {
+			ID   int
+			Tags []string `toml:"tags,omitempty"`
+		}
+		Server struct {
+			Name string `toml:"name"`
+			Port int    `toml:"port,omitzero"`
+		}
+		Config struct {
+			Base
+			Title   string            `toml:"title"`
+			Skip    string            `toml:"-"`
+			Empty   string            `toml:"empty,omitempty"`
+			Created time.Time         `toml:"created"`
+			Labels  map[string]string `toml:"labels"`
+			Owner   *Server           `toml:"owner"`
+			Servers []Server          `toml:"servers"`
+			ByName  map[string]Server `toml:"by_name,keyed=name"`
+			Points  []map[string]int  `toml:"points"`
+		}
+	)
+
+	c := Config{
+		Base:    Base{ID: 1},
+		Title:   "x",
+		Created: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Labels:  map[string]string{"env": "prod", "a": "b"},
+		Owner:   &Server{Name: "o"},
+		Servers: []Server{{Name: "s1", Port: 80}, {Name: "s2"}},
+		ByName:  map[string]Server{"k": {Port: 1}},
+		Points:  []map[string]int{{"x": 1}},
+	}
+
+	plan, err := NewEncoder(nil).Plan(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, p := range plan {
+		have = append(have, fmt.Sprintf("%-14s %-9s %s", p.Key, p.TOMLType, p.GoPath))
+	}
+	want := []string{
+		"ID             Integer   Base.ID",
+		"title          String    Title",
+		"created        Datetime  Created",
+		"labels         Hash      Labels",
+		`labels.a       String    Labels["a"]`,
+		`labels.env     String    Labels["env"]`,
+		"owner          Hash      Owner",
+		"owner.name     String    Owner.Name",
+		"servers        ArrayHash Servers[0]",
+		"servers.name   String    Servers[0].Name",
+		"servers.port   Integer   Servers[0].Port",
+		"servers        ArrayHash Servers[1]",
+		"servers.name   String    Servers[1].Name",
+		`by_name        ArrayHash ByName["k"]`,
+		`by_name.name   String    ByName["k"]`,
+		`by_name.port   Integer   ByName["k"].Port`,
+		"points         ArrayHash Points[0]",
+		`points.x       Integer   Points[0]["x"]`,
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Compare against what's actually written.
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(c); err != nil {
+		t.Fatal(err)
+	}
+	var v any
+	meta, err := Decode(buf.String(), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var planned, encoded []string
+	for _, p := range plan {
+		planned = append(planned, p.Key.String()+" "+p.TOMLType)
+	}
+	for _, k := range meta.Keys() {
+		encoded = append(encoded, k.String()+" "+meta.Type(k...))
+	}
+	if !reflect.DeepEqual(planned, encoded) {
+		t.Errorf("plan doesn't match output\nplan:\n%s\noutput:\n%s\n\n%s",
+			strings.Join(planned, "\n"), strings.Join(encoded, "\n"), buf.String())
+	}
+
+	_, err = NewEncoder(nil).Plan(map[string]any{"a": []any{1, nil}})
+	if err == nil || err.Error() != "toml: cannot encode array with nil element" {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestEncodeJSONInterfaces(t *testing.T) {
+	type S struct {
+		R     jsonRange
+		Ptr   *jsonRange
+		Nil   *jsonRange
+		Map   map[string]jsonRange
+		Slice []jsonRange
+		Raw   json.RawMessage
+	}
+	s := S{
+		R:     jsonRange{1, 2},
+		Ptr:   &jsonRange{3, 3},
+		Map:   map[string]jsonRange{"a": {4, 5}},
+		Slice: []jsonRange{{6, 7}},
+		Raw:   json.RawMessage(`{"n": null, "f": 1.5, "a": [1, null]}`),
+	}
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).UseJSONInterfaces(true).Encode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `
+[R]
+  hi = 2
+  lo = 1
+
+[Ptr]
+  hi = 3
+  lo = 3
+
+[Map]
+  [Map.a]
+    hi = 5
+    lo = 4
+
+[[Slice]]
+  hi = 7
+  lo = 6
+
+[Raw]
+  a = [1]
+  f = 1.5
+`[1:]
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	var s2 S
+	if _, err := NewDecoder(&buf).UseJSONInterfaces(true).Decode(&s2); err != nil {
+		t.Fatal(err)
+	}
+	if s2.R != s.R || *s2.Ptr != *s.Ptr || s2.Map["a"] != s.Map["a"] || s2.Slice[0] != s.Slice[0] {
+		t.Errorf("not the same after round trip:\nhave: %+v\nwant: %+v", s2, s)
+	}
+
+	_, err = Marshal(struct{ R jsonRange }{})
+	if err == nil || !strings.Contains(err.Error(), "has no exported fields and no marshaler") {
+		t.Errorf("wrong error: %v", err)
+	}
+	err = NewEncoder(new(bytes.Buffer)).UseJSONInterfaces(true).Encode(struct{ A []json.RawMessage }{
+		[]json.RawMessage{json.RawMessage(`1`), json.RawMessage(`null`)}})
+	if err != errArrayNilElement {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestEncodeFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+
+	if err := EncodeFile(path, map[string]int{"a": 1}, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	have, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(have) != "a = 1\n" {
+		t.Errorf("wrong content: %q", have)
+	}
+
+	// Existing permissions are kept.
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeFile(path, map[string]int{"b": 2}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	have, _ = os.ReadFile(path)
+	if string(have) != "b = 2\n" {
+		t.Errorf("wrong content: %q", have)
+	}
+	if runtime.GOOS != "windows" {
+		st, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := st.Mode().Perm(); p != 0o600 {
+			t.Errorf("wrong permissions: %o", p)
+		}
+	}
+
+	// Nothing is written on errors, even if some keys were encoded already.
+	err = EncodeFile(path, map[string]any{"a": 1, "b": []any{1, nil}}, 0o644)
+	if err != errArrayNilElement {
+		t.Fatalf("wrong error: %v", err)
+	}
+	have, _ = os.ReadFile(path)
+	if string(have) != "b = 2\n" {
+		t.Errorf("file changed: %q", have)
+	}
+
+	ls, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 {
+		t.Errorf("temporary files left behind: %v", ls)
+	}
+}
+
+type writeMapFS map[string]string
+
+func (m writeMapFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m[name] = string(data)
+	return nil
+}
+
+func TestEncodeFS(t *testing.T) {
+	fsys := writeMapFS{"a.toml": "old"}
+	if err := EncodeFS(fsys, "b.toml", map[string]int{"a": 1}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeFS(fsys, "a.toml", map[string]any{"a": []any{nil}}, 0o644); err != errArrayNilElement {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if have := fmt.Sprint(fsys); have != "map[a.toml:old b.toml:a = 1\n]" {
+		t.Errorf("wrong files: %q", have)
+	}
+}
+
+// multiline is a MarshalTOML that writes a multiline string, with a trailing
+// newline.
+type multiline string
+
+func (m multiline) MarshalTOML() ([]byte, error) {
+	return []byte("\"\"\"\n" + string(m) + "\"\"\"\n\n"), nil
+}
+
+func TestEncodeTrailingNewline(t *testing.T) {
+	tests := []struct {
+		name string
+		in   any
+		want string
+	}{
+		{"empty", map[string]any{}, ""},
+		{"nil table", map[string]any{"a": nil}, ""},
+		{"single key", map[string]int{"a": 1}, "a = 1\n"},
+		{"table", map[string]any{"a": 1, "tbl": map[string]int{"b": 2}}, "a = 1\n\n[tbl]\n  b = 2\n"},
+		{"empty table", map[string]any{"tbl": map[string]int{}}, "[tbl]\n"},
+		{"array table", map[string]any{"arr": []map[string]int{{"a": 1}, {"a": 2}}},
+			"[[arr]]\n  a = 1\n\n[[arr]]\n  a = 2\n"},
+		{"multiline", map[string]any{"s": multiline("a\n")}, "s = \"\"\"\na\n\"\"\"\n"},
+		{"marshaler doc", Doc1{"x"}, "marshal_toml = \"x\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).Encode(tt.in); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", buf.String(), tt.want)
+			}
+
+			buf.Reset()
+			if err := NewEncoder(&buf).TrailingNewline(false).Encode(tt.in); err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.TrimSuffix(tt.want, "\n"); buf.String() != want {
+				t.Errorf("TrailingNewline(false)\nhave: %q\nwant: %q", buf.String(), want)
+			}
+		})
+	}
+
+	// The newline is still written before the next document.
+	for _, nl := range []bool{true, false} {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf).TrailingNewline(nl)
+		for _, v := range []any{map[string]int{"a": 1}, map[string]int{}, map[string]int{"b": 2}} {
+			if err := enc.Encode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := "a = 1\nb = 2\n"
+		if !nl {
+			want = "a = 1\nb = 2"
+		}
+		if buf.String() != want {
+			t.Errorf("\nhave: %q\nwant: %q", buf.String(), want)
+		}
+	}
+}
+
+func TestEncodeFloat32(t *testing.T) {
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{struct{ F float32 }{0.1}, "F = 0.1\n"},
+		{struct{ F *float32 }{new(float32)}, "F = 0.0\n"},
+		{map[string]float32{"f": 0.1}, "f = 0.1\n"},
+		{map[string]any{"f": float32(0.1)}, "f = 0.1\n"},
+		{map[string]any{"f": []float32{0.1, 1e10}}, "f = [0.1, 10000000000.0]\n"},
+		{map[string]any{"f": []any{float32(0.1), 0.1}}, "f = [0.1, 0.1]\n"},
+		{map[string]any{"f": map[string]any{"g": float32(0.1)}}, "[f]\n  g = 0.1\n"},
+
+		// Can't know this was a float32.
+		{map[string]any{"f": float64(float32(0.1))}, "f = 0.10000000149011612\n"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have, err := Marshal(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(have) != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+
+	// Round trip.
+	var s struct {
+		F float32
+		M map[string]float32
+		S []float32
+	}
+	in := map[string]any{
+		"F": float32(0.1),
+		"M": map[string]any{"f": float32(0.1)},
+		"S": []any{float32(0.1)},
+	}
+	b, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.F != 0.1 || s.M["f"] != 0.1 || s.S[0] != 0.1 {
+		t.Errorf("%v", s)
+	}
+}
+
+type ordered struct {
+	keys []string
+	m    map[string]any
+}
+
+func (o *ordered) Keys() []string { return o.keys }
+func (o *ordered) Get(k string) (any, bool) {
+	v, ok := o.m[k]
+	return v, ok
+}
+
+func (o *ordered) set(k string, v any) *ordered {
+	if o.m == nil {
+		o.m = make(map[string]any)
+	}
+	if _, ok := o.m[k]; !ok {
+		o.keys = append(o.keys, k)
+	}
+	o.m[k] = v
+	return o
+}
+
+// orderTables converts all tables in v to ordered, using the key order from
+// MetaData.Keys().
+func orderTables(meta MetaData, v any) any {
+	tables := make(map[string][]*ordered) // Array tables share a key.
+	var conv func(k Key, v any) any
+	conv = func(k Key, v any) any {
+		switch vv := v.(type) {
+		case map[string]any:
+			o := &ordered{m: make(map[string]any)}
+			tables[k.String()] = append(tables[k.String()], o)
+			for kk, vvv := range vv {
+				o.m[kk] = conv(k.add(kk), vvv)
+			}
+			return o
+		case []map[string]any:
+			s := make([]any, 0, len(vv))
+			for _, t := range vv {
+				s = append(s, conv(k, t))
+			}
+			return s
+		}
+		return v
+	}
+	v = conv(nil, v)
+
+	seen := make(map[string]bool)
+	for _, k := range meta.Keys() {
+		if seen[k.String()] {
+			continue
+		}
+		seen[k.String()] = true
+		for _, o := range tables[k.Parent().String()] {
+			if _, ok := o.m[k.Last()]; ok {
+				o.keys = append(o.keys, k.Last())
+			}
+		}
+	}
+	return v
+}
+
+func TestEncodeOrderedMap(t *testing.T) {
+	sub := new(ordered).set("z", 1).set("a", 2)
+	v := new(ordered).
+		set("zz", "first").
+		set("tbl", sub).
+		set("inline", []any{new(ordered).set("b", 1).set("a", 2)}).
+		set("arr", []any{1, new(ordered).set("b", 1).set("a", 2)}).
+		set("plain", map[string]any{"z": 1, "a": 2}).
+		set("aa", "second").
+		set("nil", nil)
+
+	have, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `zz = "first"
+arr = [1, {b = 1, a = 2}]
+aa = "second"
+
+[tbl]
+  z = 1
+  a = 2
+
+[[inline]]
+  b = 1
+  a = 2
+
+[plain]
+  a = 2
+  z = 1
+`
+	if string(have) != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+	}
+
+	// Also in a struct, and as the value of a plain map.
+	var s struct {
+		T     *ordered `toml:"t,omitempty"`
+		Empty *ordered `toml:"empty,omitempty"`
+		M     map[string]*ordered
+	}
+	s.T = sub
+	s.Empty = new(ordered)
+	s.M = map[string]*ordered{"x": sub}
+	have, err = Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "[t]\n  z = 1\n  a = 2\n\n[M]\n  [M.x]\n    z = 1\n    a = 2\n"
+	if string(have) != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+	}
+
+	// Round trip, with the order from MetaData.
+	in := `title = "x"
+owner = "me"
+z = [1, 2]
+
+[servers]
+  [servers.beta]
+    ip = "10.0.0.2"
+    dc = "eqdc10"
+  [servers.alpha]
+    ip = "10.0.0.1"
+    dc = "eqdc10"
+
+[[products]]
+  name = "Hammer"
+  sku = 738594937
+
+[[products]]
+  name = "Nail"
+  sku = 284758393
+`
+	var m map[string]any
+	meta, err := Decode(in, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err = Marshal(orderTables(meta, m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(have) != in {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", have, in)
+	}
+}
+
+func TestEncodeTimesInUTC(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	type s struct {
+		T    time.Time `toml:"t"`
+		Zero time.Time `toml:"zero,omitempty"`
+	}
+
+	// DST starts at 2024-03-10T07:00:00Z.
+	before := time.Date(2024, 3, 10, 6, 30, 0, 0, time.UTC).In(ny)
+	after := before.Add(time.Hour)
+
+	encode := func(utc bool, v s) string {
+		t.Helper()
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).TimesInUTC(utc).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	// Decode, add an hour, and encode again.
+	reencode := func(utc bool, out string) string {
+		t.Helper()
+		var v s
+		if _, err := Decode(out, &v); err != nil {
+			t.Fatal(err)
+		}
+		v.T = v.T.Add(time.Hour)
+		return encode(utc, v)
+	}
+
+	tests := []struct {
+		utc              bool
+		before, after    string
+		afterFromDecoded string
+	}{
+		{false, "t = 2024-03-10T01:30:00-05:00\n", "t = 2024-03-10T03:30:00-04:00\n", "t = 2024-03-10T02:30:00-05:00\n"},
+		{true, "t = 2024-03-10T06:30:00Z\n", "t = 2024-03-10T07:30:00Z\n", "t = 2024-03-10T07:30:00Z\n"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%t", tt.utc), func(t *testing.T) {
+			// Zero time in another zone is still omitted.
+			out := encode(tt.utc, s{T: before, Zero: time.Time{}.In(ny)})
+			if out != tt.before {
+				t.Errorf("before\nhave: %q\nwant: %q", out, tt.before)
+			}
+			if have := encode(tt.utc, s{T: after}); have != tt.after {
+				t.Errorf("after\nhave: %q\nwant: %q", have, tt.after)
+			}
+			if have := reencode(tt.utc, out); have != tt.afterFromDecoded {
+				t.Errorf("re-encoded\nhave: %q\nwant: %q", have, tt.afterFromDecoded)
+			}
+		})
+	}
+
+	// Local datetimes aren't converted, and monotonic readings aren't written.
+	local := time.Date(2024, 3, 10, 1, 30, 0, 0, internal.LocalDatetime)
+	if have := encode(true, s{T: local}); have != "t = 2024-03-10T01:30:00\n" {
+		t.Errorf("local: %q", have)
+	}
+	now := time.Now().In(ny)
+	if have, want := encode(true, s{T: now}), "t = "+now.UTC().Format(time.RFC3339Nano)+"\n"; have != want {
+		t.Errorf("monotonic\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestEncodePlaceholder(t *testing.T) {
+	type db struct {
+		Host     string `toml:"host"`
+		Password string `toml:"password"`
+	}
+	type config struct {
+		Name   string            `toml:"name"`
+		APIKey string            `toml:"api_key"`
+		Port   int               `toml:"port"`
+		DB     db                `toml:"db"`
+		Labels map[string]string `toml:"labels"`
+	}
+
+	var md MetaData
+	md.Placeholder("api_key", "required: your API key")
+	md.Placeholder("port", "")
+	md.Placeholder("extra", "optional")
+	md.Placeholder("db.password", "required\nask the DBA")
+	md.Placeholder("db.user", "")
+	md.Placeholder(`labels."the env"`, "")
+	md.Placeholder("labels.a", "")
+	md.Placeholder("missing.key", "not written")
+
+	tests := []struct {
+		in           config
+		want         string
+		placeholders string
+	}{
+		{config{Name: "n", DB: db{Host: "h"}, Labels: map[string]string{"a": "", "b": "x"}}, `
+name = "n"
+# api_key =   # required: your API key
+# port =
+# extra =   # optional
+
+[db]
+  host = "h"
+  # password =   # required
+  #              # ask the DBA
+  # user =
+
+[labels]
+  # a =
+  b = "x"
+  # "the env" =
+`, `[api_key port extra db.password db.user labels.a labels."the env"]`},
+
+		{config{Name: "n", APIKey: "k", Port: 80, DB: db{Host: "h", Password: "p"}, Labels: map[string]string{"a": "x"}}, `
+name = "n"
+api_key = "k"
+port = 80
+# extra =   # optional
+
+[db]
+  host = "h"
+  password = "p"
+  # user =
+
+[labels]
+  a = "x"
+  # "the env" =
+`, `[extra db.user labels."the env"]`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).MetaData(&md).Encode(tt.in); err != nil {
+				t.Fatal(err)
+			}
+			if have := buf.String(); have != tt.want[1:] {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", have, tt.want[1:])
+			}
+
+			var c config
+			meta, err := Decode(buf.String(), &c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := fmt.Sprintf("%v", meta.Placeholders()); have != tt.placeholders {
+				t.Errorf("placeholders\nhave: %s\nwant: %s", have, tt.placeholders)
+			}
+		})
+	}
+
+	// Filled in placeholders aren't reported.
+	var c config
+	meta, err := Decode("# api_key =   # required\napi_key = 'k'\n[db]\n# password =\nhost = 'h' # port =\n# note: not a placeholder = \n# x = 1\n", &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := fmt.Sprintf("%v", meta.Placeholders()); have != "[db.password]" {
+		t.Errorf("placeholders: %s", have)
+	}
+}
+
+func TestEncodeCommentOmitted(t *testing.T) {
+	type tls struct {
+		Cert string `toml:"cert"`
+		Key  string `toml:"key,omitempty"`
+		Opts struct {
+			Verify bool `toml:"verify"`
+		} `toml:"opts"`
+	}
+	type config struct {
+		Name   string         `toml:"name,omitempty"`
+		Port   int            `toml:"port,omitzero"`
+		Tags   []string       `toml:"tags,omitempty"`
+		Host   string         `toml:"host"`
+		TLS    *tls           `toml:"tls,omitempty"`
+		Labels map[string]any `toml:"labels,omitempty"`
+		Nest   struct {
+			X int `toml:"x,omitzero"`
+			Y int `toml:"y"`
+		} `toml:"nest"`
+		List []tls `toml:"list"`
+	}
+
+	tests := []struct {
+		depth int
+		in    config
+		want  string
+	}{
+		{0, config{Host: "h", List: []tls{{Cert: "c"}}}, `
+# name = ""
+# port = 0
+# tags = []
+host = "h"
+
+# [tls]
+  # cert = ""
+  # key = ""
+  # [tls.opts]
+    # verify = false
+
+# [labels]
+
+[nest]
+  # x = 0
+  y = 0
+
+[[list]]
+  cert = "c"
+  # key = ""
+  [list.opts]
+    verify = false
+`},
+		{1, config{Host: "h", Port: 80}, `
+# name = ""
+port = 80
+# tags = []
+host = "h"
+
+# [tls]
+  # cert = ""
+  # key = ""
+
+# [labels]
+
+[nest]
+  # x = 0
+  y = 0
+`},
+		{0, config{Name: "n", Tags: []string{"a"}, Host: "h", Port: 80, TLS: &tls{Cert: "c"}, Labels: map[string]any{"l": 1}}, `
+name = "n"
+port = 80
+tags = ["a"]
+host = "h"
+
+[tls]
+  cert = "c"
+  # key = ""
+  [tls.opts]
+    verify = false
+
+[labels]
+  l = 1
+
+[nest]
+  # x = 0
+  y = 0
+`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var buf bytes.Buffer
+			err := NewEncoder(&buf).CommentOmitted(true).CommentOmittedDepth(tt.depth).Encode(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have := buf.String(); have != tt.want[1:] {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", have, tt.want[1:])
+			}
+
+			// Decodes the same as without the comments.
+			plain, err := Marshal(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want, have any
+			if _, err := Decode(string(plain), &want); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Decode(buf.String(), &have); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(have, want) {
+				t.Errorf("\nhave: %#v\nwant: %#v", have, want)
+			}
+		})
+	}
+}
+
+func TestEncodeList(t *testing.T) {
+	type Migration struct {
+		Version int    `toml:"version"`
+		SQL     string `toml:"sql"`
+		Opts    struct {
+			Tx bool `toml:"tx"`
+		} `toml:"opts"`
+	}
+	in := []Migration{{Version: 1, SQL: "create table t (id int)"}, {Version: 2, SQL: "drop table t"}}
+	in[1].Opts.Tx = true
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).EncodeList("migration", in); err != nil {
+		t.Fatal(err)
+	}
+	want := `[[migration]]
+  version = 1
+  sql = "create table t (id int)"
+  [migration.opts]
+    tx = false
+
+[[migration]]
+  version = 2
+  sql = "drop table t"
+  [migration.opts]
+    tx = true
+`
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	var have []Migration
+	if _, err := Decode(buf.String(), &have); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, in) {
+		t.Errorf("\nhave: %#v\nwant: %#v", have, in)
+	}
+
+	buf.Reset()
+	if err := NewEncoder(&buf).EncodeList("migration", []Migration{}); err != nil || buf.Len() != 0 {
+		t.Errorf("empty list: %q, %v", buf.String(), err)
+	}
+
+	for _, v := range []any{nil, Migration{}, []int{1}} {
+		err := NewEncoder(&buf).EncodeList("migration", v)
+		if !errorContains(err, "toml: EncodeList needs a") {
+			t.Errorf("%T: wrong error: %v", v, err)
+		}
+	}
+}
+
+type regionEnv struct{ Region, Env string }
+
+func (r regionEnv) MarshalText() ([]byte, error) { return []byte(r.Region + "/" + r.Env), nil }
+func (r *regionEnv) UnmarshalText(b []byte) error {
+	var ok bool
+	r.Region, r.Env, ok = strings.Cut(string(b), "/")
+	if !ok {
+		return fmt.Errorf("no / in %q", b)
+	}
+	return nil
+}
+
+func TestEncodeTextMarshalerMapKey(t *testing.T) {
+	type config struct {
+		Replicas int      `toml:"replicas"`
+		Tags     []string `toml:"tags"`
+	}
+	type nested struct {
+		Deploy map[regionEnv]config `toml:"deploy"`
+	}
+	m := map[regionEnv]config{
+		{"us-east-1", "prod"}: {Replicas: 3},
+		{"eu.west", "a=b"}:    {Replicas: 2, Tags: []string{"x"}},
+		{`q"uote`, "日本"}:      {Replicas: 1},
+	}
+
+	tests := []struct {
+		in       any
+		want     string
+		wantKeys []string
+	}{
+		{m, `["eu.west/a=b"]
+  replicas = 2
+  tags = ["x"]
+
+["q\"uote/日本"]
+  replicas = 1
+
+["us-east-1/prod"]
+  replicas = 3
+`, []string{
+			`"eu.west/a=b"`, `"eu.west/a=b".replicas`, `"eu.west/a=b".tags`,
+			`"q\"uote/日本"`, `"q\"uote/日本".replicas`,
+			`"us-east-1/prod"`, `"us-east-1/prod".replicas`,
+		}},
+		{nested{m}, `[deploy]
+  [deploy."eu.west/a=b"]
+    replicas = 2
+    tags = ["x"]
+  [deploy."q\"uote/日本"]
+    replicas = 1
+  [deploy."us-east-1/prod"]
+    replicas = 3
+`, []string{
+			`deploy`,
+			`deploy."eu.west/a=b"`, `deploy."eu.west/a=b".replicas`, `deploy."eu.west/a=b".tags`,
+			`deploy."q\"uote/日本"`, `deploy."q\"uote/日本".replicas`,
+			`deploy."us-east-1/prod"`, `deploy."us-east-1/prod".replicas`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).Encode(tt.in); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), tt.want)
+			}
+
+			out := reflect.New(reflect.TypeOf(tt.in))
+			meta, err := Decode(buf.String(), out.Interface())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Elem().Interface(), tt.in) {
+				t.Errorf("\nhave: %#v\nwant: %#v", out.Elem().Interface(), tt.in)
+			}
+
+			var keys []string
+			for _, k := range meta.Keys() {
+				keys = append(keys, k.String())
+			}
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("\nhave: %q\nwant: %q", keys, tt.wantKeys)
+			}
+			for _, k := range meta.Keys() {
+				want := "Hash"
+				switch k[len(k)-1] {
+				case "replicas":
+					want = "Integer"
+				case "tags":
+					want = "Array"
+				}
+				if have := meta.Type(k...); have != want {
+					t.Errorf("type of %s: %s, want %s", k, have, want)
+				}
+			}
+		})
+	}
+
+	// Keys with the same MarshalText output can't both be written.
+	err := NewEncoder(new(bytes.Buffer)).Encode(map[dupText]int{{1}: 1, {2}: 2})
+	if !errorContains(err, `map has more than one key that's written as "dup"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// Errors from UnmarshalText have the position.
+	var out map[regionEnv]config
+	_, err = Decode("\n[noslash]\nreplicas = 1", &out)
+	if !errorContains(err, `toml: line 2 (last key "noslash"): no / in "noslash"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+type dupText struct{ n int }
+
+func (dupText) MarshalText() ([]byte, error) { return []byte("dup"), nil }
+
+func TestEncodeLocalZones(t *testing.T) {
+	v := struct {
+		DT, D, T time.Time
+		All      []time.Time
+	}{
+		DT: time.Date(1979, 5, 27, 7, 32, 0, 250000000, LocalDatetimeZone),
+		D:  time.Date(1979, 5, 27, 0, 0, 0, 0, LocalDateZone),
+		T:  time.Date(0, 1, 1, 7, 32, 0, 0, LocalTimeZone),
+	}
+	v.All = []time.Time{v.DT, v.D, v.T}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	want := `DT = 1979-05-27T07:32:00.25
+D = 1979-05-27
+T = 07:32:00
+All = [1979-05-27T07:32:00.25, 1979-05-27, 07:32:00]
+`
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+type port int
+
+func (p port) MarshalTOML() ([]byte, error) { return []byte(strconv.Itoa(int(p))), nil }
+
+func TestEncodeAnnotateTypes(t *testing.T) {
+	type backend struct {
+		Host   string `toml:"host"`
+		Weight *int   `toml:"weight,omitempty"`
+	}
+	type config struct {
+		Name    string             `toml:"name"`
+		Timeout time.Duration      `toml:"timeout,omitempty"`
+		Port    port               `toml:"port"`
+		Ratio   float32            `toml:"ratio,omitzero"`
+		Tags    []string           `toml:"tags"`
+		Mixed   []any              `toml:"mixed"`
+		Labels  map[string]any     `toml:"labels"`
+		Server  struct{ TLS bool } `toml:"server"`
+		Backend []backend          `toml:"backend"`
+	}
+	w := 2
+	in := config{
+		Name:    "app",
+		Timeout: 30 * time.Second,
+		Port:    8080,
+		Tags:    []string{"a"},
+		Mixed:   []any{1, map[string]any{"x": 1}},
+		Labels:  map[string]any{"env": "prod", "n": 1},
+		Backend: []backend{{Host: "a", Weight: &w}, {Host: "b"}},
+	}
+	in.Server.TLS = true
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).AnnotateTypes(true).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	want := `name = "app"  # string (string)
+timeout = "30s"  # string (time.Duration), optional
+port = 8080  # integer (toml.port)
+tags = ["a"]  # array ([]string)
+mixed = [1, {x = 1}]  # array ([]any)
+
+[labels]  # map[string]any
+  env = "prod"  # string (string)
+  n = 1  # integer (int)
+
+[server]  # struct { TLS bool }
+  TLS = true  # bool (bool)
+
+[[backend]]  # toml.backend
+  host = "a"  # string (string)
+  weight = 2  # integer (*int), optional
+
+[[backend]]  # toml.backend
+  host = "b"  # string (string)
+`
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	var out config
+	if _, err := Decode(buf.String(), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	// Omitted fields written as comments are annotated too.
+	buf.Reset()
+	err := NewEncoder(&buf).AnnotateTypes(true).CommentOmitted(true).Encode(struct {
+		N *int            `toml:"n,omitempty"`
+		S struct{ A int } `toml:"s,omitempty"`
+	}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `# n = 0  # integer (*int), optional
+
+# [s]  # struct { A int }
+  # A = 0  # integer (int)
+`
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+type level int
+
+func (l level) MarshalText() ([]byte, error) {
+	return []byte([]string{"debug", "info", "error"}[l]), nil
+}
+
+func (l *level) UnmarshalText(b []byte) error {
+	for i, s := range []string{"debug", "info", "error"} {
+		if s == string(b) {
+			*l = level(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown level %q", b)
+}
+
+func TestEncodeTextMarshalerMapKeyTypes(t *testing.T) {
+	type host struct {
+		Addr string `toml:"addr"`
+		Port int    `toml:"port"`
+	}
+	type config struct {
+		Names  map[netip.Addr]string `toml:"names"`
+		Levels map[level]int         `toml:"levels"`
+		Hosts  map[level]host        `toml:"hosts,keyed=level"`
+	}
+	in := config{
+		Names: map[netip.Addr]string{
+			netip.MustParseAddr("10.0.0.2"): "b",
+			netip.MustParseAddr("::1"):      "local",
+			netip.MustParseAddr("10.0.0.1"): "a",
+		},
+		Levels: map[level]int{2: 10, 0: 30, 1: 20},
+		Hosts:  map[level]host{1: {"x", 1}, 0: {"y", 2}},
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	want := `[names]
+  "10.0.0.1" = "a"
+  "10.0.0.2" = "b"
+  "::1" = "local"
+
+[levels]
+  debug = 30
+  error = 10
+  info = 20
+
+[[hosts]]
+  level = "debug"
+  addr = "y"
+  port = 2
+
+[[hosts]]
+  level = "info"
+  addr = "x"
+  port = 1
+`
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	var out config
+	if _, err := Decode(buf.String(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("\nhave: %#v\nwant: %#v", out, in)
+	}
+
+	_, err := Decode("[[hosts]]\nlevel = \"warn\"", &out)
+	if !errorContains(err, `hosts[0]: unknown level "warn"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestEncodeStringMapKeyType(t *testing.T) {
+	type customString string
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(map[customString]int{"b": 2, "a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "a = 1\nb = 2\n"; buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	in := map[customString]any{
+		"key":      1,
+		"with dot": "x.y",
+		"tbl": map[customString]any{
+			"a b": 1,
+			"sub": map[customString]int{"": 2, "c": 3},
+		},
+		"arr": []map[customString]int{{"x": 1}, {"x.y": 2}},
+	}
+	buf.Reset()
+	if err := NewEncoder(&buf).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	want := `key = 1
+"with dot" = "x.y"
+
+[[arr]]
+  x = 1
+
+[[arr]]
+  "x.y" = 2
+
+[tbl]
+  "a b" = 1
+  [tbl.sub]
+    "" = 2
+    c = 3
+`
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	var out map[customString]any
+	if _, err := Decode(buf.String(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if have := fmt.Sprint(out); have != "map[arr:[map[x:1] map[x.y:2]] key:1 tbl:map[a b:1 sub:map[:2 c:3]] with dot:x.y]" {
+		t.Errorf("wrong decoded: %s", have)
+	}
+}
+
+func TestEncodeMultilineArrays(t *testing.T) {
+	type config struct {
+		Hosts  []string `toml:"hosts"`
+		Ports  []int    `toml:"ports"`
+		Empty  []int    `toml:"empty"`
+		Nested [][]int  `toml:"nested"`
+		Inline []any    `toml:"inline"`
+		Server struct {
+			Names []string       `toml:"names"`
+			Opts  map[string]any `toml:"opts"`
+		} `toml:"server"`
+	}
+	in := config{
+		Hosts:  []string{"alpha.example.com", "beta.example.com"},
+		Ports:  []int{80, 443},
+		Empty:  []int{},
+		Nested: [][]int{{1, 2}, {3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}},
+		Inline: []any{"x", map[string]any{"a": []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}}},
+	}
+	in.Server.Names = []string{"a-long-server-name", "another-server-name"}
+	in.Server.Opts = map[string]any{"list": []string{"a-long-option-value", "another-option-value"}}
+
+	tests := []struct {
+		width int
+		want  string
+	}{
+		{0, `hosts = ["alpha.example.com", "beta.example.com"]
+ports = [80, 443]
+empty = []
+nested = [[1, 2], [3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16]]
+inline = ["x", {a = [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14]}]
+
+[server]
+  names = ["a-long-server-name", "another-server-name"]
+  [server.opts]
+    list = ["a-long-option-value", "another-option-value"]
+`},
+		{40, `hosts = [
+  "alpha.example.com",
+  "beta.example.com",
+]
+ports = [80, 443]
+empty = []
+nested = [
+  [1, 2],
+  [3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16],
+]
+inline = [
+  "x",
+  {a = [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14]},
+]
+
+[server]
+  names = [
+    "a-long-server-name",
+    "another-server-name",
+  ]
+  [server.opts]
+    list = [
+      "a-long-option-value",
+      "another-option-value",
+    ]
+`},
+		{1, `hosts = [
+  "alpha.example.com",
+  "beta.example.com",
+]
+ports = [
+  80,
+  443,
+]
+empty = []
+nested = [
+  [1, 2],
+  [3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16],
+]
+inline = [
+  "x",
+  {a = [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14]},
+]
+
+[server]
+  names = [
+    "a-long-server-name",
+    "another-server-name",
+  ]
+  [server.opts]
+    list = [
+      "a-long-option-value",
+      "another-option-value",
+    ]
+`},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d", tt.width), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).MultilineArrays(tt.width).Encode(in); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), tt.want)
+			}
+
+			var out config
+			if _, err := Decode(buf.String(), &out); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out.Hosts, in.Hosts) || !reflect.DeepEqual(out.Nested, in.Nested) ||
+				!reflect.DeepEqual(out.Server.Names, in.Server.Names) {
+				t.Errorf("\nhave: %#v\nwant: %#v", out, in)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).MultilineArrays(1).AnnotateTypes(true).Encode(struct{ Ports []int }{[]int{80}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Ports = [\n  80,\n]  # array ([]int)\n"; buf.String() != want {
+		t.Errorf("\nhave: %q\nwant: %q", buf.String(), want)
+	}
+}
+
+func TestEncodeMetaDataTables(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"explicit empty parent", "[a]\n[a.b]\n", "[a]\n[a.b]\n"},
+		{"implicit parent", "[a.b.c]\nx = 1\n", "[a.b.c]\nx = 1\n"},
+		{"without super", "[x.y.z.w]\n[x]\n", "[x]\n[x.y.z.w]\n"},
+		{"dotted keys", "a.b.c = 1\n[d.e]\n", "a.b.c = 1\n[d.e]\n"},
+		{"document order", "[z]\n[m.n]\n[[arr.x]]\n[[arr.x]]\n[arr.y]\n", "[z]\n[m.n]\n[[arr.x]]\n[[arr.x]]\n[arr.y]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m map[string]any
+			meta, err := Decode(tt.in, &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf).MetaData(&meta).Spacing(SpacingCompact)
+			enc.Indent = ""
+			if err := enc.Encode(m); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+
+	// Implicit tables still get a header if a key was added.
+	var m map[string]map[string]any
+	meta, err := Decode("[a.b]\n", &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m["a"]["k"] = 1
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).MetaData(&meta).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[a]\n  k = 1\n  [a.b]\n"; buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestEncodeMetaDataDotted(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"dotted", `name = "x"
+fruit.count = 1
+fruit.apple.color = "red"
+fruit.apple.size = 2
+`, ""},
+		{"dotted in table", `[fruit]
+apple.color = "red"
+"quoted key".x = 1
+`, `[fruit]
+  apple.color = "red"
+  "quoted key".x = 1
+`},
+		{"header", `[fruit.apple]
+color = "red"
+`, `  [fruit.apple]
+    color = "red"
+`},
+		{"mixed", `[fruit]
+apple.color = "red"
+
+[fruit.apple.texture]
+smooth = true
+`, `[fruit]
+  [fruit.apple]
+    color = "red"
+    [fruit.apple.texture]
+      smooth = true
+`},
+		{"array", `[[fruit]]
+apple.color = "red"
+
+[[fruit]]
+apple.color = "green"
+`, `[[fruit]]
+  apple.color = "red"
+[[fruit]]
+  apple.color = "green"
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.want == "" {
+				tt.want = tt.in
+			}
+			var m map[string]any
+			meta, err := Decode(tt.in, &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).Profile(EncodeProfile{MetaData: &meta, Spacing: SpacingCompact}).Encode(m); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), tt.want)
+			}
+
+			var m2 map[string]any
+			if _, err := Decode(buf.String(), &m2); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m, m2) {
+				t.Errorf("\nhave: %#v\nwant: %#v", m2, m)
+			}
+		})
+	}
+
+	// Written with a header if there's nothing left to write as a dotted key.
+	var m map[string]any
+	meta, err := Decode("a.b.c = 1\n", &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Dotted("a", "b") || meta.Dotted("a", "b", "c") || meta.Dotted("x") {
+		t.Error("wrong Dotted()")
+	}
+	m["a"].(map[string]any)["b"] = map[string]any{}
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).MetaData(&meta).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	if want := "  [a.b]\n"; buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestEncodeMetaDataComments(t *testing.T) {
+	in := `# The title.
+title = "x"  # trailing
+
+# Not attached to anything.
+
+# Server config.
+# Two lines.
+[server] # srv
+host = "h" # the host
+  # indented
+port = 1
+
+[[replicas]]
+# first
+name = "a"
+
+# Second replica.
+[[replicas]] # two
+name = "b"
+ports = [
+  1, # inside an array
+  2,
+] # ports
+`
+	var m map[string]any
+	meta, err := Decode(in, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if above, after := meta.Comment("server"); above != " Server config.\n Two lines." || after != " srv" {
+		t.Errorf("wrong comment: %q %q", above, after)
+	}
+	if above, after := meta.Comment("replicas[1].ports"); above != "" || after != " ports" {
+		t.Errorf("wrong comment: %q %q", above, after)
+	}
+
+	m["server"].(map[string]any)["port"] = 2
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).MetaData(&meta).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	want := `# The title.
+title = "x"  # trailing
+
+# Server config.
+# Two lines.
+[server]  # srv
+  host = "h"  # the host
+  # indented
+  port = 2
+
+[[replicas]]
+  # first
+  name = "a"
+
+# Second replica.
+[[replicas]]  # two
+  name = "b"
+  ports = [1, 2]  # ports
+`
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestEncodeMetaDataFormat(t *testing.T) {
+	var m map[string]any
+	meta, err := Decode("port = 0xFF\nmasks = [0o644, 10, [0b11]]\n[tbl]\nk = {a = 0x1}\n", &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := meta.Format("masks", "[2]", "[0]"); f.Base != 2 {
+		t.Errorf("wrong format: %#v", f)
+	}
+	if f := meta.Format("masks", "[1]"); f.Base != 0 {
+		t.Errorf("wrong format: %#v", f)
+	}
+
+	m["port"] = int64(0x100)
+	m["masks"] = append(m["masks"].([]any), int64(0o755))
+	meta.SetFormat(Key{"masks", "[3]"}, Format{Base: 8})
+	meta.SetFormat(Key{"masks", "[0]"}, Format{})
+	meta.SetFormat(Key{"tbl", "new"}, Format{Base: 16})
+	m["tbl"].(map[string]any)["new"] = uint8(255)
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).MetaData(&meta).Spacing(SpacingCompact).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	want := "masks = [420, 10, [0b11], 0o755]\nport = 0x100\n[tbl]\n  new = 0xff\n  [tbl.k]\n    a = 0x1\n"
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// Negative numbers can't have a prefix.
+	buf.Reset()
+	if err := NewEncoder(&buf).MetaData(&meta).Encode(map[string]int{"port": -1}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "port = -1\n"; buf.String() != want {
+		t.Errorf("\nhave: %q\nwant: %q", buf.String(), want)
+	}
+}
+
+func TestMarshalWithProfile(t *testing.T) {
+	type config struct {
+		Name  string            `toml:"name,omitempty"`
+		Time  time.Time         `toml:"time"`
+		Sub   map[string]string `toml:"sub"`
+		Ports []int             `toml:"ports"`
+		Tbl   struct{ X int }   `toml:"tbl"`
+	}
+	in := config{
+		Time:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600)),
+		Ports: []int{80, 443},
+		Sub:   map[string]string{"k": "v"},
+	}
+	var meta MetaData
+	meta.Placeholder("name", "the name")
+
+	tests := []struct {
+		p    EncodeProfile
+		with func(*Encoder)
+	}{
+		{EncodeProfile{}, func(*Encoder) {}},
+		{EncodeProfile{Indent: "\t"}, func(e *Encoder) { e.Indent = "\t" }},
+		{EncodeProfile{NoTrailingNewline: true}, func(e *Encoder) { e.TrailingNewline(false) }},
+		{EncodeProfile{CommentOmitted: true}, func(e *Encoder) { e.CommentOmitted(true) }},
+		{EncodeProfile{TimesInUTC: true}, func(e *Encoder) { e.TimesInUTC(true) }},
+		{EncodeProfile{AnnotateTypes: true}, func(e *Encoder) { e.AnnotateTypes(true) }},
+		{EncodeProfile{MultilineArrays: 1}, func(e *Encoder) { e.MultilineArrays(1) }},
+		{EncodeProfile{PreserveFieldOrder: true}, func(e *Encoder) { e.PreserveFieldOrder(true) }},
+		{EncodeProfile{Spacing: SpacingLoose}, func(e *Encoder) { e.Spacing(SpacingLoose) }},
+		{EncodeProfile{MetaData: &meta}, func(e *Encoder) { e.MetaData(&meta) }},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%+v", tt.p), func(t *testing.T) {
+			have, err := MarshalWithProfile(in, tt.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf)
+			tt.with(enc)
+			if err := enc.Encode(in); err != nil {
+				t.Fatal(err)
+			}
+			if string(have) != buf.String() {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", have, buf.String())
+			}
+
+			def, _ := Marshal(in)
+			if tt.p != (EncodeProfile{}) && string(have) == string(def) {
+				t.Errorf("same as the default:\n%s", have)
+			}
+		})
+	}
+
+	opaque := struct{ S struct{ x int } }{}
+	if _, err := Marshal(opaque); err == nil {
+		t.Error("no error")
+	}
+	if _, err := MarshalWithProfile(opaque, EncodeProfile{AllowOpaqueStructs: true}); err != nil {
+		t.Error(err)
+	}
+
+	// Options set before are overwritten.
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf).TimesInUTC(true).Profile(EncodeProfile{})
+	enc.Indent = ""
+	if err := enc.Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "time = 2020-01-02T03:04:05+01:00\n") {
+		t.Errorf("wrong output:\n%s", buf.String())
+	}
+}
+
+func TestEncodeArrayPointers(t *testing.T) {
+	type stage struct{ N int }
+	type config struct {
+		Gains  *[3]float64 `toml:"gains"`
+		Ints   [3]*int     `toml:"ints"`
+		Stages [4]*stage   `toml:"stages"`
+	}
+	one, two := 1, 2
+
+	tests := []struct {
+		in   config
+		want string
+	}{
+		{config{}, "ints = []\nstages = []\n"},
+		{config{Gains: &[3]float64{1, 2, 3}, Ints: [3]*int{&one, &two}},
+			"gains = [1.0, 2.0, 3.0]\nints = [1, 2]\nstages = []\n"},
+		{config{Stages: [4]*stage{{1}, {2}}},
+			"ints = []\n\n[[stages]]\n  N = 1\n\n[[stages]]\n  N = 2\n"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have, err := Marshal(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(have) != tt.want {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", have, tt.want)
+			}
+
+			var out config
+			if _, err := Decode(string(have), &out); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(out, tt.in) {
+				t.Errorf("\nhave: %#v\nwant: %#v", out, tt.in)
+			}
+		})
+	}
+
+	// A nil element before other elements can't be written without changing
+	// the position of the elements after it.
+	for _, in := range []config{{Ints: [3]*int{nil, &one}}, {Stages: [4]*stage{{1}, nil, {3}}}} {
+		if _, err := Marshal(in); err != errArrayNilElement {
+			t.Errorf("wrong error: %v", err)
+		}
+	}
+}
+
+func TestEncodeKeySort(t *testing.T) {
+	// Compare numeric suffixes by value, so that "pkg2" < "pkg10".
+	natural := func(a, b string) bool {
+		ta, tb := strings.TrimRight(a, "0123456789"), strings.TrimRight(b, "0123456789")
+		if ta != tb || len(a) == len(b) {
+			return a < b
+		}
+		return len(a) < len(b)
+	}
+
+	tables := make(map[string]bool)
+	v := map[string]any{
+		"name":  "app",
+		"alpha": 1,
+		"dependencies": map[string]any{
+			"pkg10": "1.0", "pkg2": "1.0", "pkg1": "1.0", "other": "1.0",
+			"sub": map[string]any{"v10": 1, "v9": 2},
+		},
+		"z": map[string]any{"k10": 1, "k9": 2},
+	}
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).SetKeySort(func(table Key, a, b string) bool {
+		tables[table.String()] = true
+		switch table.String() {
+		case "":
+			if a == "name" || b == "name" { // Priority key first.
+				return a == "name"
+			}
+		case "dependencies", "dependencies.sub":
+			return natural(a, b)
+		}
+		return a < b
+	}).Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `name = "app"
+alpha = 1
+
+[dependencies]
+  other = "1.0"
+  pkg1 = "1.0"
+  pkg2 = "1.0"
+  pkg10 = "1.0"
+  [dependencies.sub]
+    v9 = 2
+    v10 = 1
+
+[z]
+  k10 = 1
+  k9 = 2
+`
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	if want := map[string]bool{"": true, "dependencies": true, "dependencies.sub": true, "z": true}; !reflect.DeepEqual(tables, want) {
+		t.Errorf("wrong tables: %v", tables)
+	}
+}
+
+func TestEncodeKeyOrder(t *testing.T) {
+	in := map[string]any{
+		"name": "app",
+		"port": 8080,
+		"all":  true,
+		"log":  map[string]any{"level": "info", "file": "app.log", "debug": false},
+		"db":   map[string]any{"host": "localhost"},
+	}
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).
+		KeyOrder(nil, []string{"port", "log", "nope", "name"}).
+		KeyOrder(Key{"log"}, []string{"level", "file"}).
+		Encode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sub-tables are still written after the other keys.
+	want := `port = 8080
+name = "app"
+all = true
+
+[log]
+  level = "info"
+  file = "app.log"
+  debug = false
+
+[db]
+  host = "localhost"
+`
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// Takes precedence over the order from MetaData.
+	var m map[string]any
+	meta, err := Decode("[b]\n[a]\n[c]\n", &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	err = NewEncoder(&buf).MetaData(&meta).Spacing(SpacingCompact).Encode(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[b]\n[a]\n[c]\n"; buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	buf.Reset()
+	err = NewEncoder(&buf).MetaData(&meta).Spacing(SpacingCompact).KeyOrder(nil, []string{"c"}).Encode(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[c]\n[a]\n[b]\n"; buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	err = NewEncoder(&buf).KeyOrder(Key{"log"}, []string{"file", "level", "file"}).Encode(in)
+	if err == nil || err.Error() != `toml: KeyOrder for "log" has the key "file" more than once` {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestEncodePreserveFieldOrder(t *testing.T) {
+	type db struct {
+		Host string `toml:"host"`
+	}
+	type embed struct {
+		E   int `toml:"e"`
+		Sub db  `toml:"sub"`
+	}
+	type config struct {
+		Name string `toml:"name"`
+		Log  struct {
+			Level string `toml:"level"`
+			File  struct {
+				Path string `toml:"path"`
+			} `toml:"file"`
+		} `toml:"log"`
+		Servers []db `toml:"servers"`
+		Port    int  `toml:"port"`
+		embed
+		Labels  map[string]string `toml:"labels"`
+		Retries int               `toml:"retries"`
+		DB      db                `toml:"db"`
+		Backup  []db              `toml:"backup"`
+	}
+	in := config{
+		Name:    "app",
+		Servers: []db{{"a"}, {"b"}},
+		Port:    8080,
+		embed:   embed{E: 1, Sub: db{"s"}},
+		Labels:  map[string]string{"env": "prod"},
+		Retries: 3,
+		DB:      db{"localhost"},
+		Backup:  []db{{"c"}},
+	}
+	in.Log.Level = "info"
+	in.Log.File.Path = "/var/log"
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).PreserveFieldOrder(true).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	want := `name = "app"
+log = {level = "info", file = {path = "/var/log"}}
+servers = [{host = "a"}, {host = "b"}]
+port = 8080
+e = 1
+sub = {host = "s"}
+labels = {env = "prod"}
+retries = 3
+
+[db]
+  host = "localhost"
+
+[[backup]]
+  host = "c"
+`
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	var out config
+	if _, err := Decode(buf.String(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("\nhave: %#v\nwant: %#v", out, in)
+	}
+
+	// Tables in tables are written in order too.
+	buf.Reset()
+	err := NewEncoder(&buf).PreserveFieldOrder(true).Encode(map[string]any{"t": struct {
+		A db
+		B int
+		C db
+	}{db{"a"}, 2, db{"c"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[t]\n  A = {host = \"a\"}\n  B = 2\n  [t.C]\n    host = \"c\"\n"; buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// The output for floats, integers, and datetimes must be identical on all Go
+// versions, as people rely on generated files not changing. Run with -update to
+// write testdata/encode-golden.toml after an intended change.
+func TestEncodeGolden(t *testing.T) {
+	v := struct {
+		Float64  map[string]float64
+		Float32  map[string]float32
+		Int      map[string]int64
+		Uint     map[string]uint64
+		Datetime map[string]time.Time
+		Duration map[string]time.Duration
+	}{
+		Float64: map[string]float64{
+			"zero":            0,
+			"negative-zero":   math.Copysign(0, -1),
+			"tenth":           0.1,
+			"sum":             0.1 + 0.2,
+			"third":           1.0 / 3,
+			"integral":        100,
+			"fraction":        123456789.123,
+			"exp-neg-7":       1e-7,
+			"exp-21":          1e21,
+			"exp-22":          1e22,
+			"int-boundary":    1 << 53,
+			"int-boundary-p1": 1<<53 + 2,
+			"max":             math.MaxFloat64,
+			"min-normal":      2.2250738585072014e-308,
+			"max-subnormal":   2.225073858507201e-308,
+			"min-subnormal":   math.SmallestNonzeroFloat64,
+			"nan":             math.NaN(),
+			"inf":             math.Inf(1),
+			"negative-inf":    math.Inf(-1),
+		},
+		Float32: map[string]float32{
+			"tenth":         0.1,
+			"third":         1.0 / 3,
+			"int-boundary":  1 << 24,
+			"max":           math.MaxFloat32,
+			"min-normal":    1.1754944e-38,
+			"min-subnormal": math.SmallestNonzeroFloat32,
+		},
+		Int: map[string]int64{
+			"zero":    0,
+			"min":     math.MinInt64,
+			"max":     math.MaxInt64,
+			"hex":     0xdead_beef,
+			"octal":   0o755,
+			"binary":  0b1101_0110,
+			"neg-one": -1,
+		},
+		Uint: map[string]uint64{
+			"max":       math.MaxUint64,
+			"above-int": math.MaxInt64 + 1,
+		},
+		Datetime: map[string]time.Time{
+			"utc":             time.Date(2024, 2, 29, 13, 14, 15, 0, time.UTC),
+			"nanosecond":      time.Date(2024, 2, 29, 13, 14, 15, 1, time.UTC),
+			"millisecond":     time.Date(2024, 2, 29, 13, 14, 15, 123_000_000, time.UTC),
+			"tenth":           time.Date(2024, 2, 29, 13, 14, 15, 100_000_000, time.UTC),
+			"all-fraction":    time.Date(2024, 2, 29, 13, 14, 15, 999_999_999, time.UTC),
+			"offset":          time.Date(2024, 2, 29, 13, 14, 15, 0, time.FixedZone("IST", 5*3600+30*60)),
+			"negative-offset": time.Date(2024, 2, 29, 13, 14, 15, 0, time.FixedZone("", -8*3600)),
+			"offset-seconds":  time.Date(1880, 1, 1, 0, 0, 0, 0, time.FixedZone("LMT", 5*3600+53*60+28)),
+			"zero-offset":     time.Date(2024, 2, 29, 13, 14, 15, 0, time.FixedZone("GMT", 0)),
+			"year-1":          time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC),
+			"year-9999":       time.Date(9999, 12, 31, 23, 59, 59, 999_999_999, time.UTC),
+			"local-datetime":  time.Date(2024, 2, 29, 13, 14, 15, 500_000_000, internal.LocalDatetime),
+			"local-date":      time.Date(2024, 2, 29, 0, 0, 0, 0, internal.LocalDate),
+			"local-time":      time.Date(0, 1, 1, 13, 14, 15, 250_000, internal.LocalTime),
+		},
+		Duration: map[string]time.Duration{
+			"zero":        0,
+			"nanosecond":  1,
+			"fraction":    1500 * time.Millisecond,
+			"hours":       26*time.Hour + 3*time.Minute,
+			"max":         math.MaxInt64,
+			"negative":    -90 * time.Second,
+			"microsecond": 1500 * time.Nanosecond,
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("testdata", "encode-golden.toml")
+	if *update {
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	haveLines, wantLines := strings.Split(buf.String(), "\n"), strings.Split(string(want), "\n")
+	for i := range wantLines {
+		if i >= len(haveLines) || haveLines[i] != wantLines[i] {
+			have := ""
+			if i < len(haveLines) {
+				have = haveLines[i]
+			}
+			t.Fatalf("output differs from %s on line %d:\nhave: %s\nwant: %s", path, i+1, have, wantLines[i])
+		}
+	}
+	if len(haveLines) != len(wantLines) {
+		t.Fatalf("output has %d lines; %s has %d", len(haveLines), path, len(wantLines))
+	}
+
+	// Decoding and encoding again gives the same output.
+	dec := reflect.New(reflect.TypeOf(v))
+	if _, err := Decode(string(want), dec.Interface()); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := NewEncoder(buf).Encode(dec.Elem().Interface()); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != string(want) {
+		t.Errorf("different output after decoding:\n%s", buf.String())
+	}
+}
+
+func TestEncodeSplit(t *testing.T) {
+	type server struct {
+		Name string `toml:"name"`
+	}
+	type config struct {
+		Title    string            `toml:"title"`
+		Database map[string]any    `toml:"database"`
+		Servers  []server          `toml:"servers"`
+		Owner    map[string]string `toml:"owner"`
+		Port     int               `toml:"port"`
+	}
+	decide := func(key string) string {
+		switch key {
+		case "":
+			return "main.toml"
+		case "owner":
+			return ""
+		}
+		return key + ".toml"
+	}
+
+	t.Run("split", func(t *testing.T) {
+		in := config{
+			Title:    "test",
+			Database: map[string]any{"host": "localhost", "pool": map[string]any{"size": int64(5)}},
+			Servers:  []server{{"one"}, {"two"}},
+			Owner:    map[string]string{"name": "me"},
+			Port:     80,
+		}
+		var (
+			files []string
+			out   = make(map[string]string)
+		)
+		err := EncodeSplit(in, decide, func(f string, data []byte) error {
+			files = append(files, f)
+			out[f] = string(data)
+			return nil
+		}, EncodeProfile{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if have, want := strings.Join(files, " "), "main.toml database.toml servers.toml"; have != want {
+			t.Errorf("\nhave: %s\nwant: %s", have, want)
+		}
+		want := map[string]string{
+			"main.toml":     "title = \"test\"\nport = 80\n\n[owner]\n  name = \"me\"\n",
+			"database.toml": "[database]\n  host = \"localhost\"\n  [database.pool]\n    size = 5\n",
+			"servers.toml":  "[[servers]]\n  name = \"one\"\n\n[[servers]]\n  name = \"two\"\n",
+		}
+		for f, w := range want {
+			if out[f] != w {
+				t.Errorf("%s:\nhave:\n%s\nwant:\n%s", f, out[f], w)
+			}
+		}
+
+		var merged config
+		for _, f := range files {
+			if _, err := Decode(out[f], &merged); err != nil {
+				t.Fatalf("%s: %s", f, err)
+			}
+		}
+		if !reflect.DeepEqual(merged, in) {
+			t.Errorf("not the same after decoding:\nhave: %#v\nwant: %#v", merged, in)
+		}
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		var v map[string]any
+		meta, err := Decode("# The title.\ntitle = \"x\"\n\n# The database.\n[database]\nhost = \"localhost\"\n", &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make(map[string]string)
+		err = EncodeSplit(v, decide, func(f string, data []byte) error {
+			out[f] = string(data)
+			return nil
+		}, EncodeProfile{MetaData: &meta})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{
+			"main.toml":     "# The title.\ntitle = \"x\"\n",
+			"database.toml": "# The database.\n[database]\n  host = \"localhost\"\n",
+		}
+		if !reflect.DeepEqual(out, want) {
+			t.Errorf("\nhave: %q\nwant: %q", out, want)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		written := 0
+		err := EncodeSplit(map[string]any{
+			"a":   1,
+			"ok":  map[string]any{"b": 2},
+			"bad": map[string]any{"c": make(chan int)},
+		}, decide, func(string, []byte) error {
+			written++
+			return nil
+		}, EncodeProfile{})
+		if !errorContains(err, "unsupported type: chan") {
+			t.Errorf("wrong error: %v", err)
+		}
+		if written != 0 {
+			t.Errorf("wrote %d files", written)
+		}
+	})
+}
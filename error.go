@@ -2,7 +2,12 @@ package toml
 
 import (
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // ParseError is returned when there is an error parsing the TOML syntax such as
@@ -49,27 +54,77 @@ import (
 //	      [table]
 //	      key    = 42
 //	      second = 43
+//
+// The error keeps a copy of the few lines from the input that are shown, so
+// these methods can be used after the input is gone.
 type ParseError struct {
 	Message  string   // Short technical message.
 	Usage    string   // Longer message with usage guidance; may be blank.
 	Position Position // Position of the error
 	LastKey  string   // Last parsed key, may be blank.
+	Source   string   // Name of the input, set with Decoder.SetName; may be blank.
 
 	// Line the error occurred.
 	//
 	// Deprecated: use [Position].
 	Line int
 
-	err   error
-	input string
+	err       error
+	input     string // Lines of the input shown by ErrorWithPosition.
+	inputLine int    // Line number of the first line in input.
+}
+
+// TimeoutError is returned if reading and parsing the document takes longer
+// than the [Decoder.Deadline].
+type TimeoutError struct {
+	Deadline time.Duration // The deadline that was set.
+	Position Position      // Position the parser reached.
+	Bytes    int           // Number of bytes processed, including a BOM.
+}
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("toml: line %d: parsing took longer than the deadline of %s (processed %d bytes)",
+		e.Position.Line, e.Deadline, e.Bytes)
+}
+
+// PlaceholderError is returned by the [Decoder] if there are placeholder
+// comments that weren't given a value and [Decoder.DisallowPlaceholders] is set.
+type PlaceholderError struct {
+	Keys []Key // Keys without a value, as returned by MetaData.Placeholders.
+}
+
+func (e PlaceholderError) Error() string {
+	keys := make([]string, 0, len(e.Keys))
+	for _, k := range e.Keys {
+		keys = append(keys, strconv.Quote(k.String()))
+	}
+	if len(keys) == 1 {
+		return fmt.Sprintf("toml: placeholder %s has no value", keys[0])
+	}
+	return fmt.Sprintf("toml: placeholders %s have no value", strings.Join(keys, ", "))
+}
+
+// SizeLimitError is returned by the [Encoder] if the output is larger than
+// [Encoder.MaxOutputSize].
+type SizeLimitError struct {
+	Key   Key // Key that was being written; empty if it's before the first key.
+	Limit int // The limit that was set.
+	Size  int // Number of bytes written when the limit was exceeded.
+}
+
+func (e SizeLimitError) Error() string {
+	if len(e.Key) == 0 {
+		return fmt.Sprintf("toml: output is larger than the limit of %d bytes", e.Limit)
+	}
+	return fmt.Sprintf("toml: output is larger than the limit of %d bytes while writing %q", e.Limit, e.Key)
 }
 
 // Position of an error.
 type Position struct {
 	Line  int // Line number, starting at 1.
-	Col   int // Error column, starting at 1.
+	Col   int // Error column in bytes, starting at 1.
 	Start int // Start of error, as byte offset starting at 0.
-	Len   int // Lenght of the error in bytes.
+	Len   int // Length of the error in bytes.
 }
 
 func (p Position) withCol(tomlFile string) Position {
@@ -79,7 +134,7 @@ func (p Position) withCol(tomlFile string) Position {
 	)
 	for i := range lines {
 		ll := len(lines[i]) + 1 // +1 for the removed newline
-		if pos+ll >= p.Start {
+		if pos+ll > p.Start {
 			p.Col = p.Start - pos + 1
 			if p.Col < 1 { // Should never happen, but just in case.
 				p.Col = 1
@@ -93,52 +148,188 @@ func (p Position) withCol(tomlFile string) Position {
 
 func (pe ParseError) Error() string {
 	if pe.LastKey == "" {
-		return fmt.Sprintf("toml: line %d: %s", pe.Position.Line, pe.Message)
+		return fmt.Sprintf("toml: %sline %d: %s", pe.source(), pe.Position.Line, pe.Message)
 	}
-	return fmt.Sprintf("toml: line %d (last key %q): %s",
-		pe.Position.Line, pe.LastKey, pe.Message)
+	return fmt.Sprintf("toml: %sline %d (last key %q): %s",
+		pe.source(), pe.Position.Line, pe.LastKey, pe.Message)
+}
+
+// source returns the Source as a prefix for the line number.
+func (pe ParseError) source() string {
+	if pe.Source == "" {
+		return ""
+	}
+	return pe.Source + ": "
 }
 
 // ErrorWithPosition returns the error with detailed location context.
 //
 // See the documentation on [ParseError].
 func (pe ParseError) ErrorWithPosition() string {
-	if pe.input == "" { // Should never happen, but just in case.
-		return pe.Error()
+	lines := strings.Split(pe.input, "\n")
+	line := func(n int) string { return lines[n-pe.inputLine] }
+	if pe.input == "" || pe.Position.Line < pe.inputLine || pe.Position.Line-pe.inputLine >= len(lines) {
+		return pe.Error() // Should never happen, but just in case.
 	}
 
 	// TODO: don't show control characters as literals? This may not show up
 	// well everywhere.
 
+	/// Position.Col and Position.Len are in bytes, but the ^^^s need to line up
+	/// with what's displayed: expand tabs, count wide characters (such as CJK
+	/// and most emoji) as two columns and combining characters as zero. The
+	/// "column 10-13" is shown as the character index, as we don't know the
+	/// tabsize of the user in their editor, which can be 8, 4, 2, or something
+	/// else. We can't know. So leaving it as the character index is probably
+	/// the "most correct".
 	var (
-		lines = strings.Split(pe.input, "\n")
-		b     = new(strings.Builder)
+		l          = line(pe.Position.Line)
+		start, end = runeSpan(l, pe.Position.Col-1, pe.Position.Len)
+		pad        = displayWidth(l[:start], 0)
+		width      = displayWidth(l[start:end], pad) - pad
+		col        = utf8.RuneCountInString(l[:start]) + 1
+		n          = utf8.RuneCountInString(l[start:end]) + pe.Position.Len - (end - start)
 	)
-	if pe.Position.Len == 1 {
-		fmt.Fprintf(b, "toml: error: %s\n\nAt line %d, column %d:\n\n",
-			pe.Message, pe.Position.Line, pe.Position.Col)
+	if width < 1 {
+		width = 1
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	b := new(strings.Builder)
+	if n == 1 {
+		fmt.Fprintf(b, "toml: error: %s\n\nAt %sline %d, column %d:\n\n", pe.Message, pe.source(), pe.Position.Line, col)
 	} else {
-		fmt.Fprintf(b, "toml: error: %s\n\nAt line %d, column %d-%d:\n\n",
-			pe.Message, pe.Position.Line, pe.Position.Col, pe.Position.Col+pe.Position.Len-1)
+		fmt.Fprintf(b, "toml: error: %s\n\nAt %sline %d, column %d-%d:\n\n", pe.Message, pe.source(), pe.Position.Line, col, col+n-1)
 	}
-	if pe.Position.Line > 2 {
-		fmt.Fprintf(b, "% 7d | %s\n", pe.Position.Line-2, expandTab(lines[pe.Position.Line-3]))
+	if pe.Position.Line-2 >= pe.inputLine {
+		fmt.Fprintf(b, "% 7d | %s\n", pe.Position.Line-2, expandTab(line(pe.Position.Line-2)))
 	}
-	if pe.Position.Line > 1 {
-		fmt.Fprintf(b, "% 7d | %s\n", pe.Position.Line-1, expandTab(lines[pe.Position.Line-2]))
+	if pe.Position.Line-1 >= pe.inputLine {
+		fmt.Fprintf(b, "% 7d | %s\n", pe.Position.Line-1, expandTab(line(pe.Position.Line-1)))
 	}
+	fmt.Fprintf(b, "% 7d | %s\n", pe.Position.Line, expandTab(l))
+	fmt.Fprintf(b, "% 10s%s%s\n", "", strings.Repeat(" ", pad), strings.Repeat("^", width))
+	return b.String()
+}
 
-	/// Expand tabs, so that the ^^^s are at the correct position, but leave
-	/// "column 10-13" intact. Adjusting this to the visual column would be
-	/// better, but we don't know the tabsize of the user in their editor, which
-	/// can be 8, 4, 2, or something else. We can't know. So leaving it as the
-	/// character index is probably the "most correct".
-	expanded := expandTab(lines[pe.Position.Line-1])
-	diff := len(expanded) - len(lines[pe.Position.Line-1])
+// runeSpan returns the byte offsets of the error in line, starting at the byte
+// column col (starting at 0) for length bytes, clamped to the line and moved to
+// the start of a rune so a multi-byte sequence is never split.
+func runeSpan(line string, col, length int) (int, int) {
+	start := col
+	if start > len(line) {
+		start = len(line)
+	}
+	if start < 0 {
+		start = 0
+	}
+	for start > 0 && start < len(line) && !utf8.RuneStart(line[start]) {
+		start--
+	}
+	end := col + length
+	if end > len(line) {
+		end = len(line)
+	}
+	if end < start {
+		end = start
+	}
+	for end < len(line) && !utf8.RuneStart(line[end]) {
+		end++
+	}
+	return start, end
+}
 
-	fmt.Fprintf(b, "% 7d | %s\n", pe.Position.Line, expanded)
-	fmt.Fprintf(b, "% 10s%s%s\n", "", strings.Repeat(" ", pe.Position.Col-1+diff), strings.Repeat("^", pe.Position.Len))
-	return b.String()
+// displayWidth returns the column s ends on in a terminal if it starts on column
+// col (starting at 0), with tabs expanded to 8 columns.
+func displayWidth(s string, col int) int {
+	for _, r := range s {
+		if r == '\t' {
+			col += 8 - col%8
+		} else {
+			col += runeWidth(r)
+		}
+	}
+	return col
+}
+
+// runeWidth returns the number of columns r takes up in a terminal: 0 for
+// combining and formatting characters, 2 for East Asian wide characters and
+// emoji, and 1 for everything else.
+//
+// This is a rough approximation of Unicode TR 11 that covers the common cases,
+// which is good enough to line up the ^^^s in ErrorWithPosition.
+func runeWidth(r rune) int {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case r >= 0x1100 && r <= 0x115f, // Hangul Jamo
+		r >= 0x2e80 && r <= 0x303e, // CJK radicals, punctuation
+		r >= 0x3041 && r <= 0x33ff, // Hiragana, Katakana, CJK compatibility
+		r >= 0x3400 && r <= 0x4dbf, // CJK extension A
+		r >= 0x4e00 && r <= 0x9fff, // CJK unified ideographs
+		r >= 0xa000 && r <= 0xa4cf, // Yi
+		r >= 0xac00 && r <= 0xd7a3, // Hangul syllables
+		r >= 0xf900 && r <= 0xfaff, // CJK compatibility ideographs
+		r >= 0xfe30 && r <= 0xfe4f, // CJK compatibility forms
+		r >= 0xff00 && r <= 0xff60, // Fullwidth forms
+		r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f, // Emoji
+		r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x20000 && r <= 0x3fffd: // CJK extensions
+		return 2
+	}
+	return 1
+}
+
+// withInput sets the lines from the input document that are shown by
+// ErrorWithPosition: the line with the error and the two lines before it.
+//
+// These are copied, so that the error doesn't keep the entire document in
+// memory, and can still be shown after the document is gone.
+func (pe ParseError) withInput(input string) ParseError {
+	pe.input, pe.inputLine = "", 0
+	if pe.Position.Line < 1 {
+		return pe
+	}
+	first := pe.Position.Line - 2
+	if first < 1 {
+		first = 1
+	}
+	var start, line = 0, 1
+	for ; line < first; line++ {
+		i := strings.IndexByte(input[start:], '\n')
+		if i == -1 {
+			return pe
+		}
+		start += i + 1
+	}
+	end := start
+	for ; line <= pe.Position.Line; line++ {
+		i := strings.IndexByte(input[end:], '\n')
+		if i == -1 {
+			end = len(input)
+			break
+		}
+		end += i + 1
+	}
+	pe.input, pe.inputLine = strings.Clone(strings.TrimSuffix(input[start:end], "\n")), first
+	return pe
+}
+
+// withInputAt is like withInput, for input that starts after the given number
+// of lines and bytes in the document. The line is relative to the document, and
+// the start is relative to input.
+func (pe ParseError) withInputAt(input string, lines, start int) ParseError {
+	pe.Position.Line -= lines
+	pe = pe.withInput(input)
+	pe.Position.Line += lines
+	if pe.input != "" {
+		pe.inputLine += lines
+	}
+	pe.Position.Start += start
+	return pe
 }
 
 // ErrorWithUsage returns the error with detailed location context and usage
@@ -180,7 +371,7 @@ func expandTab(s string) string {
 			l += tw
 		default:
 			b.WriteRune(r)
-			l += 1
+			l += runeWidth(r)
 		}
 	}
 	return b.String()
@@ -190,6 +381,7 @@ type (
 	errLexControl       struct{ r rune }
 	errLexEscape        struct{ r rune }
 	errLexUTF8          struct{ b byte }
+	errLexBOM           struct{}
 	errParseDate        struct{ v string }
 	errLexInlineTableNL struct{}
 	errLexStringNL      struct{}
@@ -202,6 +394,36 @@ type (
 		size string      // "float32" or "float64"
 	}
 	errParseDuration struct{ d string }
+	errLexTooLong    struct {
+		what string // "key" or "value"
+		max  int
+	}
+	errDatetimeNumber struct{ dst string } // "integer" or "float"
+	errFloatToInt     struct {
+		f   float64
+		typ string // Go type of the destination.
+	}
+	errLocalDatetime struct{ v string }
+	errArrayLength   struct{ want, have int }
+	errArrayElem     struct {
+		index int
+		key   string // Key of the array, with the index of any outer arrays.
+		err   error
+	}
+	errKeyConflict struct {
+		key  Key    // Key being defined.
+		def  string // "table", "array of tables", or "value".
+		prev Key    // Key that was already defined; key or one of its parents.
+		was  string // How prev was defined, like def.
+		line int    // Line prev was defined on; 0 for implicit tables.
+	}
+	errInternal   struct{ v any }    // Recovered panic that wasn't a ParseError.
+	errQuotedBool struct{ s string } // "true" or "false" as a string.
+	errWeakBool   struct{ v any }    // int64 or string that can't be a bool with WeakTypes.
+	errQuotedNum  struct {
+		s   string // String in the document.
+		typ string // Go type of the field with the "string" option.
+	}
 )
 
 func (e errLexControl) Error() string {
@@ -209,10 +431,14 @@ func (e errLexControl) Error() string {
 }
 func (e errLexControl) Usage() string { return "" }
 
-func (e errLexEscape) Error() string        { return fmt.Sprintf(`invalid escape in string '\%c'`, e.r) }
-func (e errLexEscape) Usage() string        { return usageEscape }
-func (e errLexUTF8) Error() string          { return fmt.Sprintf("invalid UTF-8 byte: 0x%02x", e.b) }
-func (e errLexUTF8) Usage() string          { return "" }
+func (e errLexEscape) Error() string { return fmt.Sprintf(`invalid escape in string '\%c'`, e.r) }
+func (e errLexEscape) Usage() string { return usageEscape }
+func (e errLexUTF8) Error() string   { return fmt.Sprintf("invalid UTF-8 byte: 0x%02x", e.b) }
+func (e errLexUTF8) Usage() string   { return "" }
+func (e errLexBOM) Error() string {
+	return "unexpected byte-order mark (U+FEFF); remove it, or only use it at the start of the file"
+}
+func (e errLexBOM) Usage() string           { return "" }
 func (e errParseDate) Error() string        { return fmt.Sprintf("invalid datetime: %q", e.v) }
 func (e errParseDate) Usage() string        { return usageDate }
 func (e errLexInlineTableNL) Error() string { return "newlines not allowed within inline tables" }
@@ -227,6 +453,95 @@ func (e errUnsafeFloat) Error() string {
 func (e errUnsafeFloat) Usage() string   { return usageUnsafeFloat }
 func (e errParseDuration) Error() string { return fmt.Sprintf("invalid duration: %q", e.d) }
 func (e errParseDuration) Usage() string { return usageDuration }
+func (e errLexTooLong) Error() string {
+	return fmt.Sprintf("%s is longer than the maximum of %d bytes", e.what, e.max)
+}
+func (e errLexTooLong) Usage() string { return "" }
+func (e errDatetimeNumber) Error() string {
+	return fmt.Sprintf("incompatible types: TOML value has type time.Time; destination has type %s", e.dst)
+}
+func (e errDatetimeNumber) Usage() string { return usageDatetimeNumber }
+func (e errFloatToInt) Error() string {
+	var f string
+	switch {
+	case math.IsNaN(e.f):
+		f = "nan"
+	case math.IsInf(e.f, 1):
+		f = "inf"
+	case math.IsInf(e.f, -1):
+		f = "-inf"
+	default:
+		f = floatAddDecimal(strconv.FormatFloat(e.f, 'f', -1, 64))
+	}
+	if e.f != math.Trunc(e.f) && !math.IsNaN(e.f) {
+		return fmt.Sprintf("TOML value %s has a fractional part; destination %s is an integer type", f, e.typ)
+	}
+	return fmt.Sprintf("TOML value %s is a float; destination %s is an integer type", f, e.typ)
+}
+func (e errFloatToInt) Usage() string { return usageFloatToInt }
+func (e errLocalDatetime) Error() string {
+	return fmt.Sprintf("datetime %q has no timezone offset, and an offset is required", e.v)
+}
+func (e errLocalDatetime) Usage() string { return usageLocalDatetime }
+func (e errArrayLength) Error() string {
+	return fmt.Sprintf("expected array length %d; got TOML array of length %d", e.want, e.have)
+}
+func (e errArrayLength) Usage() string { return "" }
+func (e errArrayElem) Error() string {
+	return fmt.Sprintf("error at index %d of %q: %s", e.index, e.key, e.err)
+}
+func (e errArrayElem) Usage() string {
+	if u, ok := e.err.(interface{ Usage() string }); ok {
+		return u.Usage()
+	}
+	return ""
+}
+func (e errKeyConflict) Error() string {
+	var s string
+	switch e.def {
+	case "value":
+		s = fmt.Sprintf("cannot set key '%s' to a value because it was already defined as %s", e.key, e.as(e.was, e.prev))
+	default:
+		s = fmt.Sprintf("cannot define %s because key '%s' was already ", e.as(e.def, e.key), e.prev)
+		if e.was == "value" {
+			s += "set to a value"
+		} else {
+			s += "defined as " + e.as(e.was, e.prev)
+		}
+	}
+	if e.line > 0 {
+		s += fmt.Sprintf(" on line %d", e.line)
+	}
+	return s
+}
+func (e errKeyConflict) Usage() string { return usageKeyConflict }
+func (e errInternal) Error() string    { return fmt.Sprintf("internal error: %v", e.v) }
+func (e errInternal) Usage() string    { return "" }
+func (e errQuotedBool) Error() string {
+	return fmt.Sprintf("incompatible types: TOML value has type string (%q); destination has type boolean; "+
+		"TOML booleans are the bare tokens true and false, without quotes", e.s)
+}
+func (e errQuotedBool) Usage() string { return usageQuotedBool }
+func (e errWeakBool) Error() string {
+	if _, ok := e.v.(string); ok {
+		return fmt.Sprintf("string %q can't be used as a boolean; only \"true\" and \"false\" are accepted", e.v)
+	}
+	return fmt.Sprintf("integer %d can't be used as a boolean; only 0 and 1 are accepted", e.v)
+}
+func (e errWeakBool) Usage() string { return "" }
+func (e errQuotedNum) Error() string {
+	return fmt.Sprintf("invalid %s in string %q for a field with the string option", e.typ, e.s)
+}
+func (e errQuotedNum) Usage() string { return "" }
+func (e errKeyConflict) as(def string, k Key) string {
+	switch def {
+	case "table":
+		return "table [" + k.String() + "]"
+	case "array of tables":
+		return "array of tables [[" + k.String() + "]]"
+	}
+	return "a value"
+}
 
 const usageEscape = `
 A '\' inside a "-delimited string is interpreted as an escape character.
@@ -312,6 +627,63 @@ Accuracy ranges:
 	float64 = 9,007,199,254,740,991
 `
 
+const usageFloatToInt = `
+TOML has separate integer and float types: a number with a fraction or exponent
+is a float, and a number without one is an integer:
+
+    integer = 5
+    float   = 5.0
+    float2  = 5e3
+
+A float can't be used for an integer value; write it without the fraction
+instead. Floats without a fraction, such as 5.0, can be accepted by the program
+with Decoder.AllowIntegralFloats(), but a fraction is always an error.
+`
+
+const usageQuotedBool = `
+TOML booleans are written as the bare words true and false, without quotes; a
+quoted "true" is a string, not a boolean:
+
+    # INVALID for a boolean
+    enabled = "true"
+
+    enabled = true
+    verbose = false
+
+Strings and the integers 0 and 1 can be accepted by the program with
+Decoder.WeakTypes().
+`
+
+const usageDatetimeNumber = `
+The value was read as a date or time, but a number is expected here. Values
+that look like a date (2024-01-01) or time (12:00:00) are always dates or times
+in TOML, even without quotes.
+
+If it's meant to be a number, then write it as a number:
+
+    port = 8080
+
+If it's meant to be a date, then it must be a string for this key:
+
+    key = "2024-01-01"
+`
+
+const usageKeyConflict = `
+A key can only be defined once, either as a value, a table, or an array of
+tables:
+
+    a = {b = 1}     # Value; an inline table is a value too.
+
+    [a]             # Table; can only be given once.
+    b = 1
+
+    [[a]]           # Array of tables; every [[a]] adds a new table.
+    b = 1
+
+These can't be mixed: after a = {..} or a = 1 you can't use [a] or [[a]], and
+after [a] you can't use [[a]] or set a as a value (and vice versa).
+`
+
 const usageDuration = `
 A duration must be as "number<unit>", without any spaces. Valid units are:
 
@@ -340,6 +712,15 @@ Seconds may optionally have a fraction, up to nanosecond precision:
     15:04:05.856018510
 `
 
+const usageLocalDatetime = `
+Local datetimes, dates, and times aren't allowed here, as they don't describe
+an exact moment in time without knowing the timezone. Add an offset, or use Z
+for UTC:
+
+    2006-01-02T15:04:05Z
+    2006-01-02T15:04:05+01:00
+`
+
 // TOML 1.1:
 // The seconds part in times is optional, and may be omitted:
 //     2006-01-02T15:04Z07:00
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io/fs"
 	"math"
+	"reflect"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -35,7 +37,7 @@ At line 1, column 23:
                                 ^`},
 
 		{"array/tables-2.toml", `
-toml: error: Key 'fruit.variety' has already been defined.
+toml: error: cannot define table [fruit.variety] because key 'fruit.variety' was already defined as array of tables [[fruit.variety]] on line 5
 
 At line 9, column 4-8:
 
@@ -295,6 +297,135 @@ func (n *Enum1) UnmarshalText(text []byte) error {
 }
 
 // Make sure custom types are wrapped in ParseError with correct location.
+// The ParseError should be usable after the input is gone, and not keep the
+// entire input in memory.
+func TestParseErrorSelfContained(t *testing.T) {
+	var (
+		b    strings.Builder
+		pad  = strings.Repeat("x", 100)
+		errs = make(chan error, 2)
+	)
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&b, "k%d = '%s'\n", i, pad)
+	}
+	input := []byte(b.String() + "a = 1\nb = 2\nc = = 3\n" + b.String())
+	input2 := []byte(b.String() + "b = 300\n")
+	go func() {
+		var m map[string]any
+		_, err := toml.Decode(string(input), &m)
+		errs <- err
+
+		var s struct{ B int8 }
+		_, err = toml.Decode(string(input2), &s)
+		errs <- err
+	}()
+	err1, err2 := <-errs, <-errs
+	for i := range input { // Make sure nothing refers to the input.
+		input[i] = '!'
+	}
+	for i := range input2 {
+		input2[i] = '!'
+	}
+	input, input2 = nil, nil
+
+	var pErr toml.ParseError
+	if !errors.As(err1, &pErr) {
+		t.Fatal(err1)
+	}
+	want := `
+toml: error: expected value but found '=' instead
+
+At line 1003, column 5:
+
+   1001 | a = 1
+   1002 | b = 2
+   1003 | c = = 3
+              ^
+`[1:]
+	if have := pErr.ErrorWithPosition(); have != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+	}
+	if have := pErr.ErrorWithUsage(); have != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+	}
+	if n := reflect.ValueOf(pErr).FieldByName("input").Len(); n > 100 {
+		t.Errorf("input is %d bytes", n)
+	}
+
+	if !errors.As(err2, &pErr) {
+		t.Fatal(err2)
+	}
+	want = `toml: error: 300 is out of range for int8
+
+At line 1001, column 5-7:
+
+    999 | k998 = '` + pad + `'
+   1000 | k999 = '` + pad + `'
+   1001 | b = 300
+              ^^^
+`
+	if have := pErr.ErrorWithPosition(); have != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", have, want)
+	}
+}
+
+func TestParseErrorSource(t *testing.T) {
+	fsys := fstest.MapFS{
+		"conf.d/10-db.toml":  {Data: []byte("[db]\nhost = \"x\"\nport = = 1\n")},
+		"conf.d/20-web.toml": {Data: []byte("[web]\nport = 99999\n")},
+		"conf.d/30-log.toml": {Data: []byte("[log]\nlevel = 1\n")},
+	}
+	type config struct {
+		Web struct{ Port int16 }
+		Log struct{ Level string }
+	}
+
+	tests := []struct {
+		file, err, pos string
+	}{
+		{"conf.d/10-db.toml",
+			`toml: conf.d/10-db.toml: line 3 (last key "db.port"): expected value but found '=' instead`,
+			"At conf.d/10-db.toml: line 3, column 8:"},
+		{"conf.d/20-web.toml",
+			`toml: conf.d/20-web.toml: line 2 (last key "web.port"): 99999 is out of range for int16`,
+			"At conf.d/20-web.toml: line 2, column 8-12:"},
+		{"conf.d/30-log.toml",
+			`toml: conf.d/30-log.toml: line 2 (last key "log.level"): incompatible types: TOML value has type int64; destination has type string`,
+			""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			var c config
+			_, err := toml.DecodeFS(fsys, tt.file, &c)
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.err)
+			}
+			if tt.pos == "" {
+				return
+			}
+			var pErr toml.ParseError
+			if !errors.As(err, &pErr) {
+				t.Fatalf("not a ParseError: %#v", err)
+			}
+			if pErr.Source != tt.file {
+				t.Errorf("Source: %q", pErr.Source)
+			}
+			if have := pErr.ErrorWithPosition(); !strings.Contains(have, tt.pos) {
+				t.Errorf("ErrorWithPosition:\n%s\nwant: %s", have, tt.pos)
+			}
+		})
+	}
+
+	t.Run("SetName", func(t *testing.T) {
+		var c config
+		_, err := toml.NewDecoder(strings.NewReader("a = 1\nb = ?\n")).SetName("stdin").Decode(&c)
+		want := `toml: stdin: line 2 (last key "b"): expected value but found '?' instead`
+		if err == nil || err.Error() != want {
+			t.Errorf("wrong error\nhave: %v\nwant: %s", err, want)
+		}
+	})
+}
+
 func TestUnmarshalTypeError(t *testing.T) {
 	var c struct {
 		K1 string `toml:"k1"`
@@ -325,6 +456,94 @@ At line 3, column 7-13:
 	}
 }
 
+func TestDatetimeNumberError(t *testing.T) {
+	var c struct {
+		Port    int
+		Timeout float64
+	}
+	_, err := toml.Decode("port = 2024-01-01", &c)
+	var pErr toml.ParseError
+	if !errors.As(err, &pErr) {
+		t.Fatalf("not a ParseError: %#v", err)
+	}
+
+	want := `toml: error: incompatible types: TOML value has type time.Time; destination has type integer
+
+At line 1, column 8-17:
+
+      1 | port = 2024-01-01
+                 ^^^^^^^^^^
+Error help:
+
+    The value was read as a date or time, but a number is expected here. Values
+    that look like a date (2024-01-01) or time (12:00:00) are always dates or times
+    in TOML, even without quotes.
+
+    If it's meant to be a number, then write it as a number:
+
+        port = 8080
+
+    If it's meant to be a date, then it must be a string for this key:
+
+        key = "2024-01-01"
+`
+	if have := pErr.ErrorWithUsage(); have != want {
+		t.Errorf("\nwant:\n%s\nhave:\n%s", want, have)
+	}
+
+	_, err = toml.Decode("timeout = 12:00:00", &c)
+	if !errors.As(err, &pErr) || !strings.Contains(pErr.ErrorWithUsage(), "destination has type float") ||
+		!strings.Contains(pErr.ErrorWithUsage(), "The value was read as a date or time") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestKeyConflictError(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"a = 1\n[a]",
+			"toml: line 2: cannot define table [a] because key 'a' was already set to a value on line 1"},
+		{"a = {b = 1}\n\n[[a]]",
+			"toml: line 3: cannot define array of tables [[a]] because key 'a' was already set to a value on line 1"},
+		{"[t.a]\n[t]\na = 1",
+			`toml: line 3 (last key "t.a"): cannot set key 't.a' to a value because it was already defined as table [t.a] on line 1`},
+		{"[a]\n[[a]]",
+			"toml: line 2: cannot define array of tables [[a]] because key 'a' was already defined as table [a] on line 1"},
+		{"[[t.a]]\n[[t.a]]\n[t]\na = 1",
+			`toml: line 4 (last key "t.a"): cannot set key 't.a' to a value because it was already defined as array of tables [[t.a]] on line 2`},
+		{"[[a]]\n[a]",
+			"toml: line 2: cannot define table [a] because key 'a' was already defined as array of tables [[a]] on line 1"},
+
+		// Conflict with a parent.
+		{"a = 1\n[a.b]",
+			"toml: line 2: cannot define table [a.b] because key 'a' was already set to a value on line 1"},
+		{"[a.b]\n[[a]]",
+			"toml: line 2: cannot define array of tables [[a]] because key 'a' was already defined as table [a]"},
+
+		// Same kind of definition.
+		{"a = 1\na = {}", `toml: line 2 (last key "a"): Key 'a' has already been defined.`},
+		{"[a]\n[a]", "toml: line 2: Key 'a' has already been defined."},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var x any
+			_, err := toml.Decode(tt.in, &x)
+			var pErr toml.ParseError
+			if !errors.As(err, &pErr) {
+				t.Fatalf("not a ParseError: %#v", err)
+			}
+			if pErr.Error() != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", pErr.Error(), tt.want)
+			}
+			// Only differing definitions have the usage.
+			if u := pErr.ErrorWithUsage(); strings.Contains(tt.want, "cannot") != strings.Contains(u, "A key can only be defined once") {
+				t.Errorf("wrong usage:\n%s", u)
+			}
+		})
+	}
+}
+
 type Enum2 uint8
 
 func (n *Enum2) UnmarshalTOML(text any) error {
@@ -419,3 +638,56 @@ At line 2, column 11-13:
 		t.Errorf("\nwant:\n%s\nhave:\n%s", want, have)
 	}
 }
+
+func TestErrorPositionWide(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"k = \"日本語\" xxx", `
+At line 1, column 10-11:
+
+      1 | k = "日本語" xxx
+                      ^^
+`},
+		{"k = \"🎉🎉\" xxx", `
+At line 1, column 9-10:
+
+      1 | k = "🎉🎉" xxx
+                    ^^
+`},
+		// e + U+0301 COMBINING ACUTE ACCENT.
+		{"k = \"éé\" xxx", `
+At line 1, column 11-12:
+
+      1 | k = "e` + "́" + `e` + "́" + `" xxx
+                  ^^
+`},
+		{"k = 1\n日本 = \"x\"", `
+At line 2, column 1:
+
+      1 | k = 1
+      2 | 日本 = "x"
+          ^^
+`},
+		{"k = \"語\"\t= xxx", `
+At line 1, column 8-9:
+
+      1 | k = "語"        = xxx
+                  ^^^^^^^^^
+`},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			var m map[string]any
+			_, err := toml.Decode(tt.in, &m)
+			var pErr toml.ParseError
+			if !errors.As(err, &pErr) {
+				t.Fatalf("not a ParseError: %#v", err)
+			}
+			have := pErr.ErrorWithPosition()
+			if !strings.HasSuffix(have, tt.want) {
+				t.Errorf("\nwant:\n%s\nhave:\n%s", tt.want, have)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package toml
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// NotFoundError is returned by [ExtractSection] if the key isn't in the
+// document.
+type NotFoundError struct {
+	Key Key
+}
+
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("toml: key %q not found", e.Key)
+}
+
+// ExtractSection returns the table for key from the TOML document in src as a
+// standalone document.
+//
+// The table's header is removed and the headers of all sub-tables and arrays
+// of tables are rewritten to be relative to the table, so that:
+//
+//	[database.primary]  # extracted with key "database.primary"
+//	host = "localhost"
+//	[database.primary.pool]
+//	size = 4
+//
+// becomes:
+//
+//	# extracted with key "database.primary"
+//	host = "localhost"
+//	[pool]
+//	size = 4
+//
+// The sub-tables don't need to be next to each other in src. Everything else
+// is copied as-is, including the comments directly above every header. The
+// table's own keys are always written first.
+//
+// If the table is defined with dotted keys or an inline table rather than with
+// a header the formatting can't be kept, and the table is encoded with the
+// [Encoder] instead.
+//
+// A [NotFoundError] is returned if the key doesn't exist in the document. It's
+// an error if key isn't a table.
+func ExtractSection(src []byte, key Key) ([]byte, error) {
+	src = bytes.TrimPrefix(src, []byte("\xef\xbb\xbf"))
+	_, tomlNext := os.LookupEnv("BURNTSUSHI_TOML_110")
+	p, err := parseStream(bytes.NewReader(src), DecodeProfile{}, tomlNext, false, false, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return src, nil
+	}
+
+	var (
+		tbl map[string]any
+		cur any = p.mapping
+	)
+	for i, k := range key {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			if _, ok := cur.([]map[string]any); ok {
+				return nil, fmt.Errorf("toml: can't extract %q: %q is an array of tables", key, key[:i])
+			}
+			return nil, NotFoundError{Key: key}
+		}
+		if cur, ok = m[k]; !ok {
+			return nil, NotFoundError{Key: key}
+		}
+	}
+	switch v := cur.(type) {
+	case map[string]any:
+		tbl = v
+	case []map[string]any:
+		return nil, fmt.Errorf("toml: can't extract %q: it's an array of tables", key)
+	default:
+		return nil, fmt.Errorf("toml: can't extract %q: it's not a table but %s", key, p.keyInfo[key.String()].tomlType)
+	}
+
+	// Split the document in sections, starting at the comments above every
+	// header.
+	type section struct {
+		h          header
+		start, end int
+	}
+	comments := make(map[int]bool, len(p.comments))
+	for _, c := range p.comments {
+		comments[c] = true
+	}
+	sections := make([]section, len(p.headers))
+	for i, h := range p.headers {
+		sections[i] = section{h: h, start: commentsAbove(src, h.start, comments)}
+		if i > 0 {
+			sections[i-1].end = sections[i].start
+		}
+	}
+	if len(sections) > 0 {
+		sections[len(sections)-1].end = len(src)
+	}
+
+	var keep []section
+	for _, s := range sections {
+		if s.h.key.HasPrefix(key) {
+			keep = append(keep, s)
+		}
+	}
+
+	// Every key in the table must be in one of the sections; it's not if the
+	// table (or part of it) is defined from a parent table.
+	for _, k := range p.ordered {
+		if !k.HasPrefix(key) {
+			continue
+		}
+		pos := p.keyInfo[k.String()].pos.Start
+		i := sort.Search(len(keep), func(i int) bool { return keep[i].end > pos })
+		if i == len(keep) || pos < keep[i].start {
+			var b bytes.Buffer
+			if err := NewEncoder(&b).Encode(tbl); err != nil {
+				return nil, err
+			}
+			return b.Bytes(), nil
+		}
+	}
+
+	// The table itself goes first, as any other table would end its keys.
+	sort.SliceStable(keep, func(i, j int) bool {
+		return len(keep[i].h.key) == len(key) && len(keep[j].h.key) != len(key)
+	})
+
+	var b bytes.Buffer
+	for _, s := range keep {
+		b.Write(src[s.start:s.h.start])
+		if len(s.h.key) == len(key) {
+			// Keep a comment after the header, but not an empty line.
+			rest := bytes.TrimLeft(src[s.h.end:s.end], " \t")
+			if len(rest) > 0 && rest[0] == '\r' {
+				rest = rest[1:]
+			}
+			if len(rest) > 0 && rest[0] == '\n' {
+				rest = rest[1:]
+			}
+			b.Write(rest)
+		} else {
+			l, r := "[", "]"
+			if s.h.array {
+				l, r = "[[", "]]"
+			}
+			b.WriteString(l + s.h.key[len(key):].String() + r)
+			b.Write(src[s.h.end:s.end])
+		}
+		if b.Len() > 0 && b.Bytes()[b.Len()-1] != '\n' {
+			b.WriteByte('\n')
+		}
+	}
+	out := bytes.TrimRight(b.Bytes(), " \t\r\n")
+	if len(out) > 0 {
+		out = append(out, '\n')
+	}
+	return out, nil
+}
+
+// commentsAbove returns the offset of the first line of the comments directly
+// above the line that start is on, or start if there are none.
+func commentsAbove(src []byte, start int, comments map[int]bool) int {
+	bol := bytes.LastIndexByte(src[:start], '\n') + 1
+	if len(bytes.TrimLeft(src[bol:start], " \t")) == 0 {
+		start = bol
+	}
+	for {
+		eol := bytes.LastIndexByte(src[:start], '\n')
+		if eol == -1 {
+			return start
+		}
+		bol := bytes.LastIndexByte(src[:eol], '\n') + 1
+		line := string(src[bol:eol])
+		c := bol + len(line) - len(strings.TrimLeft(line, " \t"))
+		if !comments[c] {
+			return start
+		}
+		start = bol
+	}
+}
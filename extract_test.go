@@ -0,0 +1,160 @@
+package toml_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestExtractSection(t *testing.T) {
+	doc := `title = "config"
+
+# The database.
+[database]  # Main database.
+name = "app"
+
+[server]
+port = 8080
+
+# Primary.
+[database.primary]
+host = "db1"
+ports = [
+# Not a header comment.
+	5432,
+]
+
+[server.tls]
+cert = "x.pem"
+
+[[database.replicas]]
+host = "db2"
+
+[[fruits]]
+name = "apple"
+
+# Second replica.
+[[database.replicas]]
+host = "db3"
+[database.replicas.pool]
+size = 4
+
+[database.primary.pool]
+size = 8
+`
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"database", `# The database.
+# Main database.
+name = "app"
+
+# Primary.
+[primary]
+host = "db1"
+ports = [
+# Not a header comment.
+	5432,
+]
+
+[[replicas]]
+host = "db2"
+
+# Second replica.
+[[replicas]]
+host = "db3"
+[replicas.pool]
+size = 4
+
+[primary.pool]
+size = 8
+`},
+		{"database.primary", `# Primary.
+host = "db1"
+ports = [
+# Not a header comment.
+	5432,
+]
+
+[pool]
+size = 8
+`},
+		{"server", `port = 8080
+
+[tls]
+cert = "x.pem"
+`},
+	}
+
+	var all map[string]any
+	if _, err := toml.Decode(doc, &all); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			key := toml.Key(strings.Split(tt.key, "."))
+			have, err := toml.ExtractSection([]byte(doc), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(have) != tt.want {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", have, tt.want)
+			}
+
+			var got map[string]any
+			if _, err := toml.Decode(string(have), &got); err != nil {
+				t.Fatal(err)
+			}
+			want := any(all)
+			for _, k := range key {
+				want = want.(map[string]any)[k]
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("\nhave: %#v\nwant: %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestExtractSectionEncode(t *testing.T) {
+	have, err := toml.ExtractSection([]byte("a.b.c = 1\n[x]\nd = {e = 2}\n"), toml.Key{"x", "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "e = 2\n"; string(have) != want {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+
+	have, err = toml.ExtractSection([]byte("a.b.c = 1\n[x]\nd = {e = 2}\n"), toml.Key{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[b]\n  c = 1\n"; string(have) != want {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestExtractSectionError(t *testing.T) {
+	doc := []byte("a = 1\n[[arr]]\nb = 2\n[tbl]\nc = 3\n")
+
+	_, err := toml.ExtractSection(doc, toml.Key{"tbl", "x"})
+	var nf toml.NotFoundError
+	if !errors.As(err, &nf) {
+		t.Fatalf("wrong error: %#v", err)
+	}
+	if !nf.Key.Equal(toml.Key{"tbl", "x"}) {
+		t.Errorf("wrong key: %q", nf.Key)
+	}
+
+	for _, k := range []toml.Key{{"a"}, {"arr"}, {"arr", "b"}, {"tbl", "c"}} {
+		_, err := toml.ExtractSection(doc, k)
+		if err == nil || errors.As(err, &nf) {
+			t.Errorf("%q: wrong error: %v", k, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"math"
+	"reflect"
+	"time"
+)
+
+// DeepEqual is like reflect.DeepEqual, except that:
+//
+//   - NaN floats are considered equal to each other;
+//   - time.Time values are compared with time.Time.Equal, and a local datetime,
+//     date, or time is only equal to the same kind of local value;
+//   - nil and empty slices and maps are considered equal, as the TOML encoding
+//     of these is the same (or they are both omitted).
+func DeepEqual(want, have any) bool {
+	return deepEqual(reflect.ValueOf(want), reflect.ValueOf(have))
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func deepEqual(want, have reflect.Value) bool {
+	if !want.IsValid() || !have.IsValid() {
+		return want.IsValid() == have.IsValid()
+	}
+	if want.Type() != have.Type() {
+		return false
+	}
+
+	// Time.Equal deals with some edge-cases such as offset +0000 and Z being
+	// identical. Unexported fields can't be converted to an interface, so
+	// these fall through to comparing the struct fields.
+	if want.Type() == timeType && want.CanInterface() && have.CanInterface() {
+		w, h := want.Interface().(time.Time), have.Interface().(time.Time)
+		return w.Equal(h) && localZone(w) == localZone(h)
+	}
+
+	switch want.Kind() {
+	case reflect.Float32, reflect.Float64:
+		w, h := want.Float(), have.Float()
+		return w == h || (math.IsNaN(w) && math.IsNaN(h))
+	case reflect.Complex64, reflect.Complex128:
+		return want.Complex() == have.Complex()
+	case reflect.Bool:
+		return want.Bool() == have.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return want.Int() == have.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return want.Uint() == have.Uint()
+	case reflect.String:
+		return want.String() == have.String()
+	case reflect.Ptr, reflect.Interface:
+		if want.IsNil() || have.IsNil() {
+			return want.IsNil() == have.IsNil()
+		}
+		return deepEqual(want.Elem(), have.Elem())
+	case reflect.Array, reflect.Slice:
+		if want.Len() != have.Len() {
+			return false
+		}
+		for i := 0; i < want.Len(); i++ {
+			if !deepEqual(want.Index(i), have.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if want.Len() != have.Len() {
+			return false
+		}
+		iter := want.MapRange()
+		for iter.Next() {
+			h := have.MapIndex(iter.Key())
+			if !h.IsValid() || !deepEqual(iter.Value(), h) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < want.NumField(); i++ {
+			if !deepEqual(want.Field(i), have.Field(i)) {
+				return false
+			}
+		}
+		return true
+	default: // Func, Chan, UnsafePointer
+		return want.Pointer() == have.Pointer()
+	}
+}
+
+// localZone gets the location of a local datetime, date, or time, or nil for
+// datetimes with an offset.
+func localZone(t time.Time) *time.Location {
+	switch l := t.Location(); l {
+	case LocalDatetime, LocalDate, LocalTime:
+		return l
+	}
+	return nil
+}
@@ -60,6 +60,8 @@ func Add(key string, tomlData any) any {
 		return tag("string", orig)
 	case int64:
 		return tag("integer", fmt.Sprintf("%d", orig))
+	case uint64:
+		return tag("integer", fmt.Sprintf("%d", orig))
 	case float64:
 		switch {
 		case math.IsNaN(orig):
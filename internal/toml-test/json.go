@@ -190,7 +190,9 @@ var datetimeRepl = strings.NewReplacer(
 	"t", "T",
 	"z", "Z")
 
-var layouts = map[string]string{
+// DatetimeLayouts are the time.Parse() layouts for the datetime types in the
+// JSON tests.
+var DatetimeLayouts = map[string]string{
 	"datetime":       time.RFC3339Nano,
 	"datetime-local": "2006-01-02T15:04:05.999999999",
 	"date-local":     "2006-01-02",
@@ -198,7 +200,7 @@ var layouts = map[string]string{
 }
 
 func (r Test) cmpAsDatetimes(kind, want, have string) Test {
-	layout, ok := layouts[kind]
+	layout, ok := DatetimeLayouts[kind]
 	if !ok {
 		panic("should never happen")
 	}
@@ -56,6 +56,14 @@ type Runner struct {
 	Timeout    time.Duration     // Maximum time for parse.
 	IntAsFloat bool              // Int values have type=float.
 	Errors     map[string]string // Expected errors list.
+
+	// CompareOverride is called before comparing the output of valid tests.
+	// It can return a Test with Failure set or cleared to decide the result,
+	// or nil to use the default comparison.
+	//
+	// For encoder tests want and have are TOML values as decoded by Decode(),
+	// and for decoder tests they're the decoded JSON.
+	CompareOverride func(test Test, want, have any) *Test
 }
 
 // A Parser instance is used to call the TOML parser we test.
@@ -109,6 +117,8 @@ type Test struct {
 	OutputFromStderr bool          // The Output came from stderr, not stdout.
 	Timeout          time.Duration // Maximum time for parse.
 	IntAsFloat       bool          // Int values have type=float.
+
+	CompareOverride func(test Test, want, have any) *Test // See Runner.CompareOverride.
 }
 
 type timeoutError struct{ d time.Duration }
@@ -202,6 +212,8 @@ func (r Runner) Run() (Tests, error) {
 			Encoder:    r.Encoder,
 			Timeout:    r.Timeout,
 			IntAsFloat: r.IntAsFloat,
+
+			CompareOverride: r.CompareOverride,
 		}
 		if r.hasSkip(p) {
 			tests.Skipped++
@@ -440,7 +452,7 @@ func (t Test) runValid(p Parser, fsys fs.FS) Test {
 			//return t.fail("decode TOML from encoder %q:\n  %s", cmd, err)
 			return t.fail("decode TOML from encoder:\n  %s", err)
 		}
-		return t.CompareTOML(want, have)
+		return t.compare(want, have, t.CompareTOML)
 	}
 
 	// Compare for decoder test
@@ -454,7 +466,18 @@ func (t Test) runValid(p Parser, fsys fs.FS) Test {
 		return t.fail("decode JSON output from parser:\n  %s", err)
 	}
 
-	return t.CompareJSON(want, have)
+	return t.compare(want, have, t.CompareJSON)
+}
+
+// compare want and have with CompareOverride, or cmp if that's not set or
+// returns nil.
+func (t Test) compare(want, have any, cmp func(want, have any) Test) Test {
+	if t.CompareOverride != nil {
+		if r := t.CompareOverride(t, want, have); r != nil {
+			return *r
+		}
+	}
+	return cmp(want, have)
 }
 
 // ReadInput reads the file sent to the encoder.
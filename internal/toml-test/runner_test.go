@@ -0,0 +1,75 @@
+package tomltest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"testing/fstest"
+)
+
+type staticParser string
+
+func (p staticParser) Encode(ctx context.Context, input string) (string, bool, error) {
+	return string(p), false, nil
+}
+func (p staticParser) Decode(ctx context.Context, input string) (string, bool, error) {
+	return string(p), false, nil
+}
+
+func TestCompareOverride(t *testing.T) {
+	fsys := fstest.MapFS{
+		"valid/arr.json": {Data: []byte(`{}`)},
+		"valid/arr.toml": {Data: []byte("a = [1, 2, 3]\nb = 'x'\n")},
+	}
+
+	// Accept arrays in any order.
+	unordered := func(test Test, want, have any) *Test {
+		w, h := want.(map[string]any), have.(map[string]any)
+		for _, m := range []map[string]any{w, h} {
+			if a, ok := m["a"].([]any); ok {
+				sort.Slice(a, func(i, j int) bool { return fmt.Sprint(a[i]) < fmt.Sprint(a[j]) })
+			}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		out      string
+		override func(Test, any, any) *Test
+		wantFail bool
+	}{
+		{"a = [1, 2, 3]\nb = 'x'", nil, false},
+		{"a = [3, 1, 2]\nb = 'x'", nil, true},
+		{"a = [3, 1, 2]\nb = 'x'", unordered, false},
+		{"a = [3, 1, 4]\nb = 'x'", unordered, true},
+		{"a = [3, 1, 2]\nb = 'y'", unordered, true},
+
+		// Decide the result without the default comparison.
+		{"a = [1, 2, 3]\nb = 'x'", func(test Test, want, have any) *Test {
+			test.Failure = "custom"
+			return &test
+		}, true},
+		{"a = 'wrong'", func(test Test, want, have any) *Test { return &test }, false},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			r := Runner{
+				Files:           fsys,
+				Encoder:         true,
+				Parser:          staticParser(tt.out),
+				CompareOverride: tt.override,
+			}
+			tests, err := r.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tests.Tests) != 1 {
+				t.Fatalf("%d tests", len(tests.Tests))
+			}
+			if f := tests.Tests[0].Failed(); f != tt.wantFail {
+				t.Errorf("failed=%t; want %t\n%s", f, tt.wantFail, tests.Tests[0].Failure)
+			}
+		})
+	}
+}
@@ -2,11 +2,10 @@ package tomltest
 
 import (
 	"fmt"
-	"math"
-	"reflect"
 	"sort"
 	"strings"
-	"time"
+
+	"github.com/BurntSushi/toml/internal"
 )
 
 // CompareTOML compares the given arguments.
@@ -26,7 +25,7 @@ func (r Test) CompareTOML(want, have any) Test {
 				r.Key, want, fmtType(want), have, fmtType(have))
 		}
 
-		if !deepEqual(want, have) {
+		if !DeepEqual(want, have) {
 			return r.fail("Values for key %q differ:\n"+
 				"  Expected:     %v (%s)\n"+
 				"  Your encoder: %v (%s)",
@@ -114,35 +113,9 @@ func (r Test) cmpTOMLArrays(want []any, have any) Test {
 	return r
 }
 
-// reflect.DeepEqual() that deals with NaN != NaN
-func deepEqual(want, have any) bool {
-	var wantF, haveF float64
-	switch f := want.(type) {
-	case float32:
-		wantF = float64(f)
-	case float64:
-		wantF = f
-	}
-	switch f := have.(type) {
-	case float32:
-		haveF = float64(f)
-	case float64:
-		haveF = f
-	}
-	if math.IsNaN(wantF) && math.IsNaN(haveF) {
-		return true
-	}
-
-	// Time.Equal deals with some edge-cases such as offset +0000 and Z being
-	// identical.
-	if haveT, ok := have.(time.Time); ok {
-		if wantT, ok := want.(time.Time); ok {
-			return wantT.Equal(haveT)
-		}
-	}
-
-	return reflect.DeepEqual(want, have)
-}
+// DeepEqual is reflect.DeepEqual(), except that NaN is equal to NaN and times
+// are compared with time.Time.Equal().
+func DeepEqual(want, have any) bool { return internal.DeepEqual(want, have) }
 
 func isTomlValue(v any) bool {
 	switch v.(type) {
@@ -0,0 +1,230 @@
+package toml
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml/internal/tag"
+)
+
+// JSONOptions are options for [ToJSON] and [FromJSON].
+type JSONOptions struct {
+	// Tagged uses the format from toml-test, where every value is an object
+	// with the type and value as a string:
+	//
+	//	{"type": "integer", "value": "42"}
+	//
+	// This keeps all type information, so converting back and forth is never
+	// lossy. All other options except Indent are ignored if this is set.
+	Tagged bool
+
+	// Indent every level of the JSON output with this; the default is to not
+	// indent anything.
+	Indent string
+
+	// NaNError returns an error from ToJSON for NaN and infinite floats. The
+	// default is to write them as the strings "nan", "inf", and "-inf", as
+	// JSON has no way to represent them.
+	NaNError bool
+
+	// NullError returns an error from FromJSON for null values. The default is
+	// to skip them, as TOML has no way to represent null.
+	NullError bool
+}
+
+// ToJSON converts a TOML document to JSON.
+//
+// Without the Tagged option values are mapped as:
+//
+//   - Tables become objects, and arrays become arrays.
+//   - Strings and booleans stay the same.
+//   - Integers are written exactly, including those larger than 2^53 which
+//     most JSON implementations read as a float.
+//   - Floats are always written with a fraction (1.0 rather than 1), so they
+//     can be distinguished from integers. NaN and infinity are strings, or an
+//     error with the NaNError option.
+//   - Offset datetimes are strings in RFC 3339 format; local datetimes, dates,
+//     and times are strings in the same format as they're written in TOML
+//     ("2006-01-02T15:04:05", "2006-01-02", "15:04:05").
+func ToJSON(tomlSrc []byte, opts JSONOptions) ([]byte, error) {
+	var v any
+	if _, err := NewDecoder(bytes.NewReader(tomlSrc)).Decode(&v); err != nil {
+		return nil, err
+	}
+
+	if opts.Tagged {
+		v = tag.Add("", v)
+	} else {
+		var err error
+		v, err = toJSON(v, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", opts.Indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func toJSON(v any, opts JSONOptions) (any, error) {
+	switch vv := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(vv))
+		for k, v := range vv {
+			var err error
+			m[k], err = toJSON(v, opts)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", Key{k}, err)
+			}
+		}
+		return m, nil
+	case []map[string]any:
+		a := make([]any, len(vv))
+		for i, v := range vv {
+			var err error
+			a[i], err = toJSON(v, opts)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		return a, nil
+	case []any:
+		a := make([]any, len(vv))
+		for i, v := range vv {
+			var err error
+			a[i], err = toJSON(v, opts)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		return a, nil
+	case int64:
+		return json.Number(strconv.FormatInt(vv, 10)), nil
+	case uint64:
+		return json.Number(strconv.FormatUint(vv, 10)), nil
+	case float64:
+		switch {
+		case math.IsNaN(vv), math.IsInf(vv, 0):
+			if opts.NaNError {
+				return nil, fmt.Errorf("toml.ToJSON: can't represent %v in JSON", vv)
+			}
+			if math.IsNaN(vv) {
+				return "nan", nil
+			}
+			if vv > 0 {
+				return "inf", nil
+			}
+			return "-inf", nil
+		}
+		return json.Number(floatAddDecimal(strconv.FormatFloat(vv, 'f', -1, 64))), nil
+	case time.Time:
+		switch vv.Location() {
+		case LocalDatetimeZone:
+			return vv.Format("2006-01-02T15:04:05.999999999"), nil
+		case LocalDateZone:
+			return vv.Format("2006-01-02"), nil
+		case LocalTimeZone:
+			return vv.Format("15:04:05.999999999"), nil
+		}
+		return vv.Format(time.RFC3339Nano), nil
+	}
+	return v, nil
+}
+
+// FromJSON converts a JSON document to TOML. The JSON document must be an
+// object.
+//
+// Without the Tagged option values are mapped as:
+//
+//   - Objects become tables, and arrays become arrays.
+//   - Strings and booleans stay the same. Strings are never converted to
+//     datetimes.
+//   - Numbers without a fraction or exponent are integers, and an error if
+//     they're too large for an int64 or uint64. All other numbers are floats.
+//   - Nulls are skipped, or an error with the NullError option.
+func FromJSON(jsonSrc []byte, opts JSONOptions) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(jsonSrc))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, ok := v.(map[string]any); !ok {
+		return nil, fmt.Errorf("toml.FromJSON: JSON document must be an object, not %s", fmtType(v))
+	}
+
+	var err error
+	if opts.Tagged {
+		v, err = tag.Remove(v)
+	} else {
+		v, _, err = fromJSON(v, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(v)
+}
+
+var errNull = errors.New("toml.FromJSON: can't represent null in TOML")
+
+// fromJSON converts a JSON value; it returns false if the value should be
+// skipped.
+func fromJSON(v any, opts JSONOptions) (any, bool, error) {
+	switch vv := v.(type) {
+	case nil:
+		if opts.NullError {
+			return nil, false, errNull
+		}
+		return nil, false, nil
+	case map[string]any:
+		m := make(map[string]any, len(vv))
+		for k, v := range vv {
+			c, ok, err := fromJSON(v, opts)
+			if err != nil {
+				return nil, false, fmt.Errorf("%s: %w", Key{k}, err)
+			}
+			if ok {
+				m[k] = c
+			}
+		}
+		return m, true, nil
+	case []any:
+		a := make([]any, 0, len(vv))
+		for i, v := range vv {
+			c, ok, err := fromJSON(v, opts)
+			if err != nil {
+				return nil, false, fmt.Errorf("[%d]: %w", i, err)
+			}
+			if ok {
+				a = append(a, c)
+			}
+		}
+		return a, true, nil
+	case json.Number:
+		s := string(vv)
+		if strings.ContainsAny(s, ".eE") {
+			f, err := strconv.ParseFloat(s, 64)
+			return f, true, err
+		}
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, true, nil
+		}
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return n, true, nil
+		}
+		return nil, false, fmt.Errorf("toml.FromJSON: integer %s is out of range", s)
+	}
+	return v, true, nil
+}
@@ -0,0 +1,173 @@
+package toml_test
+
+import (
+	"encoding/json"
+	"io/fs"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/BurntSushi/toml/internal/tag"
+	tomltest "github.com/BurntSushi/toml/internal/toml-test"
+)
+
+func TestJSONCorpus(t *testing.T) {
+	fsys := tomltest.EmbeddedTests()
+	fs.WalkDir(fsys, "valid", func(path string, d fs.DirEntry, err error) error {
+		if !strings.HasSuffix(path, ".toml") {
+			return nil
+		}
+		t.Run(path, func(t *testing.T) {
+			src, err := fs.ReadFile(fsys, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var orig any
+			if _, err := toml.Decode(string(src), &orig); err != nil {
+				t.Skip("not valid in this TOML version")
+			}
+			want := tagged(t, orig)
+
+			// The tagged format is never lossy.
+			j, err := toml.ToJSON(src, toml.JSONOptions{Tagged: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			back, err := toml.FromJSON(j, toml.JSONOptions{Tagged: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var have any
+			if _, err := toml.Decode(string(back), &have); err != nil {
+				t.Fatalf("%s\n%s", err, back)
+			}
+			if h := tagged(t, have); h != want {
+				t.Errorf("tagged: changed after round trip\nhave: %s\nwant: %s", h, want)
+			}
+
+			// Without tags it only works if there are no datetimes or NaN/inf.
+			if !representable(orig) {
+				return
+			}
+			j, err = toml.ToJSON(src, toml.JSONOptions{NaNError: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			back, err = toml.FromJSON(j, toml.JSONOptions{NullError: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			have = nil
+			if _, err := toml.Decode(string(back), &have); err != nil {
+				t.Fatalf("%s\n%s", err, back)
+			}
+			if h := tagged(t, have); h != want {
+				t.Errorf("untagged: changed after round trip\nhave: %s\nwant: %s\nJSON: %s", h, want, j)
+			}
+		})
+		return nil
+	})
+}
+
+// Normalize to the tagged JSON, so that []any and []map[string]any compare
+// equal.
+func tagged(t *testing.T, v any) string {
+	t.Helper()
+	j, err := json.Marshal(tag.Add("", v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(j)
+}
+
+func representable(v any) bool {
+	switch vv := v.(type) {
+	case time.Time:
+		return false
+	case float64:
+		return !math.IsNaN(vv) && !math.IsInf(vv, 0)
+	case map[string]any:
+		for _, v := range vv {
+			if !representable(v) {
+				return false
+			}
+		}
+	case []map[string]any:
+		for _, v := range vv {
+			if !representable(v) {
+				return false
+			}
+		}
+	case []any:
+		for _, v := range vv {
+			if !representable(v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		opts    toml.JSONOptions
+		want    string
+		wantErr string
+	}{
+		{`i = 9007199254740993`, toml.JSONOptions{}, `{"i":9007199254740993}`, ""},
+		{`u = 18446744073709551615`, toml.JSONOptions{}, `{"u":18446744073709551615}`, ""},
+		{`f = 1.0`, toml.JSONOptions{}, `{"f":1.0}`, ""},
+		{`f = [nan, inf, -inf]`, toml.JSONOptions{}, `{"f":["nan","inf","-inf"]}`, ""},
+		{`f = [1.0, nan]`, toml.JSONOptions{NaNError: true}, "", `f: [1]: toml.ToJSON: can't represent NaN in JSON`},
+		{`s = "<&>"`, toml.JSONOptions{}, `{"s":"<&>"}`, ""},
+		{`d = [1979-05-27T07:32:00-07:00, 1979-05-27T07:32:00, 1979-05-27, 07:32:00.5]`, toml.JSONOptions{},
+			`{"d":["1979-05-27T07:32:00-07:00","1979-05-27T07:32:00","1979-05-27","07:32:00.5"]}`, ""},
+		{`d = 1979-05-27`, toml.JSONOptions{Tagged: true}, `{"d":{"type":"date-local","value":"1979-05-27"}}`, ""},
+		{"[[a]]\nb = 1", toml.JSONOptions{Indent: " "}, "{\n \"a\": [\n  {\n   \"b\": 1\n  }\n ]\n}", ""},
+		{`a = `, toml.JSONOptions{}, "", "unexpected EOF; expected value"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have, err := toml.ToJSON([]byte(tt.in), tt.opts)
+			if (err == nil) != (tt.wantErr == "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if h := strings.TrimSpace(string(have)); h != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		opts    toml.JSONOptions
+		want    string
+		wantErr string
+	}{
+		{`{"i": 9007199254740993, "f": 1.0, "e": 1e3}`, toml.JSONOptions{},
+			"e = 1000.0\nf = 1.0\ni = 9007199254740993\n", ""},
+		{`{"u": 18446744073709551615}`, toml.JSONOptions{}, "u = 18446744073709551615\n", ""},
+		{`{"i": 18446744073709551616}`, toml.JSONOptions{}, "", "i: toml.FromJSON: integer 18446744073709551616 is out of range"},
+		{`{"n": null, "a": [1, null, 2]}`, toml.JSONOptions{}, "a = [1, 2]\n", ""},
+		{`{"a": [1, null]}`, toml.JSONOptions{NullError: true}, "", "a: [1]: toml.FromJSON: can't represent null in TOML"},
+		{`{"d": "1979-05-27"}`, toml.JSONOptions{}, "d = \"1979-05-27\"\n", ""},
+		{`{"d": {"type": "date-local", "value": "1979-05-27"}}`, toml.JSONOptions{Tagged: true}, "d = 1979-05-27\n", ""},
+		{`[1]`, toml.JSONOptions{}, "", "JSON document must be an object, not []any"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have, err := toml.FromJSON([]byte(tt.in), tt.opts)
+			if (err == nil) != (tt.wantErr == "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if string(have) != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,11 @@ package toml
 
 import (
 	"fmt"
+	"io"
 	"reflect"
 	"runtime"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -36,9 +38,13 @@ const (
 	itemCommentStart
 	itemInlineTableStart
 	itemInlineTableEnd
+	itemBOM // Byte-order mark at the start of a line, which is skipped.
 )
 
-const eof = 0
+const (
+	eof = 0
+	bom = '\ufeff'
+)
 
 type stateFn func(lx *lexer) stateFn
 
@@ -48,13 +54,43 @@ func (p Position) String() string {
 
 type lexer struct {
 	input    string
+	r        io.Reader        // Read more input from this if not nil.
+	src      *strings.Builder // Input read from r so far; input is src.String(); nil if the input was in memory.
+	readBuf  []byte
+	readOff  int   // Offset of input in the reader (there may be a BOM).
+	readErr  error // Error from r, other than io.EOF.
+	lines    int   // Number of lines removed from the input with discard().
+	dropped  int   // Number of bytes removed from the input with discard().
 	start    int
 	pos      int
 	line     int
 	state    stateFn
-	items    chan item
+	items    []item // emitted items not yet returned by nextItem()
+	nitem    int    // number of items already returned
 	tomlNext bool
 	esc      bool
+	features []Feature // TOML 1.1 features used, if tomlNext is set.
+	comma    Position  // Last comma in an inline table, for trailing commas.
+
+	// Stop at a line with only delim; see Decoder.Delimiter. Once it's found,
+	// end is the offset in the reader after the delimiter line, and rest is
+	// the input after that.
+	delim string
+	end   int
+	rest  string
+
+	// Maximum length of a single key or value in bytes, or 0 for no limit.
+	// limit is the limit for the current token, and limitLine the line it
+	// started on.
+	maxKey, maxValue int
+	limit, limitLine int
+	limitWhat        string
+
+	// Stop with a TimeoutError after the deadline, if set. It's checked every
+	// deadlineCheck bytes; nextCheck is the offset to check it at next.
+	timeout   time.Duration
+	deadline  time.Time
+	nextCheck int
 
 	// Allow for backing up up to 4 runes. This is necessary because TOML
 	// contains 3-rune tokens (""" and ''').
@@ -79,22 +115,22 @@ type item struct {
 }
 
 func (lx *lexer) nextItem() item {
-	for {
-		select {
-		case item := <-lx.items:
-			return item
-		default:
-			lx.state = lx.state(lx)
-			//fmt.Printf("     STATE %-24s  current: %-10s	stack: %s\n", lx.state, lx.current(), lx.stack)
-		}
+	// Lexing is synchronous, so there's no need for a channel: keep running
+	// state functions until at least one item is emitted.
+	for lx.nitem == len(lx.items) {
+		lx.items, lx.nitem = lx.items[:0], 0
+		lx.state = lx.state(lx)
+		//fmt.Printf("     STATE %-24s  current: %-10s	stack: %s\n", lx.state, lx.current(), lx.stack)
 	}
+	lx.nitem++
+	return lx.items[lx.nitem-1]
 }
 
 func lex(input string, tomlNext bool) *lexer {
 	lx := &lexer{
 		input:    input,
 		state:    lexTop,
-		items:    make(chan item, 10),
+		items:    make([]item, 0, 10),
 		stack:    make([]stateFn, 0, 10),
 		line:     1,
 		tomlNext: tomlNext,
@@ -102,6 +138,70 @@ func lex(input string, tomlNext bool) *lexer {
 	return lx
 }
 
+// lexReader is like lex(), but reads the input from r as it's needed, rather
+// than requiring the full document upfront. offset is the number of bytes
+// already read from r.
+func lexReader(r io.Reader, offset int, tomlNext bool) *lexer {
+	lx := lex("", tomlNext)
+	lx.r, lx.src, lx.readOff = r, new(strings.Builder), offset
+	return lx
+}
+
+// Size of the first and largest reads from the reader; the size doubles on
+// every read, so small documents don't need a large buffer.
+const (
+	minRead = 512
+	maxRead = 32 * 1024
+)
+
+// fill reads from the reader until there are at least n bytes from the current
+// position available in the input, or until the reader is exhausted.
+func (lx *lexer) fill(n int) {
+	for lx.r != nil && len(lx.input)-lx.pos < n {
+		switch {
+		case lx.readBuf == nil:
+			lx.readBuf = make([]byte, minRead)
+		case len(lx.readBuf) < maxRead:
+			lx.readBuf = make([]byte, 2*len(lx.readBuf))
+		}
+		m, err := lx.r.Read(lx.readBuf)
+		if m > 0 {
+			lx.src.Write(lx.readBuf[:m])
+			lx.input = lx.src.String() // Doesn't copy.
+		}
+		if err != nil {
+			if err != io.EOF {
+				lx.readErr = readError(lx.readOff+len(lx.input), err)
+			}
+			lx.r, lx.readBuf = nil, nil
+		}
+	}
+}
+
+// discard removes the first n bytes from the input, which must have been lexed
+// already, so they can be freed. Positions are relative to the remaining input
+// afterwards. lines is the number of lines in the removed input.
+func (lx *lexer) discard(n, lines int) {
+	rest := lx.input[n:]
+	if lx.src == nil {
+		lx.input = rest
+	} else {
+		lx.src = new(strings.Builder)
+		lx.src.WriteString(rest)
+		lx.input = lx.src.String()
+	}
+	lx.start, lx.pos = lx.start-n, lx.pos-n
+	lx.readOff += n
+	lx.lines, lx.dropped = lx.lines+lines, lx.dropped+n
+	for i := lx.nitem; i < len(lx.items); i++ {
+		lx.items[i].pos.Start -= n
+	}
+}
+
+func readError(offset int, err error) error {
+	return fmt.Errorf("toml: reading input at byte %d: %w", offset, err)
+}
+
 func (lx *lexer) push(state stateFn) {
 	lx.stack = append(lx.stack, state)
 }
@@ -119,7 +219,7 @@ func (lx *lexer) current() string {
 	return lx.input[lx.start:lx.pos]
 }
 
-func (lx lexer) getPos() Position {
+func (lx *lexer) getPos() Position {
 	p := Position{
 		Line:  lx.line,
 		Start: lx.start,
@@ -137,19 +237,70 @@ func (lx *lexer) emit(typ itemType) {
 		lx.error(errLexUTF8{lx.input[lx.pos]})
 		return
 	}
-	lx.items <- item{typ: typ, pos: lx.getPos(), val: lx.current()}
-	lx.start = lx.pos
+	if lx.limit > 0 && lx.pos-lx.start > lx.limit {
+		lx.errorTooLong()
+		return
+	}
+	lx.items = append(lx.items, item{typ: typ, pos: lx.getPos(), val: lx.current()})
+	lx.start, lx.limit = lx.pos, 0
 }
 
 func (lx *lexer) emitTrim(typ itemType) {
-	lx.items <- item{typ: typ, pos: lx.getPos(), val: strings.TrimSpace(lx.current())}
-	lx.start = lx.pos
+	v := strings.TrimSpace(lx.current())
+	if lx.limit > 0 && len(v) > lx.limit {
+		lx.errorTooLong()
+		return
+	}
+	lx.items = append(lx.items, item{typ: typ, pos: lx.getPos(), val: v})
+	lx.start, lx.limit = lx.pos, 0
+}
+
+// The lexer can read up to 4 runes past the end of a token before backing up,
+// so a token is only known to be too long in next() once it's this many bytes
+// over the limit; shorter tokens are checked when they're emitted.
+const limitSlack = 4 * utf8.UTFMax
+
+// startLimit sets the length limit for the key or value that's about to be
+// lexed; the limit is removed once it's emitted.
+func (lx *lexer) startLimit(what string) {
+	max := lx.maxValue
+	if what == "key" {
+		max = lx.maxKey
+	}
+	lx.limit, lx.limitLine, lx.limitWhat = max, lx.line, what
+}
+
+// errorTooLong emits an error for a key or value that's longer than the limit.
+func (lx *lexer) errorTooLong() {
+	lx.items = append(lx.items, item{
+		typ: itemError,
+		pos: Position{Line: lx.limitLine, Start: lx.start, Len: 1},
+		err: errLexTooLong{what: lx.limitWhat, max: lx.limit},
+	})
+	lx.limit = 0
 }
 
 func (lx *lexer) next() (r rune) {
 	if lx.atEOF {
 		panic("BUG in lexer: next called after EOF")
 	}
+	if lx.limit > 0 && lx.pos-lx.start >= lx.limit+limitSlack {
+		// Stop reading: truncate the input so that only EOF is returned from
+		// here on.
+		lx.errorTooLong()
+		lx.input, lx.r, lx.readBuf = lx.input[:lx.pos], nil, nil
+	}
+	if lx.r != nil {
+		// Make sure there's a full rune available, and the byte after a \r.
+		lx.fill(1)
+		if lx.pos < len(lx.input) {
+			if c := lx.input[lx.pos]; c == '\r' {
+				lx.fill(2)
+			} else if c >= utf8.RuneSelf && !utf8.FullRuneInString(lx.input[lx.pos:]) {
+				lx.fill(utf8.UTFMax)
+			}
+		}
+	}
 	if lx.pos >= len(lx.input) {
 		lx.atEOF = true
 		return eof
@@ -179,9 +330,32 @@ func (lx *lexer) next() (r rune) {
 
 	lx.prevWidths[0] = w
 	lx.pos += w
+	if lx.timeout > 0 {
+		lx.checkDeadline()
+	}
 	return r
 }
 
+// deadlineCheck is how often the lexer checks the deadline, in bytes.
+const deadlineCheck = 4096
+
+// checkDeadline stops with a TimeoutError if the deadline has passed. It only
+// looks at the time once every deadlineCheck bytes, as time.Now() isn't free.
+func (lx *lexer) checkDeadline() {
+	off := lx.readOff + lx.pos
+	if off < lx.nextCheck {
+		return
+	}
+	lx.nextCheck = off + deadlineCheck
+	if time.Now().After(lx.deadline) {
+		panic(TimeoutError{
+			Deadline: lx.timeout,
+			Position: Position{Line: lx.line, Start: lx.pos, Len: 1}.withCol(lx.input),
+			Bytes:    off,
+		})
+	}
+}
+
 // ignore skips over the pending input before this point.
 func (lx *lexer) ignore() {
 	lx.start = lx.pos
@@ -224,6 +398,38 @@ func (lx *lexer) peek() rune {
 	return r
 }
 
+// skipASCII skips all bytes for which valid returns true; this is a faster
+// version of next() for long runs of ASCII text. valid must never return true
+// for newlines, control characters, or bytes >=0x80, as those need the checks
+// in next().
+func (lx *lexer) skipASCII(valid func(byte) bool) {
+	n, end := 0, len(lx.input)
+	if lx.limit > 0 && lx.start+lx.limit+limitSlack < end {
+		end = lx.start + lx.limit + limitSlack // Let next() report the error.
+	}
+	for lx.pos < end && valid(lx.input[lx.pos]) {
+		lx.pos++
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	if n > len(lx.prevWidths) {
+		n = len(lx.prevWidths)
+	}
+	copy(lx.prevWidths[n:], lx.prevWidths[:len(lx.prevWidths)-n])
+	for i := 0; i < n; i++ {
+		lx.prevWidths[i] = 1
+	}
+	lx.nprev += n
+	if lx.nprev > len(lx.prevWidths) {
+		lx.nprev = len(lx.prevWidths)
+	}
+	if lx.timeout > 0 {
+		lx.checkDeadline()
+	}
+}
+
 // skip ignores all input that matches the given predicate.
 func (lx *lexer) skip(pred func(rune) bool) {
 	for {
@@ -245,7 +451,7 @@ func (lx *lexer) error(err error) stateFn {
 	if lx.atEOF {
 		return lx.errorPrevLine(err)
 	}
-	lx.items <- item{typ: itemError, pos: lx.getPos(), err: err}
+	lx.items = append(lx.items, item{typ: itemError, pos: lx.getPos(), err: err})
 	return nil
 }
 
@@ -258,30 +464,40 @@ func (lx *lexer) errorPrevLine(err error) stateFn {
 	pos.Line--
 	pos.Len = 1
 	pos.Start = lx.pos - 1
-	lx.items <- item{typ: itemError, pos: pos, err: err}
+	lx.items = append(lx.items, item{typ: itemError, pos: pos, err: err})
 	return nil
 }
 
+// feature records that a TOML 1.1 feature was used.
+func (lx *lexer) feature(name string, line, start, length int) {
+	lx.features = append(lx.features, Feature{Name: name, Position: Position{Line: line, Start: start, Len: length}})
+}
+
 // errorPos is like error(), but allows explicitly setting the position.
 func (lx *lexer) errorPos(start, length int, err error) stateFn {
 	pos := lx.getPos()
 	pos.Start = start
 	pos.Len = length
-	lx.items <- item{typ: itemError, pos: pos, err: err}
+	lx.items = append(lx.items, item{typ: itemError, pos: pos, err: err})
 	return nil
 }
 
 // errorf is like error, and creates a new error.
 func (lx *lexer) errorf(format string, values ...any) stateFn {
+	// The unexpected character is almost always the last argument; a BOM is
+	// invisible, so give an error that says what it is.
+	if n := len(values); n > 0 && values[n-1] == bom && lx.pos >= 3 && lx.input[lx.pos-3:lx.pos] == string(bom) {
+		return lx.errorPos(lx.pos-3, 3, errLexBOM{})
+	}
 	if lx.atEOF {
 		pos := lx.getPos()
 		pos.Line--
 		pos.Len = 1
 		pos.Start = lx.pos - 1
-		lx.items <- item{typ: itemError, pos: pos, err: fmt.Errorf(format, values...)}
+		lx.items = append(lx.items, item{typ: itemError, pos: pos, err: fmt.Errorf(format, values...)})
 		return nil
 	}
-	lx.items <- item{typ: itemError, pos: lx.getPos(), err: fmt.Errorf(format, values...)}
+	lx.items = append(lx.items, item{typ: itemError, pos: lx.getPos(), err: fmt.Errorf(format, values...)})
 	return nil
 }
 
@@ -291,6 +507,13 @@ func (lx *lexer) errorControlChar(cc rune) stateFn {
 
 // lexTop consumes elements at the top level of TOML data.
 func lexTop(lx *lexer) stateFn {
+	if n := lx.delimLen(); n > 0 {
+		lx.end, lx.rest = lx.readOff+lx.pos+n, lx.input[lx.pos+n:]
+		lx.input, lx.r, lx.readBuf = lx.input[:lx.pos], nil, nil
+		lx.emit(itemEOF)
+		return nil
+	}
+
 	r := lx.next()
 	if isWhitespace(r) || isNL(r) {
 		return lexSkip(lx, lexTop)
@@ -307,6 +530,13 @@ func lexTop(lx *lexer) stateFn {
 		}
 		lx.emit(itemEOF)
 		return nil
+	case bom:
+		// Concatenating files can leave a BOM at the start of a line; the
+		// one at the start of the document is already removed.
+		if lx.pos == 3 || lx.input[lx.pos-4] == '\n' {
+			lx.emit(itemBOM)
+			return lexTop
+		}
 	}
 
 	// At this point, the only valid item can be a key, so we back up
@@ -316,6 +546,29 @@ func lexTop(lx *lexer) stateFn {
 	return lexKeyStart
 }
 
+// delimLen gets the length of the delimiter line, including the newline, if
+// it's at the current position. It returns 0 if it's not, or if there's no
+// delimiter.
+func (lx *lexer) delimLen() int {
+	if lx.delim == "" || (lx.pos > 0 && lx.input[lx.pos-1] != '\n') {
+		return 0
+	}
+	lx.fill(len(lx.delim) + 2)
+	rest := lx.input[lx.pos:]
+	if !strings.HasPrefix(rest, lx.delim) {
+		return 0
+	}
+	switch rest = rest[len(lx.delim):]; {
+	case rest == "":
+		return len(lx.delim)
+	case rest[0] == '\n':
+		return len(lx.delim) + 1
+	case strings.HasPrefix(rest, "\r\n"):
+		return len(lx.delim) + 2
+	}
+	return 0
+}
+
 // lexTopEnd is entered whenever a top-level item has been consumed. (A value
 // or a table.) It must see only whitespace, and will turn back to lexTop
 // upon a newline. If it sees EOF, it will quit the lexer successfully.
@@ -327,6 +580,7 @@ func lexTopEnd(lx *lexer) stateFn {
 		lx.push(lexTop)
 		return lexCommentStart
 	case isWhitespace(r):
+		lx.skipASCII(isWhitespaceByte)
 		return lexTopEnd
 	case isNL(r):
 		lx.ignore()
@@ -370,6 +624,7 @@ func lexArrayTableEnd(lx *lexer) stateFn {
 
 func lexTableNameStart(lx *lexer) stateFn {
 	lx.skip(isWhitespace)
+	lx.startLimit("key")
 	switch r := lx.peek(); {
 	case r == ']' || r == eof:
 		return lx.errorf("unexpected end of table name (table names cannot be empty)")
@@ -409,6 +664,7 @@ func lexTableNameEnd(lx *lexer) stateFn {
 //
 // Lexes only one part, e.g. only 'a' inside 'a.b'.
 func lexBareName(lx *lexer) stateFn {
+	lx.skipASCII(isBareKeyByte)
 	r := lx.next()
 	if isBareKeyChar(r, lx.tomlNext) {
 		return lexBareName
@@ -461,6 +717,7 @@ func lexKeyStart(lx *lexer) stateFn {
 
 func lexKeyNameStart(lx *lexer) stateFn {
 	lx.skip(isWhitespace)
+	lx.startLimit("key")
 	switch r := lx.peek(); {
 	case r == '=' || r == eof:
 		return lx.errorf("unexpected '='")
@@ -505,6 +762,7 @@ func lexKeyEnd(lx *lexer) stateFn {
 func lexValue(lx *lexer) stateFn {
 	// We allow whitespace to precede a value, but NOT newlines.
 	// In array syntax, the array states are responsible for ignoring newlines.
+	lx.startLimit("value")
 	r := lx.next()
 	switch {
 	case isWhitespace(r):
@@ -627,6 +885,7 @@ func lexInlineTableValue(lx *lexer) stateFn {
 		return lexSkip(lx, lexInlineTableValue)
 	case isNL(r):
 		if lx.tomlNext {
+			lx.feature("inline-table-newline", lx.line-1, lx.pos-1, 1)
 			return lexSkip(lx, lexInlineTableValue)
 		}
 		return lx.errorPrevLine(errLexInlineTableNL{})
@@ -636,8 +895,13 @@ func lexInlineTableValue(lx *lexer) stateFn {
 	case r == ',':
 		return lx.errorf("unexpected comma")
 	case r == '}':
+		if lx.comma.Len > 0 {
+			lx.feature("inline-table-trailing-comma", lx.comma.Line, lx.comma.Start, 1)
+			lx.comma = Position{}
+		}
 		return lexInlineTableEnd
 	}
+	lx.comma = Position{}
 	lx.backup()
 	lx.push(lexInlineTableValueEnd)
 	return lexKeyStart
@@ -652,6 +916,7 @@ func lexInlineTableValueEnd(lx *lexer) stateFn {
 		return lexSkip(lx, lexInlineTableValueEnd)
 	case isNL(r):
 		if lx.tomlNext {
+			lx.feature("inline-table-newline", lx.line-1, lx.pos-1, 1)
 			return lexSkip(lx, lexInlineTableValueEnd)
 		}
 		return lx.errorPrevLine(errLexInlineTableNL{})
@@ -659,14 +924,17 @@ func lexInlineTableValueEnd(lx *lexer) stateFn {
 		lx.push(lexInlineTableValueEnd)
 		return lexCommentStart
 	case r == ',':
+		comma := Position{Line: lx.line, Start: lx.pos - 1, Len: 1}
 		lx.ignore()
 		lx.skip(isWhitespace)
 		if lx.peek() == '}' {
 			if lx.tomlNext {
+				lx.feature("inline-table-trailing-comma", comma.Line, comma.Start, 1)
 				return lexInlineTableValueEnd
 			}
 			return lx.errorf("trailing comma not allowed in inline tables")
 		}
+		lx.comma = comma
 		return lexInlineTableValue
 	case r == '}':
 		return lexInlineTableEnd
@@ -856,6 +1124,7 @@ func lexStringEscape(lx *lexer) stateFn {
 		if !lx.tomlNext {
 			return lx.error(errLexEscape{r})
 		}
+		lx.feature("escape-e", lx.line, lx.pos-2, 2)
 		fallthrough
 	case 'b':
 		fallthrough
@@ -879,6 +1148,7 @@ func lexStringEscape(lx *lexer) stateFn {
 		if !lx.tomlNext {
 			return lx.error(errLexEscape{r})
 		}
+		lx.feature("escape-x", lx.line, lx.pos-2, 2)
 		return lexHexEscape
 	case 'u':
 		return lexShortUnicodeEscape
@@ -1177,6 +1447,7 @@ func lexCommentStart(lx *lexer) stateFn {
 // It will consume *up to* the first newline character, and pass control
 // back to the last state on the stack.
 func lexComment(lx *lexer) stateFn {
+	lx.skipASCII(isCommentByte)
 	switch r := lx.next(); {
 	case isNL(r) || r == eof:
 		lx.backup()
@@ -1242,6 +1513,8 @@ func (itype itemType) String() string {
 		return "InlineTableStart"
 	case itemInlineTableEnd:
 		return "InlineTableEnd"
+	case itemBOM:
+		return "BOM"
 	}
 	panic(fmt.Sprintf("BUG: Unknown type '%d'.", int(itype)))
 }
@@ -1252,6 +1525,16 @@ func (item item) String() string {
 
 func isWhitespace(r rune) bool { return r == '\t' || r == ' ' }
 func isNL(r rune) bool         { return r == '\n' || r == '\r' }
+func isWhitespaceByte(c byte) bool {
+	return c == '\t' || c == ' '
+}
+func isCommentByte(c byte) bool { // Printable ASCII and tab
+	return c == '\t' || (c >= 0x20 && c < 0x7f)
+}
+func isBareKeyByte(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+		(c >= '0' && c <= '9') || c == '_' || c == '-'
+}
 func isControl(r rune) bool { // Control characters except \t, \r, \n
 	switch r {
 	case '\t', '\r', '\n':
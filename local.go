@@ -0,0 +1,33 @@
+package toml
+
+import (
+	"time"
+
+	"github.com/BurntSushi/toml/internal"
+)
+
+// Locations of the [time.Time] values for TOML local datetimes, local dates,
+// and local times. These have the offset of the local timezone, but a different
+// name, so that they're written back in the same format by the [Encoder].
+//
+// Use [IsLocalDatetime], [IsLocalDate], and [IsLocalTime] to check if a decoded
+// time.Time is a local value, or use these with time.Date() to create a time
+// that's written without an offset:
+//
+//	time.Date(2024, 3, 10, 0, 0, 0, 0, toml.LocalDateZone) // 2024-03-10
+//
+// Don't assign to these variables; the locations are compared by pointer.
+var (
+	LocalDatetimeZone = internal.LocalDatetime
+	LocalDateZone     = internal.LocalDate
+	LocalTimeZone     = internal.LocalTime
+)
+
+// IsLocalDatetime reports if t is a local datetime such as 1979-05-27T07:32:00.
+func IsLocalDatetime(t time.Time) bool { return t.Location() == LocalDatetimeZone }
+
+// IsLocalDate reports if t is a local date such as 1979-05-27.
+func IsLocalDate(t time.Time) bool { return t.Location() == LocalDateZone }
+
+// IsLocalTime reports if t is a local time such as 07:32:00.
+func IsLocalTime(t time.Time) bool { return t.Location() == LocalTimeZone }
@@ -1,7 +1,15 @@
 package toml
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml/internal"
 )
 
 // MetaData allows access to meta information about TOML data that's not
@@ -10,25 +18,57 @@ import (
 // It allows checking if a key is defined in the TOML data, whether any keys
 // were undecoded, and the TOML type of a key.
 type MetaData struct {
-	context Key // Used only during decoding.
+	context   Key         // Used only during decoding.
+	arrayElem bool        // Next value to decode is an array element; used only during decoding.
+	elems     []elemIndex // Tables in arrays of tables in context; used only during decoding.
+
+	keyInfo  map[string]keyInfo
+	firstPos map[string]Position // Tables without a position; see keyPos.
+	reparsed *parser             // For positions of array elements; see elemPositions.
+	indexed  bool                // Positions in arrays of tables were added; see indexPositions.
+	formats  map[string]Format   // Set with SetFormat, or from the document.
+	dotted   map[string]struct{} // Tables defined with dotted keys.
+	raw      map[rawKey]string   // Source text of values; see RawMessage.
+	canon    map[string]string   // Set with Decoder.CanonicalKeys; see parser.canonical.
+	aliases  map[string][]Key    // Other spellings of keys, with Decoder.CanonicalKeys.
+	mapping  map[string]any
+	keys     []Key
+	decoded  map[string]struct{}
+	data     string // Input file; for errors.
+	name     string // Set with Decoder.SetName; for errors.
+	lines    int    // Number of lines in the document before data; see Decoder.DecodeTables.
+	start    int    // Number of bytes in the document before data.
+	tomlNext bool   // Data was parsed as TOML 1.1.
+
+	opts         DecodeProfile // Options set on the Decoder.
+	conversions  []Conversion
+	warnings     []Warning
+	defaultTypes map[reflect.Type]interfaceFunc // Set with Decoder.RegisterDefaultType.
+	adapters     map[reflect.Type]TypeAdapter   // Set with Decoder.RegisterType.
+	placeholders []placeholder                  // Set with Placeholder, or "# key =" comments when decoding.
+	unions       map[string]string              // Chosen variant for fields with the "union" option.
+	comments     map[string]comment             // Comments for keys and headers in the document.
+	tracer       func(TraceEvent)               // Set with Decoder.SetTrace.
+	traced       bool                           // TraceError was sent; used only during decoding.
+}
 
-	keyInfo map[string]keyInfo
-	mapping map[string]any
-	keys    []Key
-	decoded map[string]struct{}
-	data    []byte // Input file; for errors.
+type placeholder struct {
+	key  Key
+	hint string
 }
 
 // IsDefined reports if the key exists in the TOML data.
 //
 // The key should be specified hierarchically, for example to access the TOML
-// key "a.b.c" you would use IsDefined("a", "b", "c"). Keys are case sensitive.
+// key "a.b.c" you would use IsDefined("a", "b", "c"). Keys are case sensitive,
+// unless [Decoder.CanonicalKeys] is set.
 //
 // Returns false for an empty key.
 func (md *MetaData) IsDefined(key ...string) bool {
 	if len(key) == 0 {
 		return false
 	}
+	key = md.canonical(key)
 
 	var (
 		hash      map[string]any
@@ -49,14 +89,186 @@ func (md *MetaData) IsDefined(key ...string) bool {
 // Type returns a string representation of the type of the key specified.
 //
 // Type will return the empty string if given an empty key or a key that does
-// not exist. Keys are case sensitive.
+// not exist. Keys are case sensitive, unless [Decoder.CanonicalKeys] is set.
 func (md *MetaData) Type(key ...string) string {
-	if ki, ok := md.keyInfo[Key(key).String()]; ok {
+	if ki, ok := md.keyInfo[Key(md.canonical(key)).String()]; ok {
 		return ki.tomlType.typeString()
 	}
 	return ""
 }
 
+// Format is how a value is written in the document; see [MetaData.Format].
+type Format struct {
+	// Base is 2, 8, or 16 for integers written with a 0b, 0o, or 0x prefix, and
+	// 0 for all other values.
+	Base int
+}
+
+// Format returns the format of the value for the key in the document.
+//
+// Elements of arrays are specified with the index in brackets as a key of its
+// own; for example Format("masks", "[1]") is the format of the second element
+// in "masks = [0o644, 0o755]", and Format("a", "[0]", "[2]") of the third
+// element of the first nested array in a. Values in an array of tables use the
+// key without an index (the last table that has the key). Keys are case
+// sensitive.
+func (md *MetaData) Format(key ...string) Format {
+	return md.formats[formatKey(key)]
+}
+
+// SetFormat sets the format for the value for key, in the same format as
+// [MetaData.Format]. This is used to write the value with
+// [Encoder.MetaData], and can be used to keep the format after changing the
+// keys or adding elements to an array. The zero Format writes the value as it
+// normally would.
+func (md *MetaData) SetFormat(key Key, f Format) {
+	k := formatKey(key)
+	if f == (Format{}) {
+		delete(md.formats, k)
+		return
+	}
+	if md.formats == nil {
+		md.formats = make(map[string]Format)
+	}
+	md.formats[k] = f
+}
+
+// Dotted reports if the table key was only defined with dotted keys in the
+// document, such as "fruit" and "fruit.apple" in:
+//
+//	fruit.apple.color = "red"
+//
+// An [Encoder] that uses this MetaData writes these tables with dotted keys as
+// well, rather than with a [fruit.apple] header; see [Encoder.MetaData].
+func (md *MetaData) Dotted(key ...string) bool {
+	_, ok := md.dotted[Key(key).String()]
+	return ok
+}
+
+// formatKey gets the key for md.formats, where array indexes are written as
+// "a[1]" rather than a."[1]".
+func formatKey(key Key) string {
+	var b strings.Builder
+	for i, k := range key {
+		if len(k) > 2 && k[0] == '[' && k[len(k)-1] == ']' {
+			if _, err := strconv.Atoi(k[1 : len(k)-1]); err == nil {
+				b.WriteString(k)
+				continue
+			}
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(Key{k}.String())
+	}
+	return b.String()
+}
+
+// Position returns the position of the key's value in the TOML document, or
+// the position of the header for tables and arrays of tables. This is useful
+// for reporting errors when validating the decoded data.
+//
+// For keys in an array of tables this is the position in the last table of the
+// array that has the key. A zero Position is returned for keys that don't
+// exist and for tables that were never defined (such as "a" in "[a.b]"). Keys
+// are case sensitive.
+func (md *MetaData) Position(key ...string) Position {
+	pos := md.keyInfo[Key(md.canonical(key)).String()].pos
+	if pos.Line == 0 {
+		return Position{}
+	}
+	return md.position(pos)
+}
+
+// position adds the column to pos, and makes it relative to the document if
+// the meta data is for a part of it.
+func (md *MetaData) position(pos Position) Position {
+	pos = pos.withCol(md.data)
+	if pos.Line > 0 {
+		pos.Line, pos.Start = pos.Line+md.lines, pos.Start+md.start
+	}
+	return pos
+}
+
+// Any returns the parsed value of the key, and reports if the key exists.
+//
+// The key is specified hierarchically, just as with [MetaData.IsDefined]; an
+// empty key returns the entire document. The value is one of:
+//
+//   - map[string]any for tables;
+//   - []map[string]any for arrays of tables;
+//   - []any for other arrays (including arrays of inline tables);
+//   - int64 (or uint64 if it's larger than math.MaxInt64), float64, string,
+//     bool, or time.Time for the other types.
+//
+// This is always the value as parsed from the document, irrespective of what
+// it was decoded in to; values are never wrapped in a [Primitive]. Maps and
+// slices are shared with the MetaData and should not be modified.
+func (md *MetaData) Any(key ...string) (any, bool) {
+	var v any = md.mapping
+	for _, k := range md.canonical(key) {
+		hash, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = hash[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Len returns the number of elements in an array or the number of keys in a
+// table.
+//
+// It returns -1 if the key doesn't exist or if it's not an array or table.
+func (md *MetaData) Len(key ...string) int {
+	v, _ := md.Any(key...)
+	switch vv := v.(type) {
+	case map[string]any:
+		return len(vv)
+	case []map[string]any:
+		return len(vv)
+	case []any:
+		return len(vv)
+	}
+	return -1
+}
+
+// UnionChoice returns the name of the variant that was set for a struct field
+// with the "union" option, and reports if a variant was set. For example with
+// "[input.kafka]" UnionChoice("input") returns "kafka".
+//
+// The name is the TOML key as written in the document. For a union in an array
+// of tables this is the variant in the last table of the array.
+func (md *MetaData) UnionChoice(key ...string) (string, bool) {
+	v, ok := md.unions[Key(key).String()]
+	return v, ok
+}
+
+// Aliases returns the other spellings of key in the document with
+// [Decoder.CanonicalKeys], in the order they're first used. The key can be
+// written with any spelling.
+func (md *MetaData) Aliases(key Key) []Key {
+	return md.aliases[Key(md.canonical(key)).String()]
+}
+
+// canonical gets the spelling of key that's used in the document with
+// Decoder.CanonicalKeys.
+func (md *MetaData) canonical(key []string) []string {
+	if md.canon == nil {
+		return key
+	}
+	c := make([]string, len(key))
+	for i := range key {
+		c[i] = key[i]
+		if s, ok := md.canon[strings.ToLower(Key(c[:i+1]).String())]; ok {
+			c[i] = s
+		}
+	}
+	return c
+}
+
 // Keys returns a slice of every key in the TOML data, including key groups.
 //
 // Each key is itself a slice, where the first element is the top of the
@@ -65,9 +277,64 @@ func (md *MetaData) Type(key ...string) string {
 //
 // All keys returned are non-empty.
 func (md *MetaData) Keys() []Key {
+	if md.opts.SkipKeyOrder {
+		return md.mappingKeys()
+	}
 	return md.keys
 }
 
+// mappingKeys gets all keys from the mapping, for when the key order wasn't
+// recorded. The keys are sorted by their position in the document.
+func (md *MetaData) mappingKeys() []Key {
+	type posKey struct {
+		key Key
+		str string
+		pos int
+	}
+	var (
+		found = make([]posKey, 0, len(md.keyInfo))
+		walk  func(Key, map[string]any)
+	)
+	walk = func(parent Key, m map[string]any) {
+		for k, v := range m {
+			key := make(Key, len(parent)+1)
+			copy(key, parent)
+			key[len(parent)] = k
+
+			// Implicit tables (e.g. "a" in "a.b = 1") aren't included.
+			str := key.String()
+			if ki, ok := md.keyInfo[str]; ok {
+				found = append(found, posKey{key: key, str: str, pos: ki.pos.Start})
+			}
+			switch vv := v.(type) {
+			case map[string]any:
+				walk(key, vv)
+			case []map[string]any:
+				for _, t := range vv {
+					walk(key, t)
+				}
+			}
+		}
+	}
+	walk(nil, md.mapping)
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].pos != found[j].pos {
+			return found[i].pos < found[j].pos
+		}
+		return found[i].str < found[j].str
+	})
+	keys := make([]Key, 0, len(found))
+	for i, f := range found {
+		// Keys in an array of tables are found once for every table.
+		if i > 0 && f.str == found[i-1].str {
+			continue
+		}
+		keys = append(keys, f.key)
+	}
+	return keys
+}
+
 // Undecoded returns all keys that have not been decoded in the order in which
 // they appear in the original TOML document.
 //
@@ -80,21 +347,344 @@ func (md *MetaData) Keys() []Key {
 // In this sense, the Undecoded keys correspond to keys in the TOML document
 // that do not have a concrete type in your representation.
 func (md *MetaData) Undecoded() []Key {
-	undecoded := make([]Key, 0, len(md.keys))
-	for _, key := range md.keys {
-		if _, ok := md.decoded[key.String()]; !ok {
+	keys := md.Keys()
+	undecoded := make([]Key, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := md.decoded[key.Comparable()]; !ok {
 			undecoded = append(undecoded, key)
 		}
 	}
 	return undecoded
 }
 
+// KeyCount returns the number of keys in the TOML data, without allocating.
+//
+// This is the number of distinct keys in [MetaData.Keys]: keys in an array of
+// tables are counted once, rather than once for every table. It's the same
+// with and without [Decoder.SkipKeyOrder].
+func (md *MetaData) KeyCount() int {
+	n := 0
+	for k := range md.keyInfo {
+		if !isIndexedKey(k) {
+			n++
+		}
+	}
+	return n
+}
+
+// UndecodedCount returns the number of keys that have not been decoded,
+// without allocating. Keys are counted in the same way as [MetaData.KeyCount].
+//
+// Just as with [MetaData.Undecoded], this goes down after a [Primitive] value
+// is decoded with [MetaData.PrimitiveDecode].
+func (md *MetaData) UndecodedCount() int {
+	n := 0
+	for k := range md.keyInfo {
+		if _, ok := md.decoded[k]; !ok && !isIndexedKey(k) {
+			n++
+		}
+	}
+	return n
+}
+
+// InputSize returns the size of the TOML document in bytes.
+func (md *MetaData) InputSize() int {
+	return len(md.data)
+}
+
+// isIndexedKey reports if the keyInfo key k is for a single table in an array
+// of tables or a key in it, such as "arr[1]" or "arr[1].key".
+func isIndexedKey(k string) bool {
+	return indexByteKey(k, '[', 0) > -1
+}
+
+// indexByteKey gets the index of the first c at or after i in the key string k
+// that's not in a quoted part of the key, or -1 if there is none.
+func indexByteKey(k string, c byte, i int) int {
+	quoted := false
+	for ; i < len(k); i++ {
+		switch k[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case c:
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Comment returns the comment directly above the key or table header in the
+// document, and the comment after it on the same line. The text is everything
+// after the "#" (usually with a leading space), and the lines of a comment with
+// several lines are separated by "\n".
+//
+// The key is in the same format as [Key.String]; for keys in an array of tables
+// the index of the table is added to the key of the array, as in
+// "servers[1].name".
+//
+// The comments are written back by an [Encoder] that uses this MetaData (see
+// [Encoder.MetaData]). Comments that aren't directly above or after a key, such
+// as those followed by a blank line and comments inside arrays, aren't kept.
+func (md *MetaData) Comment(key string) (above, after string) {
+	c := md.comments[key]
+	return strings.Join(c.above, "\n"), c.after
+}
+
+// Placeholder sets a placeholder for the key, for an [Encoder] that uses this
+// MetaData; see [Encoder.MetaData].
+//
+// If the key has no value then it's written as a comment with the hint, rather
+// than being skipped or written with an empty value:
+//
+//	# api_key =   # required: your API key
+//
+// The key is a full dotted key in the same format as [Key.String], for example
+// "server.api_key". Placeholders for fields that don't exist are written after
+// the other keys in the table, but only if the table itself is written.
+//
+// A hint with several lines is written as several comments.
+func (md *MetaData) Placeholder(key string, hint string) {
+	k, ok := parseKey(key)
+	if !ok {
+		k = Key{key}
+	}
+	for i := range md.placeholders {
+		if md.placeholders[i].key.Equal(k) {
+			md.placeholders[i].hint = hint
+			return
+		}
+	}
+	md.placeholders = append(md.placeholders, placeholder{key: k, hint: hint})
+}
+
+// Placeholders returns all keys that were written as a placeholder comment (see
+// [MetaData.Placeholder]) in the TOML document, and weren't given a value, in
+// the order in which they appear.
+//
+// Every comment on a line of its own with a key followed by "=" and nothing
+// else (except another comment) is a placeholder, no matter how it was written.
+// This includes a commented-out key in a template such as "# timeout =", but
+// not a commented-out key with a value such as "# timeout = 5".
+//
+// This can be used to check that all placeholders have been filled in; see
+// [Decoder.DisallowPlaceholders] to make that an error when decoding.
+func (md *MetaData) Placeholders() []Key {
+	var keys []Key
+	for _, p := range md.placeholders {
+		if _, ok := md.keyInfo[p.key.Comparable()]; !ok {
+			keys = append(keys, p.key)
+		}
+	}
+	return keys
+}
+
+// KeyChange is a difference between two TOML documents; see [DiffMetaData].
+type KeyChange struct {
+	Key  Key
+	Kind ChangeKind
+	Old  any // Old value, as returned by MetaData.Any(); nil for Added.
+	New  any // New value, as returned by MetaData.Any(); nil for Removed.
+}
+
+func (c KeyChange) String() string {
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("%s: %s %v", c.Key, c.Kind, c.New)
+	case Removed:
+		return fmt.Sprintf("%s: %s %v", c.Key, c.Kind, c.Old)
+	}
+	return fmt.Sprintf("%s: %s %v → %v", c.Key, c.Kind, c.Old, c.New)
+}
+
+// ChangeKind is the kind of a [KeyChange].
+type ChangeKind uint8
+
+const (
+	Added        ChangeKind = iota + 1 // Key is only in the new document.
+	Removed                            // Key is only in the old document.
+	ValueChanged                       // Key has the same type, but a different value.
+	TypeChanged                        // Key has a different type, such as String and Integer.
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case ValueChanged:
+		return "value changed"
+	case TypeChanged:
+		return "type changed"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", uint8(k))
+}
+
+// DiffMetaData returns all keys that are different in the documents old and
+// new were decoded from.
+//
+// Only the parsed values are compared, so changes in comments or formatting,
+// such as writing an integer as hex or using a literal string, are never
+// reported. NaN is equal to NaN, and datetimes are equal if they're the same
+// instant.
+//
+// Tables are reported only if they're added, removed, or changed to another
+// type; changes inside a table are reported for the keys in the table. Arrays
+// and arrays of tables are compared as a whole.
+//
+// Changes are in the order the keys appear in new, followed by removed keys in
+// the order they appear in old.
+func DiffMetaData(old, new MetaData) []KeyChange {
+	var (
+		changes []KeyChange
+		seen    = make(map[string]bool)
+	)
+	for _, k := range new.Keys() {
+		if seen[k.Comparable()] || inArray(&old, k) || inArray(&new, k) {
+			continue
+		}
+		seen[k.Comparable()] = true
+
+		nv, _ := new.Any(k...)
+		ov, ok := old.Any(k...)
+		switch {
+		case !ok:
+			changes = append(changes, KeyChange{Key: k, Kind: Added, New: nv})
+		case old.Type(k...) != new.Type(k...):
+			changes = append(changes, KeyChange{Key: k, Kind: TypeChanged, Old: ov, New: nv})
+		case new.Type(k...) != tomlHash.typeString() && !internal.DeepEqual(ov, nv):
+			changes = append(changes, KeyChange{Key: k, Kind: ValueChanged, Old: ov, New: nv})
+		}
+	}
+	for _, k := range old.Keys() {
+		if seen[k.Comparable()] || inArray(&old, k) {
+			continue
+		}
+		seen[k.Comparable()] = true
+		if !new.IsDefined(k...) {
+			ov, _ := old.Any(k...)
+			changes = append(changes, KeyChange{Key: k, Kind: Removed, Old: ov})
+		}
+	}
+	return changes
+}
+
+// inArray reports if the key is in an array or array of tables.
+func inArray(md *MetaData, k Key) bool {
+	for i := 1; i < len(k); i++ {
+		switch md.Type(k[:i]...) {
+		case tomlArray.typeString(), tomlArrayHash.typeString():
+			return true
+		}
+	}
+	return false
+}
+
+// Warnings returns problems found while decoding that aren't errors, but should
+// probably be fixed in the TOML document, such as using a deprecated key name.
+func (md *MetaData) Warnings() []Warning {
+	return md.warnings
+}
+
+// Warning is a problem found while decoding; see [MetaData.Warnings].
+type Warning struct {
+	Key      Key      // Key the warning is for; empty if it's not for a key.
+	Position Position // Position of the key in the TOML document.
+	Message  string
+}
+
+func (w Warning) String() string {
+	if len(w.Key) == 0 {
+		return fmt.Sprintf("toml: line %d: %s", w.Position.Line, w.Message)
+	}
+	return fmt.Sprintf("toml: line %d (key %q): %s", w.Position.Line, w.Key, w.Message)
+}
+
+// Conversions returns all implicit conversions that were done while decoding,
+// in the order they were done.
+//
+// This is always empty unless [Decoder.RecordConversions] was enabled.
+func (md *MetaData) Conversions() []Conversion {
+	return md.conversions
+}
+
+// Conversion describes a TOML value that was converted to a Go value of a
+// different type while decoding.
+type Conversion struct {
+	Key          Key            // Key the value was decoded from.
+	Position     Position       // Position of the key in the TOML document.
+	FromTOMLType string         // TOML type, as returned by MetaData.Type().
+	ToGoType     string         // Go type of the destination.
+	Kind         ConversionKind // Kind of conversion.
+}
+
+func (c Conversion) String() string {
+	return fmt.Sprintf("%s: %s %s to %s", c.Key, c.Kind, c.FromTOMLType, c.ToGoType)
+}
+
+// ConversionKind is the kind of a [Conversion].
+type ConversionKind uint8
+
+const (
+	// Widening is a conversion to a type that can represent every value of
+	// the TOML type, such as an integer to a float64 or json.Number.
+	Widening ConversionKind = iota + 1
+
+	// Narrowing is a conversion to a type that can only represent some values
+	// of the TOML type, such as an integer to an int8 or uint, or a float to
+	// a float32. The value is always in range, as it's an error otherwise.
+	Narrowing
+
+	// UnitInterpretation is a conversion that assigns a unit to a value, such
+	// as an integer being read as nanoseconds for a time.Duration.
+	UnitInterpretation
+
+	// CustomUnmarshal is a conversion done by an UnmarshalTOML or
+	// UnmarshalText method, or by a TypeAdapter.
+	CustomUnmarshal
+
+	// Weak is a conversion from a different TOML type that's only done with
+	// Decoder.WeakTypes, such as the integer 1 or string "true" to a bool.
+	Weak
+
+	// Promotion is a conversion of a single value to a slice with one
+	// element, such as a string to a []string.
+	Promotion
+)
+
+func (k ConversionKind) String() string {
+	switch k {
+	case Widening:
+		return "widening"
+	case Narrowing:
+		return "narrowing"
+	case UnitInterpretation:
+		return "unit interpretation"
+	case CustomUnmarshal:
+		return "custom unmarshal"
+	case Weak:
+		return "weak"
+	case Promotion:
+		return "promotion"
+	}
+	return fmt.Sprintf("ConversionKind(%d)", uint8(k))
+}
+
 // Key represents any TOML key, including key groups. Use [MetaData.Keys] to get
 // values of this type.
 type Key []string
 
 func (k Key) String() string {
 	// This is called quite often, so it's a bit funky to make it faster.
+	if len(k) == 1 { /// Doesn't allocate for bare keys.
+		return k.maybeQuoted(0)
+	}
 	var b strings.Builder
 	b.Grow(len(k) * 25)
 outer:
@@ -109,7 +699,7 @@ outer:
 				// "Inline" isBareKeyChar
 				if !((r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-') {
 					b.WriteByte('"')
-					b.WriteString(dblQuotedReplacer.Replace(kk))
+					b.WriteString(escapeKey(kk))
 					b.WriteByte('"')
 					continue outer
 				}
@@ -128,11 +718,36 @@ func (k Key) maybeQuoted(i int) string {
 		if (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
 			continue
 		}
-		return `"` + dblQuotedReplacer.Replace(k[i]) + `"`
+		return `"` + escapeKey(k[i]) + `"`
 	}
 	return k[i]
 }
 
+// escapeKey escapes a key for use in a quoted key. Unprintable characters are
+// written as \uXXXX, so that keys consisting of (only) invisible characters can
+// be seen.
+func escapeKey(k string) string {
+	k = dblQuotedReplacer.Replace(k)
+	if strings.IndexFunc(k, func(r rune) bool { return !unicode.IsPrint(r) && r != utf8.RuneError }) == -1 {
+		return k
+	}
+	var b strings.Builder
+	b.Grow(len(k) + 8)
+	for len(k) > 0 {
+		r, n := utf8.DecodeRuneInString(k)
+		switch {
+		case unicode.IsPrint(r) || r == utf8.RuneError: /// Keep invalid UTF-8 as-is.
+			b.WriteString(k[:n])
+		case r > 0xffff:
+			fmt.Fprintf(&b, `\U%08x`, r)
+		default:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+		k = k[n:]
+	}
+	return b.String()
+}
+
 // Like append(), but only increase the cap by 1.
 func (k Key) add(piece string) Key {
 	if cap(k) > len(k) {
@@ -144,5 +759,50 @@ func (k Key) add(piece string) Key {
 	return newKey
 }
 
-func (k Key) parent() Key  { return k[:len(k)-1] } // all except the last piece.
-func (k Key) last() string { return k[len(k)-1] }  // last piece of this key.
+// Parent returns the key without the last piece; this is empty for top-level
+// keys.
+func (k Key) Parent() Key {
+	if len(k) == 0 {
+		return nil
+	}
+	return k[:len(k)-1]
+}
+
+// Last returns the last piece of the key, or "" for an empty key.
+func (k Key) Last() string {
+	if len(k) == 0 {
+		return ""
+	}
+	return k[len(k)-1]
+}
+
+// Depth returns the number of pieces in the key.
+func (k Key) Depth() int { return len(k) }
+
+// Equal reports if both keys have the same pieces.
+func (k Key) Equal(other Key) bool {
+	return len(k) == len(other) && k.HasPrefix(other)
+}
+
+// HasPrefix reports if the first pieces of k are the pieces of other; this
+// compares pieces, not strings, so "server" is not a prefix of "servers", but
+// it is of "server.port".
+//
+// Every key has the empty key as a prefix.
+func (k Key) HasPrefix(other Key) bool {
+	if len(other) > len(k) {
+		return false
+	}
+	for i := range other {
+		if k[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Comparable returns a string that's unique for the key, for use as a map key.
+//
+// This is the same as String(): pieces are quoted where needed, so a piece
+// containing a dot is never confused with two pieces.
+func (k Key) Comparable() string { return k.String() }
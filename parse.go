@@ -1,15 +1,16 @@
 package toml
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"math"
-	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
-
-	"github.com/BurntSushi/toml/internal"
 )
 
 type parser struct {
@@ -18,66 +19,189 @@ type parser struct {
 	currentKey string   // Base key name for everything except hashes.
 	pos        Position // Current position in the TOML file.
 	tomlNext   bool
-
-	ordered []Key // List of keys in the order that they appear in the TOML data.
+	noLocal    bool   // Local datetimes are an error; set with Decoder.RequireOffsets.
+	noOrder    bool   // Don't record the key order; set with Decoder.SkipKeyOrder.
+	defining   string // "table" or "array of tables" while adding a [..] or [[..]] header.
+
+	ordered      []Key         // List of keys in the order that they appear in the TOML data.
+	placeholders []placeholder // "# key =" comments; see MetaData.Placeholder.
+	warnings     []Warning     // Byte-order marks after a newline.
+	headers      []header      // All [..] and [[..]] headers, if sections is set.
+	comments     []int         // Offsets of all comments outside values, if sections is set.
+	sections     bool          // Record headers and comments, for ExtractSection.
+
+	// Comments for keys and headers; see addComment.
+	keyComments map[string]comment
+	docComment  []string // Lines of the comment directly above the current line.
+	docLine     int      // Line of the last line in docComment.
+	lastCtx     Key      // Context of the last key or header, for a comment after it.
+	lastName    string   // Last key in lastCtx; empty for headers.
 
 	keyInfo   map[string]keyInfo  // Map keyname → info about the TOML key.
+	indexed   bool                // Also record keys in arrays of tables by index; see indexedKey.
+	arrayPos  map[*any][]Position // First element of an array → position of every element, if set.
+	formats   map[string]Format   // Integers not written in base 10; see MetaData.Format.
+	dotted    map[string]struct{} // Tables defined with dotted keys; see MetaData.Dotted.
+	elem      []int               // Index of the element being parsed for every array value.
+	raw       map[rawKey]string   // Source text of every value, if decoding in to a RawMessage.
+	rawEnd    int                 // Offset after the last array or inline table.
 	mapping   map[string]any      // Map keyname → key value.
 	implicits map[string]struct{} // Record implicit keys (e.g. "key.group.names").
+
+	// Set for Decoder.CanonicalKeys.
+	canon   map[string]string // Lowercase key → spelling of the last part that's used first.
+	aliases map[string][]Key  // Key → other spellings of it.
+
+	// Set for Decoder.DecodeTables; see nextChunk.
+	stream      func(chunk) error
+	streamKeys  []string            // Top-level keys in the current chunk.
+	streamDone  map[string]struct{} // Top-level keys already passed to stream.
+	streamStart int                 // Offset of the current chunk in the input.
+	streamLine  int                 // Line the current chunk starts on.
 }
 
+// chunk is the part of the document for one or more top-level keys, for
+// Decoder.DecodeTables.
+type chunk struct {
+	keys         []string // Top-level keys, in the order they were defined.
+	mapping      map[string]any
+	keyInfo      map[string]keyInfo
+	formats      map[string]Format
+	dotted       map[string]struct{}
+	ordered      []Key
+	placeholders []placeholder
+	warnings     []Warning
+	comments     map[string]comment
+	data         string
+	lines, start int // Number of lines and bytes in the document before data.
+}
+
+// errStream is a panic for an error returned by the stream function.
+type errStream struct{ err error }
+
+// panicOnBug re-panics on panics that aren't a ParseError, instead of
+// returning them as an error. This is set in the tests so that bugs in the
+// parser aren't hidden.
+var panicOnBug = false
+
 type keyInfo struct {
 	pos      Position
 	tomlType tomlType
 }
 
-func parse(data string) (p *parser, err error) {
-	_, tomlNext := os.LookupEnv("BURNTSUSHI_TOML_110")
+// header is a [table] or [[array of tables]] header.
+type header struct {
+	key        Key
+	array      bool
+	start, end int // Offset of the first "[" and after the last "]".
+}
+
+func parse(r io.Reader, opts DecodeProfile, tomlNext bool) (*parser, error) {
+	return parseStream(r, opts, tomlNext, false, false, false, nil)
+}
 
+// parseStream parses the document, calling stream for every chunk that's
+// complete if it's not nil. Data is removed from the parser once it's passed
+// to stream.
+//
+// The source text of every value is recorded if raw is set, the position of
+// every array element and of every key in every table of an array of tables if
+// positions is set, and the position of every header and comment if sections
+// is set.
+func parseStream(r io.Reader, opts DecodeProfile, tomlNext, raw, positions, sections bool, stream func(chunk) error) (p *parser, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			if pErr, ok := r.(ParseError); ok {
-				pErr.input = data
-				err = pErr
+			if tErr, ok := r.(TimeoutError); ok {
+				err = tErr
+				return
+			}
+			if sErr, ok := r.(errStream); ok {
+				err = sErr.err
+				return
+			}
+			pErr, ok := r.(ParseError)
+			if !ok {
+				if panicOnBug {
+					panic(r)
+				}
+				if p == nil {
+					err = fmt.Errorf("toml: %w", errInternal{r})
+					return
+				}
+				pErr = p.internalError(r)
+			}
+			// Syntax errors are caused by the truncated input.
+			if p.lx.readErr != nil {
+				err = p.lx.readErr
 				return
 			}
-			panic(r)
+			err = pErr.withInputAt(p.lx.input, p.lx.lines, p.lx.dropped)
 		}
 	}()
 
-	// Read over BOM; do this here as the lexer calls utf8.DecodeRuneInString()
-	// which mangles stuff. UTF-16 BOM isn't strictly valid, but some tools add
-	// it anyway.
-	if strings.HasPrefix(data, "\xff\xfe") || strings.HasPrefix(data, "\xfe\xff") { // UTF-16
-		data = data[2:]
-		//lint:ignore S1017 https://github.com/dominikh/go-tools/issues/1447
-	} else if strings.HasPrefix(data, "\xef\xbb\xbf") { // UTF-8
-		data = data[3:]
-	}
-
-	// Examine first few bytes for NULL bytes; this probably means it's a UTF-16
-	// file (second byte in surrogate pair being NULL). Again, do this here to
-	// avoid having to deal with UTF-8/16 stuff in the lexer.
-	ex := 6
-	if len(data) < 6 {
-		ex = len(data)
-	}
-	if i := strings.IndexRune(data[:ex], 0); i > -1 {
-		return nil, ParseError{
-			Message:  "files cannot contain NULL bytes; probably using UTF-16; TOML files must be UTF-8",
-			Position: Position{Line: 1, Col: 1, Start: i, Len: 1},
-			Line:     1,
-			input:    data,
+	var (
+		lx *lexer
+		br *bufio.Reader
+	)
+	if src, ok := readInMemory(r); ok {
+		bom := skipBOM(src)
+		if err := checkNULL(src[bom:]); err != nil {
+			return nil, err
 		}
+		lx = lex(src[bom:], tomlNext)
+		lx.readOff = bom
+	} else {
+		// Only buffer enough to look at the start; the lexer reads the rest.
+		br = bufio.NewReaderSize(r, 16)
+		bom := 0
+		for {
+			head, err := br.Peek(3)
+			if err != nil && err != io.EOF {
+				return nil, readError(bom+len(head), err)
+			}
+			n := skipBOM(string(head))
+			if n == 0 {
+				break
+			}
+			br.Discard(n)
+			bom += n
+		}
+		head, err := br.Peek(6)
+		if err != nil && err != io.EOF {
+			return nil, readError(bom+len(head), err)
+		}
+		if err := checkNULL(string(head)); err != nil {
+			return nil, err
+		}
+		lx = lexReader(br, bom, tomlNext)
+	}
+	lx.maxKey, lx.maxValue = opts.MaxKeyLength, opts.MaxValueLength
+	lx.delim = opts.Delimiter
+	if opts.Deadline > 0 {
+		lx.timeout, lx.deadline, lx.nextCheck = opts.Deadline, time.Now().Add(opts.Deadline), deadlineCheck
 	}
-
 	p = &parser{
 		keyInfo:   make(map[string]keyInfo),
 		mapping:   make(map[string]any),
-		lx:        lex(data, tomlNext),
+		lx:        lx,
 		ordered:   make([]Key, 0),
 		implicits: make(map[string]struct{}),
 		tomlNext:  tomlNext,
+		noLocal:   opts.RequireOffsets,
+		noOrder:   opts.SkipKeyOrder,
+		sections:  sections,
+	}
+	if stream != nil {
+		p.stream, p.streamDone, p.streamLine = stream, make(map[string]struct{}), 1
+	}
+	if raw {
+		p.raw = make(map[rawKey]string)
+	}
+	if positions {
+		p.arrayPos, p.indexed = make(map[*any][]Position), true
+	}
+	if opts.CanonicalKeys && !opts.CaseSensitive {
+		p.canon = make(map[string]string)
 	}
 	for {
 		item := p.next()
@@ -86,10 +210,80 @@ func parse(data string) (p *parser, err error) {
 		}
 		p.topLevel(item)
 	}
+	if p.lx.readErr != nil {
+		return nil, p.lx.readErr
+	}
+	if p.lx.end > 0 {
+		// Keep what's read after the delimiter, for the next document.
+		if br != nil {
+			b, _ := br.Peek(br.Buffered())
+			p.lx.rest += string(b)
+		}
+	} else {
+		p.lx.end = p.lx.readOff + len(p.lx.input)
+	}
+	if p.stream != nil {
+		p.sendChunk(len(p.lx.input))
+	}
 
 	return p, nil
 }
 
+// readInMemory returns the rest of r if it's a reader for data that's already
+// in memory, so it can be lexed as-is rather than read in chunks.
+func readInMemory(r io.Reader) (string, bool) {
+	var n int
+	switch rr := r.(type) {
+	case *strings.Reader:
+		n = rr.Len()
+	case *bytes.Reader:
+		n = rr.Len()
+	case *bytes.Buffer:
+		n = rr.Len()
+	default:
+		return "", false
+	}
+	var b strings.Builder
+	b.Grow(n)
+	r.(io.WriterTo).WriteTo(&b) // Can't fail.
+	return b.String(), true
+}
+
+// skipBOM gets the length of the BOMs at the start of s. Do this here as the
+// lexer calls utf8.DecodeRuneInString() which mangles stuff. UTF-16 BOM isn't
+// strictly valid, but some tools add it anyway. Some tools also add a BOM when
+// there already is one, so skip all of them.
+func skipBOM(s string) int {
+	n := 0
+	for {
+		switch {
+		case strings.HasPrefix(s[n:], "\xff\xfe") || strings.HasPrefix(s[n:], "\xfe\xff"): // UTF-16
+			n += 2
+		case strings.HasPrefix(s[n:], "\xef\xbb\xbf"): // UTF-8
+			n += 3
+		default:
+			return n
+		}
+	}
+}
+
+// checkNULL examines the first few bytes of s for NULL bytes; this probably
+// means it's a UTF-16 file (second byte in surrogate pair being NULL). Again,
+// do this here to avoid having to deal with UTF-8/16 stuff in the lexer.
+func checkNULL(s string) error {
+	if len(s) > 6 {
+		s = s[:6]
+	}
+	if i := strings.IndexByte(s, 0); i > -1 {
+		return ParseError{
+			Message:  "files cannot contain NULL bytes; probably using UTF-16; TOML files must be UTF-8",
+			Position: Position{Line: 1, Col: 1, Start: i, Len: 1},
+			Line:     1,
+		}.withInput(s)
+	}
+	return nil
+}
+
 func (p *parser) panicErr(it item, err error) {
 	panic(ParseError{
 		Message:  err.Error(),
@@ -147,22 +341,46 @@ func (p *parser) bug(format string, v ...any) {
 	panic(fmt.Sprintf("BUG: "+format+"\n\n", v...))
 }
 
+// internalError converts a recovered panic to a ParseError at the last
+// position the lexer reached.
+func (p *parser) internalError(r any) ParseError {
+	pos := Position{Line: p.lx.line, Start: p.lx.pos, Len: 1}
+	if pos.Start > len(p.lx.input) {
+		pos.Start = len(p.lx.input)
+	}
+	err := errInternal{r}
+	return ParseError{
+		Message:  err.Error(),
+		err:      err,
+		Position: pos.withCol(p.lx.input),
+		Line:     pos.Line,
+		LastKey:  p.current(),
+	}
+}
+
 func (p *parser) expect(typ itemType) item {
 	it := p.next()
-	p.assertEqual(typ, it.typ)
+	p.assertEqual(typ, it)
 	return it
 }
 
-func (p *parser) assertEqual(expected, got itemType) {
-	if expected != got {
-		p.bug("Expected '%s' but got '%s'.", expected, got)
+// assertEqual checks that the item is of the expected type.
+func (p *parser) assertEqual(expected itemType, it item) {
+	if expected != it.typ {
+		p.panicItemf(it, "expected %s but got %s", expected, it.typ)
 	}
 }
 
 func (p *parser) topLevel(item item) {
 	switch item.typ {
 	case itemCommentStart: // # ..
-		p.expect(itemText)
+		if p.sections {
+			p.comments = append(p.comments, item.pos.Start-1) // Start is after the "#".
+		}
+		text := p.expect(itemText).val
+		if !p.placeholder(item, text) {
+			p.addComment(item, text)
+		}
 	case itemTableStart: // [ .. ]
 		name := p.nextPos()
 
@@ -170,11 +388,25 @@ func (p *parser) topLevel(item item) {
 		for ; name.typ != itemTableEnd && name.typ != itemEOF; name = p.next() {
 			key = append(key, p.keyString(name))
 		}
-		p.assertEqual(itemTableEnd, name.typ)
+		p.assertEqual(itemTableEnd, name)
+		if p.canon != nil {
+			key = p.canonical(nil, key, item.pos)
+		}
+		if p.stream != nil {
+			p.nextChunk(key, false, &item, &name)
+		}
+		if p.sections {
+			p.headers = append(p.headers, header{key: key, start: item.pos.Start, end: name.pos.Start + len(name.val)})
+		}
 
+		p.defining = "table"
 		p.addContext(key, false)
+		p.defining = ""
 		p.setType("", tomlHash, item.pos)
-		p.ordered = append(p.ordered, key)
+		p.keyComment(key, "", item.pos.Line)
+		if !p.noOrder {
+			p.ordered = append(p.ordered, key)
+		}
 	case itemArrayTableStart: // [[ .. ]]
 		name := p.nextPos()
 
@@ -182,11 +414,33 @@ func (p *parser) topLevel(item item) {
 		for ; name.typ != itemArrayTableEnd && name.typ != itemEOF; name = p.next() {
 			key = append(key, p.keyString(name))
 		}
-		p.assertEqual(itemArrayTableEnd, name.typ)
+		p.assertEqual(itemArrayTableEnd, name)
+		if p.canon != nil {
+			key = p.canonical(nil, key, item.pos)
+		}
+		if p.stream != nil {
+			p.nextChunk(key, true, &item, &name)
+		}
+		if p.sections {
+			p.headers = append(p.headers, header{key: key, array: true, start: item.pos.Start, end: name.pos.Start + len(name.val)})
+		}
 
+		p.defining = "array of tables"
 		p.addContext(key, true)
+		p.defining = ""
 		p.setType("", tomlArrayHash, item.pos)
-		p.ordered = append(p.ordered, key)
+		if p.indexed {
+			p.keyInfo[p.indexedKey(key)] = keyInfo{tomlType: tomlHash, pos: item.pos}
+		}
+		p.keyComment(key, "", item.pos.Line)
+		if !p.noOrder {
+			p.ordered = append(p.ordered, key)
+		}
+	case itemBOM: // Skipped by the lexer.
+		pos := item.pos.withCol(p.lx.input)
+		pos.Start += p.lx.dropped
+		p.warnings = append(p.warnings, Warning{Position: pos,
+			Message: "skipped byte-order mark (U+FEFF) at the start of the line; this usually happens when files are concatenated"})
 	case itemKeyStart: // key = ..
 		outerContext := p.context
 		/// Read all the key parts (e.g. 'a' and 'b' in 'a.b')
@@ -195,30 +449,266 @@ func (p *parser) topLevel(item item) {
 		for ; k.typ != itemKeyEnd && k.typ != itemEOF; k = p.next() {
 			key = append(key, p.keyString(k))
 		}
-		p.assertEqual(itemKeyEnd, k.typ)
+		p.assertEqual(itemKeyEnd, k)
+		if p.canon != nil {
+			key = p.canonical(p.context, key, item.pos)
+		}
+		if p.stream != nil && len(p.context) == 0 && !hasString(p.streamKeys, key[0]) {
+			p.streamKeys = append(p.streamKeys, key[0])
+		}
 
 		/// The current key is the last part.
-		p.currentKey = key.last()
+		p.currentKey = key.Last()
 
 		/// All the other parts (if any) are the context; need to set each part
 		/// as implicit.
-		context := key.parent()
+		context := key.Parent()
 		for i := range context {
 			p.addImplicitContext(append(p.context, context[i:i+1]...))
+			if p.dotted == nil {
+				p.dotted = make(map[string]struct{})
+			}
+			p.dotted[p.context.String()] = struct{}{}
+		}
+		if !p.noOrder {
+			p.ordered = append(p.ordered, p.context.add(p.currentKey))
 		}
-		p.ordered = append(p.ordered, p.context.add(p.currentKey))
 
 		/// Set value.
 		vItem := p.next()
 		val, typ := p.value(vItem, false)
-		p.setValue(p.currentKey, val)
+		hash := p.setValue(p.currentKey, val)
 		p.setType(p.currentKey, typ, vItem.pos)
+		p.keyComment(p.context, p.currentKey, item.pos.Line)
+		if p.raw != nil {
+			p.setRaw(hash, p.currentKey, vItem)
+		}
 
 		/// Remove the context we added (preserving any context from [tbl] lines).
 		p.context = outerContext
 		p.currentKey = ""
 	default:
-		p.bug("Unexpected type at top level: %s", item.typ)
+		p.panicItemf(item, "unexpected %s at top level", item.typ)
+	}
+}
+
+// nextChunk is called for the [table] or [[array of tables]] header with the
+// key, and sends the current chunk to the stream function if the header starts
+// a new top-level key or a new table in a top-level array of tables.
+//
+// The input before the header may be discarded, in which case the positions of
+// the header items are updated.
+func (p *parser) nextChunk(key Key, array bool, start, end *item) {
+	var (
+		name     = key[0]
+		newTable = array && len(key) == 1
+	)
+	if hasString(p.streamKeys, name) && !newTable {
+		return
+	}
+	if _, ok := p.streamDone[name]; ok && !hasString(p.streamKeys, name) {
+		if _, isArr := p.mapping[name].([]map[string]any); !newTable || !isArr {
+			p.panicf("Key '%s' must be directly after the other tables in '%s' when decoding one table at a time.",
+				key, name)
+		}
+	}
+
+	// Start the next chunk at the start of the header's line.
+	lineStart := strings.LastIndexByte(p.lx.input[:start.pos.Start], '\n') + 1
+	p.sendChunk(lineStart)
+	p.streamKeys, p.streamStart, p.streamLine = append(p.streamKeys, name), lineStart, start.pos.Line
+
+	// Free the input if that's more than what needs to be copied.
+	if lineStart > len(p.lx.input)-lineStart {
+		p.lx.discard(lineStart, p.streamLine-1-p.lx.lines)
+		p.streamStart = 0
+		start.pos.Start, end.pos.Start, p.pos.Start = start.pos.Start-lineStart, end.pos.Start-lineStart, p.pos.Start-lineStart
+	}
+}
+
+// sendChunk sends the keys since the last chunk to the stream function, with
+// the input up to the offset end, and removes them from the parser.
+func (p *parser) sendChunk(end int) {
+	if len(p.streamKeys) == 0 {
+		return
+	}
+	c := chunk{
+		keys:         p.streamKeys,
+		mapping:      make(map[string]any, len(p.streamKeys)),
+		keyInfo:      p.keyInfo,
+		formats:      p.formats,
+		dotted:       p.dotted,
+		ordered:      p.ordered,
+		placeholders: p.placeholders,
+		warnings:     p.warnings,
+		comments:     p.keyComments,
+		data:         p.lx.input[p.streamStart:end],
+		lines:        p.streamLine - 1,
+		start:        p.lx.dropped + p.streamStart,
+	}
+	for k, ki := range c.keyInfo {
+		ki.pos.Line -= c.lines
+		ki.pos.Start -= p.streamStart
+		c.keyInfo[k] = ki
+	}
+	for _, k := range c.keys {
+		c.mapping[k] = p.mapping[k]
+		p.streamDone[k] = struct{}{}
+		if _, ok := p.mapping[k].([]map[string]any); ok {
+			p.mapping[k] = make([]map[string]any, 0, 1)
+		} else {
+			delete(p.mapping, k)
+		}
+	}
+
+	p.streamKeys = nil
+	p.keyInfo, p.implicits, p.formats = make(map[string]keyInfo), make(map[string]struct{}), nil
+	p.dotted = nil
+	p.ordered, p.placeholders, p.warnings = nil, nil, nil
+	p.keyComments = nil
+	if err := p.stream(c); err != nil {
+		panic(errStream{err})
+	}
+}
+
+func hasString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// placeholder records the comment if it's a placeholder written by the Encoder:
+//
+//	# key =   # hint
+//
+// Only comments on a line of their own can be a placeholder.
+func (p *parser) placeholder(it item, comment string) bool {
+	if !p.ownLine(it) {
+		return false
+	}
+	for i := 0; i < len(comment); i++ {
+		if comment[i] != '=' {
+			continue
+		}
+		rest := strings.TrimLeft(comment[i+1:], " \t")
+		if rest != "" && rest[0] != '#' {
+			continue
+		}
+		k, ok := parseKey(strings.TrimSpace(comment[:i]))
+		if !ok {
+			continue
+		}
+		hint := ""
+		if rest != "" {
+			hint = strings.TrimSpace(rest[1:])
+		}
+		p.placeholders = append(p.placeholders, placeholder{key: append(p.context[:len(p.context):len(p.context)], k...), hint: hint})
+		return true
+	}
+	return false
+}
+
+// comment is the comment for a key or header; see MetaData.Comment.
+type comment struct {
+	above []string // Lines of the comment directly above the key.
+	after string   // Comment on the same line as the value or header.
+}
+
+// addComment records the comment it with the text as the comment after the
+// last key or header if it's on the same line, or as a line of the comment for
+// the next key if it's on a line of its own.
+func (p *parser) addComment(it item, text string) {
+	if !p.ownLine(it) {
+		if p.lastCtx == nil && p.lastName == "" {
+			return
+		}
+		k := append(Key(nil), p.lastCtx...)
+		if p.lastName != "" {
+			k = append(k, p.lastName)
+		}
+		ik := p.indexedKey(k)
+		c := p.keyComments[ik]
+		c.after = text
+		p.setComment(ik, c)
+		return
+	}
+	if it.pos.Line != p.docLine+1 {
+		p.docComment = p.docComment[:0]
+	}
+	p.docComment, p.docLine = append(p.docComment, text), it.pos.Line
+}
+
+// ownLine reports if the comment it is on a line of its own, rather than after
+// a key or header.
+func (p *parser) ownLine(it item) bool {
+	for i := it.pos.Start - 2; i >= 0 && p.lx.input[i] != '\n'; i-- { // Start is after the "#".
+		if c := p.lx.input[i]; c != ' ' && c != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// keyComment is called for every key or header on line, with the context ctx
+// and name (empty for headers). The comment directly above it is added to the
+// comment for the key.
+func (p *parser) keyComment(ctx Key, name string, line int) {
+	p.lastCtx, p.lastName = ctx, name
+	if len(p.docComment) == 0 {
+		return
+	}
+	if p.docLine == line-1 {
+		k := append(Key(nil), ctx...)
+		if name != "" {
+			k = append(k, name)
+		}
+		ik := p.indexedKey(k)
+		c := p.keyComments[ik]
+		c.above = append([]string(nil), p.docComment...)
+		p.setComment(ik, c)
+	}
+	p.docComment = p.docComment[:0]
+}
+
+func (p *parser) setComment(k string, c comment) {
+	if p.keyComments == nil {
+		p.keyComments = make(map[string]comment)
+	}
+	p.keyComments[k] = c
+}
+
+// parseKey parses a dotted key, such as "a.b" or `"a b".c`.
+//
+// This is called for every comment that looks like a placeholder, so it only
+// runs the lexer rather than parsing a whole document.
+func parseKey(s string) (k Key, ok bool) {
+	if s == "" {
+		return nil, false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			k, ok = nil, false
+		}
+	}()
+
+	p := &parser{lx: lex(s+" =", false)}
+	if p.lx.nextItem().typ != itemKeyStart {
+		return nil, false
+	}
+	for {
+		it := p.lx.nextItem()
+		switch it.typ {
+		case itemKeyEnd:
+			// Make sure that it's all key, and not something like "a = 0 #".
+			return k, it.pos.Start == len(s)+1
+		case itemText, itemString, itemStringEsc, itemRawString:
+			k = append(k, p.keyString(it))
+		default:
+			return nil, false
+		}
 	}
 }
 
@@ -232,7 +722,7 @@ func (p *parser) keyString(it item) string {
 		s, _ := p.value(it, false)
 		return s.(string)
 	default:
-		p.bug("Unexpected key type: %s", it.typ)
+		p.panicItemf(it, "expected a key but got %s", it.typ)
 	}
 	panic("unreachable")
 }
@@ -276,7 +766,7 @@ func (p *parser) value(it item, parentIsArray bool) (any, tomlType) {
 	case itemInlineTableStart:
 		return p.valueInlineTable(it, parentIsArray)
 	default:
-		p.bug("Unexpected value type: %s", it.typ)
+		p.panicItemf(it, "expected a value but got %s", it.typ)
 	}
 	panic("unreachable")
 }
@@ -297,14 +787,53 @@ func (p *parser) valueInteger(it item) (any, tomlType) {
 		// So mark the former as a bug but the latter as a legitimate user
 		// error.
 		if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange {
-			p.panicErr(it, errParseRange{i: it.val, size: "int64"})
+			// Positive numbers larger than the int64 range are stored as a
+			// uint64, so they can still be decoded in to uint64 fields. It's up
+			// to unify() to reject these for smaller types.
+			if it.val[0] == '-' {
+				p.panicErr(it, errParseRange{i: it.val, size: "int64"})
+			}
+			if unum, err := strconv.ParseUint(strings.TrimPrefix(it.val, "+"), 0, 64); err == nil {
+				p.recordFormat(it.val)
+				return unum, p.typeOfPrimitive(it)
+			}
+			p.panicErr(it, errParseRange{i: it.val, size: "uint64"})
 		} else {
 			p.bug("Expected integer value, but got '%s'.", it.val)
 		}
 	}
+	p.recordFormat(it.val)
 	return num, p.typeOfPrimitive(it)
 }
 
+// recordFormat records the base of integers written with a 0x, 0o, or 0b
+// prefix. Array elements are recorded with the index, e.g. "a.b[1][0]".
+func (p *parser) recordFormat(val string) {
+	if len(val) < 2 || val[0] != '0' {
+		return
+	}
+	var f Format
+	switch val[1] {
+	case 'x':
+		f.Base = 16
+	case 'o':
+		f.Base = 8
+	case 'b':
+		f.Base = 2
+	default:
+		return
+	}
+
+	k := p.context.add(p.currentKey).String()
+	for _, i := range p.elem {
+		k += "[" + strconv.Itoa(i) + "]"
+	}
+	if p.formats == nil {
+		p.formats = make(map[string]Format)
+	}
+	p.formats[k] = f
+}
+
 func (p *parser) valueFloat(it item) (any, tomlType) {
 	parts := strings.FieldsFunc(it.val, func(r rune) bool {
 		switch r {
@@ -354,14 +883,14 @@ var dtTypes = []struct {
 	next bool
 }{
 	{time.RFC3339Nano, time.Local, false},
-	{"2006-01-02T15:04:05.999999999", internal.LocalDatetime, false},
-	{"2006-01-02", internal.LocalDate, false},
-	{"15:04:05.999999999", internal.LocalTime, false},
+	{"2006-01-02T15:04:05.999999999", LocalDatetimeZone, false},
+	{"2006-01-02", LocalDateZone, false},
+	{"15:04:05.999999999", LocalTimeZone, false},
 
 	// tomlNext
 	{"2006-01-02T15:04Z07:00", time.Local, true},
-	{"2006-01-02T15:04", internal.LocalDatetime, true},
-	{"15:04", internal.LocalTime, true},
+	{"2006-01-02T15:04", LocalDatetimeZone, true},
+	{"15:04", LocalTimeZone, true},
 }
 
 func (p *parser) valueDatetime(it item) (any, tomlType) {
@@ -380,6 +909,12 @@ func (p *parser) valueDatetime(it item) (any, tomlType) {
 			if missingLeadingZero(it.val, dt.fmt) {
 				p.panicErr(it, errParseDate{it.val})
 			}
+			if dt.next {
+				p.lx.features = append(p.lx.features, Feature{Name: "datetime-no-seconds", Position: it.pos})
+			}
+			if p.noLocal && dt.zone != time.Local {
+				p.panicErr(it, errLocalDatetime{it.val})
+			}
 			ok = true
 			break
 		}
@@ -415,6 +950,7 @@ func (p *parser) valueArray(it item) (any, tomlType) {
 		// decodes into a non-nil slice inside something like struct { S
 		// []string }. See #338
 		array = make([]any, 0, 2)
+		pos   []Position
 	)
 	for it = p.next(); it.typ != itemArrayEnd; it = p.next() {
 		if it.typ == itemCommentStart {
@@ -422,8 +958,13 @@ func (p *parser) valueArray(it item) (any, tomlType) {
 			continue
 		}
 
+		p.elem = append(p.elem, len(array))
 		val, typ := p.value(it, true)
+		p.elem = p.elem[:len(p.elem)-1]
 		array = append(array, val)
+		if p.arrayPos != nil {
+			pos = append(pos, it.pos)
+		}
 
 		// XXX: type isn't used here, we need it to record the accurate type
 		// information.
@@ -432,6 +973,10 @@ func (p *parser) valueArray(it item) (any, tomlType) {
 		// "key[1]" notation, or maybe store it on the Array type?
 		_ = typ
 	}
+	p.rawEnd = it.pos.Start
+	if p.arrayPos != nil && len(array) > 0 {
+		p.arrayPos[&array[0]] = pos
+	}
 	return array, tomlArray
 }
 
@@ -440,7 +985,9 @@ func (p *parser) valueInlineTable(it item, parentIsArray bool) (any, tomlType) {
 		topHash      = make(map[string]any)
 		outerContext = p.context
 		outerKey     = p.currentKey
+		outerElem    = p.elem
 	)
+	p.elem = nil // Keys in inline tables don't have the index of the array.
 
 	p.context = append(p.context, p.currentKey)
 	prevContext := p.context
@@ -450,7 +997,7 @@ func (p *parser) valueInlineTable(it item, parentIsArray bool) (any, tomlType) {
 	p.addContext(p.context, parentIsArray)
 
 	/// Loop over all table key/value pairs.
-	for it := p.next(); it.typ != itemInlineTableEnd; it = p.next() {
+	for it = p.next(); it.typ != itemInlineTableEnd; it = p.next() {
 		if it.typ == itemCommentStart {
 			p.expect(itemText)
 			continue
@@ -462,23 +1009,29 @@ func (p *parser) valueInlineTable(it item, parentIsArray bool) (any, tomlType) {
 		for ; k.typ != itemKeyEnd && k.typ != itemEOF; k = p.next() {
 			key = append(key, p.keyString(k))
 		}
-		p.assertEqual(itemKeyEnd, k.typ)
+		p.assertEqual(itemKeyEnd, k)
+		if p.canon != nil {
+			key = p.canonical(p.context, key, it.pos)
+		}
 
 		/// The current key is the last part.
-		p.currentKey = key.last()
+		p.currentKey = key.Last()
 
 		/// All the other parts (if any) are the context; need to set each part
 		/// as implicit.
-		context := key.parent()
+		context := key.Parent()
 		for i := range context {
 			p.addImplicitContext(append(p.context, context[i:i+1]...))
 		}
-		p.ordered = append(p.ordered, p.context.add(p.currentKey))
+		if !p.noOrder {
+			p.ordered = append(p.ordered, p.context.add(p.currentKey))
+		}
 
 		/// Set the value.
-		val, typ := p.value(p.next(), false)
-		p.setValue(p.currentKey, val)
-		p.setType(p.currentKey, typ, it.pos)
+		vItem := p.next()
+		val, typ := p.value(vItem, false)
+		set := p.setValue(p.currentKey, val)
+		p.setType(p.currentKey, typ, vItem.pos)
 
 		hash := topHash
 		for _, c := range context {
@@ -493,12 +1046,18 @@ func (p *parser) valueInlineTable(it item, parentIsArray bool) (any, tomlType) {
 			}
 		}
 		hash[p.currentKey] = val
+		if p.raw != nil {
+			// The table in the mapping is the one that setValue() used,
+			// except in arrays, which have topHash.
+			p.setRaw(hash, p.currentKey, vItem)
+			p.setRaw(set, p.currentKey, vItem)
+		}
 
 		/// Restore context.
 		p.context = prevContext
 	}
-	p.context = outerContext
-	p.currentKey = outerKey
+	p.rawEnd = it.pos.Start
+	p.context, p.currentKey, p.elem = outerContext, outerKey, outerElem
 	return topHash, tomlHash
 }
 
@@ -559,7 +1118,7 @@ func (p *parser) addContext(key Key, array bool) {
 	keyContext := make(Key, 0, len(key)-1)
 
 	/// We only need implicit hashes for the parents.
-	for _, k := range key.parent() {
+	for _, k := range key.Parent() {
 		_, ok := hashContext[k]
 		keyContext = append(keyContext, k)
 
@@ -580,6 +1139,9 @@ func (p *parser) addContext(key Key, array bool) {
 		case map[string]any:
 			hashContext = t
 		default:
+			if p.defining != "" {
+				p.panicConflict(key, keyContext, t)
+			}
 			p.panicf("Key '%s' was already created as a hash.", keyContext)
 		}
 	}
@@ -588,7 +1150,7 @@ func (p *parser) addContext(key Key, array bool) {
 	if array {
 		// If this is the first element for this array, then allocate a new
 		// list of tables for it.
-		k := key.last()
+		k := key.Last()
 		if _, ok := hashContext[k]; !ok {
 			hashContext[k] = make([]map[string]any, 0, 4)
 		}
@@ -598,18 +1160,18 @@ func (p *parser) addContext(key Key, array bool) {
 		if hash, ok := hashContext[k].([]map[string]any); ok {
 			hashContext[k] = append(hash, make(map[string]any))
 		} else {
-			p.panicf("Key '%s' was already created and cannot be used as an array.", key)
+			p.panicConflict(key, key, hashContext[k])
 		}
 	} else {
-		p.setValue(key.last(), make(map[string]any))
+		p.setValue(key.Last(), make(map[string]any))
 	}
-	p.context = append(p.context, key.last())
+	p.context = append(p.context, key.Last())
 }
 
-// setValue sets the given key to the given value in the current context.
-// It will make sure that the key hasn't already been defined, account for
-// implicit key groups.
-func (p *parser) setValue(key string, value any) {
+// setValue sets the key in the current context to value, and returns the table
+// it was set in. It will make sure that the key hasn't already been defined,
+// account for implicit key groups.
+func (p *parser) setValue(key string, value any) map[string]any {
 	var (
 		tmpHash    any
 		ok         bool
@@ -647,18 +1209,112 @@ func (p *parser) setValue(key string, value any) {
 		if p.isArray(keyContext) {
 			p.removeImplicit(keyContext)
 			hash[key] = value
-			return
+			return hash
 		}
 		if p.isImplicit(keyContext) {
 			p.removeImplicit(keyContext)
-			return
+			return hash
 		}
 		// Otherwise, we have a concrete key trying to override a previous key,
 		// which is *always* wrong.
-		p.panicf("Key '%s' has already been defined.", keyContext)
+		p.panicConflict(keyContext, keyContext, hash[key])
 	}
 
 	hash[key] = value
+	return hash
+}
+
+// canonical replaces every part of key in the table ctx with the spelling it was
+// first used with, ignoring case, and adds a warning for every new spelling.
+func (p *parser) canonical(ctx, key Key, pos Position) Key {
+	full := make(Key, 0, len(ctx)+len(key))
+	full = append(append(full, ctx...), key...)
+	for i := len(ctx); i < len(full); i++ {
+		fold := strings.ToLower(full[:i+1].String())
+		c, ok := p.canon[fold]
+		if !ok {
+			p.canon[fold] = full[i]
+			continue
+		}
+		if c == full[i] {
+			continue
+		}
+
+		alias := make(Key, i+1)
+		copy(alias, full[:i+1])
+		full[i] = c
+		k := full[:i+1].String()
+		if p.aliases == nil {
+			p.aliases = make(map[string][]Key)
+		}
+		seen := false
+		for _, a := range p.aliases[k] {
+			seen = seen || a.String() == alias.String()
+		}
+		if seen {
+			continue
+		}
+		p.aliases[k] = append(p.aliases[k], alias)
+		p.warnings = append(p.warnings, Warning{Key: alias, Position: pos.withCol(p.lx.input),
+			Message: fmt.Sprintf("%q is the same key as %q, which is used instead as it was written first", alias, k)})
+	}
+	return full[len(ctx):]
+}
+
+// setRaw records the source text of the value for key in hash, which starts
+// with the item it.
+func (p *parser) setRaw(hash map[string]any, key string, it item) {
+	start, end := it.pos.Start, it.pos.Start+len(it.val)
+	switch it.typ {
+	case itemString, itemStringEsc, itemRawString:
+		start, end = start-1, end+1
+	case itemMultilineString, itemRawMultilineString:
+		start, end = start-3, end+3
+	case itemArray, itemInlineTableStart:
+		start, end = start-1, p.rawEnd
+	}
+	p.raw[rawKey{reflect.ValueOf(hash).Pointer(), key}] = p.lx.input[start:end]
+}
+
+// panicConflict panics with an error for defining key as a table, array of
+// tables, or value when the key prev was already defined as the existing value.
+// The error says what both are if they're a different kind of thing, as that's
+// an easy mistake to make.
+func (p *parser) panicConflict(key, prev Key, existing any) {
+	def := p.defining
+	if def == "" {
+		def = "value"
+	}
+	was := p.definedAs(prev, existing)
+	if was == def {
+		p.panicf("Key '%s' has already been defined.", prev)
+	}
+	err := errKeyConflict{key: key, def: def, prev: prev, was: was, line: p.keyInfo[prev.String()].pos.Line}
+	panic(ParseError{
+		Message:  err.Error(),
+		err:      err,
+		Position: p.pos.withCol(p.lx.input),
+		Line:     p.pos.Line,
+		LastKey:  p.current(),
+	})
+}
+
+// definedAs describes how the key k with the value v was defined: "table",
+// "array of tables", or "value".
+func (p *parser) definedAs(k Key, v any) string {
+	switch v.(type) {
+	case []map[string]any:
+		return "array of tables"
+	case map[string]any:
+		// Inline tables are a value; the position is just after the opening
+		// "{". There is no keyInfo for implicit tables.
+		ki, ok := p.keyInfo[k.String()]
+		if ok && ki.pos.Start > 0 && ki.pos.Start <= len(p.lx.input) && p.lx.input[ki.pos.Start-1] == '{' {
+			return "value"
+		}
+		return "table"
+	}
+	return "value"
 }
 
 // setType sets the type of a particular value at a given key. It should be
@@ -678,7 +1334,16 @@ func (p *parser) setType(key string, typ tomlType, pos Position) {
 	if len(keyContext) == 0 {
 		keyContext = Key{""}
 	}
-	p.keyInfo[keyContext.String()] = keyInfo{tomlType: typ, pos: pos}
+	k := keyContext.String()
+	p.keyInfo[k] = keyInfo{tomlType: typ, pos: pos}
+
+	// Keys in an array of tables are also recorded for the table they're in,
+	// since the above only has the last one.
+	if p.indexed && typ != tomlArrayHash {
+		if ik := p.indexedKey(keyContext); ik != k {
+			p.keyInfo[ik] = keyInfo{tomlType: typ, pos: pos}
+		}
+	}
 }
 
 // Implicit keys need to be created when tables are implied in "a.b.c.d = 1" and
@@ -689,6 +1354,33 @@ func (p *parser) isImplicit(key Key) bool    { _, ok := p.implicits[key.String()
 func (p *parser) isArray(key Key) bool       { return p.keyInfo[key.String()].tomlType == tomlArray }
 func (p *parser) addImplicitContext(key Key) { p.addImplicit(key); p.addContext(key, false) }
 
+// indexedKey returns the key with the index of the last element added for every
+// array of tables in the key, for example "servers[2].hosts[0]".
+//
+// This is used for comments, and to record the position of every [[..]] and the
+// keys in it in keyInfo if indexed is set; "[" is never valid in a bare key, so
+// this can't conflict with any other key.
+func (p *parser) indexedKey(key Key) string {
+	var (
+		b    []byte
+		hash = p.mapping
+	)
+	for i, k := range key {
+		if i > 0 {
+			b = append(b, '.')
+		}
+		b = append(b, key.maybeQuoted(i)...)
+		switch t := hash[k].(type) {
+		case []map[string]any:
+			b = append(strconv.AppendInt(append(b, '['), int64(len(t)-1), 10), ']')
+			hash = t[len(t)-1]
+		case map[string]any:
+			hash = t
+		}
+	}
+	return string(b)
+}
+
 // current returns the full key name of the current context.
 func (p *parser) current() string {
 	if len(p.currentKey) == 0 {
@@ -778,13 +1470,20 @@ func (p *parser) replaceEscapes(it item, str string) string {
 			continue
 		}
 
-		if i >= len(str) {
-			p.bug("Escape sequence at end of string.")
-			return ""
+		// The lexer should reject all invalid escapes, but don't rely on that:
+		// a bad escape here is an error rather than a panic.
+		if i+1 >= len(str) {
+			p.panicItemf(it, "invalid escape at end of string")
+		}
+		hex := func(n int) string {
+			if i+2+n > len(str) {
+				p.panicItemf(it, "invalid escape: '%s' needs %d hex digits", str[i:i+2], n)
+			}
+			return str[i+2 : i+2+n]
 		}
 		switch str[i+1] {
 		default:
-			p.bug("Expected valid escape code after \\, but got %q.", str[i+1])
+			p.panicItemf(it, "invalid escape: '\\%c'", str[i+1])
 		case ' ', '\t':
 			p.panicItemf(it, "invalid escape: '\\%c'", str[i+1])
 		case 'b':
@@ -803,30 +1502,30 @@ func (p *parser) replaceEscapes(it item, str string) string {
 			b.WriteByte(0x0d)
 			skip = 1
 		case 'e':
-			if p.tomlNext {
-				b.WriteByte(0x1b)
-				skip = 1
+			if !p.tomlNext {
+				p.panicItemf(it, "invalid escape: '\\%c'", str[i+1])
 			}
+			b.WriteByte(0x1b)
+			skip = 1
 		case '"':
 			b.WriteByte(0x22)
 			skip = 1
 		case '\\':
 			b.WriteByte(0x5c)
 			skip = 1
-		// The lexer guarantees the correct number of characters are present;
-		// don't need to check here.
 		case 'x':
-			if p.tomlNext {
-				escaped := p.asciiEscapeToUnicode(it, str[i+2:i+4])
-				b.WriteRune(escaped)
-				skip = 3
+			if !p.tomlNext {
+				p.panicItemf(it, "invalid escape: '\\%c'", str[i+1])
 			}
+			escaped := p.asciiEscapeToUnicode(it, hex(2))
+			b.WriteRune(escaped)
+			skip = 3
 		case 'u':
-			escaped := p.asciiEscapeToUnicode(it, str[i+2:i+6])
+			escaped := p.asciiEscapeToUnicode(it, hex(4))
 			b.WriteRune(escaped)
 			skip = 5
 		case 'U':
-			escaped := p.asciiEscapeToUnicode(it, str[i+2:i+10])
+			escaped := p.asciiEscapeToUnicode(it, hex(8))
 			b.WriteRune(escaped)
 			skip = 9
 		}
@@ -837,7 +1536,7 @@ func (p *parser) replaceEscapes(it item, str string) string {
 func (p *parser) asciiEscapeToUnicode(it item, s string) rune {
 	hex, err := strconv.ParseUint(strings.ToLower(s), 16, 32)
 	if err != nil {
-		p.bug("Could not parse '%s' as a hexadecimal number, but the lexer claims it's OK: %s", s, err)
+		p.panicItemf(it, "invalid escape: '%s' is not a hexadecimal number", s)
 	}
 	if !utf8.ValidRune(rune(hex)) {
 		p.panicItemf(it, "Escaped character '\\u%s' is not valid UTF-8.", s)
@@ -0,0 +1,81 @@
+package toml
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// RawMessage is the source text of a TOML value, such as `{ a = 1, b = 2 }` or
+// `"str"`. It can be used to decode a value later, to pass it through
+// unchanged, or to hash it.
+//
+// Decoding in to a RawMessage copies the value from the document exactly as
+// written, including whitespace and comments in arrays and inline tables,
+// without decoding it. This only works for the value of a key: tables defined
+// with a [header] or dotted keys, and array elements, are an error. It also
+// doesn't work with [Decoder.DecodeTables].
+//
+// Encoding a RawMessage writes it as-is, after checking that it's a valid TOML
+// value.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// MarshalTOML returns m as the TOML value, or an error if it's not a single
+// valid TOML value.
+func (m RawMessage) MarshalTOML() ([]byte, error) {
+	p, err := parse(strings.NewReader("v = "+string(m)), DecodeProfile{}, true)
+	if err != nil {
+		return nil, fmt.Errorf("toml: invalid RawMessage %q: %w", m, err)
+	}
+	if len(p.mapping) != 1 {
+		return nil, fmt.Errorf("toml: invalid RawMessage %q: not a single value", m)
+	}
+	return m, nil
+}
+
+// rawKey is the key of a value in the table with the given address.
+type rawKey struct {
+	table uintptr
+	key   string
+}
+
+// unifyRaw sets rv to the source text of the value for key in tmap.
+func (md *MetaData) unifyRaw(tmap map[string]any, key string, rv reflect.Value) error {
+	if md.raw == nil {
+		return md.e("RawMessage can't be used with DecodeTables")
+	}
+	s, ok := md.raw[rawKey{reflect.ValueOf(tmap).Pointer(), key}]
+	if !ok {
+		return md.e("RawMessage can only be used for a value written as key = value, not for a table")
+	}
+	rv.SetBytes([]byte(s))
+	return nil
+}
+
+// hasRawMessage reports if rt has a RawMessage anywhere in it, or a Primitive
+// that can be decoded in to one later.
+func hasRawMessage(rt reflect.Type, seen map[reflect.Type]bool) bool {
+	if rt == rawMessageType || rt == primitiveType {
+		return true
+	}
+	switch rt.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return hasRawMessage(rt.Elem(), seen)
+	case reflect.Struct:
+		if seen[rt] {
+			return false
+		}
+		if seen == nil {
+			seen = make(map[reflect.Type]bool)
+		}
+		seen[rt] = true
+		for i := 0; i < rt.NumField(); i++ {
+			if hasRawMessage(rt.Field(i).Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package toml_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestRawMessage(t *testing.T) {
+	type server struct {
+		Name   string
+		Config toml.RawMessage
+	}
+	type config struct {
+		Inline  toml.RawMessage
+		Array   toml.RawMessage
+		Str     toml.RawMessage
+		Multi   toml.RawMessage
+		Num     toml.RawMessage
+		Date    toml.RawMessage
+		Ptr     *toml.RawMessage
+		Map     map[string]toml.RawMessage
+		Servers []server
+	}
+
+	in := `inline = { a = 1,   b = [1, 2] ,c = "x" }  # comment
+array = [
+	1,   # one
+	2,
+	# three
+	3,
+]
+str = "a\tb"
+multi = '''
+line'''
+num = 1_000
+date = 1979-05-27T07:32:00Z
+ptr = [[1], {x = 1}]
+
+[map]
+a = { b = 1 }
+c = 'lit'
+
+[[servers]]
+name = "one"
+config = {port = 1}
+
+[[servers]]
+name = "two"
+config = {port = 2}
+`
+	var c config
+	_, err := toml.Decode(in, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		have toml.RawMessage
+		want string
+	}{
+		{c.Inline, `{ a = 1,   b = [1, 2] ,c = "x" }`},
+		{c.Array, "[\n\t1,   # one\n\t2,\n\t# three\n\t3,\n]"},
+		{c.Str, `"a\tb"`},
+		{c.Multi, "'''\nline'''"},
+		{c.Num, `1_000`},
+		{c.Date, `1979-05-27T07:32:00Z`},
+		{*c.Ptr, `[[1], {x = 1}]`},
+		{c.Map["a"], `{ b = 1 }`},
+		{c.Map["c"], `'lit'`},
+		{c.Servers[0].Config, `{port = 1}`},
+		{c.Servers[1].Config, `{port = 2}`},
+	}
+	for _, tt := range tests {
+		if string(tt.have) != tt.want {
+			t.Errorf("\nhave: %s\nwant: %s", tt.have, tt.want)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err = toml.NewEncoder(buf).Encode(struct {
+		Inline toml.RawMessage `toml:"inline"`
+		Array  toml.RawMessage `toml:"array"`
+	}{c.Inline, c.Array})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "inline = { a = 1,   b = [1, 2] ,c = \"x\" }\narray = [\n\t1,   # one\n\t2,\n\t# three\n\t3,\n]\n"
+	if buf.String() != want {
+		t.Errorf("\nhave:\n%s\nwant:\n%s", buf, want)
+	}
+
+	var again config
+	if _, err := toml.Decode(buf.String(), &again); err != nil {
+		t.Fatal(err)
+	}
+	if string(again.Inline) != string(c.Inline) || string(again.Array) != string(c.Array) {
+		t.Errorf("not the same after encoding:\n%s\n%s", again.Inline, again.Array)
+	}
+}
+
+func TestRawMessageInline(t *testing.T) {
+	in := "e = {y = 1, z = { a = 'x' }}\narr = [{y = [1, 2]}]\n"
+
+	var s struct {
+		E struct {
+			Y toml.RawMessage
+			Z struct{ A toml.RawMessage }
+		}
+		Arr []struct{ Y toml.RawMessage }
+	}
+	if _, err := toml.Decode(in, &s); err != nil {
+		t.Fatal(err)
+	}
+	if string(s.E.Y) != "1" || string(s.E.Z.A) != "'x'" || string(s.Arr[0].Y) != "[1, 2]" {
+		t.Errorf("wrong values: %q %q %q", s.E.Y, s.E.Z.A, s.Arr[0].Y)
+	}
+
+	var m map[string]map[string]toml.RawMessage
+	if _, err := toml.Decode(in[:strings.IndexByte(in, '\n')], &m); err != nil {
+		t.Fatal(err)
+	}
+	if string(m["e"]["y"]) != "1" || string(m["e"]["z"]) != "{ a = 'x' }" {
+		t.Errorf("wrong values: %q", m)
+	}
+}
+
+func TestRawMessageError(t *testing.T) {
+	t.Run("decode", func(t *testing.T) {
+		tests := []struct {
+			in   string
+			dst  any
+			want string
+		}{
+			{"[tbl]\na = 1", &struct{ Tbl toml.RawMessage }{}, "not for a table"},
+			{"tbl.a = 1", &struct{ Tbl toml.RawMessage }{}, "not for a table"},
+			{"arr = [1, 2]", &struct{ Arr []toml.RawMessage }{}, "not for array elements"},
+		}
+		for _, tt := range tests {
+			t.Run("", func(t *testing.T) {
+				_, err := toml.Decode(tt.in, tt.dst)
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("wrong error\nhave: %v\nwant: %s", err, tt.want)
+				}
+			})
+		}
+	})
+
+	t.Run("encode", func(t *testing.T) {
+		for _, raw := range []string{``, `{a = `, `1 2`, "1\nb = 2", "{}\n[tbl]"} {
+			err := toml.NewEncoder(new(bytes.Buffer)).Encode(map[string]any{"k": toml.RawMessage(raw)})
+			if err == nil || !strings.Contains(err.Error(), "invalid RawMessage") {
+				t.Errorf("%q: wrong error: %v", raw, err)
+			}
+		}
+	})
+}
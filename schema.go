@@ -0,0 +1,245 @@
+package toml
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Schema describes the keys and types of a TOML document or table, for
+// [Validate].
+//
+// A Schema can be written as TOML and loaded with [ParseSchema]:
+//
+//	type = "Hash"
+//	[keys.name]
+//	type     = "String"
+//	required = true
+//	[keys.ports]
+//	type = "Array"
+//	elem = {type = "Integer"}
+//	[keys.servers]
+//	type = "Hash"
+//	[keys.servers.keys."*"]  # Any key in [servers].
+//	type       = "Hash"
+//	additional = true
+type Schema struct {
+	// TOML type, as returned by [MetaData.Type]: "String", "Integer",
+	// "Float", "Bool", "Datetime", "Array", "Hash", or "ArrayHash". Empty
+	// allows any type.
+	//
+	// Tables and inline tables are a "Hash", and arrays of tables ([[..]]) are
+	// an "ArrayHash". An array of inline tables is an "Array" with an Elem of
+	// type "Hash".
+	Type string `toml:"type"`
+
+	// Key must be present in the parent table.
+	Required bool `toml:"required"`
+
+	// Schema for every element of an "Array", or for every table of an
+	// "ArrayHash".
+	Elem *Schema `toml:"elem"`
+
+	// Keys in a "Hash". The key "*" matches all keys that aren't listed, so
+	// it can be used for tables with any name.
+	Keys map[string]*Schema `toml:"keys"`
+
+	// Allow keys in a "Hash" that aren't in Keys. Additional keys aren't
+	// validated.
+	Additional bool `toml:"additional"`
+}
+
+// SchemaError is a violation of a [Schema]; see [Validate].
+type SchemaError struct {
+	Key      Key      // Key the error is for.
+	Position Position // Position of the key, or of the table for missing keys.
+	Message  string
+}
+
+func (e SchemaError) Error() string {
+	if e.Position.Line == 0 {
+		return fmt.Sprintf("toml: key %q: %s", e.Key, e.Message)
+	}
+	return fmt.Sprintf("toml: line %d (key %q): %s", e.Position.Line, e.Key, e.Message)
+}
+
+var schemaTypes = map[string]bool{"": true, "String": true, "Integer": true,
+	"Float": true, "Bool": true, "Datetime": true, "Array": true, "Hash": true,
+	"ArrayHash": true}
+
+// ParseSchema loads a [Schema] from a TOML document.
+//
+// Unknown keys and types are an error.
+func ParseSchema(data []byte) (Schema, error) {
+	var s Schema
+	_, err := NewDecoder(bytes.NewReader(data)).DisallowUnknownFields(true).Decode(&s)
+	if err != nil {
+		return s, err
+	}
+	return s, s.check(nil)
+}
+
+// check makes sure that all types are valid.
+func (s *Schema) check(key Key) error {
+	if !schemaTypes[s.Type] {
+		return fmt.Errorf("toml: schema for %q: unknown type %q", key, s.Type)
+	}
+	if s.Elem != nil {
+		if err := s.Elem.check(key); err != nil {
+			return err
+		}
+	}
+	for k, sub := range s.Keys {
+		if sub == nil {
+			continue
+		}
+		if err := sub.check(append(key[:len(key):len(key)], k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that the TOML document in data matches the schema, without
+// decoding it to any Go value.
+//
+// All violations are returned as a [SchemaError], in the order they appear in
+// the document. If data isn't valid TOML the only error is the [ParseError].
+func Validate(data []byte, schema Schema) []error {
+	if err := schema.check(nil); err != nil {
+		return []error{err}
+	}
+
+	_, tomlNext := os.LookupEnv("BURNTSUSHI_TOML_110")
+	p, err := parseStream(bytes.NewReader(data), DecodeProfile{}, tomlNext, false, true, false, nil)
+	if err != nil {
+		return []error{err}
+	}
+
+	v := validator{p: p}
+	v.value(nil, p.mapping, &schema, Position{})
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		return v.errs[i].(SchemaError).Position.Start < v.errs[j].(SchemaError).Position.Start
+	})
+	return v.errs
+}
+
+type validator struct {
+	p     *parser
+	errs  []error
+	elems []elemIndex // Tables in arrays of tables in the key being validated.
+}
+
+func (v *validator) errorf(key Key, pos Position, format string, args ...any) {
+	v.errs = append(v.errs, SchemaError{
+		Key:      key,
+		Position: pos.withCol(v.p.lx.input),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// pos gets the position of key in the tables of arrays of tables that are
+// being validated, or def if the key has no position (such as array elements).
+func (v *validator) pos(key Key, def Position) Position {
+	if ki, ok := v.p.keyInfo[indexKey(key, v.elems)]; ok {
+		return ki.pos
+	}
+	return def
+}
+
+func (v *validator) value(key Key, val any, s *Schema, pos Position) {
+	typ := schemaTypeOf(val)
+	if s.Type != "" && s.Type != typ {
+		v.errorf(key, pos, "expected type %s, but got %s", s.Type, typ)
+		return
+	}
+
+	switch val := val.(type) {
+	case map[string]any:
+		v.table(key, val, s, pos)
+	case []map[string]any:
+		if s.Elem != nil {
+			v.elems = append(v.elems, elemIndex{depth: len(key)})
+			for i, tbl := range val {
+				v.elems[len(v.elems)-1].i = i
+				v.value(key, tbl, s.Elem, v.pos(key, pos))
+			}
+			v.elems = v.elems[:len(v.elems)-1]
+		}
+	case []any:
+		if s.Elem != nil {
+			for _, e := range val {
+				v.value(key, e, s.Elem, pos)
+			}
+		}
+	}
+}
+
+func (v *validator) table(key Key, tbl map[string]any, s *Schema, pos Position) {
+	keys := make([]string, 0, len(tbl))
+	for k := range tbl {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		sub, ok := s.Keys[k]
+		if !ok {
+			sub, ok = s.Keys["*"]
+		}
+		kk := append(key[:len(key):len(key)], k)
+		kpos := v.pos(kk, pos)
+		if !ok || sub == nil {
+			if !s.Additional {
+				v.errorf(kk, kpos, "key not allowed in %s", tableName(key))
+			}
+			continue
+		}
+		v.value(kk, tbl[k], sub, kpos)
+	}
+
+	missing := make([]string, 0, len(s.Keys))
+	for k, sub := range s.Keys {
+		if _, ok := tbl[k]; !ok && k != "*" && sub != nil && sub.Required {
+			missing = append(missing, k)
+		}
+	}
+	sort.Strings(missing)
+	for _, k := range missing {
+		v.errorf(append(key[:len(key):len(key)], k), pos, "required key missing from %s", tableName(key))
+	}
+}
+
+func tableName(key Key) string {
+	if len(key) == 0 {
+		return "the document"
+	}
+	return "[" + key.String() + "]"
+}
+
+// schemaTypeOf gets the TOML type of a parsed value, in the same format as
+// MetaData.Type().
+func schemaTypeOf(v any) string {
+	switch v.(type) {
+	case string:
+		return tomlString.typeString()
+	case int64:
+		return tomlInteger.typeString()
+	case float64:
+		return tomlFloat.typeString()
+	case bool:
+		return tomlBool.typeString()
+	case time.Time:
+		return tomlDatetime.typeString()
+	case []any:
+		return tomlArray.typeString()
+	case map[string]any:
+		return tomlHash.typeString()
+	case []map[string]any:
+		return tomlArrayHash.typeString()
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", v), "*")
+}
@@ -0,0 +1,152 @@
+package toml_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestValidate(t *testing.T) {
+	schema, err := toml.ParseSchema([]byte(`
+type = "Hash"
+
+[keys.name]
+type     = "String"
+required = true
+
+[keys.ports]
+type = "Array"
+elem = {type = "Integer"}
+
+[keys.servers]
+type     = "Hash"
+required = true
+[keys.servers.keys."*"]
+type = "Hash"
+[keys.servers.keys."*".keys.ip]
+type     = "String"
+required = true
+[keys.servers.keys."*".keys.tags]
+type = "Hash"
+keys."*" = {type = "String"}
+
+[keys.users]
+type = "ArrayHash"
+[keys.users.elem]
+type       = "Hash"
+additional = true
+keys.name  = {type = "String", required = true}
+
+[keys.extra]
+type       = "Hash"
+additional = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`
+name  = "n"
+ports = [1, 2]
+[servers.alpha]
+ip   = "10.0.0.1"
+tags = {env = "prod"}
+[servers.beta]
+ip   = "10.0.0.2"
+[[users]]
+name  = "a"
+admin = true
+[extra]
+anything = [1, "x"]
+`, nil},
+
+		{`
+ports = [1, "2"]
+typo  = 1
+[servers.alpha]
+ip   = 1
+tags = {env = 1}
+[servers.beta]
+port = 80
+[[users]]
+admin = true
+`, []string{
+			`toml: key "name": required key missing from the document`,
+			`toml: line 2 (key "ports"): expected type Integer, but got String`,
+			`toml: line 3 (key "typo"): key not allowed in the document`,
+			`toml: line 5 (key "servers.alpha.ip"): expected type String, but got Integer`,
+			`toml: line 6 (key "servers.alpha.tags.env"): expected type String, but got Integer`,
+			`toml: line 7 (key "servers.beta.ip"): required key missing from [servers.beta]`,
+			`toml: line 8 (key "servers.beta.port"): key not allowed in [servers.beta]`,
+			`toml: line 9 (key "users.name"): required key missing from [users]`,
+		}},
+
+		{`
+name    = "n"
+servers = 1
+`, []string{
+			`toml: line 3 (key "servers"): expected type Hash, but got Integer`,
+		}},
+
+		{`
+name    = "n"
+servers = {}
+[[users]]
+name = 1
+[[users]]
+name = "b"
+[[users]]
+admin = true
+[[users]]
+name = 2
+`, []string{
+			`toml: line 5 (key "users.name"): expected type String, but got Integer`,
+			`toml: line 8 (key "users.name"): required key missing from [users]`,
+			`toml: line 11 (key "users.name"): expected type String, but got Integer`,
+		}},
+
+		{"name = \n", []string{
+			`toml: line 1 (last key "name"): expected value but found '\n' instead`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			errs := toml.Validate([]byte(tt.in), schema)
+			var have []string
+			for _, err := range errs {
+				have = append(have, err.Error())
+			}
+			if strings.Join(have, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("\nhave:\n%s\nwant:\n%s", strings.Join(have, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		errs := toml.Validate([]byte("a = 1\nb = 2"), toml.Schema{Type: "Hash", Keys: map[string]*toml.Schema{"a": {Type: "String"}}})
+		if len(errs) != 2 {
+			t.Fatalf("%d errors: %v", len(errs), errs)
+		}
+		var sErr toml.SchemaError
+		if !errors.As(errs[1], &sErr) {
+			t.Fatalf("not a SchemaError: %#v", errs[1])
+		}
+		if sErr.Key.String() != "b" || sErr.Position.Line != 2 || sErr.Position.Col != 5 {
+			t.Errorf("%#v", sErr)
+		}
+	})
+
+	t.Run("bad schema", func(t *testing.T) {
+		for _, s := range []string{"type = \"Int\"", "[keys.a]\nelem = {type = 'x'}", "typo = 1"} {
+			if _, err := toml.ParseSchema([]byte(s)); err == nil {
+				t.Errorf("no error for %q", s)
+			}
+		}
+	})
+}
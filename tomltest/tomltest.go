@@ -0,0 +1,160 @@
+// Package tomltest provides helpers for testing types that are encoded and
+// decoded with the toml package.
+//
+// This is mostly useful for types that implement toml.Marshaler,
+// toml.Unmarshaler, or the encoding.TextMarshaler and encoding.TextUnmarshaler
+// interfaces, where it's easy to make a mistake that causes a value to not
+// survive a round trip:
+//
+//	func TestDuration(t *testing.T) {
+//		tomltest.RoundTripValue(t, struct{ D myDuration }{myDuration(time.Hour)})
+//		tomltest.RoundTripDocument(t, "d = \"1h0m0s\"\n", new(struct{ D myDuration }),
+//			tomltest.Identical())
+//	}
+package tomltest
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/BurntSushi/toml/internal"
+)
+
+// Option modifies the behaviour of [RoundTripValue] and [RoundTripDocument].
+type Option func(*options)
+
+type options struct {
+	identical bool
+}
+
+// Identical also requires the encoded TOML to be byte-identical.
+//
+// For [RoundTripValue] this means that encoding the decoded value must produce
+// the same output as encoding the original value. For [RoundTripDocument] this
+// means that encoding the decoded value must produce the original document.
+//
+// The decoded value is encoded with the [toml.MetaData] from decoding it (see
+// [toml.Encoder.MetaData]), so that things like the key order, dotted keys, and
+// the formatting of numbers and strings are kept.
+func Identical() Option { return func(o *options) { o.identical = true } }
+
+func getOptions(opts []Option) options {
+	var o options
+	for _, f := range opts {
+		f(&o)
+	}
+	return o
+}
+
+// RoundTripValue asserts that v can be encoded to TOML, and that decoding the
+// result in to a new value of the same type produces a value equal to v.
+//
+// Values are compared with [DeepEqual].
+func RoundTripValue(t testing.TB, v any, opts ...Option) {
+	t.Helper()
+	o := getOptions(opts)
+
+	enc, err := toml.Marshal(v)
+	if err != nil {
+		t.Fatalf("tomltest.RoundTripValue: encoding %T: %s", v, err)
+		return
+	}
+
+	have := reflect.New(reflect.TypeOf(v))
+	meta, err := toml.Decode(string(enc), have.Interface())
+	if err != nil {
+		t.Fatalf("tomltest.RoundTripValue: decoding %T: %s\n\nTOML:\n%s", v, err, indent(enc))
+		return
+	}
+
+	if !DeepEqual(v, have.Elem().Interface()) {
+		t.Errorf("tomltest.RoundTripValue: value changed after round trip\n\nhave: %#v\nwant: %#v\n\nTOML:\n%s",
+			have.Elem().Interface(), v, indent(enc))
+		return
+	}
+
+	if o.identical {
+		enc2, err := encodeMeta(have.Elem().Interface(), &meta)
+		if err != nil {
+			t.Fatalf("tomltest.RoundTripValue: encoding decoded %T: %s", v, err)
+			return
+		}
+		if !bytes.Equal(enc, enc2) {
+			t.Errorf("tomltest.RoundTripValue: TOML output changed after round trip\n\nhave:\n%s\nwant:\n%s",
+				indent(enc2), indent(enc))
+		}
+	}
+}
+
+// RoundTripDocument asserts that doc can be decoded in to target, and that
+// encoding target and decoding that output again produces an equal value.
+//
+// The target must be a pointer; it will contain the decoded doc after this
+// returns.
+func RoundTripDocument(t testing.TB, doc string, target any, opts ...Option) {
+	t.Helper()
+	o := getOptions(opts)
+
+	rt := reflect.TypeOf(target)
+	if rt == nil || rt.Kind() != reflect.Ptr {
+		t.Fatalf("tomltest.RoundTripDocument: target must be a pointer, not %T", target)
+		return
+	}
+
+	meta, err := toml.Decode(doc, target)
+	if err != nil {
+		t.Fatalf("tomltest.RoundTripDocument: decoding document: %s", err)
+		return
+	}
+
+	var md *toml.MetaData
+	if o.identical {
+		md = &meta
+	}
+	enc, err := encodeMeta(target, md)
+	if err != nil {
+		t.Fatalf("tomltest.RoundTripDocument: encoding %T: %s", target, err)
+		return
+	}
+
+	have := reflect.New(rt.Elem())
+	if _, err := toml.Decode(string(enc), have.Interface()); err != nil {
+		t.Fatalf("tomltest.RoundTripDocument: decoding encoded %T: %s\n\nTOML:\n%s", target, err, indent(enc))
+		return
+	}
+
+	if !DeepEqual(target, have.Interface()) {
+		t.Errorf("tomltest.RoundTripDocument: value changed after round trip\n\nhave: %#v\nwant: %#v\n\nTOML:\n%s",
+			have.Elem().Interface(), reflect.ValueOf(target).Elem().Interface(), indent(enc))
+		return
+	}
+
+	if o.identical && string(enc) != doc {
+		t.Errorf("tomltest.RoundTripDocument: TOML output is not identical to the document\n\nhave:\n%s\nwant:\n%s",
+			indent(enc), indent([]byte(doc)))
+	}
+}
+
+// DeepEqual is like reflect.DeepEqual, except that:
+//
+//   - NaN floats are considered equal to each other;
+//   - time.Time values are compared with time.Time.Equal;
+//   - nil and empty slices and maps are considered equal, as the TOML encoding
+//     of these is the same (or they are both omitted).
+//
+// This is the same comparison the toml-test runner uses.
+func DeepEqual(want, have any) bool { return internal.DeepEqual(want, have) }
+
+// encodeMeta is toml.Marshal, but with the given MetaData set on the encoder.
+func encodeMeta(v any, md *toml.MetaData) ([]byte, error) {
+	var buf bytes.Buffer
+	err := toml.NewEncoder(&buf).MetaData(md).Encode(v)
+	return buf.Bytes(), err
+}
+
+func indent(b []byte) string {
+	return "\t" + strings.ReplaceAll(strings.TrimRight(string(b), "\n"), "\n", "\n\t")
+}
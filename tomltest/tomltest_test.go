@@ -0,0 +1,147 @@
+package tomltest
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Record failures rather than failing the test.
+type fakeT struct {
+	testing.TB
+	failed bool
+	msg    string
+}
+
+func (t *fakeT) Helper() {}
+func (t *fakeT) Errorf(format string, args ...any) {
+	t.failed, t.msg = true, fmt.Sprintf(format, args...)
+}
+func (t *fakeT) Fatalf(format string, args ...any) {
+	t.failed, t.msg = true, fmt.Sprintf(format, args...)
+}
+
+type upper string
+
+func (u upper) MarshalText() ([]byte, error) { return []byte(strings.ToUpper(string(u))), nil }
+func (u *upper) UnmarshalText(text []byte) error {
+	*u = upper(strings.ToUpper(string(text)))
+	return nil
+}
+
+type lossy string
+
+func (l lossy) MarshalText() ([]byte, error)     { return []byte(l), nil }
+func (l *lossy) UnmarshalText(text []byte) error { *l = lossy(text) + "!"; return nil }
+
+func TestRoundTripValue(t *testing.T) {
+	tests := []struct {
+		in       any
+		opts     []Option
+		wantFail string
+	}{
+		{struct{ S string }{"a"}, nil, ""},
+		{struct{ F float64 }{math.NaN()}, nil, ""},
+		{struct{ T time.Time }{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}, []Option{Identical()}, ""},
+		{&struct{ I []int }{[]int{1, 2}}, []Option{Identical()}, ""},
+		{map[string]any{"a": int64(1), "b": []any{"x"}}, nil, ""},
+		{struct{ U upper }{"ASD"}, []Option{Identical()}, ""},
+
+		{struct{ U upper }{"asd"}, nil, "value changed after round trip"},
+		{struct{ L lossy }{"x"}, nil, "value changed after round trip"},
+		{struct{ C chan int }{make(chan int)}, nil, "encoding struct { C chan int }"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			ft := &fakeT{TB: t}
+			RoundTripValue(ft, tt.in, tt.opts...)
+			if tt.wantFail == "" && ft.failed {
+				t.Fatalf("failed: %s", ft.msg)
+			}
+			if tt.wantFail != "" && !strings.Contains(ft.msg, tt.wantFail) {
+				t.Fatalf("wrong failure\nhave: %q\nwant: %q", ft.msg, tt.wantFail)
+			}
+		})
+	}
+}
+
+func TestRoundTripDocument(t *testing.T) {
+	type doc struct {
+		A int
+		B []string
+		C struct{ D upper }
+	}
+
+	tests := []struct {
+		doc      string
+		target   any
+		opts     []Option
+		wantFail string
+	}{
+		{"A = 1\nB = [\"x\"]\n\n[C]\n  D = \"Q\"\n", new(doc), []Option{Identical()}, ""},
+		{"a = 1\nb = ['x']\nc.d = 'q'", new(doc), nil, ""},
+		{"a = 1\nb = ['x']\nc.d = 'q'", new(any), nil, ""},
+		{"a = 0x10\nb.c = 1\n", new(map[string]any), []Option{Identical()}, ""},
+
+		{"a = 1", new(doc), []Option{Identical()}, "not identical"},
+		{"a = 'x'", new(doc), nil, "decoding document"},
+		{"a = 1", doc{}, nil, "target must be a pointer"},
+		{"l = 'x'", new(struct{ L lossy }), nil, "value changed after round trip"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			ft := &fakeT{TB: t}
+			RoundTripDocument(ft, tt.doc, tt.target, tt.opts...)
+			if tt.wantFail == "" && ft.failed {
+				t.Fatalf("failed: %s", ft.msg)
+			}
+			if tt.wantFail != "" && !strings.Contains(ft.msg, tt.wantFail) {
+				t.Fatalf("wrong failure\nhave: %q\nwant: %q", ft.msg, tt.wantFail)
+			}
+		})
+	}
+}
+
+func TestDeepEqual(t *testing.T) {
+	var (
+		nan  = math.NaN()
+		tz   = time.FixedZone("", 0)
+		now  = time.Now()
+		ptr1 = new(int)
+		ptr2 = new(int)
+	)
+	tests := []struct {
+		a, b any
+		want bool
+	}{
+		{nil, nil, true},
+		{1, 1, true},
+		{1, int64(1), false},
+		{nan, nan, true},
+		{[]float64{nan}, []float64{nan}, true},
+		{now, now.In(tz), true},
+		{now.In(toml.LocalDatetimeZone), now.In(toml.LocalDatetimeZone), true},
+		{now.In(toml.LocalDatetimeZone), now.In(toml.LocalDateZone), false},
+		{struct{ t time.Time }{now}, struct{ t time.Time }{now}, true},
+		{ptr1, ptr2, true},
+		{[]int(nil), []int{}, true},
+		{map[string]int(nil), map[string]int{}, true},
+		{map[string]int{"a": 1}, map[string]int{"b": 1}, false},
+		{[]any{"a", 1}, []any{"a", 1}, true},
+		{[]any{"a", 1}, []any{"a", 2}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			if have := DeepEqual(tt.a, tt.b); have != tt.want {
+				t.Errorf("DeepEqual(%#v, %#v)\nhave: %t\nwant: %t", tt.a, tt.b, have, tt.want)
+			}
+		})
+	}
+}
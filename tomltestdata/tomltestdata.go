@@ -0,0 +1,135 @@
+// Package tomltestdata provides a set of valid TOML documents with their
+// expected values, for testing code that builds on the toml package.
+//
+// The documents are a subset of the [toml-test] corpus: the examples from the
+// TOML specification and some more documents for every TOML type. All of them
+// are valid TOML 1.0.
+//
+//	func TestDecode(t *testing.T) {
+//		tomltestdata.ForEachValid(func(name, tomlSrc string, want any) {
+//			t.Run(name, func(t *testing.T) {
+//				var have any
+//				if _, err := toml.Decode(tomlSrc, &have); err != nil {
+//					t.Fatal(err)
+//				}
+//				if !tomltest.DeepEqual(want, have) {
+//					t.Errorf("\nwant: %#v\nhave: %#v", want, have)
+//				}
+//			})
+//		})
+//	}
+//
+// # Stability
+//
+// Within a major version of the toml package documents are only added, never
+// changed or removed, so tests using them won't start failing after an update.
+//
+// [toml-test]: https://github.com/toml-lang/toml-test
+package tomltestdata
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml/internal/tag"
+)
+
+//go:embed valid
+var valid embed.FS
+
+// FS returns the documents as "name.toml", with the expected value in
+// "name.json" in the [toml-test JSON format]. Names may contain a directory,
+// such as "spec/table-0".
+//
+// [toml-test JSON format]: https://github.com/toml-lang/toml-test#json-encoding
+func FS() fs.FS {
+	f, err := fs.Sub(valid, "valid")
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// ForEachValid calls fn for every document, in alphabetical order of the name.
+//
+// The expected value want is what [toml.Decode] produces when decoding in to
+// an any: a map[string]any with int64, float64, string, bool, time.Time, []any,
+// and []map[string]any (for arrays of tables) values. Local datetimes, dates,
+// and times are in [toml.LocalDatetimeZone], [toml.LocalDateZone], and
+// [toml.LocalTimeZone].
+func ForEachValid(fn func(name, tomlSrc string, want any)) {
+	fsys := FS()
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && path.Ext(p) == ".toml" {
+			names = append(names, strings.TrimSuffix(p, ".toml"))
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		src, want, err := load(fsys, name)
+		if err != nil {
+			panic(fmt.Sprintf("tomltestdata: %s: %s", name, err))
+		}
+		fn(name, src, want)
+	}
+}
+
+func load(fsys fs.FS, name string) (string, any, error) {
+	src, err := fs.ReadFile(fsys, name+".toml")
+	if err != nil {
+		return "", nil, err
+	}
+	j, err := fs.ReadFile(fsys, name+".json")
+	if err != nil {
+		return "", nil, err
+	}
+	var tagged any
+	if err := json.Unmarshal(j, &tagged); err != nil {
+		return "", nil, err
+	}
+	want, err := tag.Remove(tagged)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(src), tableArrays(want), nil
+}
+
+// tableArrays converts arrays that contain only tables to []map[string]any,
+// like the decoder does for arrays of tables.
+//
+// The JSON doesn't distinguish between arrays of tables and arrays of inline
+// tables, so no document can have an array of inline tables.
+func tableArrays(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, vv := range v {
+			v[k] = tableArrays(vv)
+		}
+	case []any:
+		tables := make([]map[string]any, 0, len(v))
+		for i := range v {
+			v[i] = tableArrays(v[i])
+			if t, ok := v[i].(map[string]any); ok {
+				tables = append(tables, t)
+			}
+		}
+		if len(v) > 0 && len(tables) == len(v) {
+			return tables
+		}
+	}
+	return v
+}
@@ -0,0 +1,48 @@
+package tomltestdata
+
+import (
+	"io/fs"
+	"path"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/BurntSushi/toml/tomltest"
+)
+
+func TestForEachValid(t *testing.T) {
+	n := 0
+	ForEachValid(func(name, tomlSrc string, want any) {
+		n++
+		t.Run(name, func(t *testing.T) {
+			v, _, err := toml.DetectVersion([]byte(tomlSrc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != toml.Version10 {
+				t.Errorf("not a TOML 1.0 document: %s", v)
+			}
+
+			var have any
+			if _, err := toml.Decode(tomlSrc, &have); err != nil {
+				t.Fatal(err)
+			}
+			if !tomltest.DeepEqual(want, have) {
+				t.Errorf("\nwant: %#v\nhave: %#v", want, have)
+			}
+		})
+	})
+
+	var files int
+	err := fs.WalkDir(FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && path.Ext(p) == ".json" {
+			files++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || files != n {
+		t.Errorf("%d documents and %d JSON files", n, files)
+	}
+}
@@ -0,0 +1,208 @@
+package toml
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TraceEvent describes what happened to a single key while decoding; see
+// [Decoder.SetTrace].
+type TraceEvent struct {
+	Key      Key          // Key in the TOML document.
+	Position Position     // Position of the key in the TOML document.
+	Outcome  TraceOutcome // What was done with the key.
+
+	// Go destination the key was decoded in to, such as "main.Config.Name"
+	// for a struct field or `map[string]int["key"]` for a map entry. For
+	// TraceNoField this is the struct type.
+	Dest string
+
+	Err error // Error for TraceError and TraceUnexported.
+
+	// For TraceNoField, the TOML name and Go field of the field with the most
+	// similar name, if there is one.
+	Closest      string
+	ClosestField string
+}
+
+func (e TraceEvent) String() string {
+	var s string
+	switch e.Outcome {
+	case TraceNoField:
+		s = fmt.Sprintf("matched no field in %s", e.Dest)
+		if e.Closest != "" {
+			s += fmt.Sprintf(" (closest: %q on field %s)", e.Closest, e.ClosestField)
+		}
+	case TraceUnexported:
+		s = fmt.Sprintf("matched the unexported field %s", e.Dest)
+	case TraceError:
+		s = fmt.Sprintf("error decoding in to %s: %s", e.Dest, e.Err)
+	case TraceUnmarshaler:
+		s = fmt.Sprintf("decoded in to %s by its unmarshaler", e.Dest)
+	default:
+		s = fmt.Sprintf("decoded in to %s", e.Dest)
+	}
+	return fmt.Sprintf("line %d: key %q %s", e.Position.Line, e.Key, s)
+}
+
+// TraceOutcome is the outcome of a [TraceEvent].
+type TraceOutcome uint8
+
+const (
+	// TraceMatched is a key that was decoded in to a struct field or map.
+	TraceMatched TraceOutcome = iota + 1
+
+	// TraceNoField is a key that doesn't match any field of the struct; the
+	// value is ignored, or it's an error with Decoder.DisallowUnknownFields.
+	TraceNoField
+
+	// TraceUnexported is a key that only matches an unexported field; this is
+	// always an error.
+	TraceUnexported
+
+	// TraceError is a key that matched a field or map, but decoding the value
+	// failed, such as for a type mismatch. Only the innermost key is reported,
+	// not the tables it's in.
+	TraceError
+
+	// TraceUnmarshaler is a key that was decoded with an UnmarshalTOML or
+	// UnmarshalText method, or by a TypeAdapter.
+	TraceUnmarshaler
+)
+
+func (o TraceOutcome) String() string {
+	switch o {
+	case TraceMatched:
+		return "matched"
+	case TraceNoField:
+		return "no matching field"
+	case TraceUnexported:
+		return "unexported field"
+	case TraceError:
+		return "error"
+	case TraceUnmarshaler:
+		return "unmarshaler"
+	}
+	return fmt.Sprintf("TraceOutcome(%d)", uint8(o))
+}
+
+// trace sends the event for the key k to the trace function.
+func (md *MetaData) trace(k Key, outcome TraceOutcome, dest string, err error) {
+	if outcome == TraceError {
+		if md.traced { /// Already reported for a key in this one.
+			return
+		}
+		md.traced = true
+	}
+	key := make(Key, len(k))
+	copy(key, k)
+	pos := md.keyPos(k)
+	if typeEqual(md.keyInfo[k.String()].tomlType, tomlArrayHash) { /// First [[..]] of an array of tables.
+		md.indexPositions()
+		if ki, ok := md.keyInfo[md.indexedKey(k)+"[0]"]; ok {
+			pos = ki.pos
+		}
+	}
+	md.tracer(TraceEvent{
+		Key:      key,
+		Position: md.position(pos),
+		Outcome:  outcome,
+		Dest:     dest,
+		Err:      err,
+	})
+}
+
+// traceDecoded sends the event for the key in md.context, which was decoded in
+// to rv.
+func (md *MetaData) traceDecoded(dest string, data any, rv reflect.Value, err error) {
+	outcome := TraceMatched
+	switch {
+	case err != nil:
+		outcome = TraceError
+	case md.customUnmarshal(data, rv):
+		outcome = TraceUnmarshaler
+	}
+	md.trace(md.context, outcome, dest, err)
+}
+
+// traceNoField sends the event for a key that doesn't match any of the fields
+// of rt, with the field that has the most similar name.
+func (md *MetaData) traceNoField(key string, rt reflect.Type, fields []field) {
+	k := md.context.add(key)
+	ev := TraceEvent{
+		Key:      k,
+		Position: md.position(md.keyPos(k)),
+		Outcome:  TraceNoField,
+		Dest:     rt.String(),
+	}
+	if f := closestField(fields, key); f != nil {
+		ev.Closest, ev.ClosestField = f.name, fieldPath(rt, f.index)[1:]
+	}
+	md.tracer(ev)
+}
+
+// customUnmarshal reports if unify() decodes data in to rv with an unmarshaler
+// method or a TypeAdapter.
+func (md *MetaData) customUnmarshal(data any, rv reflect.Value) bool {
+	if !rv.IsValid() || !rv.CanInterface() {
+		return false
+	}
+	switch rv.Interface().(type) {
+	case KeyUnmarshaler, Unmarshaler:
+		return true
+	case encoding.TextUnmarshaler:
+		_, ok := data.(time.Time)
+		return !ok || rv.Type() != timePtrType
+	}
+	return lookupAdapter(md.adapters, rv.Type()) != nil
+}
+
+// closestField finds the field with the name that's closest to key, ignoring
+// case. It returns nil if none of the names are close.
+func closestField(fields []field, key string) *field {
+	var (
+		best *field
+		min  = utf8.RuneCountInString(key)/3 + 1
+	)
+	if min > 3 {
+		min = 3
+	}
+	key = strings.ToLower(key)
+	for i := range fields {
+		if d := editDistance(key, strings.ToLower(fields[i].name)); d <= min {
+			best, min = &fields[i], d-1
+		}
+	}
+	return best
+}
+
+// editDistance gets the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev, cur := make([]int, len(rb)+1), make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := range ra {
+		cur[0] = i + 1
+		for j := range rb {
+			cost := 1
+			if ra[i] == rb[j] {
+				cost = 0
+			}
+			cur[j+1] = prev[j] + cost
+			if d := prev[j+1] + 1; d < cur[j+1] {
+				cur[j+1] = d
+			}
+			if d := cur[j] + 1; d < cur[j+1] {
+				cur[j+1] = d
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
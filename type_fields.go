@@ -9,6 +9,7 @@ package toml
 import (
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 )
 
@@ -18,6 +19,7 @@ type field struct {
 	tag   bool         // whether field has a `toml` tag
 	index []int        // represents the depth of an anonymous field
 	typ   reflect.Type // the type of the field
+	opts  tagOptions   // options from the `toml` tag
 }
 
 // byName sorts field by name, breaking ties with depth,
@@ -112,7 +114,7 @@ func typeFields(t reflect.Type) []field {
 					if name == "" {
 						name = sf.Name
 					}
-					fields = append(fields, field{name, tagged, index, ft})
+					fields = append(fields, field{name, tagged, index, ft, opts})
 					if count[f.typ] > 1 {
 						// If there were multiple instances, add a second,
 						// so that the annihilation code will see a duplicate.
@@ -207,12 +209,33 @@ func dominantField(fields []field) (field, bool) {
 	return fields[0], true
 }
 
+// unexportedField finds an unexported field in t with a toml tag for the key.
+// Unexported fields are never used, but the tag makes it clear that this is a
+// mistake rather than an unrelated field, so it's reported as an error.
+func unexportedField(t reflect.Type, key string, caseSensitive bool) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath == "" || sf.Anonymous {
+			continue
+		}
+		name := getOptions(sf.Tag).name
+		if name != "" && (name == key || (!caseSensitive && strings.EqualFold(name, key))) {
+			return sf, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
 var fieldCache struct {
 	sync.RWMutex
 	m map[reflect.Type][]field
 }
 
 // cachedTypeFields is like typeFields but uses a cache to avoid repeated work.
+//
+// Only information about the type is cached; everything about the values
+// (decoded keys, positions, etc.) is kept in MetaData by the full key, as the
+// same type can appear at different keys, including inside itself.
 func cachedTypeFields(t reflect.Type) []field {
 	fieldCache.RLock()
 	f := fieldCache.m[t]
@@ -236,3 +259,19 @@ func cachedTypeFields(t reflect.Type) []field {
 	fieldCache.Unlock()
 	return f
 }
+
+// isOpaqueStruct reports if t is a struct type with fields, but none that are
+// exported, such as struct{ m map[string]struct{} }. Encoding or decoding this
+// as a table can't do anything useful, so it's almost certainly a mistake
+// unless the type has a marshaler.
+func isOpaqueStruct(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct || t.NumField() == 0 || len(cachedTypeFields(t)) > 0 {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			return false
+		}
+	}
+	return true
+}
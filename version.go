@@ -0,0 +1,54 @@
+package toml
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Version is a version of the TOML specification.
+type Version string
+
+const (
+	Version10 Version = "1.0.0"
+	Version11 Version = "1.1.0"
+)
+
+// Feature is a feature from TOML 1.1 that was used in a document; see
+// [DetectVersion].
+type Feature struct {
+	// Name of the feature; one of:
+	//
+	//   escape-e                     \e escape in strings.
+	//   escape-x                     \xHH escape in strings.
+	//   datetime-no-seconds          Datetime or time without seconds.
+	//   inline-table-newline         Newline in an inline table.
+	//   inline-table-trailing-comma  Trailing comma in an inline table.
+	Name     string
+	Position Position // Position in the document.
+}
+
+// DetectVersion detects which version of the TOML specification the document
+// in data requires.
+//
+// This is Version10 if the document is valid TOML 1.0. Otherwise it's
+// Version11 if the document is valid TOML 1.1, and the TOML 1.1 features used
+// in the document are returned, in the order they appear.
+//
+// The error is the ParseError for TOML 1.1 if the document isn't valid in
+// either version.
+func DetectVersion(data []byte) (Version, []Feature, error) {
+	if _, err := parse(bytes.NewReader(data), DecodeProfile{}, false); err == nil {
+		return Version10, nil, nil
+	}
+
+	p, err := parse(bytes.NewReader(data), DecodeProfile{}, true)
+	if err != nil {
+		return "", nil, err
+	}
+	f := p.lx.features
+	for i := range f {
+		f[i].Position = f[i].Position.withCol(p.lx.input)
+	}
+	sort.SliceStable(f, func(i, j int) bool { return f[i].Position.Start < f[j].Position.Start })
+	return Version11, f, nil
+}
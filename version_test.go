@@ -0,0 +1,92 @@
+package toml_test
+
+import (
+	"fmt"
+	"io/fs"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	tomltest "github.com/BurntSushi/toml/internal/toml-test"
+)
+
+func TestDetectVersion(t *testing.T) {
+	tests := []struct {
+		file     string
+		want     toml.Version
+		features []string
+		wantErr  bool
+	}{
+		{"valid/example.toml", toml.Version10, nil, false},
+		{"valid/spec/table-7.toml", toml.Version10, nil, false},
+		{"valid/datetime/local.toml", toml.Version10, nil, false},
+		{"valid/string/escapes.toml", toml.Version10, nil, false},
+
+		{"valid/string/escape-esc.toml", toml.Version11, []string{"escape-e"}, false},
+		{"valid/string/hex-escape.toml", toml.Version11, []string{"escape-x"}, false},
+		{"valid/datetime/no-seconds.toml", toml.Version11, []string{"datetime-no-seconds"}, false},
+		{"valid/inline-table/newline.toml", toml.Version11, []string{"inline-table-newline", "inline-table-trailing-comma"}, false},
+		{"invalid/datetime/no-secs.toml", toml.Version11, []string{"datetime-no-seconds"}, false},
+		{"invalid/inline-table/trailing-comma.toml", toml.Version11, []string{"inline-table-trailing-comma"}, false},
+		{"invalid/string/basic-byte-escapes.toml", toml.Version11, []string{"escape-x"}, false},
+
+		{"invalid/table/duplicate.toml", "", nil, true},
+		{"invalid/string/bad-escape-1.toml", "", nil, true},
+	}
+	fsys := tomltest.EmbeddedTests()
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := fs.ReadFile(fsys, tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, features, err := toml.DetectVersion(data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if v != tt.want {
+				t.Errorf("version: have %q, want %q", v, tt.want)
+			}
+			var (
+				names []string
+				seen  = make(map[string]bool)
+			)
+			for _, f := range features {
+				if !seen[f.Name] {
+					seen[f.Name] = true
+					names = append(names, f.Name)
+				}
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.features) {
+				t.Errorf("features:\nhave: %q\nwant: %q", names, tt.features)
+			}
+		})
+	}
+
+	t.Run("positions", func(t *testing.T) {
+		in := "a = \"\\e\"\nb = {\n  c = 1,\n}\nd = 12:34\n"
+		v, features, err := toml.DetectVersion([]byte(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != toml.Version11 {
+			t.Errorf("version: %q", v)
+		}
+		var have []string
+		for _, f := range features {
+			have = append(have, fmt.Sprintf("%s %d:%d", f.Name, f.Position.Line, f.Position.Col))
+		}
+		want := []string{
+			"escape-e 1:6",
+			"inline-table-newline 2:6",
+			"inline-table-trailing-comma 3:8",
+			"inline-table-newline 3:9",
+			"datetime-no-seconds 5:5",
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("\nhave: %q\nwant: %q", have, want)
+		}
+	})
+}